@@ -4,13 +4,14 @@ go 1.25
 
 require (
 	github.com/rs/zerolog v1.34.0
+	github.com/tidwall/btree v1.8.1
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.6.2
+	github.com/yuin/gopher-lua v1.1.2
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/tidwall/btree v1.8.1 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 )
@@ -1,6 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	mukv "github.com/polera/mukv/pkg"
@@ -9,12 +18,165 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import-rdb" {
+		os.Exit(importRDB(os.Args[2:]))
+	}
+
+	cfg := mukv.DefaultConfig
+	flag.IntVar(&cfg.Shards, "shards", cfg.Shards, "number of lock-striped keyspace shards")
+	flag.IntVar(&cfg.Databases, "databases", cfg.Databases, "number of logical databases")
+	flag.Func("maxmemory", "memory limit, such as 100mb (0 for none)", func(s string) error {
+		n, ok := mukv.ParseMemory(s)
+		if !ok {
+			return errors.New("must be a memory value")
+		}
+		cfg.MaxMemory = n
+		return nil
+	})
+	flag.Func("maxmemory-policy", "eviction policy once maxmemory is reached", func(s string) error {
+		pol, ok := mukv.ParseEvictionPolicy(s)
+		if !ok {
+			return errors.New("unknown eviction policy")
+		}
+		cfg.MaxMemoryPolicy = pol
+		return nil
+	})
+	flag.Func("save", `save rules as pairs of seconds and changes, such as "3600 1 300 100" ("" for none)`, func(s string) error {
+		rules, ok := mukv.ParseSaveRules(s)
+		if !ok {
+			return errors.New("must be pairs of seconds and changes")
+		}
+		cfg.SaveRules = rules
+		return nil
+	})
+	flag.StringVar(&cfg.Dir, "dir", cfg.Dir, "directory to save snapshots and the append-only file in")
+	flag.StringVar(&cfg.DBFilename, "dbfilename", cfg.DBFilename, "name of the snapshot file")
+	flag.BoolVar(&cfg.AppendOnly, "appendonly", cfg.AppendOnly, "log every write to the append-only file")
+	flag.Func("appendfsync", "how often to sync the append-only file: always, everysec or no", func(s string) error {
+		pol, ok := mukv.ParseFsyncPolicy(s)
+		if !ok {
+			return errors.New("unknown fsync policy")
+		}
+		cfg.AppendFsync = pol
+		return nil
+	})
+	flag.StringVar(&cfg.AppendFilename, "appendfilename", cfg.AppendFilename, "name of the append-only file")
+	flag.BoolVar(&cfg.AOFLoadTruncated, "aof-load-truncated", cfg.AOFLoadTruncated, "load an append-only file whose last command was cut short")
+	importPath := flag.String("import-rdb", "", "Redis RDB file to import at startup, replacing keys of the same name")
+	port := flag.Int("port", 6480, "port to listen on")
+	flag.Func("replicaof", `leader to replicate from, as "host port"`, func(s string) error {
+		host, port, ok := strings.Cut(s, " ")
+		if !ok {
+			return errors.New(`must be "host port"`)
+		}
+		cfg.ReplicaOf = net.JoinHostPort(host, strings.TrimSpace(port))
+		return nil
+	})
+	flag.BoolVar(&cfg.ReplicaReadOnly, "replica-read-only", cfg.ReplicaReadOnly, "refuse writes from clients while replicating")
+	dynamo := mukv.DynamoConfig{N: 3, R: 2, W: 2}
+	flag.StringVar(&dynamo.Node, "dynamo-node", "", "address other nodes reach this one at, which runs it in dynamo mode")
+	flag.Func("dynamo-nodes", "comma-separated addresses of all nodes in the dynamo cluster", func(s string) error {
+		dynamo.Nodes = strings.Split(s, ",")
+		return nil
+	})
+	flag.IntVar(&dynamo.N, "dynamo-n", dynamo.N, "number of nodes each key is stored on")
+	flag.IntVar(&dynamo.R, "dynamo-r", dynamo.R, "number of nodes that must answer a read")
+	flag.IntVar(&dynamo.W, "dynamo-w", dynamo.W, "number of nodes that must acknowledge a write")
+	flag.DurationVar(&dynamo.Timeout, "dynamo-timeout", time.Second, "how long to wait for another node to answer")
+	raft := mukv.RaftConfig{}
+	flag.StringVar(&raft.ID, "raft-node", "", "address other nodes reach this one at, which runs it in raft mode")
+	flag.Func("raft-peers", "comma-separated addresses of the nodes the raft group starts with (none to join a running group)", func(s string) error {
+		raft.Peers = strings.Split(s, ",")
+		return nil
+	})
+	flag.DurationVar(&raft.ElectionTimeout, "raft-election-timeout", time.Second, "how long a follower waits to hear from the leader before standing for election")
+	flag.IntVar(&raft.SnapshotEntries, "raft-snapshot-entries", 10000, "number of entries after which the raft log is compacted")
+	flag.BoolVar(&raft.RedirectWrites, "raft-redirect-writes", false, "refuse writes sent to a follower, naming the leader, rather than proxying them")
+	flag.BoolVar(&cfg.ClusterEnabled, "cluster-enabled", cfg.ClusterEnabled, "run as a node of a cluster that splits keys into hash slots")
+	flag.StringVar(&cfg.ClusterConfigFile, "cluster-config-file", cfg.ClusterConfigFile, "name of the file the node saves its view of the cluster in")
+	flag.StringVar(&cfg.ClusterAnnounceIP, "cluster-announce-ip", cfg.ClusterAnnounceIP, "address other nodes and clients reach this node at")
+	flag.DurationVar(&cfg.ClusterNodeTimeout, "cluster-node-timeout", cfg.ClusterNodeTimeout, "how long a node may go unanswered before it is flagged as failing")
+	flag.DurationVar(&cfg.LuaTimeLimit, "lua-time-limit", cfg.LuaTimeLimit, "how long a script may run before other clients are answered BUSY and may stop it with SCRIPT KILL")
+	flag.Parse()
+
 	zerolog.TimeFieldFormat = time.RFC3339
 	logger := log.With().Str("mukv", "main").Logger()
-	muKV := mukv.New(logger)
+	if dynamo.Node != "" {
+		if cfg.ClusterEnabled {
+			logger.Fatal().Msg("dynamo mode and cluster mode cannot be combined")
+		}
+		if err := dynamo.Validate(); err != nil {
+			logger.Fatal().Err(err).Msg("invalid dynamo configuration")
+		}
+		cfg.Dynamo = &dynamo
+	}
+	if raft.ID != "" {
+		if cfg.ClusterEnabled || cfg.Dynamo != nil || cfg.ReplicaOf != "" {
+			logger.Fatal().Msg("raft mode cannot be combined with cluster mode, dynamo mode or replicaof")
+		}
+		if err := raft.Validate(); err != nil {
+			logger.Fatal().Err(err).Msg("invalid raft configuration")
+		}
+		raft.Dir = cfg.Dir
+		cfg.Raft = &raft
+	}
+	muKV := mukv.NewWithConfig(logger, cfg)
+	if err := muKV.Load(); err != nil {
+		logger.Fatal().Err(err).Msg("failed to load data")
+	}
+	if *importPath != "" {
+		stats, err := muKV.ImportRDB(*importPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to import RDB file")
+		}
+		for what, n := range stats.Skipped {
+			logger.Warn().Int("count", n).Str("skipped", what).Msg("RDB file holds unsupported data")
+		}
+	}
 
-	err := muKV.ListenAndServe(6480)
+	err := muKV.ListenAndServe(*port)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to start server")
 	}
 }
+
+// importRDB runs the import-rdb subcommand, which converts a Redis RDB file
+// into a mukv snapshot, and returns the exit status.
+func importRDB(args []string) int {
+	cfg := mukv.DefaultConfig
+	fs := flag.NewFlagSet("import-rdb", flag.ContinueOnError)
+	fs.IntVar(&cfg.Databases, "databases", cfg.Databases, "number of logical databases")
+	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "directory to write the snapshot in")
+	fs.StringVar(&cfg.DBFilename, "dbfilename", cfg.DBFilename, "name of the snapshot file, which is overwritten")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: mukv import-rdb [flags] dump.rdb")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	muKV := mukv.NewWithConfig(zerolog.Nop(), cfg)
+	stats, err := muKV.ImportRDB(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mukv import-rdb:", err)
+		return 1
+	}
+	if err := muKV.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, "mukv import-rdb:", err)
+		return 1
+	}
+
+	fmt.Printf("imported %d keys into %s\n", stats.Keys, filepath.Join(cfg.Dir, cfg.DBFilename))
+	if stats.Expired > 0 {
+		fmt.Printf("skipped %d expired keys\n", stats.Expired)
+	}
+	for _, what := range slices.Sorted(maps.Keys(stats.Skipped)) {
+		fmt.Printf("skipped %d %s\n", stats.Skipped[what], what)
+	}
+	return 0
+}
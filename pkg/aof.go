@@ -0,0 +1,598 @@
+package mukv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// FsyncPolicy sets how often the append-only file is synced to disk.
+type FsyncPolicy int32
+
+const (
+	// FsyncAlways syncs every write before the client is replied to.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec syncs once a second, so a crash loses at most about a
+	// second of writes.
+	FsyncEverySec
+	// FsyncNo leaves syncing to the operating system.
+	FsyncNo
+)
+
+var fsyncPolicyNames = [...]string{
+	FsyncAlways:   "always",
+	FsyncEverySec: "everysec",
+	FsyncNo:       "no",
+}
+
+func (p FsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+// ParseFsyncPolicy returns the policy named s, as appendfsync names it.
+func ParseFsyncPolicy(s string) (FsyncPolicy, bool) {
+	i := slices.Index(fsyncPolicyNames[:], s)
+	return FsyncPolicy(i), i >= 0
+}
+
+// aof is the append-only file, which logs every write as the command that
+// made it. Rewriting the file replaces it with a snapshot of the keyspace,
+// followed by the commands logged while the snapshot was written.
+type aof struct {
+	// The mutex guards the fields below it and orders appends.
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// buf holds the commands appended since the file was last written to.
+	buf []byte
+	// db is the database the logged commands leave selected, or -1 if the
+	// next command must select its own.
+	db int
+	// size is the size of the file, and baseSize its size when it was last
+	// rewritten.
+	size, baseSize int64
+	// rewriteBuf collects the commands appended while the file is being
+	// rewritten, for the rewritten file to end with, and rewriteDB is the
+	// database they leave selected. It is nil when no rewrite is collecting
+	// them.
+	rewriteBuf []byte
+	rewriteDB  int
+	// epoch counts the times logging was turned on or off, so that a
+	// rewrite started before either is discarded.
+	epoch    int
+	writeErr error
+
+	enabled             atomic.Bool
+	policy              atomic.Int32
+	loadTruncated       atomic.Bool
+	rewritePercentage   atomic.Int32
+	rewriteMinSize      atomic.Int64
+	rewriting           atomic.Bool
+	lastRewriteFailed   atomic.Bool
+	lastRewriteDuration atomic.Int64
+}
+
+func newAOF(cfg Config) *aof {
+	a := &aof{path: filepath.Join(cfg.Dir, cfg.AppendFilename), db: -1}
+	a.enabled.Store(cfg.AppendOnly)
+	a.policy.Store(int32(cfg.AppendFsync))
+	a.loadTruncated.Store(cfg.AOFLoadTruncated)
+	a.rewritePercentage.Store(int32(cfg.AutoAOFRewritePercentage))
+	a.rewriteMinSize.Store(cfg.AutoAOFRewriteMinSize)
+	a.lastRewriteDuration.Store(-1)
+	return a
+}
+
+func (a *aof) fsyncPolicy() FsyncPolicy {
+	return FsyncPolicy(a.policy.Load())
+}
+
+// append logs args, run in database db, if logging is on.
+func (a *aof) append(db int, args [][]byte) {
+	if !a.enabled.Load() {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.buf, a.db = appendLogged(a.buf, a.db, db, args)
+	}
+	if a.rewriteBuf != nil {
+		a.rewriteBuf, a.rewriteDB = appendLogged(a.rewriteBuf, a.rewriteDB, db, args)
+	}
+}
+
+// appendLogged appends args, run in database db, to a log whose commands
+// leave database selected selected. It returns the log and the database it
+// now leaves selected.
+func appendLogged(buf []byte, selected, db int, args [][]byte) ([]byte, int) {
+	if db != selected {
+		buf = appendCommand(buf, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})
+	}
+	return appendCommand(buf, args), db
+}
+
+// flush writes the logged commands to the file, and syncs it if the fsync
+// policy is always.
+func (a *aof) flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.write() && a.fsyncPolicy() == FsyncAlways {
+		a.setErr(a.file.Sync())
+	}
+}
+
+// write writes buf to the file, reporting whether it wrote anything. What
+// cannot be written is kept for the next attempt. a.mu must be held.
+func (a *aof) write() bool {
+	if a.file == nil || len(a.buf) == 0 {
+		return false
+	}
+	n, err := a.file.Write(a.buf)
+	a.size += int64(n)
+	a.buf = a.buf[:copy(a.buf, a.buf[n:])]
+	a.setErr(err)
+	return n > 0
+}
+
+// setErr records the outcome of the last write or sync. a.mu must be held.
+func (a *aof) setErr(err error) {
+	a.writeErr = err
+}
+
+// err returns the error the last write or sync failed with, if any. Writes
+// are refused until the file can be written again.
+func (a *aof) err() error {
+	if !a.enabled.Load() {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.writeErr
+}
+
+// open opens the file for appending after it has been replayed.
+func (a *aof) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file = f
+	a.db = -1
+	a.size = info.Size()
+	a.baseSize = info.Size()
+	return nil
+}
+
+// rewriteDue reports whether the file has grown enough since it was last
+// rewritten to be rewritten again.
+func (a *aof) rewriteDue() bool {
+	pct := int64(a.rewritePercentage.Load())
+	a.mu.Lock()
+	size, base := a.size, max(a.baseSize, 1)
+	a.mu.Unlock()
+	if pct <= 0 || size < a.rewriteMinSize.Load() {
+		return false
+	}
+	return (size-base)*100/base >= pct
+}
+
+// StartAOFLoop writes and syncs the append-only file as its fsync policy
+// calls for, and rewrites it once it has grown past the auto-rewrite
+// thresholds.
+func (mkv *MuKV) StartAOFLoop() {
+	a := mkv.aof
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Commands are written as they are run, but keys dropped by the
+		// server are only logged.
+		a.mu.Lock()
+		a.write()
+		file := a.file
+		a.mu.Unlock()
+		// Syncing is slow, so it is done without holding up appends. The
+		// file may be closed meanwhile by a rewrite replacing it.
+		if file != nil && a.fsyncPolicy() == FsyncEverySec {
+			if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				a.mu.Lock()
+				a.setErr(err)
+				a.mu.Unlock()
+			}
+		}
+
+		// A file that has not been created yet, because turning logging on
+		// failed to write it, is retried here.
+		if a.enabled.Load() && !a.rewriting.Load() && (file == nil || a.rewriteDue()) {
+			mkv.bgrewriteAOF()
+		}
+	}
+}
+
+// setAppendOnly turns logging on or off. Turning it on rewrites the file in
+// the background from the keyspace, and only logs to it once that is done.
+func (mkv *MuKV) setAppendOnly(on bool) {
+	logger := mkv.Log.With().Str("function", "setAppendOnly").Logger()
+	a := mkv.aof
+
+	mkv.order.Lock()
+	defer mkv.order.Unlock()
+	if a.enabled.Load() == on {
+		return
+	}
+
+	a.mu.Lock()
+	a.epoch++
+	a.enabled.Store(on)
+	if !on {
+		if a.file != nil {
+			a.write()
+			a.setErr(errors.Join(a.file.Sync(), a.file.Close()))
+			if a.writeErr != nil {
+				logger.Error().Err(a.writeErr).Msg("failed to close the append-only file")
+			}
+		}
+		a.file = nil
+		a.buf = nil
+		a.rewriteBuf = nil
+		a.writeErr = nil
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	// A rewrite already in progress belongs to the old epoch, and once it is
+	// discarded the AOF loop starts a new one.
+	if a.rewriting.CompareAndSwap(false, true) {
+		snap, epoch := mkv.beginRewrite()
+		go mkv.runRewrite(snap, epoch)
+	}
+}
+
+// bgrewriteAOF rewrites the append-only file in the background, reporting
+// false if a rewrite is already in progress.
+func (mkv *MuKV) bgrewriteAOF() bool {
+	if !mkv.aof.rewriting.CompareAndSwap(false, true) {
+		return false
+	}
+	mkv.order.Lock()
+	snap, epoch := mkv.beginRewrite()
+	mkv.order.Unlock()
+	go mkv.runRewrite(snap, epoch)
+	return true
+}
+
+// beginRewrite starts collecting the commands logged from now on for the
+// rewritten file, and returns a snapshot of the keyspace for it to begin
+// with. The write order lock must be held exclusively, so that no write is
+// both in the snapshot and among the commands.
+func (mkv *MuKV) beginRewrite() (*snapshot, int) {
+	a := mkv.aof
+	a.mu.Lock()
+	if a.enabled.Load() {
+		a.rewriteBuf = []byte{}
+		a.rewriteDB = -1
+	}
+	epoch := a.epoch
+	a.mu.Unlock()
+	// Keys dropped by the server are logged without the write order lock,
+	// so collecting starts first: a key dropped before the snapshot is
+	// then deleted again rather than missed.
+	return mkv.snapshot(), epoch
+}
+
+// runRewrite finishes a rewrite started in the background.
+func (mkv *MuKV) runRewrite(snap *snapshot, epoch int) {
+	logger := mkv.Log.With().Str("function", "runRewrite").Logger()
+	a := mkv.aof
+	defer a.rewriting.Store(false)
+
+	start := time.Now()
+	err := mkv.finishRewrite(snap, epoch)
+	a.lastRewriteDuration.Store(int64(time.Since(start).Seconds()))
+	a.lastRewriteFailed.Store(err != nil)
+	if err != nil {
+		logger.Error().Err(err).Str("path", a.path).Msg("append-only file rewrite failed")
+		return
+	}
+	logger.Info().Str("path", a.path).Msg("append-only file rewrite done")
+}
+
+// errRewriteDiscarded is returned for a rewrite overtaken by logging being
+// turned on or off.
+var errRewriteDiscarded = errors.New("logging was turned on or off during the rewrite")
+
+// finishRewrite writes the rewritten file from snap and the commands
+// collected since it was taken, and replaces the file with it.
+func (mkv *MuKV) finishRewrite(snap *snapshot, epoch int) error {
+	a := mkv.aof
+	f, err := createTemp(filepath.Dir(a.path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		snap.release()
+		a.stopCollecting(epoch)
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := snap.WriteTo(f)
+	// Write out most of the collected commands before taking the lock to
+	// write the rest, so that commands are held up as little as possible.
+	for i := 0; err == nil && i < 10; i++ {
+		a.mu.Lock()
+		chunk := a.rewriteBuf
+		if len(chunk) > 0 {
+			a.rewriteBuf = []byte{}
+		}
+		a.mu.Unlock()
+		size += int64(len(chunk))
+		_, err = f.Write(chunk)
+		if len(chunk) < 64<<10 {
+			break
+		}
+	}
+	if err != nil {
+		a.stopCollecting(epoch)
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.epoch != epoch {
+		return errRewriteDiscarded
+	}
+	rest := a.rewriteBuf
+	a.rewriteBuf = nil
+	if _, err := f.Write(rest); err != nil {
+		return err
+	}
+	size += int64(len(rest))
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(a.path))
+	if !a.enabled.Load() {
+		return nil
+	}
+
+	// The commands not yet written to the old file are in the new one.
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		a.setErr(err)
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.buf = a.buf[:0]
+	a.db = a.rewriteDB
+	a.size = size
+	a.baseSize = size
+	a.setErr(nil)
+	return nil
+}
+
+// stopCollecting stops collecting commands for a rewrite that failed.
+func (a *aof) stopCollecting(epoch int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.epoch == epoch {
+		a.rewriteBuf = nil
+	}
+}
+
+// rewriteAOF rewrites the append-only file from the keyspace, returning once
+// it is done.
+func (mkv *MuKV) rewriteAOF() error {
+	a := mkv.aof
+	for !a.rewriting.CompareAndSwap(false, true) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer a.rewriting.Store(false)
+	mkv.order.Lock()
+	snap, epoch := mkv.beginRewrite()
+	mkv.order.Unlock()
+	return mkv.finishRewrite(snap, epoch)
+}
+
+// errBadCommand is returned for a command stream, read from the append-only
+// file or from a leader, that is not made of commands.
+var errBadCommand = errors.New("malformed command")
+
+// maxBulkLen is the longest argument read from a command stream.
+const maxBulkLen = 512 << 20
+
+// readCommand reads a command written by appendCommand. It returns io.EOF if
+// r ends before the command, and io.ErrUnexpectedEOF if it ends partway
+// through it.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	n, err := readRESPHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errBadCommand
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		l, err := readRESPHeader(r, '$')
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, l+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if arg[l] != '\r' || arg[l+1] != '\n' {
+			return nil, errBadCommand
+		}
+		args[i] = arg[:l:l]
+	}
+	return args, nil
+}
+
+// readRESPHeader reads a RESP line holding a length after prefix.
+func readRESPHeader(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadSlice('\n')
+	switch {
+	case err == io.EOF && len(line) > 0:
+		return 0, io.ErrUnexpectedEOF
+	case err == bufio.ErrBufferFull:
+		return 0, errBadCommand
+	case err != nil:
+		return 0, err
+	}
+	if len(line) < 4 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, errBadCommand
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || n < 0 || n > maxBulkLen {
+		return 0, errBadCommand
+	}
+	return n, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// replayAOF replays the append-only file, reporting false if there is none.
+// A file whose last command was cut short is truncated to the command before
+// if aof-load-truncated allows it.
+func (mkv *MuKV) replayAOF() (bool, error) {
+	logger := mkv.Log.With().Str("function", "replayAOF").Logger()
+	a := mkv.aof
+
+	f, err := os.OpenFile(a.path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	cr := &countingReader{r: f}
+	r := bufio.NewReader(cr)
+	offset := func() int64 { return cr.n - int64(r.Buffered()) }
+
+	start := time.Now()
+	keys := 0
+	if magic, _ := r.Peek(len(snapshotMagic)); string(magic) == snapshotMagic {
+		// Keys in the snapshot a rewrite begins with are kept even if they
+		// have expired, since the commands after it ran while they were
+		// live.
+		if keys, err = mkv.restore(r, time.Time{}); err != nil {
+			return true, fmt.Errorf("loading %s: %w", a.path, err)
+		}
+	}
+
+	conn := &bufferConn{ctx: &client{}}
+	commands := 0
+	for {
+		at := offset()
+		args, err := readCommand(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if !a.loadTruncated.Load() {
+				return true, fmt.Errorf("%s is truncated at offset %d", a.path, at)
+			}
+			logger.Warn().Str("path", a.path).Int64("offset", at).
+				Msg("truncating the append-only file to its last complete command")
+			if err := f.Truncate(at); err != nil {
+				return true, err
+			}
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("reading %s at offset %d: %w", a.path, at, err)
+		}
+		mkv.Handler(conn, redcon.Command{Args: args})
+		conn.buf = conn.buf[:0]
+		commands++
+	}
+	logger.Info().Str("path", a.path).Int("keys", keys).Int("commands", commands).
+		Dur("took", time.Since(start)).Msg("append-only file loaded")
+	return true, nil
+}
+
+func (mkv *MuKV) handleBGRewriteAOF(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	if !mkv.bgrewriteAOF() {
+		conn.WriteError("ERR Background append only file rewriting already in progress")
+		return
+	}
+	conn.WriteString("Background append only file rewriting started")
+}
+
+// info returns the append-only file's fields of the INFO persistence section.
+func (a *aof) info() []string {
+	rewriteStatus := "ok"
+	if a.lastRewriteFailed.Load() {
+		rewriteStatus = "err"
+	}
+	a.mu.Lock()
+	writeStatus := "ok"
+	if a.writeErr != nil {
+		writeStatus = "err"
+	}
+	size, baseSize := a.size, a.baseSize
+	a.mu.Unlock()
+
+	lines := []string{
+		fmt.Sprintf("aof_enabled:%d", boolInt(a.enabled.Load())),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolInt(a.rewriting.Load())),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", a.lastRewriteDuration.Load()),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", rewriteStatus),
+		fmt.Sprintf("aof_last_write_status:%s", writeStatus),
+	}
+	if a.enabled.Load() {
+		lines = append(lines,
+			fmt.Sprintf("aof_current_size:%d", size),
+			fmt.Sprintf("aof_base_size:%d", baseSize),
+		)
+	}
+	return lines
+}
@@ -0,0 +1,313 @@
+package mukv
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// blockedClient is a client waiting on one or more keys. try attempts to
+// serve the client from key, writing its reply, and reports whether it did.
+type blockedClient struct {
+	keys []string
+	try  func(key string) bool
+	done chan struct{}
+}
+
+// blockedClients tracks the clients blocked by BLPOP and friends. When a key
+// is created, the clients waiting on it are served in the order they
+// blocked, for as long as the key can serve them.
+type blockedClients struct {
+	// The mutex guards waiters and is held while serving clients.
+	sync.Mutex
+	waiters map[string][]*blockedClient
+	blocked atomic.Int64
+
+	readyMu sync.Mutex
+	ready   []string
+}
+
+func newBlockedClients() *blockedClients {
+	return &blockedClients{waiters: make(map[string][]*blockedClient)}
+}
+
+// block calls try for each of keys in turn and, if none of them can serve
+// the client, waits until one can or timeout passes. A zero timeout waits
+// forever and a negative timeout does not wait at all. held is the locks
+// the client holds, if any, which are released while it waits so that
+// other clients can write the keys it is waiting on. gone, if not nil, is
+// called once the client is about to wait and returns a channel closed if
+// the client disconnects, which gives up the wait. block reports whether
+// the client was served. Clients that serving it unblocks in turn are left
+// for the caller to serve once the command is logged.
+func (b *blockedClients) block(keys []string, timeout time.Duration, held sync.Locker, gone func() <-chan struct{}, try func(key string) bool) bool {
+	b.Lock()
+	for _, key := range keys {
+		if try(key) {
+			b.Unlock()
+			return true
+		}
+	}
+	if timeout < 0 {
+		b.Unlock()
+		return false
+	}
+	c := &blockedClient{keys: keys, try: try, done: make(chan struct{})}
+	for _, key := range keys {
+		b.waiters[key] = append(b.waiters[key], c)
+	}
+	b.blocked.Add(1)
+	b.Unlock()
+
+	if held != nil {
+		held.Unlock()
+		defer held.Lock()
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var disconnected <-chan struct{}
+	if gone != nil {
+		disconnected = gone()
+	}
+	select {
+	case <-c.done:
+		return true
+	case <-expired:
+	case <-disconnected:
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	select {
+	case <-c.done:
+		// Served while the timeout fired or the client went away.
+		return true
+	default:
+	}
+	b.remove(c)
+	return false
+}
+
+// signal marks key as ready to serve the clients waiting on it. They are
+// served by the next call to serveReady, which the command that made the key
+// ready makes once it is done.
+func (b *blockedClients) signal(key string) {
+	if b.blocked.Load() == 0 {
+		return
+	}
+	b.readyMu.Lock()
+	b.ready = append(b.ready, key)
+	b.readyMu.Unlock()
+}
+
+// signalAll marks every key clients are waiting on as ready, for when the
+// whole keyspace may have changed under them.
+func (b *blockedClients) signalAll() {
+	b.Lock()
+	keys := make([]string, 0, len(b.waiters))
+	for key := range b.waiters {
+		keys = append(keys, key)
+	}
+	b.Unlock()
+	for _, key := range keys {
+		b.signal(key)
+	}
+}
+
+func (b *blockedClients) nextReady() (string, bool) {
+	b.readyMu.Lock()
+	defer b.readyMu.Unlock()
+	if len(b.ready) == 0 {
+		return "", false
+	}
+	key := b.ready[0]
+	b.ready = b.ready[1:]
+	return key, true
+}
+
+func (b *blockedClients) hasReady() bool {
+	b.readyMu.Lock()
+	defer b.readyMu.Unlock()
+	return len(b.ready) > 0
+}
+
+// serveReady serves the clients waiting on keys marked ready, for as long as
+// each key can serve them. Serving a client can make more keys ready, which
+// are served in turn.
+func (b *blockedClients) serveReady() {
+	if !b.hasReady() {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	for key, ok := b.nextReady(); ok; key, ok = b.nextReady() {
+		for len(b.waiters[key]) > 0 {
+			c := b.waiters[key][0]
+			if !c.try(key) {
+				break
+			}
+			b.remove(c)
+			close(c.done)
+		}
+	}
+}
+
+// remove unregisters c from every key it waits on. b must be locked.
+func (b *blockedClients) remove(c *blockedClient) {
+	for _, key := range c.keys {
+		waiters := slices.DeleteFunc(b.waiters[key], func(w *blockedClient) bool {
+			return w == c
+		})
+		if len(waiters) == 0 {
+			delete(b.waiters, key)
+		} else {
+			b.waiters[key] = waiters
+		}
+	}
+	b.blocked.Add(-1)
+}
+
+// parseTimeout parses the timeout of a blocking command, given in seconds.
+func parseTimeout(arg []byte) (time.Duration, string) {
+	secs, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || secs > float64(1<<63-1)/float64(time.Second) {
+		return 0, "ERR timeout is not a float or out of range"
+	}
+	if secs < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return time.Duration(secs * float64(time.Second)), ""
+}
+
+// block is blockedClients.block for the client on conn, waiting on keys in
+// the database it has selected. A client running a transaction never
+// waits.
+func (mkv *MuKV) block(conn redcon.Conn, keys []string, timeout time.Duration, try func(key string) bool) bool {
+	cl := clientFor(conn)
+	if cl.noBlock {
+		timeout = -1
+	}
+	held := lockChain{mkv.isolation.RLocker()}
+	if cl.order != nil {
+		held = append(held, cl.order)
+	}
+	gone := func() <-chan struct{} {
+		d := mkv.detach(conn)
+		if d == nil {
+			return nil
+		}
+		d.startRead()
+		return d.gone
+	}
+	return mkv.db(conn).blocked.block(keys, timeout, held, gone, try)
+}
+
+// detachedClient is a client taken off the server loop while it blocks, so
+// that its connection can be read to notice it disconnecting. Once the
+// command that blocked it returns, serveDetached serves the client in place
+// of the server loop.
+type detachedClient struct {
+	redcon.DetachedConn
+	// read is closed once the read started by startRead has finished,
+	// leaving the command read or the error reading it in cmd and err. gone
+	// is also closed if the read failed.
+	read chan struct{}
+	gone chan struct{}
+	cmd  redcon.Command
+	err  error
+	// handedOff is set once a command has detached the connection for
+	// itself, as PSYNC does.
+	handedOff bool
+}
+
+// detach takes the client on conn off the server loop, if it is not
+// already. It returns nil for connections with no network client.
+func (mkv *MuKV) detach(conn redcon.Conn) *detachedClient {
+	cl := clientFor(conn)
+	if cl.detached == nil {
+		dc := conn.Detach()
+		if dc == nil {
+			return nil
+		}
+		cl.detached = &detachedClient{DetachedConn: dc}
+	}
+	return cl.detached
+}
+
+// startRead starts reading the client's next command, unless a read is
+// already under way.
+func (d *detachedClient) startRead() {
+	if d.read != nil {
+		return
+	}
+	read, gone := make(chan struct{}), make(chan struct{})
+	d.read, d.gone = read, gone
+	go func() {
+		d.cmd, d.err = d.DetachedConn.ReadCommand()
+		if d.err != nil {
+			close(gone)
+		}
+		close(read)
+	}()
+}
+
+// ReadCommand returns the client's next command.
+func (d *detachedClient) ReadCommand() (redcon.Command, error) {
+	d.startRead()
+	<-d.read
+	d.read = nil
+	return d.cmd, d.err
+}
+
+// Detach hands the connection to the command detaching it, ending
+// serveDetached.
+func (d *detachedClient) Detach() redcon.DetachedConn {
+	d.handedOff = true
+	return d
+}
+
+// serveDetached serves the commands of a client detached while it blocked
+// until it disconnects.
+func (mkv *MuKV) serveDetached(d *detachedClient) {
+	for d.Flush() == nil {
+		cmd, err := d.ReadCommand()
+		if err != nil {
+			break
+		}
+		mkv.Handler(d, cmd)
+		if d.handedOff {
+			return
+		}
+	}
+	clientFor(d).unwatch()
+	d.Close()
+}
+
+// lockChain is a set of locks taken in order and released in reverse.
+type lockChain []sync.Locker
+
+func (c lockChain) Lock() {
+	for _, l := range c {
+		l.Lock()
+	}
+}
+
+func (c lockChain) Unlock() {
+	for i := len(c) - 1; i >= 0; i-- {
+		c[i].Unlock()
+	}
+}
+
+// writeNullArray writes the null array reply blocking commands give when
+// they time out.
+func writeNullArray(conn redcon.Conn) {
+	conn.WriteRaw([]byte("*-1\r\n"))
+}
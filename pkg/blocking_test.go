@@ -0,0 +1,75 @@
+package mukv
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+// listen serves mkv on a local port for the length of the test and returns
+// its address.
+func listen(t *testing.T, mkv *MuKV) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go redcon.Serve(ln, mkv.Handler, mkv.HandleAccept, mkv.HandleClose)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// dial connects to addr, sending args as a command once connected.
+func dial(t *testing.T, addr string, args ...string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	if _, err := conn.Write(appendCommand(nil, cmd)); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func TestBlockedClientDisconnects(t *testing.T) {
+	mkv := newTestServer(DefaultConfig)
+	addr := listen(t, mkv)
+	blocked := &mkv.DBs[0].blocked.blocked
+
+	conn, _ := dial(t, addr, "BLPOP", "q", "0")
+	eventually(t, "BLPOP to block", func() bool { return blocked.Load() == 1 })
+	conn.Close()
+	eventually(t, "the client to be unregistered", func() bool { return blocked.Load() == 0 })
+
+	c := newTestClient(mkv)
+	if got := c.must(t, "LPUSH", "q", "x"); got != int64(1) {
+		t.Fatalf("LPUSH: got %#v, want 1", got)
+	}
+	if got := c.bulk(t, "LPOP", "q"); got != "x" {
+		t.Fatalf("LPOP: got %q, want the element pushed", got)
+	}
+}
+
+func TestBlockedClientServedAfterWait(t *testing.T) {
+	mkv := newTestServer(DefaultConfig)
+	addr := listen(t, mkv)
+
+	conn, rd := dial(t, addr, "BLPOP", "q", "0.05")
+	if reply, err := readReply(rd); err != nil || reply != nil {
+		t.Fatalf("BLPOP: got %#v, %v, want a null array", reply, err)
+	}
+	if _, err := conn.Write(appendCommand(nil, [][]byte{[]byte("PING")})); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := readReply(rd); err != nil || reply != "PONG" {
+		t.Fatalf("PING: got %#v, %v, want PONG", reply, err)
+	}
+}
@@ -0,0 +1,1028 @@
+package mukv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/redcon"
+)
+
+// In cluster mode the keyspace is split into clusterSlots hash slots, each
+// served by one node, in the manner of Redis Cluster. A node serves the keys
+// of its own slots in database 0 and redirects clients to the node serving
+// any other with a MOVED error, which cluster-aware clients follow and learn
+// the slot map from.
+//
+// Nodes learn of one another with CLUSTER MEET and then gossip: every
+// clusterGossipPeriod each node sends every other its view of the cluster
+// with CLUSTER GOSSIP, and merges the view it gets back. Each node is the
+// authority on which slots it serves, and a slot claimed by two nodes goes to
+// the one claiming it under the higher config epoch, which a node raises
+// when it takes over a slot from another. The view is saved to
+// ClusterConfigFile whenever it changes, in the format CLUSTER NODES replies
+// with.
+//
+// A slot is moved between nodes while both keep serving it: the source is
+// marked MIGRATING and the target IMPORTING with CLUSTER SETSLOT, the keys
+// are moved with MIGRATE, and both are told the slot's new node. While the
+// slot migrates the source sends clients asking for keys it no longer holds
+// to the target with an ASK error, and the target serves them only after
+// ASKING.
+
+const (
+	// clusterGossipPeriod is how often a node gossips with each other node.
+	clusterGossipPeriod = time.Second
+	// clusterDialTimeout bounds connecting to another node.
+	clusterDialTimeout = time.Second
+)
+
+// clusterNode is a node of the cluster, as this node sees it.
+type clusterNode struct {
+	id   string
+	host string
+	port int
+	// epoch is the config epoch the node claims its slots under.
+	epoch uint64
+	// pingSent and pongRecv are the Unix times in milliseconds the node
+	// was last sent gossip and last answered it.
+	pingSent int64
+	pongRecv int64
+	// failing is set once the node has gone unanswered for longer than the
+	// node timeout.
+	failing bool
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+type cluster struct {
+	mu      sync.RWMutex
+	path    string
+	timeout time.Duration
+	// announceIP is the address this node gives others to reach it at.
+	announceIP string
+	self       *clusterNode
+	nodes      map[string]*clusterNode
+	// currentEpoch is the highest config epoch seen in the cluster.
+	currentEpoch uint64
+	// slots holds the node serving each slot, or nil if none does.
+	slots [clusterSlots]*clusterNode
+	// migrating and importing hold the slots being moved from this node,
+	// with the node each is moving to, and to this node, with the node each
+	// is moving from.
+	migrating map[int]*clusterNode
+	importing map[int]*clusterNode
+
+	transport *tcpTransport
+	logger    zerolog.Logger
+}
+
+func newCluster(logger zerolog.Logger, cfg Config) *cluster {
+	return &cluster{
+		path:       filepath.Join(cfg.Dir, cfg.ClusterConfigFile),
+		timeout:    cfg.ClusterNodeTimeout,
+		announceIP: cfg.ClusterAnnounceIP,
+		nodes:      make(map[string]*clusterNode),
+		migrating:  make(map[int]*clusterNode),
+		importing:  make(map[int]*clusterNode),
+		transport:  newTCPTransport(),
+		logger:     logger.With().Str("function", "cluster").Logger(),
+	}
+}
+
+// newNodeID returns a random node ID, 40 hexadecimal characters long.
+func newNodeID() string {
+	var b [20]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// nodeView is a node as described by a line of CLUSTER NODES.
+type nodeView struct {
+	clusterNode
+	myself    bool
+	slots     []int
+	migrating map[int]string
+	importing map[int]string
+}
+
+// appendSlotRanges appends the ranges of consecutive slots in slots, which
+// must be sorted, formatted as CLUSTER NODES writes them.
+func appendSlotRanges(buf []byte, slots []int) []byte {
+	for i := 0; i < len(slots); {
+		j := i
+		for j+1 < len(slots) && slots[j+1] == slots[j]+1 {
+			j++
+		}
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, int64(slots[i]), 10)
+		if j > i {
+			buf = append(buf, '-')
+			buf = strconv.AppendInt(buf, int64(slots[j]), 10)
+		}
+		i = j + 1
+	}
+	return buf
+}
+
+// slotsOf returns the slots n serves, in order. c.mu must be held.
+func (c *cluster) slotsOf(n *clusterNode) []int {
+	var slots []int
+	for slot, owner := range c.slots {
+		if owner == n {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// sortedNodes returns the nodes, this one first and the rest by ID. c.mu
+// must be held.
+func (c *cluster) sortedNodes() []*clusterNode {
+	nodes := []*clusterNode{c.self}
+	for _, id := range slices.Sorted(maps.Keys(c.nodes)) {
+		nodes = append(nodes, c.nodes[id])
+	}
+	return nodes
+}
+
+// nodesText returns the view of the cluster as CLUSTER NODES writes it.
+// c.mu must be held.
+func (c *cluster) nodesText() string {
+	var buf []byte
+	for _, n := range c.sortedNodes() {
+		flags, link := "master", "connected"
+		if n == c.self {
+			flags = "myself,master"
+		} else if n.failing {
+			flags, link = "master,fail?", "disconnected"
+		}
+		buf = fmt.Appendf(buf, "%s %s@0 %s - %d %d %d %s", n.id, n.addr(), flags, n.pingSent, n.pongRecv, n.epoch, link)
+		buf = appendSlotRanges(buf, c.slotsOf(n))
+		if n == c.self {
+			for _, slot := range slices.Sorted(maps.Keys(c.migrating)) {
+				buf = fmt.Appendf(buf, " [%d->-%s]", slot, c.migrating[slot].id)
+			}
+			for _, slot := range slices.Sorted(maps.Keys(c.importing)) {
+				buf = fmt.Appendf(buf, " [%d-<-%s]", slot, c.importing[slot].id)
+			}
+		}
+		buf = append(buf, '\n')
+	}
+	return string(buf)
+}
+
+// stateText returns the view of the cluster as it is saved and gossiped:
+// the lines of CLUSTER NODES followed by the current epoch. c.mu must be
+// held.
+func (c *cluster) stateText() string {
+	return c.nodesText() + fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", c.currentEpoch)
+}
+
+var errBadNodes = errors.New("malformed cluster nodes description")
+
+// parseState parses the view of a cluster written by stateText, returning
+// its nodes and its current epoch.
+func parseState(text string) ([]nodeView, uint64, error) {
+	var views []nodeView
+	var currentEpoch uint64
+	for line := range strings.Lines(text) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					currentEpoch, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, 0, errBadNodes
+		}
+		v := nodeView{migrating: make(map[int]string), importing: make(map[int]string)}
+		v.id = fields[0]
+		addr, _, _ := strings.Cut(fields[1], "@")
+		addr, _, _ = strings.Cut(addr, ",")
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, 0, errBadNodes
+		}
+		v.host = host
+		if v.port, err = strconv.Atoi(port); err != nil {
+			return nil, 0, errBadNodes
+		}
+		v.myself = slices.Contains(strings.Split(fields[2], ","), "myself")
+		v.pingSent, _ = strconv.ParseInt(fields[4], 10, 64)
+		v.pongRecv, _ = strconv.ParseInt(fields[5], 10, 64)
+		if v.epoch, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return nil, 0, errBadNodes
+		}
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				body := strings.Trim(field, "[]")
+				if s, id, ok := strings.Cut(body, "->-"); ok {
+					if slot, ok := parseSlot([]byte(s)); ok {
+						v.migrating[slot] = id
+					}
+				} else if s, id, ok := strings.Cut(body, "-<-"); ok {
+					if slot, ok := parseSlot([]byte(s)); ok {
+						v.importing[slot] = id
+					}
+				}
+				continue
+			}
+			first, last, isRange := strings.Cut(field, "-")
+			if !isRange {
+				last = first
+			}
+			lo, ok1 := parseSlot([]byte(first))
+			hi, ok2 := parseSlot([]byte(last))
+			if !ok1 || !ok2 || lo > hi {
+				return nil, 0, errBadNodes
+			}
+			for slot := lo; slot <= hi; slot++ {
+				v.slots = append(v.slots, slot)
+			}
+		}
+		views = append(views, v)
+	}
+	return views, currentEpoch, nil
+}
+
+// load reads the node's saved view of the cluster, or starts a new one with
+// a new node ID if there is none. The node is reached at port.
+func (c *cluster) load(port int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.self = &clusterNode{id: newNodeID(), host: c.announceIP, port: port}
+		return c.save()
+	}
+	if err != nil {
+		return err
+	}
+	views, currentEpoch, err := parseState(string(data))
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", c.path, err)
+	}
+	c.currentEpoch = currentEpoch
+	for _, v := range views {
+		n := &clusterNode{id: v.id, host: v.host, port: v.port, epoch: v.epoch}
+		if v.myself {
+			n.host, n.port = c.announceIP, port
+			c.self = n
+		} else {
+			c.nodes[n.id] = n
+		}
+		for _, slot := range v.slots {
+			c.slots[slot] = n
+		}
+	}
+	if c.self == nil {
+		return fmt.Errorf("reading %s: %w: no node is marked myself", c.path, errBadNodes)
+	}
+	for _, v := range views {
+		if !v.myself {
+			continue
+		}
+		for slot, id := range v.migrating {
+			if n := c.nodes[id]; n != nil {
+				c.migrating[slot] = n
+			}
+		}
+		for slot, id := range v.importing {
+			if n := c.nodes[id]; n != nil {
+				c.importing[slot] = n
+			}
+		}
+	}
+	return c.save()
+}
+
+// save writes the view of the cluster to the config file. c.mu must be
+// held.
+func (c *cluster) save() error {
+	dir := filepath.Dir(c.path)
+	f, err := createTemp(dir, "temp-nodes-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(c.stateText()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), c.path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// changed saves the view of the cluster after a change, logging any
+// failure to. c.mu must be held.
+func (c *cluster) changed() {
+	if err := c.save(); err != nil {
+		c.logger.Error().Err(err).Str("path", c.path).Msg("failed to save the cluster config file")
+	}
+}
+
+// assign makes n the node serving slot, leaving any migration of the slot
+// behind. c.mu must be held.
+func (c *cluster) assign(slot int, n *clusterNode) {
+	c.slots[slot] = n
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// bumpEpoch gives this node a config epoch above any other's, so that its
+// claims win over theirs. c.mu must be held.
+func (c *cluster) bumpEpoch() {
+	c.currentEpoch++
+	c.self.epoch = c.currentEpoch
+}
+
+// merge merges the view of the cluster another node sent, returning the
+// node that sent it.
+func (c *cluster) merge(text string) (*clusterNode, error) {
+	views, currentEpoch, err := parseState(text)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(views, func(v nodeView) bool { return v.myself })
+	if i < 0 {
+		return nil, errBadNodes
+	}
+	sender := views[i]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sender.id == c.self.id {
+		return nil, errors.New("gossip came from this node itself")
+	}
+	changed := false
+	if currentEpoch > c.currentEpoch {
+		c.currentEpoch = currentEpoch
+		changed = true
+	}
+
+	n := c.nodes[sender.id]
+	if n == nil {
+		n = &clusterNode{id: sender.id}
+		c.nodes[n.id] = n
+		changed = true
+	}
+	if n.host != sender.host || n.port != sender.port || n.epoch != sender.epoch {
+		n.host, n.port, n.epoch = sender.host, sender.port, sender.epoch
+		changed = true
+	}
+	c.currentEpoch = max(c.currentEpoch, n.epoch)
+	n.pongRecv = time.Now().UnixMilli()
+	n.failing = false
+
+	// The sender is the authority on which slots it serves: it gains those
+	// it claims over nodes with a lower epoch, and loses those it no longer
+	// claims.
+	claimed := make(map[int]bool, len(sender.slots))
+	for _, slot := range sender.slots {
+		claimed[slot] = true
+		cur := c.slots[slot]
+		if cur == n {
+			continue
+		}
+		if cur == nil || n.epoch > cur.epoch || n.epoch == cur.epoch && n.id < cur.id {
+			c.assign(slot, n)
+			changed = true
+		}
+	}
+	for slot, owner := range c.slots {
+		if owner == n && !claimed[slot] {
+			c.assign(slot, nil)
+			changed = true
+		}
+	}
+
+	// Learn of the nodes the sender knows. Their slots are learnt from
+	// them directly.
+	for _, v := range views {
+		if v.myself || v.id == c.self.id || c.nodes[v.id] != nil {
+			continue
+		}
+		c.nodes[v.id] = &clusterNode{id: v.id, host: v.host, port: v.port, epoch: v.epoch}
+		changed = true
+	}
+	if changed {
+		c.changed()
+	}
+	return n, nil
+}
+
+// gossip exchanges views of the cluster with the node at addr.
+func (c *cluster) gossip(addr string) (*clusterNode, error) {
+	c.mu.RLock()
+	text := c.stateText()
+	c.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterDialTimeout+c.timeout/2)
+	defer cancel()
+	reply, err := c.transport.Call(ctx, addr, [][]byte{[]byte("CLUSTER"), []byte("GOSSIP"), []byte(text)})
+	if err != nil {
+		return nil, err
+	}
+	view, ok := reply.([]byte)
+	if !ok {
+		return nil, errBadReply
+	}
+	return c.merge(string(view))
+}
+
+// StartClusterLoop gossips with the other nodes in cluster mode, until the
+// process exits.
+func (mkv *MuKV) StartClusterLoop() {
+	c := mkv.cluster
+	if c == nil {
+		return
+	}
+	ticker := time.NewTicker(clusterGossipPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.RLock()
+		nodes := slices.Collect(maps.Values(c.nodes))
+		c.mu.RUnlock()
+		for _, n := range nodes {
+			go func() {
+				c.mu.Lock()
+				n.pingSent = time.Now().UnixMilli()
+				addr := n.addr()
+				c.mu.Unlock()
+				if _, err := c.gossip(addr); err == nil {
+					return
+				}
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				if !n.failing && time.Since(time.UnixMilli(n.pongRecv)) > c.timeout {
+					n.failing = true
+				}
+			}()
+		}
+	}
+}
+
+// routeCluster checks that this node can run cmd in cluster mode, replying
+// with a redirect or an error if not, and reports whether it replied.
+// Commands replayed from disk are run as they were logged.
+func (mkv *MuKV) routeCluster(conn redcon.Conn, name string, cmd redcon.Command) bool {
+	c := mkv.cluster
+	if c == nil || mkv.loading.Load() {
+		return false
+	}
+	cl := clientFor(conn)
+	asking := cl.asking || name == "restore-asking"
+	if name != "asking" {
+		cl.asking = false
+	}
+
+	switch name {
+	case "select":
+		if len(cmd.Args) == 2 && string(cmd.Args[1]) != "0" {
+			conn.WriteError("ERR SELECT is not allowed in cluster mode")
+			return true
+		}
+	case "swapdb", "move", "replicaof", "slaveof":
+		conn.WriteError(fmt.Sprintf("ERR %s is not allowed in cluster mode", strings.ToUpper(name)))
+		return true
+	}
+
+	keys := keysOf(name, cmd.Args)
+	if len(keys) == 0 {
+		return false
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			conn.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+			return true
+		}
+	}
+
+	c.mu.RLock()
+	owner, migrating, importing := c.slots[slot], c.migrating[slot], c.importing[slot]
+	self := c.self
+	c.mu.RUnlock()
+	switch {
+	case owner == self && migrating == nil:
+		return false
+	case owner == self:
+		// Keys still here are served here. Those already moved are served
+		// by the target.
+		missing := mkv.missingKeys(keys)
+		switch {
+		case missing == 0:
+			return false
+		case missing == len(keys):
+			conn.WriteError(fmt.Sprintf("ASK %d %s", slot, migrating.addr()))
+		default:
+			conn.WriteError("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+	case importing != nil && asking:
+		if len(keys) > 1 && mkv.missingKeys(keys) > 0 {
+			conn.WriteError("TRYAGAIN Multiple keys request during rehashing of slot")
+			return true
+		}
+		return false
+	case owner == nil:
+		conn.WriteError("CLUSTERDOWN Hash slot not served")
+	default:
+		conn.WriteError(fmt.Sprintf("MOVED %d %s", slot, owner.addr()))
+	}
+	return true
+}
+
+// missingKeys returns how many of keys do not exist in database 0.
+func (mkv *MuKV) missingKeys(keys []string) int {
+	missing := 0
+	for _, key := range keys {
+		mkv.DBs[0].Peek(key, func(rec *Record) {
+			if rec == nil {
+				missing++
+			}
+		})
+	}
+	return missing
+}
+
+func (mkv *MuKV) handleAsking(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	if mkv.cluster == nil {
+		conn.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	clientFor(conn).asking = true
+	conn.WriteString("OK")
+}
+
+// handleReadOnly serves READONLY and READWRITE, which cluster clients send
+// to read from replicas. Nodes have no replicas, so they have no effect.
+func (mkv *MuKV) handleReadOnly(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	if mkv.cluster == nil {
+		conn.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleCluster(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	c := mkv.cluster
+	if c == nil {
+		conn.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	args := cmd.Args[2:]
+	arity := func(ok bool) bool {
+		if !ok {
+			conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for cluster|%s", sub))
+		}
+		return ok
+	}
+
+	switch sub {
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", cmd.Args[1]))
+	case "help":
+		conn.WriteArray(16)
+		conn.WriteString("CLUSTER <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+		conn.WriteString("ADDSLOTS <slot> [<slot> ...] -- Serve the given slots.")
+		conn.WriteString("ADDSLOTSRANGE <start> <end> [<start> <end> ...] -- Serve the given ranges of slots.")
+		conn.WriteString("COUNTKEYSINSLOT <slot> -- Return the number of keys in the slot.")
+		conn.WriteString("DELSLOTS <slot> [<slot> ...] -- Stop serving the given slots.")
+		conn.WriteString("GETKEYSINSLOT <slot> <count> -- Return up to count keys in the slot.")
+		conn.WriteString("INFO -- Return information about the cluster.")
+		conn.WriteString("KEYSLOT <key> -- Return the hash slot of the key.")
+		conn.WriteString("MEET <ip> <port> -- Join the cluster of the node at the address.")
+		conn.WriteString("MYID -- Return this node's ID.")
+		conn.WriteString("NODES -- Return the cluster's nodes and the slots each serves.")
+		conn.WriteString("SET-CONFIG-EPOCH <epoch> -- Set this node's config epoch, before it has joined a cluster.")
+		conn.WriteString("SETSLOT <slot> IMPORTING|MIGRATING|NODE <node-id> -- Move a slot between nodes.")
+		conn.WriteString("SETSLOT <slot> STABLE -- Cancel moving a slot.")
+		conn.WriteString("SHARDS -- Return the cluster's shards.")
+		conn.WriteString("SLOTS -- Return the slot ranges and the node serving each.")
+	case "keyslot":
+		if arity(len(args) == 1) {
+			conn.WriteInt(keyHashSlot(string(args[0])))
+		}
+	case "myid":
+		if arity(len(args) == 0) {
+			c.mu.RLock()
+			conn.WriteBulkString(c.self.id)
+			c.mu.RUnlock()
+		}
+	case "info":
+		if arity(len(args) == 0) {
+			conn.WriteBulkString(strings.Join(c.info(), "\r\n") + "\r\n")
+		}
+	case "nodes":
+		if arity(len(args) == 0) {
+			c.mu.RLock()
+			conn.WriteBulkString(c.nodesText())
+			c.mu.RUnlock()
+		}
+	case "slots":
+		if arity(len(args) == 0) {
+			c.writeSlots(conn)
+		}
+	case "shards":
+		if arity(len(args) == 0) {
+			c.writeShards(conn)
+		}
+	case "countkeysinslot":
+		if !arity(len(args) == 1) {
+			return
+		}
+		slot, ok := parseSlot(args[0])
+		if !ok {
+			conn.WriteError("ERR Invalid slot")
+			return
+		}
+		conn.WriteInt(mkv.DBs[0].slots.count(slot))
+	case "getkeysinslot":
+		if !arity(len(args) == 2) {
+			return
+		}
+		slot, ok := parseSlot(args[0])
+		if !ok {
+			conn.WriteError("ERR Invalid slot")
+			return
+		}
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil || n < 0 {
+			conn.WriteError("ERR Invalid number of keys")
+			return
+		}
+		keys := mkv.DBs[0].slots.list(slot, n)
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	case "addslots", "delslots":
+		if !arity(len(args) > 0) {
+			return
+		}
+		slots := make([]int, len(args))
+		for i, arg := range args {
+			slot, ok := parseSlot(arg)
+			if !ok {
+				conn.WriteError("ERR Invalid or out of range slot")
+				return
+			}
+			slots[i] = slot
+		}
+		c.writeResult(conn, c.setSlots(slots, sub == "addslots"))
+	case "addslotsrange":
+		if !arity(len(args) > 0 && len(args)%2 == 0) {
+			return
+		}
+		var slots []int
+		for i := 0; i < len(args); i += 2 {
+			lo, ok1 := parseSlot(args[i])
+			hi, ok2 := parseSlot(args[i+1])
+			if !ok1 || !ok2 {
+				conn.WriteError("ERR Invalid or out of range slot")
+				return
+			}
+			if lo > hi {
+				conn.WriteError(fmt.Sprintf("ERR start slot number %d is greater than end slot number %d", lo, hi))
+				return
+			}
+			for slot := lo; slot <= hi; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		c.writeResult(conn, c.setSlots(slots, true))
+	case "meet":
+		if !arity(len(args) == 2 || len(args) == 3) {
+			return
+		}
+		port, err := strconv.Atoi(string(args[1]))
+		if err != nil || port <= 0 || port > 65535 {
+			conn.WriteError(fmt.Sprintf("ERR Invalid base port specified: %s", args[1]))
+			return
+		}
+		if _, err := c.gossip(net.JoinHostPort(string(args[0]), strconv.Itoa(port))); err != nil {
+			conn.WriteError(fmt.Sprintf("ERR Failed to meet %s:%d: %v", args[0], port, err))
+			return
+		}
+		conn.WriteString("OK")
+	case "gossip":
+		if !arity(len(args) == 1) {
+			return
+		}
+		if _, err := c.merge(string(args[0])); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		c.mu.RLock()
+		conn.WriteBulkString(c.stateText())
+		c.mu.RUnlock()
+	case "set-config-epoch":
+		if !arity(len(args) == 1) {
+			return
+		}
+		epoch, err := strconv.ParseUint(string(args[0]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR Invalid config epoch specified: " + string(args[0]))
+			return
+		}
+		c.writeResult(conn, c.setConfigEpoch(epoch))
+	case "setslot":
+		if !arity(len(args) == 2 || len(args) == 3) {
+			return
+		}
+		slot, ok := parseSlot(args[0])
+		if !ok {
+			conn.WriteError("ERR Invalid or out of range slot")
+			return
+		}
+		action := strings.ToLower(string(args[1]))
+		var id string
+		if action != "stable" {
+			if !arity(len(args) == 3) {
+				return
+			}
+			id = string(args[2])
+		}
+		c.writeResult(conn, c.setSlot(slot, action, id, mkv.DBs[0].slots.count(slot)))
+	}
+}
+
+// writeResult replies OK, or with the error err.
+func (c *cluster) writeResult(conn redcon.Conn, err error) {
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// setSlots starts serving slots, if add is set, or stops serving them.
+func (c *cluster) setSlots(slots []int, add bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		switch owner := c.slots[slot]; {
+		case add && owner != nil:
+			return fmt.Errorf("Slot %d is already busy", slot)
+		case !add && owner == nil:
+			return fmt.Errorf("Slot %d is already unassigned", slot)
+		}
+	}
+	owner := c.self
+	if !add {
+		owner = nil
+	} else if c.self.epoch == 0 {
+		c.bumpEpoch()
+	}
+	for _, slot := range slots {
+		c.assign(slot, owner)
+	}
+	c.changed()
+	return nil
+}
+
+// setConfigEpoch sets this node's config epoch, which is allowed only before
+// it knows of other nodes.
+func (c *cluster) setConfigEpoch(epoch uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case epoch == 0:
+		return errors.New("Invalid config epoch specified: 0")
+	case len(c.nodes) > 0:
+		return errors.New("The user can assign a config epoch only when the node does not know any other node.")
+	case c.self.epoch != 0:
+		return errors.New("Node config epoch is already non-zero")
+	}
+	c.self.epoch = epoch
+	c.currentEpoch = max(c.currentEpoch, epoch)
+	c.changed()
+	return nil
+}
+
+// setSlot runs CLUSTER SETSLOT on slot, which holds keys keys on this node.
+func (c *cluster) setSlot(slot int, action, id string, keys int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n *clusterNode
+	if action != "stable" {
+		if n = c.node(id); n == nil {
+			return fmt.Errorf("I don't know about node %s", id)
+		}
+	}
+	switch action {
+	case "migrating":
+		if c.slots[slot] != c.self {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		if n == c.self {
+			return errors.New("Target node is myself")
+		}
+		c.migrating[slot] = n
+	case "importing":
+		if c.slots[slot] == c.self {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		if n == c.self {
+			return errors.New("Source node is myself")
+		}
+		c.importing[slot] = n
+	case "stable":
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	case "node":
+		if c.slots[slot] == c.self && n != c.self && keys > 0 {
+			return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		// A node taking over a slot claims it under a new epoch, so that
+		// its claim wins over the previous owner's.
+		if n == c.self && c.importing[slot] != nil {
+			c.bumpEpoch()
+		}
+		c.assign(slot, n)
+	default:
+		return errors.New("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	c.changed()
+	return nil
+}
+
+// node returns the node with ID id, which may be this one, or nil. c.mu
+// must be held.
+func (c *cluster) node(id string) *clusterNode {
+	if id == c.self.id {
+		return c.self
+	}
+	return c.nodes[id]
+}
+
+func (c *cluster) info() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assigned, pfail := 0, 0
+	serving := make(map[*clusterNode]bool)
+	for _, owner := range c.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		serving[owner] = true
+		if owner.failing {
+			pfail++
+		}
+	}
+	state := "ok"
+	if assigned < clusterSlots {
+		state = "fail"
+	}
+	return []string{
+		"cluster_enabled:1",
+		fmt.Sprintf("cluster_state:%s", state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		"cluster_slots_fail:0",
+		fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)+1),
+		fmt.Sprintf("cluster_size:%d", len(serving)),
+		fmt.Sprintf("cluster_current_epoch:%d", c.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", c.self.epoch),
+	}
+}
+
+// slotRange is a range of consecutive slots served by one node.
+type slotRange struct {
+	first, last int
+	node        *clusterNode
+}
+
+// slotRanges returns the ranges of slots served by a node, in order. c.mu
+// must be held.
+func (c *cluster) slotRanges() []slotRange {
+	var ranges []slotRange
+	for slot, owner := range c.slots {
+		if owner == nil {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].node == owner && ranges[n-1].last == slot-1 {
+			ranges[n-1].last = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{slot, slot, owner})
+	}
+	return ranges
+}
+
+func (c *cluster) writeSlots(conn redcon.Conn) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ranges := c.slotRanges()
+	conn.WriteArray(len(ranges))
+	for _, r := range ranges {
+		conn.WriteArray(3)
+		conn.WriteInt(r.first)
+		conn.WriteInt(r.last)
+		conn.WriteArray(4)
+		conn.WriteBulkString(r.node.host)
+		conn.WriteInt(r.node.port)
+		conn.WriteBulkString(r.node.id)
+		conn.WriteArray(0)
+	}
+}
+
+func (c *cluster) writeShards(conn redcon.Conn) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ranges := c.slotRanges()
+	nodes := c.sortedNodes()
+	conn.WriteArray(len(nodes))
+	for _, n := range nodes {
+		conn.WriteArray(4)
+		conn.WriteBulkString("slots")
+		var bounds []int
+		for _, r := range ranges {
+			if r.node == n {
+				bounds = append(bounds, r.first, r.last)
+			}
+		}
+		conn.WriteArray(len(bounds))
+		for _, b := range bounds {
+			conn.WriteInt(b)
+		}
+		conn.WriteBulkString("nodes")
+		conn.WriteArray(1)
+		health := "online"
+		if n.failing {
+			health = "fail"
+		}
+		conn.WriteArray(14)
+		conn.WriteBulkString("id")
+		conn.WriteBulkString(n.id)
+		conn.WriteBulkString("port")
+		conn.WriteInt(n.port)
+		conn.WriteBulkString("ip")
+		conn.WriteBulkString(n.host)
+		conn.WriteBulkString("endpoint")
+		conn.WriteBulkString(n.host)
+		conn.WriteBulkString("role")
+		conn.WriteBulkString("master")
+		conn.WriteBulkString("replication-offset")
+		conn.WriteInt(0)
+		conn.WriteBulkString("health")
+		conn.WriteBulkString(health)
+	}
+}
+
+func (mkv *MuKV) clusterInfo() []string {
+	if mkv.cluster == nil {
+		return []string{"cluster_enabled:0"}
+	}
+	return []string{"cluster_enabled:1"}
+}
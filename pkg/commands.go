@@ -2,7 +2,11 @@ package mukv
 
 import (
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
@@ -20,34 +24,157 @@ func (mkv *MuKV) handleQuit(conn redcon.Conn) error {
 	return conn.Close()
 }
 
+const (
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+)
+
+// setOptions holds the options parsed from a SET command.
+type setOptions struct {
+	nx, xx   bool
+	get      bool
+	keepTTL  bool
+	expire   bool
+	deadline time.Time
+	// relative is set when the expire time is given relative to now, by
+	// the EX or PX option at expireArg among the options.
+	relative  bool
+	expireArg int
+}
+
+func parseSetOptions(args [][]byte, now time.Time) (setOptions, string) {
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch opt {
+		case "nx":
+			if opts.xx {
+				return opts, errSyntax
+			}
+			opts.nx = true
+		case "xx":
+			if opts.nx {
+				return opts, errSyntax
+			}
+			opts.xx = true
+		case "get":
+			opts.get = true
+		case "keepttl":
+			if opts.expire {
+				return opts, errSyntax
+			}
+			opts.keepTTL = true
+		case "ex", "px", "exat", "pxat":
+			if opts.expire || opts.keepTTL || i+1 == len(args) {
+				return opts, errSyntax
+			}
+			i++
+			unit := time.Second
+			if opt[0] == 'p' {
+				unit = time.Millisecond
+			}
+			absolute := strings.HasSuffix(opt, "at")
+			deadline, errStr := parseExpire(args[i], unit, absolute, now)
+			if errStr == errNotInteger {
+				return opts, errStr
+			}
+			base := now
+			if absolute {
+				base = time.Unix(0, 0)
+			}
+			if errStr != "" || !deadline.After(base) {
+				return opts, "ERR invalid expire time in 'set' command"
+			}
+			opts.expire = true
+			opts.deadline = deadline
+			opts.relative = !absolute
+			opts.expireArg = i - 1
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, ""
+}
+
+// parseExpire parses an expire time counted in unit, relative to now or,
+// when absolute is set, from the Unix epoch.
+func parseExpire(arg []byte, unit time.Duration, absolute bool, now time.Time) (time.Time, string) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, errNotInteger
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return time.Time{}, "ERR invalid expire time"
+	}
+	if absolute {
+		return time.Unix(0, 0).Add(time.Duration(n) * unit), ""
+	}
+	return now.Add(time.Duration(n) * unit), ""
+}
+
 func (mkv *MuKV) handleSet(conn redcon.Conn, cmd redcon.Command) {
-	argLen := len(cmd.Args)
-	if argLen < 3 {
+	if len(cmd.Args) < 3 {
 		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
 		conn.WriteError(errStr)
-	} else {
-		var err error
-		var rec *Record
-		switch argLen {
-		case 3:
-			rec, err = mkv.Receive(string(cmd.Args[1]), "", "")
-		case 5:
-			switch strings.ToLower(string(cmd.Args[3])) {
-			case "px":
-				rec, err = mkv.Receive(string(cmd.Args[1]), string(cmd.Args[4]), "ms")
-			default:
-				rec, err = mkv.Receive(string(cmd.Args[1]), string(cmd.Args[4]), "s")
+		return
+	}
+	now := time.Now()
+	opts, errStr := parseSetOptions(cmd.Args[3:], now)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	var old []byte
+	var existed, written bool
+	var wrongType bool
+	mkv.db(conn).Update(string(cmd.Args[1]), func(cur *Record) *Record {
+		existed = cur != nil
+		if existed && opts.get {
+			var ok bool
+			if old, ok = asString(cur); !ok {
+				wrongType = true
 			}
 		}
-		if err != nil {
-			conn.WriteError(err.Error())
-		} else {
-			mkv.Datastore.Store(rec.Key, cmd.Args[2])
-			mkv.RWMutex.Lock()
-			mkv.Records[rec.Key] = rec
-			mkv.RWMutex.Unlock()
-			conn.WriteString("OK")
+		if wrongType || (opts.nx && existed) || (opts.xx && !existed) {
+			return Unchanged
+		}
+		written = true
+
+		deadline := opts.deadline
+		if opts.keepTTL && existed {
+			deadline = cur.Deadline()
+		}
+		if !deadline.IsZero() && mkv.db(conn).passed(deadline, now) {
+			return nil
 		}
+		rec := &Record{Value: encodeString(cmd.Args[2]), Created: now}
+		rec.SetDeadline(deadline)
+		return rec
+	})
+
+	switch {
+	case !written:
+		// Nothing was written, so there is nothing to log.
+		clientFor(conn).propagated = true
+	case opts.relative:
+		// Replaying a relative expire time would restart it, so log the
+		// deadline instead.
+		args := slices.Clone(cmd.Args)
+		args[3+opts.expireArg] = []byte("PXAT")
+		args[4+opts.expireArg] = pxatArg(opts.deadline)
+		mkv.propagate(conn, args...)
+	}
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case opts.get && existed:
+		conn.WriteBulk(old)
+	case opts.get, !written:
+		conn.WriteNull()
+	default:
+		conn.WriteString("OK")
 	}
 }
 
@@ -57,71 +184,234 @@ func (mkv *MuKV) handleGet(conn redcon.Conn, cmd redcon.Command) {
 		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
 		conn.WriteError(errStr)
 	} else {
-		rec, ok := mkv.Datastore.Load(string(cmd.Args[1]))
-		if !ok {
-			conn.WriteNull()
-		} else {
-			mkv.RWMutex.Lock()
-			r := mkv.Records[string(cmd.Args[1])]
-			r.Hits += 1
-			mkv.RWMutex.Unlock()
-			logger.Debug().Int(r.Key, r.Hits).Msg("key get")
-			conn.WriteAny(rec)
-		}
+		mkv.db(conn).View(string(cmd.Args[1]), func(r *Record) {
+			if r == nil {
+				conn.WriteNull()
+				return
+			}
+			val, ok := asString(r)
+			if !ok {
+				conn.WriteError(errWrongType)
+				return
+			}
+			hits := r.Hits.Load()
+			logger.Debug().Int64(r.Key, hits).Msg("key get")
+			conn.WriteBulk(val)
+		})
 	}
 }
 
-func (mkv *MuKV) handleDel(conn redcon.Conn, cmd redcon.Command) {
-	if len(cmd.Args) != 2 {
+func (mkv *MuKV) handleMGet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
 		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
 		conn.WriteError(errStr)
-	} else {
-		mkv.Datastore.Delete(string(cmd.Args[1]))
-		mkv.RWMutex.Lock()
-		_, ok := mkv.Records[string(cmd.Args[1])]
-		delete(mkv.Records, string(cmd.Args[1]))
-		mkv.RWMutex.Unlock()
-		if !ok {
-			conn.WriteInt(0)
-		} else {
-			conn.WriteInt(1)
+		return
+	}
+
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[1:]), func(recs []*Record) {
+		conn.WriteArray(len(recs))
+		for _, rec := range recs {
+			// Keys holding other types read as missing rather than failing
+			// the whole reply.
+			val, ok := asString(rec)
+			if !ok || rec == nil {
+				conn.WriteNull()
+				continue
+			}
+			conn.WriteBulk(val)
+		}
+	})
+}
+
+// handleMSet implements MSET and MSETNX, which sets nothing if any of the
+// keys already exists. Either way the keys are set all at once.
+func (mkv *MuKV) handleMSet(conn redcon.Conn, cmd redcon.Command, nx bool) {
+	if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	keys := make([]string, 0, len(cmd.Args)/2)
+	for i := 1; i < len(cmd.Args); i += 2 {
+		keys = append(keys, string(cmd.Args[i]))
+	}
+
+	written := false
+	mkv.db(conn).UpdateAll(keys, func(recs []*Record) []*Record {
+		if nx && slices.ContainsFunc(recs, func(rec *Record) bool { return rec != nil }) {
+			return nil
+		}
+		for i := range recs {
+			recs[i] = newRecord(encodeString(cmd.Args[i*2+2]))
 		}
+		written = true
+		return recs
+	})
+
+	switch {
+	case !nx:
+		conn.WriteString("OK")
+	case written:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
 	}
 }
 
-func (mkv *MuKV) handleTouch(conn redcon.Conn, cmd redcon.Command) {
-	logger := mkv.Log.With().Str("function", "handleTouch").Logger()
-	if len(cmd.Args) != 2 {
+// lazyFreeThreshold is the number of elements above which UNLINK frees a
+// value in the background rather than while the client waits.
+const lazyFreeThreshold = 64
+
+// freeValue releases the memory held by a value removed from the keyspace,
+// clearing its containers so that the garbage collector can reclaim their
+// contents piecemeal.
+func freeValue(v any) {
+	switch v := v.(type) {
+	case hashValue:
+		clear(v)
+	case *deque:
+		*v = deque{}
+	case *setValue:
+		*v = setValue{}
+	case *zsetValue:
+		v.tree.Clear()
+		clear(v.scores)
+	}
+}
+
+// handleDel implements DEL and UNLINK, which removes the keys at once but
+// frees large values in the background.
+func (mkv *MuKV) handleDel(conn redcon.Conn, cmd redcon.Command, unlink bool) {
+	if len(cmd.Args) < 2 {
 		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
 		conn.WriteError(errStr)
-	} else {
-		_, ok := mkv.Datastore.Load(string(cmd.Args[1]))
-		if !ok {
-			conn.WriteNull()
-		} else {
-			mkv.RWMutex.Lock()
-			r := mkv.Records[string(cmd.Args[1])]
-			r.Touch()
-			mkv.RWMutex.Unlock()
-			logger.Debug().Int(r.Key, r.Hits).Msg("key touch")
-			conn.WriteInt(r.Hits)
+		return
+	}
+
+	deleted := 0
+	var large []any
+	mkv.db(conn).UpdateAll(argStrings(cmd.Args[1:]), func(recs []*Record) []*Record {
+		for i, rec := range recs {
+			if rec == nil || slices.Contains(recs[:i], rec) {
+				continue
+			}
+			deleted++
+			if unlink && rec.Type() != TypeString && rec.Len() > lazyFreeThreshold {
+				large = append(large, rec.Value)
+			}
 		}
+		clear(recs)
+		return recs
+	})
+
+	if len(large) > 0 {
+		go func() {
+			for _, v := range large {
+				freeValue(v)
+			}
+		}()
 	}
+	conn.WriteInt(deleted)
 }
 
-func (mkv *MuKV) handleTTL(conn redcon.Conn, cmd redcon.Command) {
-	if len(cmd.Args) != 2 {
+func (mkv *MuKV) handleExists(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
 		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
 		conn.WriteError(errStr)
-	} else {
-		_, ok := mkv.Datastore.Load(string(cmd.Args[1]))
-		if !ok {
-			conn.WriteNull()
-		} else {
-			mkv.RWMutex.RLock()
-			r := mkv.Records[string(cmd.Args[1])]
-			mkv.RWMutex.RUnlock()
-			conn.WriteInt(int(r.TimeToExpiry()))
+		return
+	}
+
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[1:]), func(recs []*Record) {
+		// A key repeated in the command is counted each time.
+		n := 0
+		for _, rec := range recs {
+			if rec != nil {
+				n++
+			}
 		}
+		conn.WriteInt(n)
+	})
+}
+
+func (mkv *MuKV) handleTouch(conn redcon.Conn, cmd redcon.Command) {
+	logger := mkv.Log.With().Str("function", "handleTouch").Logger()
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	// ViewAll counts each key as used, which is all TOUCH does.
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[1:]), func(recs []*Record) {
+		n := 0
+		for _, rec := range recs {
+			if rec == nil {
+				continue
+			}
+			logger.Debug().Str("key", rec.Key).Msg("key touch")
+			n++
+		}
+		conn.WriteInt(n)
+	})
+}
+
+func parseFloat(arg []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// addInt64 returns a+b, reporting false if the sum overflows.
+func addInt64(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, false
+	}
+	return a + b, true
+}
+
+func parseInt(arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	return n, err == nil
+}
+
+// normalizeRange resolves the inclusive start and stop indexes of a range
+// over n elements, where negative indexes count back from the end. It
+// reports false if the range is empty.
+func normalizeRange(start, stop int64, n int) (int, int, bool) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if stop < 0 {
+		stop += int64(n)
+	}
+	start = max(start, 0)
+	stop = min(stop, int64(n)-1)
+	if start > stop {
+		return 0, 0, false
+	}
+	return int(start), int(stop), true
+}
+
+// canonicalInt parses s as an integer. Only the canonical decimal form of an
+// integer qualifies, so that it reads back unchanged.
+func canonicalInt(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+func argStrings(args [][]byte) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
 	}
+	return strs
 }
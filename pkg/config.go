@@ -0,0 +1,296 @@
+package mukv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// configParam is a setting that CONFIG GET reads and CONFIG SET changes.
+type configParam struct {
+	get func(mkv *MuKV) string
+	// set applies value, returning why it is invalid if it is. It is nil for
+	// settings fixed at startup.
+	set func(mkv *MuKV, value string) string
+}
+
+// configParams holds the settings exposed through CONFIG, by name.
+var configParams = map[string]configParam{
+	"databases": {
+		get: func(mkv *MuKV) string { return strconv.Itoa(len(mkv.DBs)) },
+	},
+	"maxmemory": {
+		get: func(mkv *MuKV) string { return strconv.FormatInt(mkv.evictor.maxMemory.Load(), 10) },
+		set: func(mkv *MuKV, value string) string {
+			n, ok := ParseMemory(value)
+			if !ok {
+				return "argument must be a memory value"
+			}
+			mkv.evictor.maxMemory.Store(n)
+			// Lowering the limit evicts at once rather than on the next
+			// write, which logs the evictions in order as a write would.
+			order := mkv.lockOrder()
+			mkv.evictor.makeRoom()
+			order.Unlock()
+			return ""
+		},
+	},
+	"maxmemory-policy": {
+		get: func(mkv *MuKV) string { return mkv.evictor.policy().String() },
+		set: func(mkv *MuKV, value string) string {
+			pol, ok := ParseEvictionPolicy(strings.ToLower(value))
+			if !ok {
+				return "argument(s) must be one of the following: " + strings.Join(evictionPolicyNames[:], ", ")
+			}
+			mkv.evictor.pol.Store(int32(pol))
+			return ""
+		},
+	},
+	"maxmemory-samples": intConfigParam(func(mkv *MuKV) *atomic.Int32 { return &mkv.evictor.samples }, 1, 64),
+	"lfu-log-factor":    intConfigParam(func(mkv *MuKV) *atomic.Int32 { return &mkv.evictor.lfuLogFactor }, 0, 1<<20),
+	"lfu-decay-time":    intConfigParam(func(mkv *MuKV) *atomic.Int32 { return &mkv.evictor.lfuDecayTime }, 0, 1<<20),
+	"save": {
+		get: func(mkv *MuKV) string {
+			mkv.saver.mu.Lock()
+			defer mkv.saver.mu.Unlock()
+			return formatSaveRules(mkv.saver.rules)
+		},
+		set: func(mkv *MuKV, value string) string {
+			rules, ok := ParseSaveRules(value)
+			if !ok {
+				return "Invalid save parameters"
+			}
+			mkv.saver.mu.Lock()
+			mkv.saver.rules = rules
+			mkv.saver.mu.Unlock()
+			return ""
+		},
+	},
+	"dir": {
+		get: func(mkv *MuKV) string {
+			mkv.saver.mu.Lock()
+			defer mkv.saver.mu.Unlock()
+			return mkv.saver.dir
+		},
+		set: func(mkv *MuKV, value string) string {
+			if info, err := os.Stat(value); err != nil || !info.IsDir() {
+				return "No such file or directory"
+			}
+			mkv.saver.mu.Lock()
+			mkv.saver.dir = value
+			mkv.saver.mu.Unlock()
+			return ""
+		},
+	},
+	"dbfilename": {
+		get: func(mkv *MuKV) string {
+			mkv.saver.mu.Lock()
+			defer mkv.saver.mu.Unlock()
+			return mkv.saver.filename
+		},
+		set: func(mkv *MuKV, value string) string {
+			if value == "" || filepath.Base(value) != value {
+				return "dbfilename can't be a path, just a filename"
+			}
+			mkv.saver.mu.Lock()
+			mkv.saver.filename = value
+			mkv.saver.mu.Unlock()
+			return ""
+		},
+	},
+	"appendonly": {
+		get: func(mkv *MuKV) string { return yesNo(mkv.aof.enabled.Load()) },
+		set: func(mkv *MuKV, value string) string {
+			on, ok := parseYesNo(value)
+			if !ok {
+				return "argument must be 'yes' or 'no'"
+			}
+			mkv.setAppendOnly(on)
+			return ""
+		},
+	},
+	"appendfsync": {
+		get: func(mkv *MuKV) string { return mkv.aof.fsyncPolicy().String() },
+		set: func(mkv *MuKV, value string) string {
+			pol, ok := ParseFsyncPolicy(strings.ToLower(value))
+			if !ok {
+				return "argument(s) must be one of the following: " + strings.Join(fsyncPolicyNames[:], ", ")
+			}
+			mkv.aof.policy.Store(int32(pol))
+			return ""
+		},
+	},
+	"appendfilename": {
+		get: func(mkv *MuKV) string { return filepath.Base(mkv.aof.path) },
+	},
+	"aof-load-truncated": {
+		get: func(mkv *MuKV) string { return yesNo(mkv.aof.loadTruncated.Load()) },
+		set: func(mkv *MuKV, value string) string {
+			on, ok := parseYesNo(value)
+			if !ok {
+				return "argument must be 'yes' or 'no'"
+			}
+			mkv.aof.loadTruncated.Store(on)
+			return ""
+		},
+	},
+	"auto-aof-rewrite-percentage": intConfigParam(func(mkv *MuKV) *atomic.Int32 { return &mkv.aof.rewritePercentage }, 0, 1<<20),
+	"auto-aof-rewrite-min-size": {
+		get: func(mkv *MuKV) string { return strconv.FormatInt(mkv.aof.rewriteMinSize.Load(), 10) },
+		set: func(mkv *MuKV, value string) string {
+			n, ok := ParseMemory(value)
+			if !ok {
+				return "argument must be a memory value"
+			}
+			mkv.aof.rewriteMinSize.Store(n)
+			return ""
+		},
+	},
+	"lua-time-limit": intConfigParam(func(mkv *MuKV) *atomic.Int32 { return &mkv.scripts.timeLimit }, 0, 1<<30),
+	"replica-read-only": {
+		get: func(mkv *MuKV) string { return yesNo(mkv.repl.replicaReadOnly.Load()) },
+		set: func(mkv *MuKV, value string) string {
+			on, ok := parseYesNo(value)
+			if !ok {
+				return "argument must be 'yes' or 'no'"
+			}
+			mkv.repl.replicaReadOnly.Store(on)
+			return ""
+		},
+	},
+}
+
+// yesNo formats a boolean setting.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseYesNo parses a boolean setting.
+func parseYesNo(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return true, true
+	case "no":
+		return false, true
+	}
+	return false, false
+}
+
+// intConfigParam returns a parameter for an integer setting between lo and
+// hi inclusive, held in the field that field returns.
+func intConfigParam(field func(mkv *MuKV) *atomic.Int32, lo, hi int32) configParam {
+	return configParam{
+		get: func(mkv *MuKV) string { return strconv.Itoa(int(field(mkv).Load())) },
+		set: func(mkv *MuKV, value string) string {
+			n, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return "argument couldn't be parsed into an integer"
+			}
+			if int32(n) < lo || int32(n) > hi {
+				return fmt.Sprintf("argument must be between %d and %d inclusive", lo, hi)
+			}
+			field(mkv).Store(int32(n))
+			return ""
+		},
+	}
+}
+
+// memoryUnits maps the suffixes of memory values to their multipliers, as
+// Redis parses them.
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1 << 10,
+	"m":  1000 * 1000,
+	"mb": 1 << 20,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1 << 30,
+}
+
+// ParseMemory parses a memory value such as 100mb, in bytes.
+func ParseMemory(s string) (int64, bool) {
+	s = strings.ToLower(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := memoryUnits[s[i:]]
+	if !ok || i == 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+func (mkv *MuKV) handleConfig(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	switch sub := strings.ToLower(string(cmd.Args[1])); sub {
+	case "get":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for config|get")
+			return
+		}
+		var pairs []string
+		for name, param := range configParams {
+			for _, pattern := range cmd.Args[2:] {
+				opts := scanOptions{pattern: strings.ToLower(string(pattern))}
+				if opts.matches(name) {
+					pairs = append(pairs, name, param.get(mkv))
+					break
+				}
+			}
+		}
+		conn.WriteArray(len(pairs))
+		for _, s := range pairs {
+			conn.WriteBulkString(s)
+		}
+	case "set":
+		if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+			conn.WriteError("ERR wrong number of arguments for config|set")
+			return
+		}
+		// Check every name before applying any value.
+		for i := 2; i < len(cmd.Args); i += 2 {
+			name := strings.ToLower(string(cmd.Args[i]))
+			param, ok := configParams[name]
+			if !ok {
+				conn.WriteError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", cmd.Args[i]))
+				return
+			}
+			if param.set == nil {
+				conn.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+				return
+			}
+		}
+		for i := 2; i < len(cmd.Args); i += 2 {
+			name := strings.ToLower(string(cmd.Args[i]))
+			if errStr := configParams[name].set(mkv, string(cmd.Args[i+1])); errStr != "" {
+				conn.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, errStr))
+				return
+			}
+		}
+		conn.WriteString("OK")
+	case "resetstat":
+		mkv.evictor.evicted.Store(0)
+		conn.WriteString("OK")
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", cmd.Args[1]))
+	}
+}
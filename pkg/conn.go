@@ -0,0 +1,131 @@
+package mukv
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/tidwall/redcon"
+)
+
+// bufferConn is a connection with no network client behind it, for running
+// commands on the server's own behalf. Replies are appended to buf.
+type bufferConn struct {
+	ctx any
+	buf []byte
+}
+
+func (c *bufferConn) RemoteAddr() string             { return "" }
+func (c *bufferConn) Close() error                   { return nil }
+func (c *bufferConn) WriteError(msg string)          { c.buf = redcon.AppendError(c.buf, msg) }
+func (c *bufferConn) WriteString(str string)         { c.buf = redcon.AppendString(c.buf, str) }
+func (c *bufferConn) WriteBulk(bulk []byte)          { c.buf = redcon.AppendBulk(c.buf, bulk) }
+func (c *bufferConn) WriteBulkString(bulk string)    { c.buf = redcon.AppendBulkString(c.buf, bulk) }
+func (c *bufferConn) WriteInt(num int)               { c.buf = redcon.AppendInt(c.buf, int64(num)) }
+func (c *bufferConn) WriteInt64(num int64)           { c.buf = redcon.AppendInt(c.buf, num) }
+func (c *bufferConn) WriteUint64(num uint64)         { c.buf = redcon.AppendUint(c.buf, num) }
+func (c *bufferConn) WriteArray(count int)           { c.buf = redcon.AppendArray(c.buf, count) }
+func (c *bufferConn) WriteNull()                     { c.buf = redcon.AppendNull(c.buf) }
+func (c *bufferConn) WriteRaw(data []byte)           { c.buf = append(c.buf, data...) }
+func (c *bufferConn) WriteAny(v any)                 { c.buf = redcon.AppendAny(c.buf, v) }
+func (c *bufferConn) Context() any                   { return c.ctx }
+func (c *bufferConn) SetContext(v any)               { c.ctx = v }
+func (c *bufferConn) SetReadBuffer(int)              {}
+func (c *bufferConn) Detach() redcon.DetachedConn    { return nil }
+func (c *bufferConn) ReadPipeline() []redcon.Command { return nil }
+func (c *bufferConn) PeekPipeline() []redcon.Command { return nil }
+func (c *bufferConn) NetConn() net.Conn              { return nil }
+
+// appendCommand appends args to buf as a RESP array of bulk strings, the
+// form clients send commands in.
+func appendCommand(buf []byte, args [][]byte) []byte {
+	buf = redcon.AppendArray(buf, len(args))
+	for _, arg := range args {
+		buf = redcon.AppendBulk(buf, arg)
+	}
+	return buf
+}
+
+var errBadReply = errors.New("malformed reply")
+
+// replyError is an error reply read by readReply.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+// readReply reads a RESP reply from r. Simple strings are returned as
+// strings, bulk strings as []byte, integers as int64, arrays as []any and
+// nulls as nil. An error reply is returned as a replyError, or held in the
+// array it is part of.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadSlice('\n')
+	switch {
+	case err == io.EOF && len(line) > 0:
+		return nil, io.ErrUnexpectedEOF
+	case err == bufio.ErrBufferFull:
+		return nil, errBadReply
+	case err != nil:
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errBadReply
+	}
+	body := string(line[1 : len(line)-2])
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, replyError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errBadReply
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxBulkLen {
+			return nil, errBadReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		bulk := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if bulk[n] != '\r' || bulk[n+1] != '\n' {
+			return nil, errBadReply
+		}
+		return bulk[:n:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxBulkLen {
+			return nil, errBadReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, 0, min(n, 1024))
+		for range n {
+			item, err := readReply(r)
+			if rerr, ok := err.(replyError); ok {
+				item, err = rerr, nil
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errBadReply
+}
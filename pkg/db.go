@@ -0,0 +1,212 @@
+package mukv
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// client holds the state kept for a connection, stored in its context.
+type client struct {
+	// db is the index of the selected database.
+	db int
+	// order is the write order lock held while the client runs a command
+	// that writes.
+	order sync.Locker
+	// propagated is set once the command being run has logged its effects
+	// itself, in place of the command.
+	propagated bool
+	// leader is set for the connection a replica applies the leader's
+	// writes through.
+	leader bool
+	// listeningPort is the port a replica connecting with this connection
+	// serves clients on, as it reported with REPLCONF.
+	listeningPort int
+	// asking is set by ASKING, letting the next command reach a slot being
+	// imported.
+	asking bool
+	// multi holds the transaction begun with MULTI, if any.
+	multi *transaction
+	// watched lists the keys the client watches with WATCH.
+	watched []watchedKey
+	// dirty is set once a key the client watches has been written, failing
+	// its next EXEC.
+	dirty atomic.Bool
+	// noBlock is set while the client runs a transaction, whose commands
+	// must not block.
+	noBlock bool
+	// detached is set once the client has been taken off the server loop
+	// to block.
+	detached *detachedClient
+}
+
+func clientFor(conn redcon.Conn) *client {
+	c, ok := conn.Context().(*client)
+	if !ok {
+		c = &client{}
+		conn.SetContext(c)
+	}
+	return c
+}
+
+// db returns the keyspace of the database the connection has selected.
+func (mkv *MuKV) db(conn redcon.Conn) *Keyspace {
+	return mkv.DBs[clientFor(conn).db]
+}
+
+// parseDB parses a database index, replying with errStr if it is not a
+// valid one.
+func (mkv *MuKV) parseDB(arg []byte) (int, string) {
+	n, ok := parseInt(arg)
+	if !ok {
+		return 0, errNotInteger
+	}
+	if n < 0 || n >= int64(len(mkv.DBs)) {
+		return 0, "ERR DB index is out of range"
+	}
+	return int(n), ""
+}
+
+// transfer calls fn with the records for srcKey in database src and dstKey
+// in database dst, and stores the records fn returns in their place, all
+// atomically. Shards in different databases are locked in database order,
+// so concurrent transfers cannot deadlock.
+func (mkv *MuKV) transfer(src int, srcKey string, dst int, dstKey string, fn func(srcRec, dstRec *Record) (*Record, *Record)) {
+	if src == dst {
+		mkv.DBs[src].UpdateAll([]string{srcKey, dstKey}, func(recs []*Record) []*Record {
+			recs[0], recs[1] = fn(recs[0], recs[1])
+			return recs
+		})
+		return
+	}
+
+	if src < dst {
+		mkv.DBs[src].Update(srcKey, func(srcRec *Record) *Record {
+			mkv.DBs[dst].Update(dstKey, func(dstRec *Record) *Record {
+				srcRec, dstRec = fn(srcRec, dstRec)
+				return dstRec
+			})
+			return srcRec
+		})
+	} else {
+		mkv.DBs[dst].Update(dstKey, func(dstRec *Record) *Record {
+			mkv.DBs[src].Update(srcKey, func(srcRec *Record) *Record {
+				srcRec, dstRec = fn(srcRec, dstRec)
+				return srcRec
+			})
+			return dstRec
+		})
+	}
+}
+
+func (mkv *MuKV) handleSelect(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	db, errStr := mkv.parseDB(cmd.Args[1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	clientFor(conn).db = db
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleSwapDB(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	a, errStr := mkv.parseDB(cmd.Args[1])
+	if errStr == errNotInteger {
+		errStr = "ERR invalid first DB index"
+	}
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	b, errStr := mkv.parseDB(cmd.Args[2])
+	if errStr == errNotInteger {
+		errStr = "ERR invalid second DB index"
+	}
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	if a != b {
+		mkv.swapMu.Lock()
+		mkv.DBs[a].Swap(mkv.DBs[b])
+		mkv.swapMu.Unlock()
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleMove(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	dst, errStr := mkv.parseDB(cmd.Args[2])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	src := clientFor(conn).db
+	if src == dst {
+		conn.WriteError("ERR source and destination objects are the same")
+		return
+	}
+
+	key := string(cmd.Args[1])
+	moved := false
+	mkv.transfer(src, key, dst, key, func(srcRec, dstRec *Record) (*Record, *Record) {
+		if srcRec == nil || dstRec != nil {
+			return Unchanged, Unchanged
+		}
+		moved = true
+		return nil, srcRec.clone(srcRec.Value)
+	})
+
+	if moved {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// handleFlush implements FLUSHDB and FLUSHALL, which flushes every database.
+func (mkv *MuKV) handleFlush(conn redcon.Conn, cmd redcon.Command, all bool) {
+	if len(cmd.Args) > 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	async := false
+	if len(cmd.Args) == 2 {
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "async":
+			async = true
+		case "sync":
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+
+	if all {
+		for _, ks := range mkv.DBs {
+			ks.Flush(async)
+		}
+	} else {
+		mkv.db(conn).Flush(async)
+	}
+	conn.WriteString("OK")
+}
@@ -0,0 +1,123 @@
+package mukv
+
+import "slices"
+
+// deque is a double-ended queue of byte strings backed by a ring buffer
+// whose capacity grows and shrinks in powers of two. Both ends are O(1) to
+// push and pop, and any element is O(1) to reach by index.
+type deque struct {
+	buf  [][]byte
+	head int
+	n    int
+}
+
+const minDequeCap = 8
+
+// Clone returns a copy of the deque sharing its elements, which are never
+// modified in place.
+func (d *deque) Clone() *deque {
+	return &deque{buf: slices.Clone(d.buf), head: d.head, n: d.n}
+}
+
+func (d *deque) Len() int {
+	return d.n
+}
+
+func (d *deque) index(i int) int {
+	return (d.head + i) & (len(d.buf) - 1)
+}
+
+// At returns the element at index i, counting from the front.
+func (d *deque) At(i int) []byte {
+	return d.buf[d.index(i)]
+}
+
+func (d *deque) Set(i int, v []byte) {
+	d.buf[d.index(i)] = v
+}
+
+func (d *deque) PushFront(v []byte) {
+	d.grow()
+	d.head = (d.head - 1) & (len(d.buf) - 1)
+	d.buf[d.head] = v
+	d.n++
+}
+
+func (d *deque) PushBack(v []byte) {
+	d.grow()
+	d.buf[d.index(d.n)] = v
+	d.n++
+}
+
+func (d *deque) PopFront() []byte {
+	v := d.buf[d.head]
+	d.buf[d.head] = nil
+	d.head = d.index(1)
+	d.n--
+	d.shrink()
+	return v
+}
+
+func (d *deque) PopBack() []byte {
+	i := d.index(d.n - 1)
+	v := d.buf[i]
+	d.buf[i] = nil
+	d.n--
+	d.shrink()
+	return v
+}
+
+// Insert places v at index i, shifting the elements on the shorter side of
+// i outwards.
+func (d *deque) Insert(i int, v []byte) {
+	if i < d.n/2 {
+		d.PushFront(nil)
+		for j := 0; j < i; j++ {
+			d.Set(j, d.At(j+1))
+		}
+	} else {
+		d.PushBack(nil)
+		for j := d.n - 1; j > i; j-- {
+			d.Set(j, d.At(j-1))
+		}
+	}
+	d.Set(i, v)
+}
+
+// Remove deletes the element at index i, closing the gap from the shorter
+// side of i.
+func (d *deque) Remove(i int) {
+	if i < d.n/2 {
+		for j := i; j > 0; j-- {
+			d.Set(j, d.At(j-1))
+		}
+		d.PopFront()
+	} else {
+		for j := i; j < d.n-1; j++ {
+			d.Set(j, d.At(j+1))
+		}
+		d.PopBack()
+	}
+}
+
+func (d *deque) grow() {
+	if d.n < len(d.buf) {
+		return
+	}
+	d.resize(max(len(d.buf)*2, minDequeCap))
+}
+
+func (d *deque) shrink() {
+	if len(d.buf) > minDequeCap && d.n <= len(d.buf)/4 {
+		d.resize(len(d.buf) / 2)
+	}
+}
+
+func (d *deque) resize(capacity int) {
+	buf := make([][]byte, capacity)
+	for i := range d.n {
+		buf[i] = d.At(i)
+	}
+	d.buf = buf
+	d.head = 0
+}
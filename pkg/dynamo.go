@@ -0,0 +1,769 @@
+package mukv
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// In dynamo mode nodes form a leaderless cluster in the manner of Amazon's
+// Dynamo. Every node accepts reads and writes for any key and coordinates
+// them with the N nodes that store it: the first N found walking a
+// consistent hash ring from the key's hash. A write succeeds once W of them
+// have stored it and a read once R of them have answered, so that reads see
+// the latest successful write as long as R + W > N. Keys are stored in
+// database 0, and only GET, SET and DEL are coordinated; other commands that
+// write are refused, and other reads see only the node's own copy.
+//
+// Each value carries a Version. A write follows every version its
+// coordinator read for the key, and nodes keep whichever of two versions
+// follows the other, or of concurrent versions the one written last.
+// Deleted keys leave a tombstone, so that a deletion supersedes the value it
+// deleted wherever that is still held.
+//
+// A node storing the key that cannot take a write is replaced by the next
+// node along the ring, which holds the write as a hint and hands it off once
+// the node is reachable again. Reads repair the nodes they find holding
+// older versions. Hints and tombstones are kept in memory only.
+
+// DynamoConfig configures dynamo mode.
+type DynamoConfig struct {
+	// Node is the ID of this node, which the other nodes reach it by.
+	Node string
+	// Nodes lists the IDs of all nodes in the cluster, this one included.
+	Nodes []string
+	// N is the number of nodes each key is stored on. R and W are the
+	// number of them that must answer a read, and acknowledge a write, for
+	// it to succeed.
+	N, R, W int
+	// Timeout bounds how long a node waits for another to answer. Zero
+	// means one second.
+	Timeout time.Duration
+	// Transport carries requests between nodes. If nil, nodes are reached
+	// over TCP, with their IDs as addresses.
+	Transport Transport
+}
+
+// Validate reports whether the configuration describes a usable cluster.
+func (c *DynamoConfig) Validate() error {
+	if !slices.Contains(c.Nodes, c.Node) {
+		return fmt.Errorf("node %q is not one of the cluster's nodes", c.Node)
+	}
+	if n := len(slices.Compact(slices.Sorted(slices.Values(c.Nodes)))); c.N < 1 || c.N > n {
+		return fmt.Errorf("N must be between 1 and the number of nodes, %d", n)
+	}
+	if c.R < 1 || c.R > c.N || c.W < 1 || c.W > c.N {
+		return errors.New("R and W must be between 1 and N")
+	}
+	return nil
+}
+
+const (
+	// dynamoVirtualNodes is the number of points each node has on the ring,
+	// which spreads keys evenly across nodes.
+	dynamoVirtualNodes = 64
+	// dynamoTimeout is the default for DynamoConfig.Timeout.
+	dynamoTimeout = time.Second
+	// handoffPeriod is how often hints are handed off to their nodes.
+	handoffPeriod = time.Second
+	// tombstoneTTL is how long a deleted key's version is kept, which must
+	// outlast any hint or repair still carrying an older version.
+	tombstoneTTL = time.Hour
+)
+
+// ringPoint is a point on the hash ring, owned by a node.
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// ringHash hashes s onto the ring.
+func ringHash(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// newRing places dynamoVirtualNodes points on the ring for each of nodes.
+func newRing(nodes []string) []ringPoint {
+	var ring []ringPoint
+	for _, node := range slices.Compact(slices.Sorted(slices.Values(nodes))) {
+		for i := range dynamoVirtualNodes {
+			ring = append(ring, ringPoint{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// dynamoValue is a version of a key's value, as held by a node. A nil
+// version means the node has never seen the key.
+type dynamoValue struct {
+	value   []byte
+	deleted bool
+	version *Version
+}
+
+// exists reports whether v holds a value.
+func (v dynamoValue) exists() bool {
+	return v.version != nil && !v.deleted
+}
+
+// newer returns whichever of a and b supersedes the other: the one whose
+// version follows, or of concurrent versions the one written last, with a
+// version that follows both.
+func newer(a, b dynamoValue) dynamoValue {
+	switch a.version.compare(b.version) {
+	case versionEqual, versionAfter:
+		return a
+	case versionBefore:
+		return b
+	}
+	if b.version.wins(a.version) {
+		a, b = b, a
+	}
+	a.version = a.version.merge(b.version)
+	return a
+}
+
+// appendValueArgs appends v to args as the command arguments it is sent
+// between nodes as: "missing", "deleted" or "value" and the value, followed
+// by the version.
+func appendValueArgs(args [][]byte, v dynamoValue) [][]byte {
+	switch {
+	case v.version == nil:
+		return append(args, []byte("missing"))
+	case v.deleted:
+		args = append(args, []byte("deleted"), nil)
+	default:
+		args = append(args, []byte("value"), v.value)
+	}
+	return v.version.appendArgs(args)
+}
+
+// parseValueArgs parses a value from the arguments appendValueArgs appends.
+// The value is copied, since args may be reused once the command has run.
+func parseValueArgs(args [][]byte) (dynamoValue, bool) {
+	if len(args) == 1 && string(args[0]) == "missing" {
+		return dynamoValue{}, true
+	}
+	if len(args) < 2 {
+		return dynamoValue{}, false
+	}
+	var v dynamoValue
+	switch string(args[0]) {
+	case "deleted":
+		v.deleted = true
+	case "value":
+		v.value = bytes.Clone(args[1])
+		if v.value == nil {
+			v.value = []byte{}
+		}
+	default:
+		return dynamoValue{}, false
+	}
+	var ok bool
+	v.version, ok = parseVersion(args[2:])
+	return v, ok
+}
+
+// parseValueReply parses a value from a node's reply to DYNAMO.GET.
+func parseValueReply(reply any) (dynamoValue, error) {
+	items, _ := reply.([]any)
+	args := make([][]byte, len(items))
+	for i, item := range items {
+		arg, ok := item.([]byte)
+		if !ok {
+			return dynamoValue{}, errBadReply
+		}
+		args[i] = arg
+	}
+	v, ok := parseValueArgs(args)
+	if !ok {
+		return dynamoValue{}, errBadReply
+	}
+	return v, nil
+}
+
+// tombstone is the version of a deleted key, kept to order the deletion
+// against other versions.
+type tombstone struct {
+	version *Version
+	at      time.Time
+}
+
+// quorumError reports a request that too few nodes answered.
+type quorumError struct {
+	op        string
+	got, need int
+}
+
+func (e *quorumError) Error() string {
+	return fmt.Sprintf("NOQUORUM %s answered by %d of the %d nodes needed", e.op, e.got, e.need)
+}
+
+type dynamo struct {
+	mkv       *MuKV
+	self      string
+	nodes     int
+	n, r, w   int
+	timeout   time.Duration
+	transport Transport
+	ring      []ringPoint
+
+	// mu serializes storing versions, so that each is compared with the
+	// one it would replace.
+	mu         sync.Mutex
+	tombstones map[string]tombstone
+
+	// counter numbers the writes this node coordinates. Each takes a number
+	// higher than any it has taken before, so no two writes coordinated by
+	// the node carry the same clock.
+	counter atomic.Uint64
+
+	hintMu sync.Mutex
+	// hints holds, for each node, the values of keys written while it was
+	// unreachable.
+	hints map[string]map[string]dynamoValue
+
+	repairs  atomic.Int64
+	handoffs atomic.Int64
+}
+
+func newDynamo(mkv *MuKV, cfg *DynamoConfig) *dynamo {
+	d := &dynamo{
+		mkv:        mkv,
+		self:       cfg.Node,
+		n:          cfg.N,
+		r:          cfg.R,
+		w:          cfg.W,
+		timeout:    cfg.Timeout,
+		transport:  cfg.Transport,
+		ring:       newRing(cfg.Nodes),
+		tombstones: make(map[string]tombstone),
+		hints:      make(map[string]map[string]dynamoValue),
+	}
+	d.nodes = len(d.ring) / dynamoVirtualNodes
+	if d.timeout == 0 {
+		d.timeout = dynamoTimeout
+	}
+	if d.transport == nil {
+		d.transport = newTCPTransport()
+	}
+	return d
+}
+
+// preferenceList returns every node in the order they are found walking the
+// ring from key's hash. The first N store the key, and the rest stand in for
+// them when they are unreachable.
+func (d *dynamo) preferenceList(key string) []string {
+	h := ringHash(key)
+	start := sort.Search(len(d.ring), func(i int) bool { return d.ring[i].hash >= h })
+	nodes := make([]string, 0, d.nodes)
+	for i := 0; len(nodes) < d.nodes; i++ {
+		node := d.ring[(start+i)%len(d.ring)].node
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// call sends args to node and returns its reply.
+func (d *dynamo) call(node string, args [][]byte) (any, error) {
+	if node == d.self {
+		return callLocal(d.mkv, args)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.transport.Call(ctx, node, args)
+}
+
+// load returns the version of key this node holds. d.mu must be held. An
+// expired key is not removed, since DYNAMO.PUT loads keys holding the write
+// order lock.
+func (d *dynamo) load(key string) (dynamoValue, error) {
+	var v dynamoValue
+	var err error
+	ks := d.mkv.DBs[0]
+	ks.peek(key, func(rec *Record) {
+		if rec == nil {
+			return
+		}
+		ks.access(rec)
+		val, ok := asString(rec)
+		if !ok {
+			err = errors.New(errWrongType)
+			return
+		}
+		v = dynamoValue{value: val, version: rec.Version}
+	})
+	if err == nil && v.version == nil {
+		if t, ok := d.tombstones[key]; ok {
+			v = dynamoValue{deleted: true, version: t.version}
+		}
+	}
+	return v, err
+}
+
+// store stores v for key unless this node holds a version that supersedes
+// it.
+func (d *dynamo) store(key string, v dynamoValue) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cur, err := d.load(key)
+	if err != nil {
+		return err
+	}
+	v = newer(cur, v)
+	if v.version.compare(cur.version) == versionEqual {
+		return nil
+	}
+	ks := d.mkv.DBs[0]
+	if v.deleted {
+		ks.Delete(key)
+		d.tombstones[key] = tombstone{version: v.version, at: time.Now()}
+		return nil
+	}
+	delete(d.tombstones, key)
+	ks.Update(key, func(*Record) *Record {
+		rec := newRecord(v.value)
+		rec.Version = v.version
+		return rec
+	})
+	return nil
+}
+
+// nodeReply is a node's answer to DYNAMO.GET.
+type nodeReply struct {
+	node  string
+	value dynamoValue
+	err   error
+}
+
+// broadcast sends args to each of nodes at once. Their replies are sent on
+// the returned channel as they arrive, and it is closed once all have.
+func (d *dynamo) broadcast(nodes []string, args [][]byte) <-chan nodeReply {
+	replies := make(chan nodeReply, len(nodes))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Go(func() {
+			rep := nodeReply{node: node}
+			reply, err := d.call(node, args)
+			if err == nil {
+				rep.value, err = parseValueReply(reply)
+			}
+			rep.err = err
+			replies <- rep
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+	return replies
+}
+
+// get reads key from the nodes that store it, returning the version that
+// supersedes the others once R of them have answered. If repair is set,
+// nodes found holding older versions, including those answering after the
+// read has returned, are repaired in the background.
+func (d *dynamo) get(key string, repair bool) (dynamoValue, error) {
+	replies := d.broadcast(d.preferenceList(key)[:d.n], [][]byte{[]byte("DYNAMO.GET"), []byte(key)})
+	var got []nodeReply
+	var latest dynamoValue
+	for rep := range replies {
+		if rep.err != nil {
+			continue
+		}
+		got = append(got, rep)
+		latest = newer(latest, rep.value)
+		if len(got) == d.r {
+			break
+		}
+	}
+	if repair {
+		go d.repair(key, got, replies)
+	}
+	if len(got) < d.r {
+		return latest, &quorumError{op: "read", got: len(got), need: d.r}
+	}
+	return latest, nil
+}
+
+// repair writes the latest version of key to the nodes among got and the
+// replies still to come that hold an older one.
+func (d *dynamo) repair(key string, got []nodeReply, replies <-chan nodeReply) {
+	for rep := range replies {
+		if rep.err == nil {
+			got = append(got, rep)
+		}
+	}
+	var latest dynamoValue
+	for _, rep := range got {
+		latest = newer(latest, rep.value)
+	}
+	if latest.version == nil {
+		return
+	}
+	put := appendValueArgs([][]byte{[]byte("DYNAMO.PUT"), []byte(key)}, latest)
+	for _, rep := range got {
+		if rep.value.version.compare(latest.version) == versionEqual {
+			continue
+		}
+		if _, err := d.call(rep.node, put); err == nil {
+			d.repairs.Add(1)
+		}
+	}
+}
+
+// put writes a new version of key, following every version read from the
+// nodes that store it, and returns the latest version it read. The write
+// itself brings the nodes it reaches up to date, so the read repairs none.
+// If the read fails to reach R nodes the write goes ahead regardless: a
+// version it missed is concurrent with the new one, and resolved like any
+// other.
+func (d *dynamo) put(key string, value []byte, deleted bool) (dynamoValue, error) {
+	prev, _ := d.get(key, false)
+	version := &Version{
+		Clock: maps.Clone(prev.version.clock()),
+		Stamp: time.Now().UnixMilli(),
+		Node:  d.self,
+	}
+	if version.Clock == nil {
+		version.Clock = make(map[string]uint64)
+	}
+	version.Clock[d.self] = d.nextCount(version.Clock[d.self])
+	v := dynamoValue{value: value, deleted: deleted, version: version}
+	if acks := d.replicate(key, v); acks < d.w {
+		return prev, &quorumError{op: "write", got: acks, need: d.w}
+	}
+	return prev, nil
+}
+
+// nextCount takes the next number for a write this node coordinates, which
+// must be above seen, the count the node's entry in the clock already has.
+func (d *dynamo) nextCount(seen uint64) uint64 {
+	for {
+		n := d.counter.Load()
+		next := max(n, seen) + 1
+		if d.counter.CompareAndSwap(n, next) {
+			return next
+		}
+	}
+}
+
+// replicate sends v to the nodes that store key, returning once W have
+// acknowledged it or all have answered, with the number of
+// acknowledgements. A node that cannot take it is replaced by the next one
+// along the ring that can, which holds it as a hint. If none can, this node
+// holds the hint, but the write is not acknowledged.
+func (d *dynamo) replicate(key string, v dynamoValue) int {
+	prefs := d.preferenceList(key)
+	primaries, fallbacks := prefs[:d.n], prefs[d.n:]
+	put := appendValueArgs([][]byte{[]byte("DYNAMO.PUT"), []byte(key)}, v)
+
+	var next atomic.Int64
+	acks := make(chan bool, len(primaries))
+	var wg sync.WaitGroup
+	for _, node := range primaries {
+		wg.Go(func() {
+			if _, err := d.call(node, put); err == nil {
+				acks <- true
+				return
+			}
+			if node == d.self {
+				acks <- false
+				return
+			}
+			hint := appendValueArgs([][]byte{[]byte("DYNAMO.HINT"), []byte(node), []byte(key)}, v)
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(fallbacks) {
+					break
+				}
+				if _, err := d.call(fallbacks[i], hint); err == nil {
+					acks <- true
+					return
+				}
+			}
+			d.addHint(node, key, v)
+			acks <- false
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(acks)
+	}()
+
+	n := 0
+	for ok := range acks {
+		if ok {
+			n++
+			if n == d.w {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// addHint holds v to hand off to node once it is reachable.
+func (d *dynamo) addHint(node, key string, v dynamoValue) {
+	d.hintMu.Lock()
+	defer d.hintMu.Unlock()
+	if d.hints[node] == nil {
+		d.hints[node] = make(map[string]dynamoValue)
+	}
+	d.hints[node][key] = newer(d.hints[node][key], v)
+}
+
+// pendingHints returns the number of hints held.
+func (d *dynamo) pendingHints() int {
+	d.hintMu.Lock()
+	defer d.hintMu.Unlock()
+	n := 0
+	for _, keys := range d.hints {
+		n += len(keys)
+	}
+	return n
+}
+
+// handoff hands the hints held to their nodes. Hints for a node that cannot
+// take one are kept for the next attempt.
+func (d *dynamo) handoff() {
+	d.hintMu.Lock()
+	pending := d.hints
+	d.hints = make(map[string]map[string]dynamoValue)
+	d.hintMu.Unlock()
+
+	for node, keys := range pending {
+		down := false
+		for key, v := range keys {
+			if !down {
+				put := appendValueArgs([][]byte{[]byte("DYNAMO.PUT"), []byte(key)}, v)
+				if _, err := d.call(node, put); err == nil {
+					d.handoffs.Add(1)
+					continue
+				}
+				down = true
+			}
+			d.addHint(node, key, v)
+		}
+	}
+}
+
+// expireTombstones forgets deleted keys once tombstoneTTL has passed.
+func (d *dynamo) expireTombstones() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, t := range d.tombstones {
+		if time.Since(t.at) > tombstoneTTL {
+			delete(d.tombstones, key)
+		}
+	}
+}
+
+// StartDynamoLoop hands off hints and expires tombstones in dynamo mode,
+// until the process exits.
+func (mkv *MuKV) StartDynamoLoop() {
+	d := mkv.dynamo
+	if d == nil {
+		return
+	}
+	ticker := time.NewTicker(handoffPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.handoff()
+		d.expireTombstones()
+	}
+}
+
+// serveDynamo runs the commands that dynamo mode coordinates across nodes,
+// and refuses the other commands that write, reporting whether it replied.
+// Commands replayed from disk or streamed from a leader are left to run
+// locally.
+func (mkv *MuKV) serveDynamo(conn redcon.Conn, name string, cmd redcon.Command) bool {
+	if mkv.dynamo == nil || mkv.loading.Load() || clientFor(conn).leader {
+		return false
+	}
+	switch name {
+	case "get":
+		mkv.handleQuorumGet(conn, cmd)
+	case "set":
+		mkv.handleQuorumSet(conn, cmd)
+	case "del", "unlink":
+		mkv.handleQuorumDel(conn, cmd)
+	case "multi", "watch", "eval", "evalsha", "eval_ro", "evalsha_ro":
+		conn.WriteError(fmt.Sprintf("ERR %s is not supported in dynamo mode", cmd.Args[0]))
+	default:
+		if commandFlags[name]&flagWrite == 0 || strings.HasPrefix(name, "dynamo.") {
+			return false
+		}
+		conn.WriteError(fmt.Sprintf("ERR %s is not supported in dynamo mode", cmd.Args[0]))
+	}
+	return true
+}
+
+func (mkv *MuKV) handleQuorumGet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	v, err := mkv.dynamo.get(string(cmd.Args[1]), true)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if !v.exists() {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteBulk(v.value)
+}
+
+func (mkv *MuKV) handleQuorumSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	if len(cmd.Args) > 3 {
+		conn.WriteError("ERR SET options are not supported in dynamo mode")
+		return
+	}
+	if _, err := mkv.dynamo.put(string(cmd.Args[1]), bytes.Clone(cmd.Args[2]), false); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleQuorumDel(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	deleted := 0
+	for _, key := range cmd.Args[1:] {
+		prev, err := mkv.dynamo.put(string(key), nil, true)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		if prev.exists() {
+			deleted++
+		}
+	}
+	conn.WriteInt(deleted)
+}
+
+// handleDynamoGet replies with this node's version of a key, for the node
+// coordinating a read.
+func (mkv *MuKV) handleDynamoGet(conn redcon.Conn, cmd redcon.Command) {
+	d := mkv.dynamo
+	if d == nil {
+		conn.WriteError("ERR dynamo mode is not enabled")
+		return
+	}
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	d.mu.Lock()
+	v, err := d.load(string(cmd.Args[1]))
+	d.mu.Unlock()
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	args := appendValueArgs(nil, v)
+	conn.WriteArray(len(args))
+	for _, arg := range args {
+		conn.WriteBulk(arg)
+	}
+}
+
+// handleDynamoPut stores a version of a key sent by another node, unless
+// this node holds one that supersedes it.
+func (mkv *MuKV) handleDynamoPut(conn redcon.Conn, cmd redcon.Command) {
+	d := mkv.dynamo
+	if d == nil {
+		conn.WriteError("ERR dynamo mode is not enabled")
+		return
+	}
+	if len(cmd.Args) < 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	v, ok := parseValueArgs(cmd.Args[2:])
+	if !ok || v.version == nil {
+		conn.WriteError(errSyntax)
+		return
+	}
+	if err := d.store(string(cmd.Args[1]), v); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// handleDynamoHint holds a version of a key for a node that could not take
+// it.
+func (mkv *MuKV) handleDynamoHint(conn redcon.Conn, cmd redcon.Command) {
+	d := mkv.dynamo
+	if d == nil {
+		conn.WriteError("ERR dynamo mode is not enabled")
+		return
+	}
+	if len(cmd.Args) < 6 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	v, ok := parseValueArgs(cmd.Args[3:])
+	if !ok || v.version == nil {
+		conn.WriteError(errSyntax)
+		return
+	}
+	d.addHint(string(cmd.Args[1]), string(cmd.Args[2]), v)
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) dynamoInfo() []string {
+	d := mkv.dynamo
+	if d == nil {
+		return []string{"dynamo_enabled:0"}
+	}
+	d.mu.Lock()
+	tombstones := len(d.tombstones)
+	d.mu.Unlock()
+	return []string{
+		"dynamo_enabled:1",
+		fmt.Sprintf("dynamo_node:%s", d.self),
+		fmt.Sprintf("dynamo_nodes:%d", d.nodes),
+		fmt.Sprintf("dynamo_n:%d", d.n),
+		fmt.Sprintf("dynamo_r:%d", d.r),
+		fmt.Sprintf("dynamo_w:%d", d.w),
+		fmt.Sprintf("dynamo_hints_pending:%d", d.pendingHints()),
+		fmt.Sprintf("dynamo_hints_delivered:%d", d.handoffs.Load()),
+		fmt.Sprintf("dynamo_read_repairs:%d", d.repairs.Load()),
+		fmt.Sprintf("dynamo_tombstones:%d", tombstones),
+	}
+}
@@ -0,0 +1,125 @@
+package mukv
+
+import (
+	"strings"
+	"testing"
+)
+
+// newDynamoCluster starts nodes a to d in dynamo mode, storing each key on
+// three of them, on a network the test can cut them off from.
+func newDynamoCluster(t *testing.T) (map[string]*MuKV, *MemoryNetwork) {
+	t.Helper()
+	ids := []string{"a", "b", "c", "d"}
+	network := NewMemoryNetwork()
+	nodes := make(map[string]*MuKV)
+	for _, id := range ids {
+		cfg := DefaultConfig
+		cfg.Dynamo = &DynamoConfig{Node: id, Nodes: ids, N: 3, R: 2, W: 2, Transport: network.Transport(id)}
+		if err := cfg.Dynamo.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		nodes[id] = newTestServer(cfg)
+		network.Add(id, nodes[id])
+	}
+	return nodes, network
+}
+
+// localValue returns the version of key node holds itself.
+func localValue(t *testing.T, node *MuKV, key string) dynamoValue {
+	t.Helper()
+	reply, err := callLocal(node, [][]byte{[]byte("DYNAMO.GET"), []byte(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := parseValueReply(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDynamoQuorum(t *testing.T) {
+	nodes, _ := newDynamoCluster(t)
+	prefs := nodes["a"].dynamo.preferenceList("k")
+	primaries, fallback := prefs[:3], prefs[3]
+
+	newTestClient(nodes[fallback]).must(t, "SET", "k", "v1")
+	for id, node := range nodes {
+		if got := newTestClient(node).bulk(t, "GET", "k"); got != "v1" {
+			t.Errorf("GET k on %s = %q, want v1", id, got)
+		}
+	}
+	for _, id := range primaries {
+		if v := localValue(t, nodes[id], "k"); !v.exists() || string(v.value) != "v1" {
+			t.Errorf("%s holds %q, want v1", id, v.value)
+		}
+	}
+	if v := localValue(t, nodes[fallback], "k"); v.exists() {
+		t.Errorf("%s, which does not store k, holds %q", fallback, v.value)
+	}
+
+	newTestClient(nodes[primaries[1]]).must(t, "DEL", "k")
+	if got := newTestClient(nodes[primaries[2]]).must(t, "GET", "k"); got != nil {
+		t.Errorf("GET k after DEL = %q, want nil", got)
+	}
+}
+
+func TestDynamoHintedHandoff(t *testing.T) {
+	nodes, network := newDynamoCluster(t)
+	prefs := nodes["a"].dynamo.preferenceList("k")
+	coordinator, down, fallback := prefs[0], prefs[2], prefs[3]
+	c := newTestClient(nodes[coordinator])
+
+	network.SetDown(down, true)
+	c.must(t, "SET", "k", "v1")
+	hints := nodes[fallback].dynamo
+	eventually(t, "the fallback to hold a hint", func() bool { return hints.pendingHints() == 1 })
+	if got := c.bulk(t, "GET", "k"); got != "v1" {
+		t.Errorf("GET k with %s down = %q, want v1", down, got)
+	}
+
+	// With a second node storing the key down, a read can no longer reach
+	// a quorum, while a write still can through the fallback.
+	network.SetDown(prefs[1], true)
+	if _, err := c.do("GET", "k"); err == nil || !strings.HasPrefix(err.Error(), "NOQUORUM") {
+		t.Errorf("GET k with two nodes down: got error %v, want NOQUORUM", err)
+	}
+	c.must(t, "SET", "k", "v2")
+	eventually(t, "both nodes down to be hinted v2", func() bool {
+		return hinted(nodes, down, "k", "v2") && hinted(nodes, prefs[1], "k", "v2")
+	})
+	network.SetDown(prefs[1], false)
+
+	for _, node := range nodes {
+		node.dynamo.handoff()
+	}
+	if v := localValue(t, nodes[down], "k"); v.exists() {
+		t.Errorf("%s was handed %q while down", down, v.value)
+	}
+	network.SetDown(down, false)
+	for id, node := range nodes {
+		node.dynamo.handoff()
+		if n := node.dynamo.pendingHints(); n != 0 {
+			t.Errorf("%s still holds %d hints after handoff", id, n)
+		}
+	}
+	for _, id := range prefs[:3] {
+		if v := localValue(t, nodes[id], "k"); string(v.value) != "v2" {
+			t.Errorf("%s holds %q after handoff, want v2", id, v.value)
+		}
+	}
+}
+
+// hinted reports whether any of nodes holds value as a hint of key for node.
+func hinted(nodes map[string]*MuKV, node, key, value string) bool {
+	for _, mkv := range nodes {
+		d := mkv.dynamo
+		d.hintMu.Lock()
+		v, ok := d.hints[node][key]
+		d.hintMu.Unlock()
+		if ok && string(v.value) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package mukv
+
+import (
+	"container/heap"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ExpireConfig tunes the active expire cycle, which samples keys with a TTL
+// and removes the ones whose deadline has passed.
+type ExpireConfig struct {
+	// Hz is the number of cycles run per second.
+	Hz int
+	// SampleSize is the number of keys sampled per pass of a cycle.
+	SampleSize int
+	// StaleRatio is the fraction of sampled keys that must have expired for
+	// the cycle to take another pass.
+	StaleRatio float64
+	// CPUBudget is the fraction of each cycle's period it may spend sampling.
+	CPUBudget float64
+}
+
+var DefaultExpireConfig = ExpireConfig{
+	Hz:         10,
+	SampleSize: 20,
+	StaleRatio: 0.1,
+	CPUBudget:  0.25,
+}
+
+// maxHz is the most cycles the active expire cycle runs per second, as in
+// Redis.
+const maxHz = 500
+
+// logExpiryRetry is how long an expired key waits, in raft mode, before its
+// removal is logged again if it has yet to run.
+const logExpiryRetry = time.Second
+
+// withDefaults returns c with the settings it leaves unset, or sets out of
+// range, replaced by their defaults.
+func (c ExpireConfig) withDefaults() ExpireConfig {
+	if c.Hz <= 0 {
+		c.Hz = DefaultExpireConfig.Hz
+	}
+	c.Hz = min(c.Hz, maxHz)
+	if c.SampleSize <= 0 {
+		c.SampleSize = DefaultExpireConfig.SampleSize
+	}
+	if c.CPUBudget <= 0 {
+		c.CPUBudget = DefaultExpireConfig.CPUBudget
+	}
+	c.CPUBudget = min(c.CPUBudget, 1)
+	return c
+}
+
+// ExpiryStats reports the state of the expiry scheduler.
+type ExpiryStats struct {
+	Pending int
+	Expired uint64
+}
+
+type expiryItem struct {
+	key      string
+	deadline time.Time
+	index    int
+}
+
+// expiryHeap is a min-heap of expiryItems ordered by deadline.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// expiryScheduler holds a single deadline per key and calls expire once that
+// deadline has passed. Scheduling, rescheduling and cancelling a key are
+// O(log n); the run loop sleeps until the earliest deadline instead of polling.
+type expiryScheduler struct {
+	sync.Mutex
+	items   expiryHeap
+	index   map[string]*expiryItem
+	wake    chan struct{}
+	expired uint64
+
+	// expire is called without the scheduler lock held and reports whether
+	// the key was actually removed.
+	expire func(key string, deadline time.Time) bool
+}
+
+func newExpiryScheduler(expire func(key string, deadline time.Time) bool) *expiryScheduler {
+	return &expiryScheduler{
+		index:  make(map[string]*expiryItem),
+		wake:   make(chan struct{}, 1),
+		expire: expire,
+	}
+}
+
+// Schedule sets the deadline for key, replacing any deadline already held.
+func (s *expiryScheduler) Schedule(key string, deadline time.Time) {
+	s.Lock()
+	item, ok := s.index[key]
+	if ok {
+		item.deadline = deadline
+		heap.Fix(&s.items, item.index)
+	} else {
+		item = &expiryItem{key: key, deadline: deadline}
+		heap.Push(&s.items, item)
+		s.index[key] = item
+	}
+	first := item.index == 0
+	s.Unlock()
+
+	if first {
+		s.notify()
+	}
+}
+
+// Cancel removes any deadline held for key.
+func (s *expiryScheduler) Cancel(key string) {
+	s.Lock()
+	defer s.Unlock()
+	item, ok := s.index[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.items, item.index)
+	delete(s.index, key)
+}
+
+// Expire removes key through the expire callback if its deadline has
+// passed, for callers that find an expired key before the run loop does.
+func (s *expiryScheduler) Expire(key string, deadline time.Time) bool {
+	s.Lock()
+	if item, ok := s.index[key]; ok && item.deadline.Equal(deadline) {
+		heap.Remove(&s.items, item.index)
+		delete(s.index, key)
+	}
+	s.Unlock()
+	return s.expireItem(key, deadline)
+}
+
+// Expired cancels key's deadline and counts it as expired, for callers
+// that have already removed the key themselves.
+func (s *expiryScheduler) Expired(key string) {
+	s.Lock()
+	defer s.Unlock()
+	if item, ok := s.index[key]; ok {
+		heap.Remove(&s.items, item.index)
+		delete(s.index, key)
+	}
+	s.expired++
+}
+
+func (s *expiryScheduler) expireItem(key string, deadline time.Time) bool {
+	if !s.expire(key, deadline) {
+		return false
+	}
+	s.Lock()
+	s.expired++
+	s.Unlock()
+	return true
+}
+
+// sample picks up to n scheduled keys at random and expires those whose
+// deadline has passed.
+func (s *expiryScheduler) sample(n int, now time.Time) (sampled, expired int) {
+	s.Lock()
+	if n > len(s.items) {
+		n = len(s.items)
+	}
+	var due []*expiryItem
+	for range n {
+		if len(s.items) == 0 {
+			break
+		}
+		item := s.items[rand.IntN(len(s.items))]
+		if item.deadline.After(now) {
+			continue
+		}
+		heap.Remove(&s.items, item.index)
+		delete(s.index, item.key)
+		due = append(due, item)
+	}
+	s.Unlock()
+
+	for _, item := range due {
+		if s.expireItem(item.key, item.deadline) {
+			expired++
+		}
+	}
+	return n, expired
+}
+
+// RunActive runs the active expire cycle described by cfg. Each cycle keeps
+// sampling while the stale ratio is exceeded and its CPU budget lasts. It
+// does not return.
+func (s *expiryScheduler) RunActive(cfg ExpireConfig) {
+	period := time.Second / time.Duration(cfg.Hz)
+	budget := time.Duration(float64(period) * cfg.CPUBudget)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		for {
+			sampled, expired := s.sample(cfg.SampleSize, time.Now())
+			if sampled == 0 || float64(expired)/float64(sampled) <= cfg.StaleRatio {
+				break
+			}
+			if time.Since(start) >= budget {
+				break
+			}
+		}
+	}
+}
+
+// sampleKeys returns up to n keys with a deadline, picked at random.
+func (s *expiryScheduler) sampleKeys(n int) []string {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, min(n, len(s.items)))
+	for range cap(keys) {
+		keys = append(keys, s.items[rand.IntN(len(s.items))].key)
+	}
+	return keys
+}
+
+// swap exchanges the deadlines held by s and other, for SWAPDB. Callers must
+// not swap concurrently.
+func (s *expiryScheduler) swap(other *expiryScheduler) {
+	s.Lock()
+	other.Lock()
+	s.items, other.items = other.items, s.items
+	s.index, other.index = other.index, s.index
+	other.Unlock()
+	s.Unlock()
+	s.notify()
+	other.notify()
+}
+
+// clear drops every deadline held, for FLUSHDB.
+func (s *expiryScheduler) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.items = nil
+	s.index = make(map[string]*expiryItem)
+}
+
+func (s *expiryScheduler) Stats() ExpiryStats {
+	s.Lock()
+	defer s.Unlock()
+	return ExpiryStats{
+		Pending: len(s.items),
+		Expired: s.expired,
+	}
+}
+
+func (s *expiryScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the earliest item if its deadline has passed, otherwise it
+// returns how long to wait before checking again. A negative wait means
+// there is nothing scheduled.
+func (s *expiryScheduler) next(now time.Time) (*expiryItem, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.items) == 0 {
+		return nil, -1
+	}
+	item := s.items[0]
+	if wait := item.deadline.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	heap.Pop(&s.items)
+	delete(s.index, item.key)
+	return item, 0
+}
+
+// Run expires keys as their deadlines pass. It does not return.
+func (s *expiryScheduler) Run() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		item, wait := s.next(time.Now())
+		if item != nil {
+			s.expireItem(item.key, item.deadline)
+			continue
+		}
+
+		if wait < 0 {
+			<-s.wake
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
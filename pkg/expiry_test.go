@@ -0,0 +1,14 @@
+package mukv
+
+import "testing"
+
+func TestExpireConfigDefaults(t *testing.T) {
+	got := ExpireConfig{Hz: 0, SampleSize: -1, StaleRatio: 0.2, CPUBudget: 0}.withDefaults()
+	want := ExpireConfig{Hz: DefaultExpireConfig.Hz, SampleSize: DefaultExpireConfig.SampleSize, StaleRatio: 0.2, CPUBudget: DefaultExpireConfig.CPUBudget}
+	if got != want {
+		t.Errorf("withDefaults() = %+v, want %+v", got, want)
+	}
+	if got := (ExpireConfig{Hz: 10000, SampleSize: 5, CPUBudget: 3}).withDefaults(); got.Hz != maxHz || got.CPUBudget != 1 {
+		t.Errorf("withDefaults() = %+v, want Hz and CPUBudget clamped", got)
+	}
+}
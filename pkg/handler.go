@@ -3,14 +3,416 @@ package mukv
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
 
+// commandFlag describes how a command affects the server beyond its reply.
+type commandFlag uint8
+
+const (
+	// flagWrite marks commands that may modify the keyspace.
+	flagWrite commandFlag = 1 << iota
+	// flagDenyOOM marks commands that may grow memory use, which are
+	// refused when the memory limit cannot be kept.
+	flagDenyOOM
+	// flagBlocking marks commands that may block the client. They are never
+	// logged as written, since replaying one could block forever.
+	flagBlocking
+	// flagNoScript marks commands scripts may not call.
+	flagNoScript
+	// flagIsolated marks commands run with every other client shut out.
+	flagIsolated
+)
+
+// commandFlags holds the flags of each command that has any.
+var commandFlags = map[string]commandFlag{
+	"set":              flagWrite | flagDenyOOM,
+	"mset":             flagWrite | flagDenyOOM,
+	"msetnx":           flagWrite | flagDenyOOM,
+	"append":           flagWrite | flagDenyOOM,
+	"setrange":         flagWrite | flagDenyOOM,
+	"incr":             flagWrite | flagDenyOOM,
+	"decr":             flagWrite | flagDenyOOM,
+	"incrby":           flagWrite | flagDenyOOM,
+	"decrby":           flagWrite | flagDenyOOM,
+	"incrbyfloat":      flagWrite | flagDenyOOM,
+	"getset":           flagWrite | flagDenyOOM,
+	"hset":             flagWrite | flagDenyOOM,
+	"hmset":            flagWrite | flagDenyOOM,
+	"hsetnx":           flagWrite | flagDenyOOM,
+	"hincrby":          flagWrite | flagDenyOOM,
+	"hincrbyfloat":     flagWrite | flagDenyOOM,
+	"lpush":            flagWrite | flagDenyOOM,
+	"rpush":            flagWrite | flagDenyOOM,
+	"lpushx":           flagWrite | flagDenyOOM,
+	"rpushx":           flagWrite | flagDenyOOM,
+	"lset":             flagWrite | flagDenyOOM,
+	"linsert":          flagWrite | flagDenyOOM,
+	"lmove":            flagWrite | flagDenyOOM,
+	"rpoplpush":        flagWrite | flagDenyOOM,
+	"blmove":           flagWrite | flagDenyOOM | flagBlocking,
+	"brpoplpush":       flagWrite | flagDenyOOM | flagBlocking,
+	"sadd":             flagWrite | flagDenyOOM,
+	"sinterstore":      flagWrite | flagDenyOOM,
+	"sunionstore":      flagWrite | flagDenyOOM,
+	"sdiffstore":       flagWrite | flagDenyOOM,
+	"zadd":             flagWrite | flagDenyOOM,
+	"zincrby":          flagWrite | flagDenyOOM,
+	"zrangestore":      flagWrite | flagDenyOOM,
+	"zunionstore":      flagWrite | flagDenyOOM,
+	"zinterstore":      flagWrite | flagDenyOOM,
+	"zdiffstore":       flagWrite | flagDenyOOM,
+	"copy":             flagWrite | flagDenyOOM,
+	"getdel":           flagWrite,
+	"getex":            flagWrite,
+	"expire":           flagWrite,
+	"pexpire":          flagWrite,
+	"expireat":         flagWrite,
+	"pexpireat":        flagWrite,
+	"persist":          flagWrite,
+	"hdel":             flagWrite,
+	"lpop":             flagWrite,
+	"rpop":             flagWrite,
+	"lrem":             flagWrite,
+	"ltrim":            flagWrite,
+	"lmpop":            flagWrite,
+	"blpop":            flagWrite | flagBlocking,
+	"brpop":            flagWrite | flagBlocking,
+	"blmpop":           flagWrite | flagBlocking,
+	"srem":             flagWrite,
+	"smove":            flagWrite,
+	"spop":             flagWrite,
+	"zrem":             flagWrite,
+	"zremrangebyrank":  flagWrite,
+	"zremrangebyscore": flagWrite,
+	"zremrangebylex":   flagWrite,
+	"zpopmin":          flagWrite,
+	"zpopmax":          flagWrite,
+	"zmpop":            flagWrite,
+	"bzpopmin":         flagWrite | flagBlocking,
+	"bzpopmax":         flagWrite | flagBlocking,
+	"bzmpop":           flagWrite | flagBlocking,
+	"swapdb":           flagWrite,
+	"move":             flagWrite,
+	"flushdb":          flagWrite,
+	"flushall":         flagWrite,
+	"rename":           flagWrite,
+	"renamenx":         flagWrite,
+	"del":              flagWrite,
+	"unlink":           flagWrite,
+	"dynamo.put":       flagWrite | flagDenyOOM | flagNoScript,
+	"restore":          flagWrite | flagDenyOOM,
+	"restore-asking":   flagWrite | flagDenyOOM,
+	"migrate":          flagWrite,
+	"dynamo.get":       flagNoScript,
+	"dynamo.hint":      flagNoScript,
+	"raft":             flagNoScript,
+	"raft.vote":        flagNoScript,
+	"raft.append":      flagNoScript,
+	"raft.snapshot":    flagNoScript,
+	"raft.propose":     flagNoScript,
+	"save":             flagNoScript,
+	"bgsave":           flagNoScript,
+	"bgrewriteaof":     flagNoScript,
+	"quit":             flagNoScript,
+	"psync":            flagNoScript,
+	"sync":             flagNoScript,
+	"replconf":         flagNoScript,
+	"replicaof":        flagNoScript,
+	"slaveof":          flagNoScript,
+	"multi":            flagNoScript,
+	"exec":             flagNoScript | flagIsolated,
+	"discard":          flagNoScript,
+	"watch":            flagNoScript,
+	"unwatch":          flagNoScript,
+	"eval":             flagNoScript | flagIsolated,
+	"evalsha":          flagNoScript | flagIsolated,
+	"eval_ro":          flagNoScript | flagIsolated,
+	"evalsha_ro":       flagNoScript | flagIsolated,
+	"script":           flagNoScript,
+}
+
+// commandArity holds the number of arguments each command takes, counting
+// its name, or minus the least number for commands taking a variable
+// number. Commands queued in a transaction are checked against it, since
+// they only run at EXEC.
+var commandArity = map[string]int{
+	"append":           3,
+	"asking":           1,
+	"bgrewriteaof":     1,
+	"bgsave":           -1,
+	"blmove":           6,
+	"blmpop":           -5,
+	"blpop":            -3,
+	"brpop":            -3,
+	"brpoplpush":       4,
+	"bzmpop":           -5,
+	"bzpopmax":         -3,
+	"bzpopmin":         -3,
+	"cluster":          -2,
+	"config":           -2,
+	"copy":             -3,
+	"dbsize":           1,
+	"decr":             2,
+	"decrby":           3,
+	"del":              -2,
+	"discard":          1,
+	"dump":             2,
+	"dynamo.get":       2,
+	"dynamo.hint":      -6,
+	"dynamo.put":       -5,
+	"eval":             -3,
+	"eval_ro":          -3,
+	"evalsha":          -3,
+	"evalsha_ro":       -3,
+	"exec":             1,
+	"exists":           -2,
+	"expire":           -3,
+	"expireat":         -3,
+	"expiretime":       2,
+	"flushall":         -1,
+	"flushdb":          -1,
+	"get":              2,
+	"getdel":           2,
+	"getex":            -2,
+	"getrange":         4,
+	"getset":           3,
+	"hdel":             -3,
+	"hexists":          3,
+	"hget":             3,
+	"hgetall":          2,
+	"hincrby":          4,
+	"hincrbyfloat":     4,
+	"hkeys":            2,
+	"hlen":             2,
+	"hmget":            -3,
+	"hmset":            -4,
+	"hrandfield":       -2,
+	"hscan":            -3,
+	"hset":             -4,
+	"hsetnx":           4,
+	"hstrlen":          3,
+	"hvals":            2,
+	"incr":             2,
+	"incrby":           3,
+	"incrbyfloat":      3,
+	"info":             -1,
+	"keys":             2,
+	"lastsave":         1,
+	"lcs":              -3,
+	"lindex":           3,
+	"linsert":          5,
+	"llen":             2,
+	"lmove":            5,
+	"lmpop":            -4,
+	"lpop":             -2,
+	"lpos":             -3,
+	"lpush":            -3,
+	"lpushx":           -3,
+	"lrange":           4,
+	"lrem":             4,
+	"lset":             4,
+	"ltrim":            4,
+	"mget":             -2,
+	"migrate":          -6,
+	"move":             3,
+	"mset":             -3,
+	"msetnx":           -3,
+	"multi":            1,
+	"object":           -2,
+	"persist":          2,
+	"pexpire":          -3,
+	"pexpireat":        -3,
+	"pexpiretime":      2,
+	"ping":             -1,
+	"psync":            -3,
+	"pttl":             2,
+	"quit":             -1,
+	"raft":             -2,
+	"raft.append":      -6,
+	"raft.propose":     -3,
+	"raft.snapshot":    7,
+	"raft.vote":        5,
+	"randomkey":        1,
+	"readonly":         1,
+	"readwrite":        1,
+	"rename":           3,
+	"renamenx":         3,
+	"replconf":         -1,
+	"replicaof":        3,
+	"restore":          -4,
+	"restore-asking":   -4,
+	"rpop":             -2,
+	"rpoplpush":        3,
+	"rpush":            -3,
+	"rpushx":           -3,
+	"sadd":             -3,
+	"save":             1,
+	"scan":             -2,
+	"scard":            2,
+	"script":           -2,
+	"sdiff":            -2,
+	"sdiffstore":       -3,
+	"select":           2,
+	"set":              -3,
+	"setrange":         4,
+	"sinter":           -2,
+	"sintercard":       -3,
+	"sinterstore":      -3,
+	"sismember":        3,
+	"slaveof":          3,
+	"smembers":         2,
+	"smismember":       -3,
+	"smove":            4,
+	"spop":             -2,
+	"srandmember":      -2,
+	"srem":             -3,
+	"sscan":            -3,
+	"strlen":           2,
+	"substr":           4,
+	"sunion":           -2,
+	"sunionstore":      -3,
+	"swapdb":           3,
+	"sync":             1,
+	"touch":            -2,
+	"ttl":              2,
+	"type":             2,
+	"unlink":           -2,
+	"unwatch":          1,
+	"watch":            -2,
+	"zadd":             -4,
+	"zcard":            2,
+	"zcount":           4,
+	"zdiff":            -3,
+	"zdiffstore":       -4,
+	"zincrby":          4,
+	"zinter":           -3,
+	"zintercard":       -3,
+	"zinterstore":      -4,
+	"zlexcount":        4,
+	"zmpop":            -4,
+	"zmscore":          -3,
+	"zpopmax":          -2,
+	"zpopmin":          -2,
+	"zrandmember":      -2,
+	"zrange":           -4,
+	"zrangebylex":      -4,
+	"zrangebyscore":    -4,
+	"zrangestore":      -5,
+	"zrank":            -3,
+	"zrem":             -3,
+	"zremrangebylex":   4,
+	"zremrangebyrank":  4,
+	"zremrangebyscore": 4,
+	"zrevrange":        -4,
+	"zrevrangebylex":   -4,
+	"zrevrangebyscore": -4,
+	"zrevrank":         -3,
+	"zscan":            -3,
+	"zscore":           3,
+	"zunion":           -3,
+	"zunionstore":      -4,
+}
+
 func (mkv *MuKV) Handler(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	if mkv.routeCluster(conn, name, cmd) || mkv.serveDynamo(conn, name, cmd) || mkv.serveRaft(conn, name, cmd) {
+		// A command that cannot run here fails the transaction it would
+		// have been queued in.
+		if t := clientFor(conn).multi; t != nil {
+			t.failed = true
+		}
+		return
+	}
+	// SCRIPT KILL has to reach the script it stops, which holds the
+	// isolation lock.
+	if name == "script" && len(cmd.Args) == 2 && strings.EqualFold(string(cmd.Args[1]), "kill") {
+		mkv.dispatch(conn, name, cmd)
+		return
+	}
+	if mkv.scripts.busy() {
+		conn.WriteError(errBusy)
+		if t := clientFor(conn).multi; t != nil {
+			t.failed = true
+		}
+		return
+	}
+	if mkv.queue(conn, name, cmd) {
+		return
+	}
+	// EXEC outside a transaction has nothing to isolate.
+	if commandFlags[name]&flagIsolated != 0 && (name != "exec" || clientFor(conn).multi != nil) {
+		mkv.isolation.Lock()
+		defer mkv.isolation.Unlock()
+	} else {
+		mkv.isolation.RLock()
+		defer mkv.isolation.RUnlock()
+	}
+	mkv.call(conn, name, cmd)
+}
+
+// call runs the command named name once it has been routed, logging it if
+// it writes.
+func (mkv *MuKV) call(conn redcon.Conn, name string, cmd redcon.Command) {
+	mkv.run(conn, name, cmd, true)
+}
+
+// callQueued is call for a command run by a transaction or script, which
+// leaves the clients it unblocks to be served once the transaction or
+// script is done, so that they see only its outcome.
+func (mkv *MuKV) callQueued(conn redcon.Conn, name string, cmd redcon.Command) {
+	mkv.run(conn, name, cmd, false)
+}
+
+// run runs the command for call and callQueued, serving the clients it
+// unblocks if serve is set.
+func (mkv *MuKV) run(conn redcon.Conn, name string, cmd redcon.Command, serve bool) {
+	flags := commandFlags[name]
+	if flags&flagWrite == 0 {
+		mkv.dispatch(conn, name, cmd)
+		return
+	}
+
+	cl := clientFor(conn)
+	if !cl.leader && mkv.repl.readOnly() {
+		conn.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+	cl.order = mkv.lockOrder()
+	defer func() {
+		cl.order.Unlock()
+		cl.order = nil
+	}()
+	// Writes streamed from the leader are applied whatever the local state,
+	// or the replica would diverge from it.
+	if err := mkv.aof.err(); err != nil && !cl.leader {
+		conn.WriteError("MISCONF Errors writing to the AOF file: " + err.Error())
+		return
+	}
+	// Keys loaded from disk were already admitted under the memory limit.
+	if flags&flagDenyOOM != 0 && !mkv.loading.Load() && !cl.leader && !mkv.evictor.makeRoom() {
+		conn.WriteError(errOOM)
+		return
+	}
+
+	cl.propagated = false
+	mkv.dispatch(conn, name, cmd)
+	if !cl.propagated && flags&flagBlocking == 0 {
+		mkv.feed(cl.db, cmd.Args)
+	}
+	if serve {
+		mkv.serveBlocked()
+	}
+	mkv.aof.flush()
+}
+
+// dispatch runs the command named name.
+func (mkv *MuKV) dispatch(conn redcon.Conn, name string, cmd redcon.Command) {
 	logger := mkv.Log.With().Str("function", "Handler").Logger()
 
-	switch strings.ToLower(string(cmd.Args[0])) {
+	switch name {
 	default:
 		mkv.handleUnknown(conn, cmd.Args[0])
 	case "ping":
@@ -21,30 +423,375 @@ func (mkv *MuKV) Handler(conn redcon.Conn, cmd redcon.Command) {
 			logger.Fatal().Err(err).Msg("failed to close connection")
 			return
 		}
+	case "config":
+		mkv.handleConfig(conn, cmd)
+	case "info":
+		mkv.handleInfo(conn, cmd)
+	case "save":
+		mkv.handleSave(conn, cmd)
+	case "bgsave":
+		mkv.handleBGSave(conn, cmd)
+	case "lastsave":
+		mkv.handleLastSave(conn, cmd)
+	case "bgrewriteaof":
+		mkv.handleBGRewriteAOF(conn, cmd)
+	case "replicaof", "slaveof":
+		mkv.handleReplicaOf(conn, cmd)
+	case "replconf":
+		mkv.handleReplConf(conn, cmd)
+	case "psync", "sync":
+		mkv.handlePSync(conn, cmd)
 	case "set":
 		mkv.handleSet(conn, cmd)
 	case "get":
 		mkv.handleGet(conn, cmd)
+	case "mget":
+		mkv.handleMGet(conn, cmd)
+	case "mset":
+		mkv.handleMSet(conn, cmd, false)
+	case "msetnx":
+		mkv.handleMSet(conn, cmd, true)
+	case "getdel":
+		mkv.handleGetDel(conn, cmd)
+	case "getex":
+		mkv.handleGetEx(conn, cmd)
+	case "getset":
+		mkv.handleGetSet(conn, cmd)
+	case "append":
+		mkv.handleAppend(conn, cmd)
+	case "strlen":
+		mkv.handleStrLen(conn, cmd)
+	case "getrange", "substr":
+		mkv.handleGetRange(conn, cmd)
+	case "setrange":
+		mkv.handleSetRange(conn, cmd)
+	case "lcs":
+		mkv.handleLCS(conn, cmd)
+	case "incr":
+		mkv.handleIncr(conn, cmd, 1)
+	case "decr":
+		mkv.handleIncr(conn, cmd, -1)
+	case "incrby":
+		mkv.handleIncrBy(conn, cmd, false)
+	case "decrby":
+		mkv.handleIncrBy(conn, cmd, true)
+	case "incrbyfloat":
+		mkv.handleIncrByFloat(conn, cmd)
 	case "ttl":
-		mkv.handleTTL(conn, cmd)
+		mkv.handleTTL(conn, cmd, time.Second)
+	case "pttl":
+		mkv.handleTTL(conn, cmd, time.Millisecond)
+	case "expire":
+		mkv.handleExpire(conn, cmd, time.Second, false)
+	case "pexpire":
+		mkv.handleExpire(conn, cmd, time.Millisecond, false)
+	case "expireat":
+		mkv.handleExpire(conn, cmd, time.Second, true)
+	case "pexpireat":
+		mkv.handleExpire(conn, cmd, time.Millisecond, true)
+	case "expiretime":
+		mkv.handleExpireTime(conn, cmd, time.Second)
+	case "pexpiretime":
+		mkv.handleExpireTime(conn, cmd, time.Millisecond)
+	case "persist":
+		mkv.handlePersist(conn, cmd)
+	case "hset", "hmset":
+		mkv.handleHSet(conn, cmd)
+	case "hsetnx":
+		mkv.handleHSetNX(conn, cmd)
+	case "hget":
+		mkv.handleHGet(conn, cmd)
+	case "hmget":
+		mkv.handleHMGet(conn, cmd)
+	case "hdel":
+		mkv.handleHDel(conn, cmd)
+	case "hexists":
+		mkv.handleHExists(conn, cmd)
+	case "hlen":
+		mkv.handleHLen(conn, cmd)
+	case "hstrlen":
+		mkv.handleHStrLen(conn, cmd)
+	case "hgetall":
+		mkv.handleHGetAll(conn, cmd, true, true)
+	case "hkeys":
+		mkv.handleHGetAll(conn, cmd, true, false)
+	case "hvals":
+		mkv.handleHGetAll(conn, cmd, false, true)
+	case "hincrby":
+		mkv.handleHIncrBy(conn, cmd)
+	case "hincrbyfloat":
+		mkv.handleHIncrByFloat(conn, cmd)
+	case "hrandfield":
+		mkv.handleHRandField(conn, cmd)
+	case "hscan":
+		mkv.handleHScan(conn, cmd)
+	case "lpush":
+		mkv.handlePush(conn, cmd, true, false)
+	case "rpush":
+		mkv.handlePush(conn, cmd, false, false)
+	case "lpushx":
+		mkv.handlePush(conn, cmd, true, true)
+	case "rpushx":
+		mkv.handlePush(conn, cmd, false, true)
+	case "lpop":
+		mkv.handlePop(conn, cmd, true)
+	case "rpop":
+		mkv.handlePop(conn, cmd, false)
+	case "llen":
+		mkv.handleLLen(conn, cmd)
+	case "lrange":
+		mkv.handleLRange(conn, cmd)
+	case "lindex":
+		mkv.handleLIndex(conn, cmd)
+	case "lset":
+		mkv.handleLSet(conn, cmd)
+	case "linsert":
+		mkv.handleLInsert(conn, cmd)
+	case "lrem":
+		mkv.handleLRem(conn, cmd)
+	case "ltrim":
+		mkv.handleLTrim(conn, cmd)
+	case "lpos":
+		mkv.handleLPos(conn, cmd)
+	case "lmove", "rpoplpush":
+		mkv.handleLMove(conn, cmd)
+	case "lmpop":
+		mkv.handleLMPop(conn, cmd)
+	case "blpop":
+		mkv.handleBPop(conn, cmd, true)
+	case "brpop":
+		mkv.handleBPop(conn, cmd, false)
+	case "blmove", "brpoplpush":
+		mkv.handleBLMove(conn, cmd)
+	case "blmpop":
+		mkv.handleBLMPop(conn, cmd)
+	case "sadd":
+		mkv.handleSAdd(conn, cmd)
+	case "srem":
+		mkv.handleSRem(conn, cmd)
+	case "sismember":
+		mkv.handleSIsMember(conn, cmd, false)
+	case "smismember":
+		mkv.handleSIsMember(conn, cmd, true)
+	case "smembers":
+		mkv.handleSMembers(conn, cmd)
+	case "scard":
+		mkv.handleSCard(conn, cmd)
+	case "sinter":
+		mkv.handleSetOp(conn, cmd, setInter)
+	case "sunion":
+		mkv.handleSetOp(conn, cmd, setUnion)
+	case "sdiff":
+		mkv.handleSetOp(conn, cmd, setDiff)
+	case "sinterstore":
+		mkv.handleSetOpStore(conn, cmd, setInter)
+	case "sunionstore":
+		mkv.handleSetOpStore(conn, cmd, setUnion)
+	case "sdiffstore":
+		mkv.handleSetOpStore(conn, cmd, setDiff)
+	case "sintercard":
+		mkv.handleSInterCard(conn, cmd)
+	case "smove":
+		mkv.handleSMove(conn, cmd)
+	case "srandmember":
+		mkv.handleSRandMember(conn, cmd)
+	case "spop":
+		mkv.handleSPop(conn, cmd)
+	case "sscan":
+		mkv.handleSScan(conn, cmd)
+	case "zadd":
+		mkv.handleZAdd(conn, cmd)
+	case "zincrby":
+		mkv.handleZIncrBy(conn, cmd)
+	case "zrem":
+		mkv.handleZRem(conn, cmd)
+	case "zscore":
+		mkv.handleZScore(conn, cmd, false)
+	case "zmscore":
+		mkv.handleZScore(conn, cmd, true)
+	case "zcard":
+		mkv.handleZCard(conn, cmd)
+	case "zcount":
+		mkv.handleZCount(conn, cmd, false)
+	case "zlexcount":
+		mkv.handleZCount(conn, cmd, true)
+	case "zrank":
+		mkv.handleZRank(conn, cmd, false)
+	case "zrevrank":
+		mkv.handleZRank(conn, cmd, true)
+	case "zrange":
+		mkv.handleZRange(conn, cmd, zrangeSpec{}, true)
+	case "zrevrange":
+		mkv.handleZRange(conn, cmd, zrangeSpec{rev: true}, false)
+	case "zrangebyscore":
+		mkv.handleZRange(conn, cmd, zrangeSpec{byScore: true}, false)
+	case "zrevrangebyscore":
+		mkv.handleZRange(conn, cmd, zrangeSpec{byScore: true, rev: true}, false)
+	case "zrangebylex":
+		mkv.handleZRange(conn, cmd, zrangeSpec{byLex: true}, false)
+	case "zrevrangebylex":
+		mkv.handleZRange(conn, cmd, zrangeSpec{byLex: true, rev: true}, false)
+	case "zrangestore":
+		mkv.handleZRangeStore(conn, cmd)
+	case "zremrangebyrank":
+		mkv.handleZRemRange(conn, cmd, zrangeSpec{})
+	case "zremrangebyscore":
+		mkv.handleZRemRange(conn, cmd, zrangeSpec{byScore: true})
+	case "zremrangebylex":
+		mkv.handleZRemRange(conn, cmd, zrangeSpec{byLex: true})
+	case "zpopmin":
+		mkv.handleZPop(conn, cmd, false)
+	case "zpopmax":
+		mkv.handleZPop(conn, cmd, true)
+	case "zmpop":
+		mkv.handleZMPop(conn, cmd)
+	case "bzpopmin":
+		mkv.handleBZPop(conn, cmd, false)
+	case "bzpopmax":
+		mkv.handleBZPop(conn, cmd, true)
+	case "bzmpop":
+		mkv.handleBZMPop(conn, cmd)
+	case "zunion":
+		mkv.handleZSetOp(conn, cmd, setUnion)
+	case "zinter":
+		mkv.handleZSetOp(conn, cmd, setInter)
+	case "zdiff":
+		mkv.handleZSetOp(conn, cmd, setDiff)
+	case "zunionstore":
+		mkv.handleZSetOpStore(conn, cmd, setUnion)
+	case "zinterstore":
+		mkv.handleZSetOpStore(conn, cmd, setInter)
+	case "zdiffstore":
+		mkv.handleZSetOpStore(conn, cmd, setDiff)
+	case "zintercard":
+		mkv.handleZInterCard(conn, cmd)
+	case "zrandmember":
+		mkv.handleZRandMember(conn, cmd)
+	case "zscan":
+		mkv.handleZScan(conn, cmd)
+	case "select":
+		mkv.handleSelect(conn, cmd)
+	case "swapdb":
+		mkv.handleSwapDB(conn, cmd)
+	case "move":
+		mkv.handleMove(conn, cmd)
+	case "flushdb":
+		mkv.handleFlush(conn, cmd, false)
+	case "flushall":
+		mkv.handleFlush(conn, cmd, true)
+	case "type":
+		mkv.handleType(conn, cmd)
+	case "rename":
+		mkv.handleRename(conn, cmd, false)
+	case "renamenx":
+		mkv.handleRename(conn, cmd, true)
+	case "copy":
+		mkv.handleCopy(conn, cmd)
+	case "object":
+		mkv.handleObject(conn, cmd)
+	case "scan":
+		mkv.handleScan(conn, cmd)
+	case "keys":
+		mkv.handleKeys(conn, cmd)
+	case "randomkey":
+		mkv.handleRandomKey(conn, cmd)
+	case "dbsize":
+		mkv.handleDBSize(conn, cmd)
 	case "touch":
 		mkv.handleTouch(conn, cmd)
 	case "del":
-		mkv.handleDel(conn, cmd)
+		mkv.handleDel(conn, cmd, false)
+	case "unlink":
+		mkv.handleDel(conn, cmd, true)
+	case "exists":
+		mkv.handleExists(conn, cmd)
+	case "dynamo.get":
+		mkv.handleDynamoGet(conn, cmd)
+	case "dynamo.put":
+		mkv.handleDynamoPut(conn, cmd)
+	case "dynamo.hint":
+		mkv.handleDynamoHint(conn, cmd)
+	case "raft":
+		mkv.handleRaft(conn, cmd)
+	case "raft.vote":
+		mkv.handleRaftVote(conn, cmd)
+	case "raft.append":
+		mkv.handleRaftAppend(conn, cmd)
+	case "raft.snapshot":
+		mkv.handleRaftSnapshot(conn, cmd)
+	case "raft.propose":
+		mkv.handleRaftPropose(conn, cmd)
+	case "cluster":
+		mkv.handleCluster(conn, cmd)
+	case "asking":
+		mkv.handleAsking(conn, cmd)
+	case "readonly", "readwrite":
+		mkv.handleReadOnly(conn, cmd)
+	case "dump":
+		mkv.handleDump(conn, cmd)
+	case "restore", "restore-asking":
+		mkv.handleRestore(conn, cmd)
+	case "migrate":
+		mkv.handleMigrate(conn, cmd)
+	case "multi":
+		mkv.handleMulti(conn, cmd)
+	case "exec":
+		mkv.handleExec(conn, cmd)
+	case "discard":
+		mkv.handleDiscard(conn, cmd)
+	case "watch":
+		mkv.handleWatch(conn, cmd)
+	case "unwatch":
+		mkv.handleUnwatch(conn, cmd)
+	case "eval":
+		mkv.handleEval(conn, cmd, false, false)
+	case "evalsha":
+		mkv.handleEval(conn, cmd, true, false)
+	case "eval_ro":
+		mkv.handleEval(conn, cmd, false, true)
+	case "evalsha_ro":
+		mkv.handleEval(conn, cmd, true, true)
+	case "script":
+		mkv.handleScript(conn, cmd)
 	}
 }
 
 func (mkv *MuKV) HandleAccept(conn redcon.Conn) bool {
+	conn.SetContext(&client{})
 	return true
 }
 
-func (mkv *MuKV) HandleClose(conn redcon.Conn, err error) {}
+func (mkv *MuKV) HandleClose(conn redcon.Conn, err error) {
+	cl := clientFor(conn)
+	// The server loop lets go of clients detached to block, which are
+	// served from here on by serveDetached.
+	if d := cl.detached; d != nil {
+		go mkv.serveDetached(d)
+		return
+	}
+	cl.unwatch()
+}
 
 func (mkv *MuKV) ListenAndServe(port int) error {
 	logger := mkv.Log.With().Str("function", "ListenAndServe").Logger()
 
 	listenAddr := fmt.Sprintf(":%d", port)
+	mkv.repl.port.Store(int64(port))
+	if mkv.cluster != nil {
+		if err := mkv.cluster.load(port); err != nil {
+			return fmt.Errorf("loading the cluster config file: %w", err)
+		}
+	}
+	if mkv.Config.ReplicaOf != "" {
+		mkv.replicaOf(mkv.Config.ReplicaOf)
+	}
 	go mkv.StartExpireLoop()
+	go mkv.StartSaveLoop()
+	go mkv.StartAOFLoop()
+	go mkv.StartReplicationLoop()
+	go mkv.StartDynamoLoop()
+	go mkv.StartRaftLoop()
+	go mkv.StartClusterLoop()
 	logger.Info().Str("listenAddr", listenAddr).Msg("listening")
 	return redcon.ListenAndServe(listenAddr,
 		mkv.Handler,
@@ -0,0 +1,470 @@
+package mukv
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// handleHSet implements HSET and HMSET, which differ only in their reply.
+func (mkv *MuKV) handleHSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	added := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		h, ok := asHash(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for i := 2; i < len(cmd.Args); i += 2 {
+			field := string(cmd.Args[i])
+			if _, ok := h[field]; !ok {
+				added++
+			}
+			h[field] = cmd.Args[i+1]
+		}
+		if rec == nil {
+			rec = newRecord(h)
+		}
+		return rec
+	})
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case strings.EqualFold(string(cmd.Args[0]), "hmset"):
+		conn.WriteString("OK")
+	default:
+		conn.WriteInt(added)
+	}
+}
+
+func (mkv *MuKV) handleHSetNX(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	added := false
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		h, ok := asHash(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		field := string(cmd.Args[2])
+		if _, ok := h[field]; ok {
+			return Unchanged
+		}
+		h[field] = cmd.Args[3]
+		added = true
+		if rec == nil {
+			rec = newRecord(h)
+		}
+		return rec
+	})
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case added:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+func (mkv *MuKV) handleHGet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		val, ok := h[string(cmd.Args[2])]
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulk(val)
+	})
+}
+
+func (mkv *MuKV) handleHMGet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteArray(len(cmd.Args) - 2)
+		for _, field := range cmd.Args[2:] {
+			if val, ok := h[string(field)]; ok {
+				conn.WriteBulk(val)
+			} else {
+				conn.WriteNull()
+			}
+		}
+	})
+}
+
+func (mkv *MuKV) handleHDel(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	deleted := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		h, ok := asHash(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for _, field := range cmd.Args[2:] {
+			if _, ok := h[string(field)]; ok {
+				delete(h, string(field))
+				deleted++
+			}
+		}
+		switch {
+		case deleted == 0:
+			return Unchanged
+		case len(h) == 0:
+			return nil
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(deleted)
+	}
+}
+
+func (mkv *MuKV) handleHExists(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		if _, ok := h[string(cmd.Args[2])]; ok {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	})
+}
+
+func (mkv *MuKV) handleHLen(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(len(h))
+	})
+}
+
+func (mkv *MuKV) handleHStrLen(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(len(h[string(cmd.Args[2])]))
+	})
+}
+
+// handleHGetAll implements HGETALL, HKEYS and HVALS.
+func (mkv *MuKV) handleHGetAll(conn redcon.Conn, cmd redcon.Command, keys, values bool) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		n := len(h)
+		if keys && values {
+			n *= 2
+		}
+		conn.WriteArray(n)
+		for field, val := range h {
+			if keys {
+				conn.WriteBulkString(field)
+			}
+			if values {
+				conn.WriteBulk(val)
+			}
+		}
+	})
+}
+
+func (mkv *MuKV) handleHIncrBy(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	incr, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+	if err != nil {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	var result int64
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		h, ok := asHash(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		field := string(cmd.Args[2])
+		var cur int64
+		if val, ok := h[field]; ok {
+			if cur, err = strconv.ParseInt(string(val), 10, 64); err != nil {
+				errStr = "ERR hash value is not an integer"
+				return Unchanged
+			}
+		}
+		if result, ok = addInt64(cur, incr); !ok {
+			errStr = "ERR increment or decrement would overflow"
+			return Unchanged
+		}
+		h[field] = strconv.AppendInt(nil, result, 10)
+		if rec == nil {
+			rec = newRecord(h)
+		}
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteInt64(result)
+	}
+}
+
+func (mkv *MuKV) handleHIncrByFloat(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	incr, ok := parseFloat(cmd.Args[3])
+	if !ok {
+		conn.WriteError("ERR value is not a valid float")
+		return
+	}
+
+	var result string
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		h, ok := asHash(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		field := string(cmd.Args[2])
+		var cur float64
+		if val, ok := h[field]; ok {
+			if cur, ok = parseFloat(val); !ok {
+				errStr = "ERR hash value is not a float"
+				return Unchanged
+			}
+		}
+		sum := cur + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			errStr = "ERR increment would produce NaN or Infinity"
+			return Unchanged
+		}
+		result = formatFloat(sum)
+		h[field] = []byte(result)
+		if rec == nil {
+			rec = newRecord(h)
+		}
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteBulkString(result)
+	}
+}
+
+func (mkv *MuKV) handleHRandField(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args) > 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var count int64
+	var withCount, withValues bool
+	if len(cmd.Args) > 2 {
+		var err error
+		if count, err = strconv.ParseInt(string(cmd.Args[2]), 10, 64); err != nil {
+			conn.WriteError(errNotInteger)
+			return
+		}
+		withCount = true
+	}
+	if len(cmd.Args) == 4 {
+		if !strings.EqualFold(string(cmd.Args[3]), "withvalues") {
+			conn.WriteError(errSyntax)
+			return
+		}
+		withValues = true
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		if !withCount {
+			for field := range h {
+				conn.WriteBulkString(field)
+				return
+			}
+			conn.WriteNull()
+			return
+		}
+
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		var picked []string
+		if count >= 0 {
+			// Distinct fields, as many as the hash holds.
+			rand.Shuffle(len(fields), func(i, j int) {
+				fields[i], fields[j] = fields[j], fields[i]
+			})
+			picked = fields[:min(int(count), len(fields))]
+		} else if len(fields) > 0 {
+			// Fields may repeat, exactly -count of them.
+			picked = make([]string, -count)
+			for i := range picked {
+				picked[i] = fields[rand.IntN(len(fields))]
+			}
+		}
+
+		if withValues {
+			conn.WriteArray(len(picked) * 2)
+		} else {
+			conn.WriteArray(len(picked))
+		}
+		for _, field := range picked {
+			conn.WriteBulkString(field)
+			if withValues {
+				conn.WriteBulk(h[field])
+			}
+		}
+	})
+}
+
+func (mkv *MuKV) handleHScan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cursor, errStr := parseScanCursor(cmd.Args[2])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	opts, errStr := parseScanOptions(cmd.Args[3:], false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		h, ok := asHash(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		page, next := scanNames(fields, cursor, opts.count)
+		page = slices.DeleteFunc(page, func(field string) bool {
+			return !opts.matches(field)
+		})
+
+		conn.WriteArray(2)
+		conn.WriteBulkString(strconv.FormatUint(next, 10))
+		if opts.noValues {
+			conn.WriteArray(len(page))
+		} else {
+			conn.WriteArray(len(page) * 2)
+		}
+		for _, field := range page {
+			conn.WriteBulkString(field)
+			if !opts.noValues {
+				conn.WriteBulk(h[field])
+			}
+		}
+	})
+}
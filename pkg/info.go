@@ -0,0 +1,122 @@
+package mukv
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// infoSection is a section of the INFO reply, whose fields are written as
+// name:value lines.
+type infoSection struct {
+	name   string
+	fields func(mkv *MuKV) []string
+}
+
+// infoSections lists the sections of the INFO reply, in the order they are
+// written.
+var infoSections = []infoSection{
+	{"memory", (*MuKV).memoryInfo},
+	{"persistence", (*MuKV).persistenceInfo},
+	{"replication", (*MuKV).replicationInfo},
+	{"dynamo", (*MuKV).dynamoInfo},
+	{"raft", (*MuKV).raftInfo},
+	{"cluster", (*MuKV).clusterInfo},
+	{"stats", (*MuKV).statsInfo},
+	{"keyspace", (*MuKV).keyspaceInfo},
+}
+
+func (mkv *MuKV) memoryInfo() []string {
+	used := mkv.evictor.used()
+	limit := mkv.evictor.maxMemory.Load()
+	return []string{
+		fmt.Sprintf("used_memory:%d", used),
+		fmt.Sprintf("used_memory_human:%s", humanBytes(used)),
+		fmt.Sprintf("maxmemory:%d", limit),
+		fmt.Sprintf("maxmemory_human:%s", humanBytes(limit)),
+		fmt.Sprintf("maxmemory_policy:%s", mkv.evictor.policy()),
+		fmt.Sprintf("number_of_cached_scripts:%d", mkv.scripts.cachedScripts()),
+	}
+}
+
+func (mkv *MuKV) persistenceInfo() []string {
+	status := "ok"
+	if mkv.saver.lastFailed.Load() {
+		status = "err"
+	}
+	lines := []string{
+		fmt.Sprintf("rdb_changes_since_last_save:%d", mkv.saver.dirty.Load()),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolInt(mkv.saver.saving.Load())),
+		fmt.Sprintf("rdb_last_save_time:%d", mkv.saver.lastSave.Load()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", status),
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", mkv.saver.lastDuration.Load()),
+		fmt.Sprintf("rdb_saves:%d", mkv.saver.saves.Load()),
+	}
+	lines = append(lines, mkv.aof.info()...)
+	return lines
+}
+
+// boolInt returns 1 for true and 0 for false, as INFO writes flags.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (mkv *MuKV) statsInfo() []string {
+	return []string{
+		fmt.Sprintf("expired_keys:%d", mkv.ExpiryStats().Expired),
+		fmt.Sprintf("evicted_keys:%d", mkv.evictor.evicted.Load()),
+	}
+}
+
+func (mkv *MuKV) keyspaceInfo() []string {
+	var fields []string
+	for i, ks := range mkv.DBs {
+		if n := ks.Len(); n > 0 {
+			fields = append(fields, fmt.Sprintf("db%d:keys=%d,expires=%d", i, n, ks.expiry.Stats().Pending))
+		}
+	}
+	return fields
+}
+
+// humanBytes formats n bytes the way INFO's *_human fields do.
+func humanBytes(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%dB", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+}
+
+func (mkv *MuKV) handleInfo(conn redcon.Conn, cmd redcon.Command) {
+	var want []string
+	for _, arg := range cmd.Args[1:] {
+		want = append(want, strings.ToLower(string(arg)))
+	}
+	all := len(want) == 0 || slices.Contains(want, "all") ||
+		slices.Contains(want, "everything") || slices.Contains(want, "default")
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !slices.Contains(want, section.name) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		for _, field := range section.fields(mkv) {
+			b.WriteString(field)
+			b.WriteString("\r\n")
+		}
+	}
+	conn.WriteBulkString(b.String())
+}
@@ -0,0 +1,387 @@
+package mukv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// handleExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, which
+// differ only in the unit of the expire time and whether it is absolute.
+func (mkv *MuKV) handleExpire(conn redcon.Conn, cmd redcon.Command, unit time.Duration, absolute bool) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range cmd.Args[3:] {
+		switch strings.ToLower(string(arg)) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			conn.WriteError(fmt.Sprintf("ERR Unsupported option %s", arg))
+			return
+		}
+	}
+	if nx && (xx || gt || lt) {
+		conn.WriteError("ERR NX and XX, GT or LT options at the same time are not compatible")
+		return
+	}
+	if gt && lt {
+		conn.WriteError("ERR GT and LT options at the same time are not compatible")
+		return
+	}
+
+	now := time.Now()
+	deadline, errStr := parseExpire(cmd.Args[2], unit, absolute, now)
+	if errStr != "" {
+		if errStr != errNotInteger {
+			errStr = fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(string(cmd.Args[0])))
+		}
+		conn.WriteError(errStr)
+		return
+	}
+
+	updated := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		if rec == nil {
+			return nil
+		}
+		// A key without a TTL is treated as never expiring by GT and LT.
+		current := rec.Deadline()
+		switch {
+		case nx && rec.TTL > 0,
+			xx && rec.TTL == 0,
+			gt && (rec.TTL == 0 || !deadline.After(current)),
+			lt && rec.TTL > 0 && !deadline.Before(current):
+			return Unchanged
+		}
+		updated = true
+		if mkv.db(conn).passed(deadline, now) {
+			return nil
+		}
+		rec.SetDeadline(deadline)
+		return rec
+	})
+	switch {
+	case !updated:
+		// Nothing was written, so there is nothing to log.
+		clientFor(conn).propagated = true
+	case !absolute:
+		// Replaying a relative expire time would restart it, so log the
+		// deadline instead.
+		args := [][]byte{[]byte("PEXPIREAT"), cmd.Args[1], pxatArg(deadline)}
+		mkv.propagate(conn, append(args, cmd.Args[3:]...)...)
+	}
+
+	if updated {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+func (mkv *MuKV) handlePersist(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	persisted := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		if rec == nil || rec.TTL == 0 {
+			return Unchanged
+		}
+		rec.SetDeadline(time.Time{})
+		persisted = true
+		return rec
+	})
+
+	if persisted {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// handleTTL implements TTL and PTTL, replying -2 for a missing key and -1
+// for a key without a TTL.
+func (mkv *MuKV) handleTTL(conn redcon.Conn, cmd redcon.Command, unit time.Duration) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).Peek(string(cmd.Args[1]), func(r *Record) {
+		switch {
+		case r == nil:
+			conn.WriteInt(-2)
+		case r.TTL == 0:
+			conn.WriteInt(-1)
+		default:
+			remaining := max(time.Until(r.Deadline()), 0)
+			conn.WriteInt64(int64((remaining + unit/2) / unit))
+		}
+	})
+}
+
+// handleExpireTime implements EXPIRETIME and PEXPIRETIME, replying with the
+// absolute Unix time at which the key expires.
+func (mkv *MuKV) handleExpireTime(conn redcon.Conn, cmd redcon.Command, unit time.Duration) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).Peek(string(cmd.Args[1]), func(r *Record) {
+		switch {
+		case r == nil:
+			conn.WriteInt(-2)
+		case r.TTL == 0:
+			conn.WriteInt(-1)
+		default:
+			conn.WriteInt64(r.Deadline().UnixNano() / int64(unit))
+		}
+	})
+}
+
+func (mkv *MuKV) handleScan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cursor, errStr := parseScanCursor(cmd.Args[1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	opts, errStr := parseScanOptions(cmd.Args[2:], true)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	var keys []string
+	next := mkv.db(conn).Scan(cursor, opts.count, func(rec *Record) {
+		if opts.valueType != "" && rec.Type().String() != opts.valueType {
+			return
+		}
+		if opts.matches(rec.Key) {
+			keys = append(keys, rec.Key)
+		}
+	})
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(next, 10))
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+func (mkv *MuKV) handleKeys(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	opts := scanOptions{pattern: string(cmd.Args[1])}
+
+	var keys []string
+	mkv.db(conn).Keys(func(rec *Record) {
+		if opts.matches(rec.Key) {
+			keys = append(keys, rec.Key)
+		}
+	})
+
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+func (mkv *MuKV) handleRandomKey(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	if key, ok := mkv.db(conn).RandomKey(); ok {
+		conn.WriteBulkString(key)
+	} else {
+		conn.WriteNull()
+	}
+}
+
+func (mkv *MuKV) handleDBSize(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	conn.WriteInt(mkv.db(conn).Len())
+}
+
+func (mkv *MuKV) handleType(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).Peek(string(cmd.Args[1]), func(rec *Record) {
+		if rec == nil {
+			conn.WriteString("none")
+		} else {
+			conn.WriteString(rec.Type().String())
+		}
+	})
+}
+
+// handleRename implements RENAME and RENAMENX, which leaves an existing
+// destination alone. The record moves as a whole, keeping its TTL and
+// metadata.
+func (mkv *MuKV) handleRename(conn redcon.Conn, cmd redcon.Command, nx bool) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	src, dst := string(cmd.Args[1]), string(cmd.Args[2])
+
+	var missing, renamed bool
+	mkv.db(conn).UpdateAll([]string{src, dst}, func(recs []*Record) []*Record {
+		switch {
+		case recs[0] == nil:
+			missing = true
+			return nil
+		case nx && recs[1] != nil:
+			return nil
+		case src == dst:
+			renamed = true
+			return nil
+		}
+		recs[0], recs[1] = nil, recs[0].clone(recs[0].Value)
+		renamed = true
+		return recs
+	})
+
+	switch {
+	case missing:
+		conn.WriteError("ERR no such key")
+	case !nx:
+		conn.WriteString("OK")
+	case renamed && src != dst:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+func (mkv *MuKV) handleCopy(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	src := clientFor(conn).db
+	dst := src
+	replace := false
+	for i := 3; i < len(cmd.Args); i++ {
+		switch opt := strings.ToLower(string(cmd.Args[i])); {
+		case opt == "replace":
+			replace = true
+		case opt == "db" && i+1 < len(cmd.Args):
+			i++
+			var errStr string
+			if dst, errStr = mkv.parseDB(cmd.Args[i]); errStr != "" {
+				conn.WriteError(errStr)
+				return
+			}
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+	srcKey, dstKey := string(cmd.Args[1]), string(cmd.Args[2])
+	if src == dst && srcKey == dstKey {
+		conn.WriteError("ERR source and destination objects are the same")
+		return
+	}
+
+	copied := false
+	mkv.transfer(src, srcKey, dst, dstKey, func(srcRec, dstRec *Record) (*Record, *Record) {
+		if srcRec == nil || (dstRec != nil && !replace) {
+			return Unchanged, Unchanged
+		}
+		copied = true
+		return Unchanged, srcRec.clone(cloneValue(srcRec.Value))
+	})
+
+	if copied {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+func (mkv *MuKV) handleObject(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	if sub == "help" {
+		conn.WriteArray(5)
+		conn.WriteString("OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+		conn.WriteString("ENCODING <key> -- Return the kind of internal representation used to store the value.")
+		conn.WriteString("FREQ <key> -- Return the number of reads of the key.")
+		conn.WriteString("IDLETIME <key> -- Return the idle time of the key in seconds.")
+		conn.WriteString("REFCOUNT <key> -- Return the number of references of the value.")
+		return
+	}
+	if sub != "encoding" && sub != "freq" && sub != "idletime" && sub != "refcount" {
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", cmd.Args[1]))
+		return
+	}
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for object|%s", sub)
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).Peek(string(cmd.Args[2]), func(rec *Record) {
+		if rec == nil {
+			conn.WriteNull()
+			return
+		}
+		switch sub {
+		case "encoding":
+			conn.WriteBulkString(rec.Encoding())
+		case "freq":
+			conn.WriteInt64(rec.Hits.Load())
+		case "idletime":
+			conn.WriteInt64(int64(rec.IdleTime() / time.Second))
+		case "refcount":
+			// Values are never shared between keys.
+			conn.WriteInt(1)
+		}
+	})
+}
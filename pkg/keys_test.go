@@ -0,0 +1,23 @@
+package mukv
+
+import "testing"
+
+func TestObject(t *testing.T) {
+	c := newTestClient(newTestServer(DefaultConfig))
+	c.must(t, "HSET", "h", "a", "1", "b", "2")
+	if got := c.bulk(t, "OBJECT", "ENCODING", "h"); got == "" {
+		t.Error("OBJECT ENCODING h replied with nothing")
+	}
+	if got := c.must(t, "OBJECT", "REFCOUNT", "h"); got != int64(1) {
+		t.Errorf("OBJECT REFCOUNT h = %#v, want 1", got)
+	}
+	if got := c.must(t, "OBJECT", "FREQ", "missing"); got != nil {
+		t.Errorf("OBJECT FREQ missing = %#v, want nil", got)
+	}
+	if _, err := c.do("OBJECT", "LENGTH", "h"); err == nil {
+		t.Error("OBJECT LENGTH, which Redis does not have, was accepted")
+	}
+	if got := c.must(t, "OBJECT", "HELP").([]any); len(got) != 5 {
+		t.Errorf("OBJECT HELP has %d lines, want 5", len(got))
+	}
+}
@@ -0,0 +1,676 @@
+package mukv
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/btree"
+)
+
+// Keyspace maps keys to records, each holding its value alongside its
+// metadata. Keys are split across lock-striped shards so that commands on
+// different keys rarely contend, while every command on a single key is
+// atomic under its shard's lock.
+type Keyspace struct {
+	Log     zerolog.Logger
+	shards  []*shard
+	seed    maphash.Seed
+	expiry  *expiryScheduler
+	blocked *blockedClients
+	// evictor, if set, enforces a memory limit shared with other keyspaces
+	// and decides how key accesses are counted.
+	evictor *evictor
+	// used is the estimated memory held by the keyspace, in bytes.
+	used atomic.Int64
+	// loading is set while the keyspace is read back from disk, during
+	// which keys do not expire.
+	loading atomic.Bool
+	// onDrop, if set, is called with the shard locked for each key removed
+	// by the server rather than by a command, once it has expired or been
+	// evicted.
+	onDrop func(key string)
+	// logExpiry, if set, is called with the shard locked for each key found
+	// expired, in raft mode, to have the leader log its removal. Expired
+	// keys are then hidden from reads but otherwise kept until the removal
+	// runs, so that every node runs the log against the same keys.
+	logExpiry func(key string, deadline time.Time)
+	// lockOrder, if set, takes the write order lock around the removal of
+	// expired keys, so that the removal is logged after the write that
+	// last stored the key.
+	lockOrder func() sync.Locker
+	// slots, if set, tracks the keys in each hash slot, in cluster mode.
+	slots *slotIndex
+	// watchers tracks the clients watching keys with WATCH, whose
+	// transactions fail once a key they watch is written.
+	watchers watchers
+	// db is the index of the database the keyspace holds, and snaps, if
+	// set, tracks the snapshots taken of it.
+	db    int
+	snaps *snapshots
+	// changes, if set, counts the writes made to the keyspace, towards the
+	// save rules.
+	changes *atomic.Int64
+}
+
+type shard struct {
+	sync.RWMutex
+	records map[string]*Record
+	// order lists the shard's keys by the sequence number each was inserted
+	// with. A key keeps its number for as long as it exists, so SCAN
+	// cursors can walk it while the shard changes.
+	order btree.Map[uint64, string]
+	seq   uint64
+	// used is the estimated memory held by the shard's records.
+	used int64
+}
+
+func NewKeyspace(logger zerolog.Logger, shards int) *Keyspace {
+	return newKeyspace(logger, shards, maphash.MakeSeed())
+}
+
+// newKeyspace creates a keyspace hashing keys with seed. Keyspaces sharing a
+// seed and shard count place every key in the same shard, so their contents
+// can be swapped shard by shard.
+func newKeyspace(logger zerolog.Logger, shards int, seed maphash.Seed) *Keyspace {
+	if shards < 1 {
+		shards = 1
+	}
+	ks := &Keyspace{
+		Log:    logger,
+		shards: make([]*shard, shards),
+		seed:   seed,
+	}
+	for i := range ks.shards {
+		ks.shards[i] = &shard{records: make(map[string]*Record)}
+	}
+	ks.expiry = newExpiryScheduler(ks.expireKey)
+	ks.blocked = newBlockedClients()
+	return ks
+}
+
+func (ks *Keyspace) shardIndex(key string) int {
+	return int(maphash.String(ks.seed, key) % uint64(len(ks.shards)))
+}
+
+func (ks *Keyspace) shardFor(key string) *shard {
+	return ks.shards[ks.shardIndex(key)]
+}
+
+// View calls fn under a read lock with the record stored for key, or nil if
+// there is none. A key whose TTL has passed is expired and reported as nil.
+func (ks *Keyspace) View(key string, fn func(rec *Record)) {
+	ks.Peek(key, func(rec *Record) {
+		if rec != nil {
+			ks.access(rec)
+		}
+		fn(rec)
+	})
+}
+
+// Peek is View without counting as a use of the key, for commands that
+// inspect keys rather than use them.
+func (ks *Keyspace) Peek(key string, fn func(rec *Record)) {
+	sh := ks.shardFor(key)
+	sh.RLock()
+	rec := sh.records[key]
+	if rec != nil && ks.expired(rec) {
+		sh.RUnlock()
+		// Where expiry is logged, the scheduler has the removal logged
+		// once rather than on every read.
+		if ks.logExpiry == nil {
+			ks.expiry.Expire(key, rec.Deadline())
+		}
+		fn(nil)
+		return
+	}
+	fn(rec)
+	sh.RUnlock()
+}
+
+// peek is Peek without removing the key if it has expired, for callers
+// holding the write order lock, which removing it takes.
+func (ks *Keyspace) peek(key string, fn func(rec *Record)) {
+	sh := ks.shardFor(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	rec := sh.records[key]
+	if rec != nil && ks.expired(rec) {
+		rec = nil
+	}
+	fn(rec)
+}
+
+// ViewAll is View for several keys at once: fn sees a consistent snapshot of
+// the records for all of keys. Keys found expired are removed once fn
+// returns, as View removes them.
+func (ks *Keyspace) ViewAll(keys []string, fn func(recs []*Record)) {
+	indexes := ks.shardIndexes(keys)
+	for _, i := range indexes {
+		ks.shards[i].RLock()
+	}
+
+	recs := make([]*Record, len(keys))
+	var expired []*Record
+	for i, key := range keys {
+		rec := ks.shardFor(key).records[key]
+		switch {
+		case rec == nil:
+		case ks.expired(rec):
+			expired = append(expired, rec)
+		default:
+			ks.access(rec)
+			recs[i] = rec
+		}
+	}
+	fn(recs)
+	for _, i := range indexes {
+		ks.shards[i].RUnlock()
+	}
+
+	if ks.logExpiry == nil {
+		for _, rec := range expired {
+			ks.expiry.Expire(rec.Key, rec.Deadline())
+		}
+	}
+}
+
+// Unchanged is returned by the functions passed to Update and UpdateAll to
+// leave a key as it was. Unlike returning its record, this does not count as
+// a write: the key's watchers are not told, nor is it counted as a use.
+var Unchanged = &Record{}
+
+// Update calls fn under a write lock with the record stored for key, or nil
+// if there is none, and stores the record fn returns in its place. Returning
+// nil deletes the key, and Unchanged leaves it alone. The key's expiry is
+// rescheduled from the stored record's TTL.
+func (ks *Keyspace) Update(key string, fn func(rec *Record) *Record) {
+	sh := ks.shardFor(key)
+	sh.Lock()
+	cur := ks.live(sh, key)
+	ks.own(cur)
+	rec := fn(cur)
+	ready := ks.store(sh, key, cur, rec)
+	sh.Unlock()
+
+	if ready {
+		ks.blocked.signal(key)
+	}
+}
+
+// UpdateAll is Update for several keys at once: fn sees and replaces the
+// records for all of keys atomically. A key repeated in keys is passed to fn
+// as the same record, and the last record returned for it is stored. fn may
+// return nil to leave every key unchanged.
+func (ks *Keyspace) UpdateAll(keys []string, fn func(recs []*Record) []*Record) {
+	unlock := ks.lockKeys(keys)
+	shards := make([]*shard, len(keys))
+	for i, key := range keys {
+		shards[i] = ks.shardFor(key)
+	}
+
+	cur := make([]*Record, len(keys))
+	seen := make(map[string]int, len(keys))
+	for i, key := range keys {
+		if j, ok := seen[key]; ok {
+			cur[i] = cur[j]
+			continue
+		}
+		seen[key] = i
+		cur[i] = ks.live(shards[i], key)
+		ks.own(cur[i])
+	}
+	recs := fn(slices.Clone(cur))
+	if recs == nil {
+		unlock()
+		return
+	}
+
+	var ready []string
+	for i, key := range keys {
+		if seen[key] != i {
+			continue
+		}
+		// Store the last record returned for the key.
+		last := i
+		for j := i + 1; j < len(keys); j++ {
+			if keys[j] == key {
+				last = j
+			}
+		}
+		if ks.store(shards[i], key, cur[i], recs[last]) {
+			ready = append(ready, key)
+		}
+	}
+	unlock()
+
+	for _, key := range ready {
+		ks.blocked.signal(key)
+	}
+}
+
+// lockKeys write locks the shards holding keys, in a fixed order so that
+// concurrent callers cannot deadlock, and returns a function that unlocks
+// them.
+func (ks *Keyspace) lockKeys(keys []string) func() {
+	indexes := ks.shardIndexes(keys)
+	for _, i := range indexes {
+		ks.shards[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			ks.shards[i].Unlock()
+		}
+	}
+}
+
+// shardIndexes returns the distinct indexes of the shards holding keys, in
+// the order they must be locked in.
+func (ks *Keyspace) shardIndexes(keys []string) []int {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, ks.shardIndex(key))
+	}
+	slices.Sort(indexes)
+	return slices.Compact(indexes)
+}
+
+// store replaces cur, the live record for key in sh, with rec and reports
+// whether this created a key that blocked clients may be waiting on. sh must
+// be write locked.
+func (ks *Keyspace) store(sh *shard, key string, cur, rec *Record) bool {
+	switch {
+	case rec == Unchanged:
+	case rec != nil:
+		ks.changed(1)
+		rec.Key = key
+		ks.access(rec)
+		size := recordSize(rec)
+		delta := size
+		if cur != nil {
+			delta -= cur.size
+		}
+		rec.size = size
+		sh.used += delta
+		ks.used.Add(delta)
+		if rec != cur && ks.snaps != nil {
+			rec.snapGen, rec.sharedGen = ks.snaps.gen.Load(), 0
+		}
+		if cur != nil {
+			rec.seq = cur.seq
+		} else {
+			sh.seq++
+			rec.seq = sh.seq
+			sh.order.Set(rec.seq, key)
+			if ks.slots != nil {
+				ks.slots.add(key)
+			}
+		}
+		sh.records[key] = rec
+		ks.schedule(rec)
+		ks.watchers.touch(key, false)
+		return cur == nil && (rec.Type() == TypeList || rec.Type() == TypeZSet)
+	case cur != nil:
+		ks.changed(1)
+		ks.remove(sh, key, cur)
+		ks.expiry.Cancel(key)
+	}
+	return false
+}
+
+// changed counts n writes made to the keyspace.
+func (ks *Keyspace) changed(n int) {
+	if ks.changes != nil {
+		ks.changes.Add(int64(n))
+	}
+}
+
+// remove deletes key, whose record is rec, from sh. sh must be write locked.
+func (ks *Keyspace) remove(sh *shard, key string, rec *Record) {
+	delete(sh.records, key)
+	sh.order.Delete(rec.seq)
+	if ks.slots != nil {
+		ks.slots.remove(key)
+	}
+	sh.used -= rec.size
+	ks.used.Add(-rec.size)
+	ks.watchers.touch(key, true)
+}
+
+// access records a use of rec's key, counting it towards the key's hits the
+// way the eviction policy calls for.
+func (ks *Keyspace) access(rec *Record) {
+	now := time.Now()
+	if ks.evictor != nil && ks.evictor.policy().lfu() {
+		rec.Hits.Store(ks.evictor.lfuAccess(rec, now))
+	} else {
+		rec.Hits.Add(1)
+	}
+	rec.Accessed.Store(now.UnixNano())
+}
+
+// Used returns the estimated memory held by the keyspace, in bytes.
+func (ks *Keyspace) Used() int64 {
+	return ks.used.Load()
+}
+
+// Delete removes key and reports whether it was present.
+func (ks *Keyspace) Delete(key string) bool {
+	var ok bool
+	ks.Update(key, func(rec *Record) *Record {
+		ok = rec != nil
+		return nil
+	})
+	return ok
+}
+
+// Len returns the number of keys stored, including expired keys that have
+// not been removed yet.
+func (ks *Keyspace) Len() int {
+	n := 0
+	for _, sh := range ks.shards {
+		sh.RLock()
+		n += len(sh.records)
+		sh.RUnlock()
+	}
+	return n
+}
+
+// Swap exchanges the contents of ks and other, which must share a seed and
+// shard count, atomically with respect to every command on either. Callers
+// must not swap concurrently.
+func (ks *Keyspace) Swap(other *Keyspace) {
+	for i := range ks.shards {
+		ks.shards[i].Lock()
+		other.shards[i].Lock()
+	}
+	// Snapshots still to capture either database must do so before their
+	// records change databases.
+	for i := range ks.shards {
+		ks.captureShard(ks.shards[i])
+		other.captureShard(other.shards[i])
+	}
+	for i, a := range ks.shards {
+		b := other.shards[i]
+		a.records, b.records = b.records, a.records
+		a.order, b.order = b.order, a.order
+		a.seq, b.seq = b.seq, a.seq
+		a.used, b.used = b.used, a.used
+		ks.used.Add(a.used - b.used)
+		other.used.Add(b.used - a.used)
+	}
+	ks.expiry.swap(other.expiry)
+	ks.changed(1)
+	for i := range ks.shards {
+		other.shards[i].Unlock()
+		ks.shards[i].Unlock()
+	}
+
+	// Clients stay blocked in their own database, which may now hold the
+	// keys they are waiting on.
+	ks.blocked.signalAll()
+	other.blocked.signalAll()
+	ks.watchers.touchAll(false)
+	other.watchers.touchAll(false)
+}
+
+// Flush removes every key. The removed values are freed before Flush returns
+// or, if async is set, in the background, unless a snapshot still holds
+// them.
+func (ks *Keyspace) Flush(async bool) {
+	var old []map[string]*Record
+	for _, sh := range ks.shards {
+		sh.Lock()
+		ks.captureShard(sh)
+		if ks.slots != nil {
+			for key := range sh.records {
+				ks.slots.remove(key)
+			}
+		}
+		ks.changed(len(sh.records))
+		old = append(old, sh.records)
+		sh.records = make(map[string]*Record)
+		sh.order = btree.Map[uint64, string]{}
+		ks.used.Add(-sh.used)
+		sh.used = 0
+		sh.Unlock()
+	}
+	ks.expiry.clear()
+	ks.watchers.touchAll(true)
+
+	// Values a snapshot still holds must be left for it to write.
+	if ks.snaps != nil && ks.snaps.oldest.Load() != 0 {
+		return
+	}
+	free := func() {
+		for _, records := range old {
+			for _, rec := range records {
+				freeValue(rec.Value)
+			}
+		}
+	}
+	if async {
+		go free()
+	} else {
+		free()
+	}
+}
+
+// scanShardBits returns the number of low cursor bits that select a shard.
+func (ks *Keyspace) scanShardBits() int {
+	return bits.Len(uint(len(ks.shards) - 1))
+}
+
+// Scan calls fn with up to count live records, starting from cursor, and
+// returns the cursor to continue from, which is 0 once every shard has been
+// walked. A cursor names a shard and a position in its insertion order, so
+// every key present for a whole walk is seen exactly once however the
+// keyspace changes between calls.
+func (ks *Keyspace) Scan(cursor uint64, count int, fn func(rec *Record)) uint64 {
+	shardBits := ks.scanShardBits()
+	i := int(cursor & (1<<shardBits - 1))
+	seq := cursor >> shardBits
+	for ; i < len(ks.shards); i, seq = i+1, 0 {
+		if count == 0 {
+			return seq<<shardBits | uint64(i)
+		}
+		sh := ks.shards[i]
+		var next uint64
+		sh.RLock()
+		sh.order.Ascend(seq, func(s uint64, key string) bool {
+			if count == 0 {
+				next = s
+				return false
+			}
+			count--
+			if rec := sh.records[key]; !ks.expired(rec) {
+				fn(rec)
+			}
+			return true
+		})
+		sh.RUnlock()
+		if next > 0 {
+			return next<<shardBits | uint64(i)
+		}
+	}
+	return 0
+}
+
+// Keys calls fn with every live record.
+func (ks *Keyspace) Keys(fn func(rec *Record)) {
+	for _, sh := range ks.shards {
+		sh.RLock()
+		for _, rec := range sh.records {
+			if !ks.expired(rec) {
+				fn(rec)
+			}
+		}
+		sh.RUnlock()
+	}
+}
+
+// RandomKey returns a key chosen uniformly at random, or false if the
+// keyspace is empty.
+func (ks *Keyspace) RandomKey() (string, bool) {
+	// Expired keys are skipped, but a keyspace full of them must not spin
+	// forever.
+	for range 100 {
+		total := ks.Len()
+		if total == 0 {
+			return "", false
+		}
+		n := rand.IntN(total)
+		for _, sh := range ks.shards {
+			sh.RLock()
+			if n >= sh.order.Len() {
+				n -= sh.order.Len()
+				sh.RUnlock()
+				continue
+			}
+			_, key, _ := sh.order.GetAt(n)
+			expired := ks.expired(sh.records[key])
+			sh.RUnlock()
+			if !expired {
+				return key, true
+			}
+			break
+		}
+	}
+	return "", false
+}
+
+// sampleKeys returns up to n keys picked at random, for eviction. If volatile
+// is set, only keys with a TTL are picked. Keys are not picked uniformly,
+// only cheaply.
+func (ks *Keyspace) sampleKeys(n int, volatile bool) []string {
+	if volatile {
+		return ks.expiry.sampleKeys(n)
+	}
+	var keys []string
+	for range n {
+		// Walk from a random shard to the first that holds keys.
+		start := rand.IntN(len(ks.shards))
+		for i := range ks.shards {
+			sh := ks.shards[(start+i)%len(ks.shards)]
+			sh.RLock()
+			l := sh.order.Len()
+			if l > 0 {
+				_, key, _ := sh.order.GetAt(rand.IntN(l))
+				keys = append(keys, key)
+			}
+			sh.RUnlock()
+			if l > 0 {
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// live returns the record for key in sh, removing it first if it has
+// expired, unless expiry is logged. sh must be write locked.
+func (ks *Keyspace) live(sh *shard, key string) *Record {
+	rec, ok := sh.records[key]
+	if !ok {
+		return nil
+	}
+	if ks.logExpiry == nil && ks.expired(rec) {
+		ks.remove(sh, key, rec)
+		ks.expiry.Expired(key)
+		ks.dropped(key)
+		return nil
+	}
+	return rec
+}
+
+// expired reports whether rec has expired. Nothing expires while the
+// keyspace is loading.
+func (ks *Keyspace) expired(rec *Record) bool {
+	return !ks.loading.Load() && rec.Expired()
+}
+
+// passed reports whether deadline has passed at now, for commands that
+// delete a key outright rather than give it a deadline in the past. Nothing
+// expires while the keyspace is loading, so there such a key is kept until
+// loading is done, nor when expiry is logged, where it is kept until the
+// leader logs its removal.
+func (ks *Keyspace) passed(deadline, now time.Time) bool {
+	return !ks.loading.Load() && ks.logExpiry == nil && !deadline.After(now)
+}
+
+// dropped reports the removal of key by the keyspace itself. The key's shard
+// must be locked.
+func (ks *Keyspace) dropped(key string) {
+	if ks.onDrop != nil {
+		ks.onDrop(key)
+	}
+}
+
+// schedule registers the record's deadline with the expiry scheduler,
+// cancelling any deadline left over from a previous value of the key.
+func (ks *Keyspace) schedule(rec *Record) {
+	if rec.TTL > 0 {
+		ks.expiry.Schedule(rec.Key, rec.Deadline())
+	} else {
+		ks.expiry.Cancel(rec.Key)
+	}
+}
+
+// expireKey removes key if it still carries the given deadline, or has the
+// leader log its removal if expiry is logged.
+func (ks *Keyspace) expireKey(key string, deadline time.Time) bool {
+	logger := ks.Log.With().Str("function", "expireKey").Logger()
+	if ks.lockOrder != nil {
+		order := ks.lockOrder()
+		defer order.Unlock()
+	}
+	sh := ks.shardFor(key)
+	sh.Lock()
+	defer sh.Unlock()
+	record, ok := sh.records[key]
+	if !ok {
+		logger.Debug().Str("key", key).Msg("no record found")
+		return false
+	}
+	if ks.logExpiry != nil && record.TTL > 0 {
+		// The key is removed once the leader logs it, and checked again
+		// later in case that never happens, as when leadership changes.
+		next := record.Deadline()
+		if record.Expired() {
+			ks.logExpiry(key, next)
+			next = time.Now().Add(logExpiryRetry)
+		}
+		ks.expiry.Schedule(key, next)
+		return false
+	}
+	if record.TTL == 0 || !record.Deadline().Equal(deadline) {
+		logger.Debug().Str("key", key).Msg("not expiring key, deadline changed")
+		return false
+	}
+
+	logger.Debug().Str("key", key).Msg("expiring key")
+	ks.remove(sh, key, record)
+	ks.dropped(key)
+	return true
+}
+
+// expireLogged removes key if it still carries deadline, in Unix
+// milliseconds, running an expiry logged by the raft leader.
+func (ks *Keyspace) expireLogged(key string, deadline int64) {
+	sh := ks.shardFor(key)
+	sh.Lock()
+	defer sh.Unlock()
+	rec, ok := sh.records[key]
+	if !ok || rec.TTL == 0 || rec.Deadline().UnixMilli() != deadline {
+		return
+	}
+	ks.own(rec)
+	ks.remove(sh, key, rec)
+	ks.expiry.Expired(key)
+	ks.dropped(key)
+}
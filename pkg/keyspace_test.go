@@ -0,0 +1,171 @@
+package mukv
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestViewAllRemovesExpiredKeys(t *testing.T) {
+	ks := NewKeyspace(zerolog.Nop(), 4)
+	var dropped []string
+	ks.onDrop = func(key string) { dropped = append(dropped, key) }
+	ks.Update("live", func(*Record) *Record { return newRecord(int64(1)) })
+	ks.Update("gone", func(*Record) *Record {
+		rec := newRecord(int64(2))
+		rec.TTL = time.Millisecond
+		return rec
+	})
+	time.Sleep(5 * time.Millisecond)
+
+	ks.ViewAll([]string{"live", "gone"}, func(recs []*Record) {
+		if recs[0] == nil || recs[1] != nil {
+			t.Errorf("ViewAll saw %v, want only the live key", recs)
+		}
+	})
+	if n := ks.Len(); n != 1 {
+		t.Errorf("Len() = %d after reading the expired key, want 1", n)
+	}
+	if len(dropped) != 1 || dropped[0] != "gone" {
+		t.Errorf("dropped %q, want [gone]", dropped)
+	}
+	if s := ks.expiry.Stats(); s.Expired != 1 || s.Pending != 0 {
+		t.Errorf("expiry stats %+v, want 1 expired and none pending", s)
+	}
+}
+
+func TestKeyspaceUnchanged(t *testing.T) {
+	ks := NewKeyspace(zerolog.Nop(), 4)
+	ks.Update("k", func(*Record) *Record { return newRecord(int64(1)) })
+	var before *Record
+	ks.Peek("k", func(rec *Record) { before = rec })
+
+	ks.Update("k", func(*Record) *Record { return Unchanged })
+	ks.UpdateAll([]string{"k", "missing"}, func([]*Record) []*Record { return nil })
+	ks.Update("missing", func(*Record) *Record { return Unchanged })
+
+	ks.Peek("k", func(rec *Record) {
+		if rec != before || rec.Value != int64(1) {
+			t.Errorf("k holds %#v, want the record stored before", rec)
+		}
+	})
+	if n := ks.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+}
+
+// legacyStore is the layout the keyspace replaced: values in a sync.Map and
+// their records in a map behind one lock, which GET took exclusively to
+// count a hit.
+type legacyStore struct {
+	sync.RWMutex
+	Datastore sync.Map
+	Records   map[string]*legacyRecord
+}
+
+type legacyRecord struct {
+	Key     string
+	Created time.Time
+	TTL     time.Duration
+	Hits    int
+}
+
+func (s *legacyStore) get(key string) {
+	s.RLock()
+	rec, ok := s.Records[key]
+	s.RUnlock()
+	if !ok || rec.TTL > 0 && time.Since(rec.Created) >= rec.TTL {
+		return
+	}
+	if _, ok := s.Datastore.Load(key); !ok {
+		return
+	}
+	s.Lock()
+	rec.Hits++
+	s.Unlock()
+}
+
+func (s *legacyStore) set(key string, value []byte) {
+	rec := &legacyRecord{Key: key, Created: time.Now()}
+	s.Datastore.Store(key, value)
+	s.Lock()
+	s.Records[key] = rec
+	s.Unlock()
+}
+
+type keyspaceStore struct{ ks *Keyspace }
+
+func (s keyspaceStore) get(key string) {
+	s.ks.View(key, func(*Record) {})
+}
+
+func (s keyspaceStore) set(key string, value []byte) {
+	s.ks.Update(key, func(*Record) *Record { return newRecord(encodeString(value)) })
+}
+
+// benchStore is what the benchmarks run GET and SET against.
+type benchStore interface {
+	get(key string)
+	set(key string, value []byte)
+}
+
+var benchLayouts = []struct {
+	name string
+	new  func() benchStore
+}{
+	{"legacy", func() benchStore { return &legacyStore{Records: make(map[string]*legacyRecord)} }},
+	{"keyspace", func() benchStore { return keyspaceStore{NewKeyspace(zerolog.Nop(), DefaultConfig.Shards)} }},
+}
+
+const benchKeys = 100000
+
+// benchParallel runs op against each layout, filled with benchKeys keys,
+// from as many goroutines as there are CPUs. op is called with a key picked
+// at random and the number of operations the goroutine has run.
+func benchParallel(b *testing.B, op func(s benchStore, key string, n int)) {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	value := []byte("value")
+	for _, layout := range benchLayouts {
+		b.Run(layout.name, func(b *testing.B) {
+			s := layout.new()
+			for _, key := range keys {
+				s.set(key, value)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for n := 0; pb.Next(); n++ {
+					op(s, keys[rand.IntN(len(keys))], n)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchParallel(b, func(s benchStore, key string, _ int) { s.get(key) })
+}
+
+func BenchmarkSet(b *testing.B) {
+	value := []byte("value")
+	benchParallel(b, func(s benchStore, key string, _ int) { s.set(key, value) })
+}
+
+// BenchmarkMixed runs one SET for every nine GETs.
+func BenchmarkMixed(b *testing.B) {
+	value := []byte("value")
+	benchParallel(b, func(s benchStore, key string, n int) {
+		if n%10 == 0 {
+			s.set(key, value)
+			return
+		}
+		s.get(key)
+	})
+}
@@ -0,0 +1,756 @@
+package mukv
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// parseDirection parses the LEFT or RIGHT argument of LMOVE and friends,
+// reporting whether it names the left end.
+func parseDirection(arg []byte) (left bool, ok bool) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return true, true
+	case "right":
+		return false, true
+	}
+	return false, false
+}
+
+// directionArg formats a direction the way parseDirection parses it.
+func directionArg(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// popCommand names the command popping from the given end of a list, which
+// blocking pops are logged as.
+func popCommand(left bool) string {
+	if left {
+		return "LPOP"
+	}
+	return "RPOP"
+}
+
+// popList pops up to count elements from one end of the list at key. It
+// returns nil if the key does not exist.
+func popList(ks *Keyspace, key string, left bool, count int) ([][]byte, string) {
+	var elems [][]byte
+	var errStr string
+	ks.Update(key, func(rec *Record) *Record {
+		l, ok := asList(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		if rec == nil {
+			return Unchanged
+		}
+		elems = make([][]byte, 0, min(count, l.Len()))
+		for range min(count, l.Len()) {
+			if left {
+				elems = append(elems, l.PopFront())
+			} else {
+				elems = append(elems, l.PopBack())
+			}
+		}
+		switch {
+		case len(elems) == 0:
+			return Unchanged
+		case l.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+	return elems, errStr
+}
+
+// moveList atomically pops an element from one end of the list at src and
+// pushes it onto one end of the list at dst. It returns nil if src does not
+// exist.
+func moveList(ks *Keyspace, src, dst string, fromLeft, toLeft bool) ([]byte, string) {
+	var elem []byte
+	var errStr string
+	ks.UpdateAll([]string{src, dst}, func(recs []*Record) []*Record {
+		from, ok := asList(recs[0])
+		if !ok {
+			errStr = errWrongType
+			return nil
+		}
+		to, ok := asList(recs[1])
+		if !ok {
+			errStr = errWrongType
+			return nil
+		}
+		if recs[0] == nil {
+			return nil
+		}
+
+		if fromLeft {
+			elem = from.PopFront()
+		} else {
+			elem = from.PopBack()
+		}
+		if recs[1] == nil {
+			recs[1] = newRecord(to)
+		}
+		if toLeft {
+			to.PushFront(elem)
+		} else {
+			to.PushBack(elem)
+		}
+		if src != dst && from.Len() == 0 {
+			recs[0] = nil
+		}
+		return recs
+	})
+	return elem, errStr
+}
+
+// handlePush implements LPUSH, RPUSH, LPUSHX and RPUSHX. The X variants
+// only push onto a list that already exists.
+func (mkv *MuKV) handlePush(conn redcon.Conn, cmd redcon.Command, left, exists bool) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	n := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		l, ok := asList(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		if rec == nil {
+			if exists {
+				return nil
+			}
+			rec = newRecord(l)
+		}
+		for _, elem := range cmd.Args[2:] {
+			if left {
+				l.PushFront(elem)
+			} else {
+				l.PushBack(elem)
+			}
+		}
+		n = l.Len()
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+// handlePop implements LPOP and RPOP.
+func (mkv *MuKV) handlePop(conn redcon.Conn, cmd redcon.Command, left bool) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	count := int64(1)
+	if len(cmd.Args) == 3 {
+		var ok bool
+		if count, ok = parseInt(cmd.Args[2]); !ok || count < 0 {
+			conn.WriteError("ERR value is out of range, must be positive")
+			return
+		}
+	}
+
+	elems, errStr := popList(mkv.db(conn), string(cmd.Args[1]), left, int(count))
+	switch {
+	case errStr != "":
+		conn.WriteError(errStr)
+	case len(cmd.Args) == 2 && len(elems) == 0:
+		conn.WriteNull()
+	case len(cmd.Args) == 2:
+		conn.WriteBulk(elems[0])
+	case elems == nil:
+		writeNullArray(conn)
+	default:
+		conn.WriteArray(len(elems))
+		for _, elem := range elems {
+			conn.WriteBulk(elem)
+		}
+	}
+}
+
+func (mkv *MuKV) handleLLen(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		l, ok := asList(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(l.Len())
+	})
+}
+
+func (mkv *MuKV) handleLRange(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	start, ok := parseInt(cmd.Args[2])
+	stop, ok2 := parseInt(cmd.Args[3])
+	if !ok || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		l, ok := asList(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		from, to, ok := normalizeRange(start, stop, l.Len())
+		if !ok {
+			conn.WriteArray(0)
+			return
+		}
+		conn.WriteArray(to - from + 1)
+		for i := from; i <= to; i++ {
+			conn.WriteBulk(l.At(i))
+		}
+	})
+}
+
+func (mkv *MuKV) handleLIndex(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	index, ok := parseInt(cmd.Args[2])
+	if !ok {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		l, ok := asList(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		if index < 0 {
+			index += int64(l.Len())
+		}
+		if index < 0 || index >= int64(l.Len()) {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulk(l.At(int(index)))
+	})
+}
+
+func (mkv *MuKV) handleLSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	index, ok := parseInt(cmd.Args[2])
+	if !ok {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		l, ok := asList(rec)
+		switch {
+		case !ok:
+			errStr = errWrongType
+			return Unchanged
+		case rec == nil:
+			errStr = "ERR no such key"
+			return Unchanged
+		}
+		if index < 0 {
+			index += int64(l.Len())
+		}
+		if index < 0 || index >= int64(l.Len()) {
+			errStr = "ERR index out of range"
+			return Unchanged
+		}
+		l.Set(int(index), cmd.Args[3])
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteString("OK")
+	}
+}
+
+func (mkv *MuKV) handleLInsert(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var after bool
+	switch strings.ToLower(string(cmd.Args[2])) {
+	case "before":
+	case "after":
+		after = true
+	default:
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	n := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		l, ok := asList(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		if rec == nil {
+			return nil
+		}
+		n = -1
+		for i := range l.Len() {
+			if bytes.Equal(l.At(i), cmd.Args[3]) {
+				if after {
+					i++
+				}
+				l.Insert(i, cmd.Args[4])
+				n = l.Len()
+				break
+			}
+		}
+		if n < 0 {
+			return Unchanged
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+func (mkv *MuKV) handleLRem(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	count, ok := parseInt(cmd.Args[2])
+	if !ok {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	removed := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		l, ok := asList(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		// Walk from the end count points at, removing matches as we go.
+		limit := int(max(count, -count))
+		if count < 0 {
+			for i := l.Len() - 1; i >= 0 && (limit == 0 || removed < limit); i-- {
+				if bytes.Equal(l.At(i), cmd.Args[3]) {
+					l.Remove(i)
+					removed++
+				}
+			}
+		} else {
+			for i := 0; i < l.Len() && (limit == 0 || removed < limit); {
+				if bytes.Equal(l.At(i), cmd.Args[3]) {
+					l.Remove(i)
+					removed++
+				} else {
+					i++
+				}
+			}
+		}
+		switch {
+		case removed == 0:
+			return Unchanged
+		case l.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(removed)
+	}
+}
+
+func (mkv *MuKV) handleLTrim(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	start, ok := parseInt(cmd.Args[2])
+	stop, ok2 := parseInt(cmd.Args[3])
+	if !ok || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		l, ok := asList(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		from, to, ok := normalizeRange(start, stop, l.Len())
+		if !ok {
+			return nil
+		}
+		for range l.Len() - 1 - to {
+			l.PopBack()
+		}
+		for range from {
+			l.PopFront()
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteString("OK")
+	}
+}
+
+func (mkv *MuKV) handleLPos(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	rank, count, maxLen := int64(1), int64(1), int64(0)
+	withCount := false
+	for i := 3; i < len(cmd.Args); i += 2 {
+		if i+1 == len(cmd.Args) {
+			conn.WriteError(errSyntax)
+			return
+		}
+		n, ok := parseInt(cmd.Args[i+1])
+		if !ok {
+			conn.WriteError(errNotInteger)
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "rank":
+			if n == 0 {
+				conn.WriteError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+				return
+			}
+			rank = n
+		case "count":
+			if n < 0 {
+				conn.WriteError("ERR COUNT can't be negative")
+				return
+			}
+			count = n
+			withCount = true
+		case "maxlen":
+			if n < 0 {
+				conn.WriteError("ERR MAXLEN can't be negative")
+				return
+			}
+			maxLen = n
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		l, ok := asList(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		var matches []int
+		skip := max(rank, -rank) - 1
+		for scanned := 0; scanned < l.Len(); scanned++ {
+			if maxLen > 0 && int64(scanned) >= maxLen {
+				break
+			}
+			i := scanned
+			if rank < 0 {
+				i = l.Len() - 1 - scanned
+			}
+			if !bytes.Equal(l.At(i), cmd.Args[2]) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			matches = append(matches, i)
+			if count > 0 && int64(len(matches)) == count {
+				break
+			}
+		}
+
+		if !withCount {
+			if len(matches) == 0 {
+				conn.WriteNull()
+			} else {
+				conn.WriteInt(matches[0])
+			}
+			return
+		}
+		conn.WriteArray(len(matches))
+		for _, i := range matches {
+			conn.WriteInt(i)
+		}
+	})
+}
+
+// handleLMove implements LMOVE and RPOPLPUSH.
+func (mkv *MuKV) handleLMove(conn redcon.Conn, cmd redcon.Command) {
+	fromLeft, toLeft, ok := false, true, true
+	switch {
+	case strings.EqualFold(string(cmd.Args[0]), "rpoplpush") && len(cmd.Args) == 3:
+	case len(cmd.Args) == 5:
+		var ok2 bool
+		fromLeft, ok = parseDirection(cmd.Args[3])
+		toLeft, ok2 = parseDirection(cmd.Args[4])
+		ok = ok && ok2
+	default:
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	if !ok {
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	elem, errStr := moveList(mkv.db(conn), string(cmd.Args[1]), string(cmd.Args[2]), fromLeft, toLeft)
+	switch {
+	case errStr != "":
+		conn.WriteError(errStr)
+	case elem == nil:
+		conn.WriteNull()
+	default:
+		conn.WriteBulk(elem)
+	}
+}
+
+// parseMPop parses the numkeys, keys, direction and COUNT arguments shared
+// by LMPOP and BLMPOP.
+func parseMPop(args [][]byte) (keys []string, left bool, count int, errStr string) {
+	numKeys, ok := parseInt(args[0])
+	if !ok || numKeys <= 0 {
+		return nil, false, 0, "ERR numkeys should be greater than 0"
+	}
+	if int64(len(args)) < numKeys+2 {
+		return nil, false, 0, errSyntax
+	}
+	for _, key := range args[1 : numKeys+1] {
+		keys = append(keys, string(key))
+	}
+	args = args[numKeys+1:]
+	if left, ok = parseDirection(args[0]); !ok {
+		return nil, false, 0, errSyntax
+	}
+	count = 1
+	switch {
+	case len(args) == 1:
+	case len(args) == 3 && strings.EqualFold(string(args[1]), "count"):
+		n, ok := parseInt(args[2])
+		if !ok || n <= 0 {
+			return nil, false, 0, "ERR count should be greater than 0"
+		}
+		count = int(n)
+	default:
+		return nil, false, 0, errSyntax
+	}
+	return keys, left, count, ""
+}
+
+func writeMPopReply(conn redcon.Conn, key string, elems [][]byte) {
+	conn.WriteArray(2)
+	conn.WriteBulkString(key)
+	conn.WriteArray(len(elems))
+	for _, elem := range elems {
+		conn.WriteBulk(elem)
+	}
+}
+
+func (mkv *MuKV) handleLMPop(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	keys, left, count, errStr := parseMPop(cmd.Args[1:])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	for _, key := range keys {
+		elems, errStr := popList(mkv.db(conn), key, left, count)
+		if errStr != "" {
+			conn.WriteError(errStr)
+			return
+		}
+		if len(elems) > 0 {
+			writeMPopReply(conn, key, elems)
+			return
+		}
+	}
+	writeNullArray(conn)
+}
+
+// handleBPop implements BLPOP and BRPOP.
+func (mkv *MuKV) handleBPop(conn redcon.Conn, cmd redcon.Command, left bool) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	timeout, errStr := parseTimeout(cmd.Args[len(cmd.Args)-1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	keys := make([]string, 0, len(cmd.Args)-2)
+	for _, key := range cmd.Args[1 : len(cmd.Args)-1] {
+		keys = append(keys, string(key))
+	}
+
+	served := mkv.block(conn, keys, timeout, func(key string) bool {
+		elems, errStr := popList(mkv.db(conn), key, left, 1)
+		switch {
+		case errStr != "":
+			conn.WriteError(errStr)
+		case len(elems) > 0:
+			mkv.propagate(conn, []byte(popCommand(left)), []byte(key))
+			conn.WriteArray(2)
+			conn.WriteBulkString(key)
+			conn.WriteBulk(elems[0])
+		default:
+			return false
+		}
+		return true
+	})
+	if !served {
+		writeNullArray(conn)
+	}
+}
+
+// handleBLMove implements BLMOVE and BRPOPLPUSH.
+func (mkv *MuKV) handleBLMove(conn redcon.Conn, cmd redcon.Command) {
+	fromLeft, toLeft, ok := false, true, true
+	switch {
+	case strings.EqualFold(string(cmd.Args[0]), "brpoplpush") && len(cmd.Args) == 4:
+	case len(cmd.Args) == 6:
+		var ok2 bool
+		fromLeft, ok = parseDirection(cmd.Args[3])
+		toLeft, ok2 = parseDirection(cmd.Args[4])
+		ok = ok && ok2
+	default:
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	if !ok {
+		conn.WriteError(errSyntax)
+		return
+	}
+	timeout, errStr := parseTimeout(cmd.Args[len(cmd.Args)-1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	src, dst := string(cmd.Args[1]), string(cmd.Args[2])
+	served := mkv.block(conn, []string{src}, timeout, func(string) bool {
+		elem, errStr := moveList(mkv.db(conn), src, dst, fromLeft, toLeft)
+		switch {
+		case errStr != "":
+			conn.WriteError(errStr)
+		case elem != nil:
+			mkv.propagate(conn, []byte("LMOVE"), []byte(src), []byte(dst),
+				[]byte(directionArg(fromLeft)), []byte(directionArg(toLeft)))
+			conn.WriteBulk(elem)
+		default:
+			return false
+		}
+		return true
+	})
+	if !served {
+		conn.WriteNull()
+	}
+}
+
+func (mkv *MuKV) handleBLMPop(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	timeout, errStr := parseTimeout(cmd.Args[1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	keys, left, count, errStr := parseMPop(cmd.Args[2:])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	served := mkv.block(conn, keys, timeout, func(key string) bool {
+		elems, errStr := popList(mkv.db(conn), key, left, count)
+		switch {
+		case errStr != "":
+			conn.WriteError(errStr)
+		case len(elems) > 0:
+			mkv.propagate(conn, []byte(popCommand(left)), []byte(key), []byte(strconv.Itoa(len(elems))))
+			writeMPopReply(conn, key, elems)
+		default:
+			return false
+		}
+		return true
+	})
+	if !served {
+		writeNullArray(conn)
+	}
+}
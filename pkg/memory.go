@@ -0,0 +1,354 @@
+package mukv
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Estimated sizes, in bytes, of the structures holding keys and values. They
+// approximate what the Go runtime allocates rather than measure it.
+const (
+	// recordOverhead covers a Record along with its entries in the shard's
+	// map and insertion order.
+	recordOverhead   = 160
+	sliceOverhead    = 24
+	mapEntryOverhead = 48
+	// zsetItemOverhead covers an item in a sorted set's B-tree alongside
+	// its score map entry.
+	zsetItemOverhead = 96
+	// sizeSamples is how many elements of a collection are measured to
+	// estimate the size of all of them, as Redis's MEMORY USAGE does.
+	sizeSamples = 5
+)
+
+// recordSize estimates the memory held by rec, its key and its value.
+func recordSize(rec *Record) int64 {
+	return recordOverhead + int64(len(rec.Key)) + valueSize(rec.Value)
+}
+
+// valueSize estimates the memory held by a value. Collections are measured
+// from a few of their elements, so that the estimate takes constant time.
+func valueSize(v any) int64 {
+	switch v := v.(type) {
+	case []byte:
+		return sliceOverhead + int64(cap(v))
+	case int64:
+		return 8
+	case hashValue:
+		var sampled, size int64
+		for field, val := range v {
+			if sampled == sizeSamples {
+				break
+			}
+			size += int64(len(field) + len(val))
+			sampled++
+		}
+		return scaleSample(len(v), sampled, size, mapEntryOverhead+2*sliceOverhead)
+	case *deque:
+		return int64(cap(v.buf))*sliceOverhead + sampleAt(v.Len(), func(i int) int {
+			return len(v.At(i))
+		})
+	case *setValue:
+		if v.members == nil {
+			return sliceOverhead + int64(cap(v.ints))*8
+		}
+		var sampled, size int64
+		for m := range v.members {
+			if sampled == sizeSamples {
+				break
+			}
+			size += int64(len(m))
+			sampled++
+		}
+		return scaleSample(len(v.members), sampled, size, mapEntryOverhead+sliceOverhead)
+	case *zsetValue:
+		return sampleAt(v.Len(), func(i int) int {
+			return len(v.At(i).member)
+		}) + int64(v.Len())*zsetItemOverhead
+	}
+	return 0
+}
+
+// sampleAt estimates the total of size over n elements from up to
+// sizeSamples of them spread evenly across the collection.
+func sampleAt(n int, size func(i int) int) int64 {
+	sampled, total := int64(0), int64(0)
+	for i := 0; i < n && sampled < sizeSamples; i += max(n/sizeSamples, 1) {
+		total += int64(size(i))
+		sampled++
+	}
+	return scaleSample(n, sampled, total, 0)
+}
+
+// scaleSample extends the size measured over sampled of n elements to all of
+// them, adding a fixed overhead per element.
+func scaleSample(n int, sampled, size, overhead int64) int64 {
+	if sampled == 0 {
+		return 0
+	}
+	return int64(n) * (size/sampled + overhead)
+}
+
+// EvictionPolicy selects which keys are evicted once the memory limit is
+// reached.
+type EvictionPolicy int32
+
+const (
+	// NoEviction refuses commands that may grow memory use instead.
+	NoEviction EvictionPolicy = iota
+	AllKeysLRU
+	AllKeysLFU
+	AllKeysRandom
+	VolatileLRU
+	VolatileLFU
+	VolatileRandom
+	// VolatileTTL evicts the keys closest to expiring first.
+	VolatileTTL
+)
+
+var evictionPolicyNames = [...]string{
+	NoEviction:     "noeviction",
+	AllKeysLRU:     "allkeys-lru",
+	AllKeysLFU:     "allkeys-lfu",
+	AllKeysRandom:  "allkeys-random",
+	VolatileLRU:    "volatile-lru",
+	VolatileLFU:    "volatile-lfu",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// ParseEvictionPolicy returns the policy named s, as maxmemory-policy
+// names it.
+func ParseEvictionPolicy(s string) (EvictionPolicy, bool) {
+	i := slices.Index(evictionPolicyNames[:], s)
+	return EvictionPolicy(i), i >= 0
+}
+
+// volatile reports whether the policy only evicts keys with a TTL.
+func (p EvictionPolicy) volatile() bool {
+	return p >= VolatileLRU
+}
+
+func (p EvictionPolicy) lfu() bool {
+	return p == AllKeysLFU || p == VolatileLFU
+}
+
+func (p EvictionPolicy) random() bool {
+	return p == AllKeysRandom || p == VolatileRandom
+}
+
+const errOOM = "OOM command not allowed when used memory > 'maxmemory'."
+
+// LFU counters follow Redis: a new key starts at lfuInitVal, each access
+// increments the counter with a probability that falls as it grows, and the
+// counter decays by one for every lfu-decay-time minutes the key goes
+// unused.
+const (
+	lfuInitVal = 5
+	lfuMax     = 255
+)
+
+// evictionPoolSize is the number of eviction candidates kept between
+// evictions, so that each sample refines the ones before it.
+const evictionPoolSize = 16
+
+// evictionCandidate is a key that may be evicted, with its score: the
+// higher the score, the better a candidate it is.
+type evictionCandidate struct {
+	db    int
+	key   string
+	score int64
+}
+
+// evictor enforces the memory limit across all databases by evicting keys
+// according to the eviction policy. Its settings can be changed at runtime.
+type evictor struct {
+	dbs []*Keyspace
+
+	maxMemory    atomic.Int64
+	pol          atomic.Int32
+	samples      atomic.Int32
+	lfuLogFactor atomic.Int32
+	lfuDecayTime atomic.Int32
+	evicted      atomic.Uint64
+
+	// The mutex guards pool and serializes evictions.
+	mu   sync.Mutex
+	pool []evictionCandidate
+}
+
+func newEvictor(dbs []*Keyspace, cfg Config) *evictor {
+	e := &evictor{dbs: dbs}
+	e.maxMemory.Store(cfg.MaxMemory)
+	e.pol.Store(int32(cfg.MaxMemoryPolicy))
+	e.samples.Store(int32(cfg.MaxMemorySamples))
+	e.lfuLogFactor.Store(int32(cfg.LFULogFactor))
+	e.lfuDecayTime.Store(int32(cfg.LFUDecayTime))
+	return e
+}
+
+func (e *evictor) policy() EvictionPolicy {
+	return EvictionPolicy(e.pol.Load())
+}
+
+// used returns the estimated memory held by all databases.
+func (e *evictor) used() int64 {
+	var n int64
+	for _, ks := range e.dbs {
+		n += ks.Used()
+	}
+	return n
+}
+
+// makeRoom evicts keys until memory use is within the limit, reporting false
+// if it cannot get there.
+func (e *evictor) makeRoom() bool {
+	limit := e.maxMemory.Load()
+	if limit <= 0 {
+		return true
+	}
+	for e.used() > limit {
+		if !e.evictOne() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictOne evicts a single key chosen by the eviction policy, reporting
+// false if there is none to evict.
+func (e *evictor) evictOne() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	pol := e.policy()
+	if pol == NoEviction {
+		return false
+	}
+	if pol.random() {
+		start := rand.IntN(len(e.dbs))
+		for i := range e.dbs {
+			db := (start + i) % len(e.dbs)
+			for _, key := range e.dbs[db].sampleKeys(1, pol.volatile()) {
+				if e.evict(db, key, pol) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	samples := int(e.samples.Load())
+	for db, ks := range e.dbs {
+		if ks.Used() == 0 {
+			continue
+		}
+		for _, key := range ks.sampleKeys(samples, pol.volatile()) {
+			// The write order lock is held, so expired keys are left for
+			// the expiry loop.
+			ks.peek(key, func(rec *Record) {
+				if rec == nil || (pol.volatile() && rec.TTL == 0) {
+					return
+				}
+				e.consider(evictionCandidate{db, key, e.score(rec, pol, now)})
+			})
+		}
+	}
+	// The pool may hold keys that have since been deleted or changed.
+	for len(e.pool) > 0 {
+		c := e.pool[len(e.pool)-1]
+		e.pool = e.pool[:len(e.pool)-1]
+		if e.evict(c.db, c.key, pol) {
+			return true
+		}
+	}
+	return false
+}
+
+// consider adds c to the pool, which is kept sorted by ascending score, and
+// drops the worst candidate if the pool overflows.
+func (e *evictor) consider(c evictionCandidate) {
+	e.pool = slices.DeleteFunc(e.pool, func(o evictionCandidate) bool {
+		return o.db == c.db && o.key == c.key
+	})
+	i, _ := slices.BinarySearchFunc(e.pool, c.score, func(o evictionCandidate, score int64) int {
+		switch {
+		case o.score < score:
+			return -1
+		case o.score > score:
+			return 1
+		}
+		return 0
+	})
+	e.pool = slices.Insert(e.pool, i, c)
+	if len(e.pool) > evictionPoolSize {
+		e.pool = e.pool[1:]
+	}
+}
+
+// score rates rec as an eviction candidate under pol.
+func (e *evictor) score(rec *Record, pol EvictionPolicy, now time.Time) int64 {
+	switch {
+	case pol.lfu():
+		return lfuMax - e.lfuDecay(rec, now)
+	case pol == VolatileTTL:
+		return math.MaxInt64 - rec.Deadline().UnixNano()
+	}
+	return now.UnixNano() - rec.Accessed.Load()
+}
+
+// evict deletes key from database db if pol still allows it.
+func (e *evictor) evict(db int, key string, pol EvictionPolicy) bool {
+	evicted := false
+	e.dbs[db].Update(key, func(rec *Record) *Record {
+		if rec == nil || (pol.volatile() && rec.TTL == 0) {
+			return Unchanged
+		}
+		evicted = true
+		e.dbs[db].dropped(key)
+		return nil
+	})
+	if evicted {
+		e.evicted.Add(1)
+	}
+	return evicted
+}
+
+// lfuDecay returns rec's LFU counter, decayed for the time since the key
+// was last used.
+func (e *evictor) lfuDecay(rec *Record, now time.Time) int64 {
+	counter := min(rec.Hits.Load(), lfuMax)
+	decayTime := int64(e.lfuDecayTime.Load())
+	if decayTime <= 0 {
+		return counter
+	}
+	idle := time.Duration(now.UnixNano() - rec.Accessed.Load())
+	periods := int64(idle/time.Minute) / decayTime
+	return max(counter-periods, 0)
+}
+
+// lfuAccess returns rec's LFU counter after an access at now. A record that
+// has never been accessed is new, and starts at lfuInitVal.
+func (e *evictor) lfuAccess(rec *Record, now time.Time) int64 {
+	if rec.Accessed.Load() == 0 {
+		return lfuInitVal
+	}
+	counter := e.lfuDecay(rec, now)
+	if counter == lfuMax {
+		return counter
+	}
+	base := float64(max(counter-lfuInitVal, 0))
+	if rand.Float64() < 1/(base*float64(e.lfuLogFactor.Load())+1) {
+		counter++
+	}
+	return counter
+}
@@ -0,0 +1,297 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// A DUMP payload holds a value as a snapshot writes it, its type code
+// followed by the value, then the snapshot version as a little-endian
+// uint16 and a CRC-64 of everything before it, as a little-endian uint64.
+
+// dumpPayload serializes v for DUMP.
+func dumpPayload(v any) []byte {
+	buf := []byte{valueType(v)}
+	buf = appendValue(buf, v)
+	buf = binary.LittleEndian.AppendUint16(buf, snapshotVersion)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Checksum(buf, crcTable))
+}
+
+// parseDumpPayload decodes a payload written by dumpPayload, reporting false
+// if it is malformed.
+func parseDumpPayload(payload []byte) (any, bool) {
+	if len(payload) < 11 {
+		return nil, false
+	}
+	body, footer := payload[:len(payload)-10], payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) != snapshotVersion ||
+		binary.LittleEndian.Uint64(footer[2:]) != crc64.Checksum(payload[:len(payload)-8], crcTable) {
+		return nil, false
+	}
+	sr := &snapshotReader{r: bufio.NewReader(bytes.NewReader(body)), crc: io.Discard}
+	v := sr.value(sr.byte())
+	if sr.err != nil || sr.r.Buffered() > 0 {
+		return nil, false
+	}
+	return v, true
+}
+
+func (mkv *MuKV) handleDump(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	mkv.db(conn).Peek(string(cmd.Args[1]), func(rec *Record) {
+		if rec == nil {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulk(dumpPayload(rec.Value))
+	})
+}
+
+// handleRestore serves RESTORE, and RESTORE-ASKING, which MIGRATE sends to
+// nodes importing a slot.
+func (mkv *MuKV) handleRestore(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	replace, absTTL := false, false
+	for _, arg := range cmd.Args[4:] {
+		switch strings.ToLower(string(arg)) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+	ttl, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	if ttl < 0 {
+		conn.WriteError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	value, ok := parseDumpPayload(cmd.Args[3])
+	if !ok {
+		conn.WriteError("ERR DUMP payload version or checksum are wrong")
+		return
+	}
+	var deadline time.Time
+	switch {
+	case ttl > 0 && absTTL:
+		deadline = time.UnixMilli(ttl)
+	case ttl > 0:
+		deadline = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+
+	key := string(cmd.Args[1])
+	busy, stored := false, false
+	mkv.db(conn).Update(key, func(cur *Record) *Record {
+		if cur != nil && !replace {
+			busy = true
+			return Unchanged
+		}
+		// A key restored already expired only removes the key it replaces.
+		if !deadline.IsZero() && !deadline.After(time.Now()) {
+			return nil
+		}
+		stored = true
+		rec := newRecord(value)
+		rec.SetDeadline(deadline)
+		return rec
+	})
+	if busy {
+		conn.WriteError("BUSYKEY Target key name already exists.")
+		return
+	}
+	// Log the key with its deadline rather than its TTL, which would run
+	// from when the log is replayed.
+	if stored {
+		at := []byte("0")
+		if !deadline.IsZero() {
+			at = pxatArg(deadline)
+		}
+		mkv.propagate(conn, []byte("RESTORE"), cmd.Args[1], at, cmd.Args[3], []byte("REPLACE"), []byte("ABSTTL"))
+	} else {
+		mkv.propagate(conn, []byte("DEL"), cmd.Args[1])
+	}
+	conn.WriteString("OK")
+}
+
+// migrateTimeout is the timeout MIGRATE uses if given none.
+const migrateTimeout = time.Second
+
+// handleMigrate serves MIGRATE, which moves keys to another server with
+// RESTORE. The keys stay locked until the server has answered, so no command
+// sees a key on both servers or on neither.
+func (mkv *MuKV) handleMigrate(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 6 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	addr := net.JoinHostPort(string(cmd.Args[1]), string(cmd.Args[2]))
+	db, err := strconv.Atoi(string(cmd.Args[4]))
+	if err != nil || db < 0 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	timeoutMs, err := strconv.ParseInt(string(cmd.Args[5]), 10, 64)
+	if err != nil {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = migrateTimeout
+	}
+	copyKeys, replace := false, false
+	keys := []string{string(cmd.Args[3])}
+	for i := 6; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "copy":
+			copyKeys = true
+		case "replace":
+			replace = true
+		case "keys":
+			if len(cmd.Args[3]) != 0 {
+				conn.WriteError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			keys = nil
+			for _, key := range cmd.Args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(cmd.Args)
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	restore := []byte("RESTORE")
+	if mkv.cluster != nil {
+		restore = []byte("RESTORE-ASKING")
+	}
+	var moved [][]byte
+	var errStr string
+	noKeys := false
+	mkv.db(conn).UpdateAll(keys, func(recs []*Record) []*Record {
+		var batch []byte
+		var sent []int
+		if db != 0 {
+			batch = appendCommand(batch, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})
+		}
+		for i, rec := range recs {
+			if rec == nil {
+				continue
+			}
+			ttl := int64(0)
+			if deadline := rec.Deadline(); !deadline.IsZero() {
+				ttl = max(time.Until(deadline).Milliseconds(), 1)
+			}
+			args := [][]byte{restore, []byte(keys[i]), strconv.AppendInt(nil, ttl, 10), dumpPayload(rec.Value)}
+			if replace {
+				args = append(args, []byte("REPLACE"))
+			}
+			batch = appendCommand(batch, args)
+			sent = append(sent, i)
+		}
+		if len(sent) == 0 {
+			noKeys = true
+			return nil
+		}
+
+		replies, err := migrateBatch(addr, timeout, batch, len(sent)+min(db, 1))
+		if err != nil {
+			errStr = "IOERR error or timeout reading to target instance"
+			return nil
+		}
+		if db != 0 {
+			if rerr, ok := replies[0].(error); ok {
+				errStr = "ERR Target instance replied with error: " + rerr.Error()
+				return nil
+			}
+			replies = replies[1:]
+		}
+		for j, i := range sent {
+			if rerr, ok := replies[j].(error); ok {
+				if errStr == "" {
+					errStr = "ERR Target instance replied with error: " + rerr.Error()
+				}
+				continue
+			}
+			if !copyKeys {
+				recs[i] = nil
+				moved = append(moved, []byte(keys[i]))
+			}
+		}
+		if len(moved) == 0 {
+			return nil
+		}
+		return recs
+	})
+
+	if len(moved) > 0 {
+		mkv.propagate(conn, append([][]byte{[]byte("DEL")}, moved...)...)
+	} else {
+		clientFor(conn).propagated = true
+	}
+	switch {
+	case noKeys:
+		conn.WriteString("NOKEY")
+	case errStr != "":
+		conn.WriteError(errStr)
+	default:
+		conn.WriteString("OK")
+	}
+}
+
+// migrateBatch sends batch, holding n commands, to the server at addr, and
+// returns its n replies, holding an error for each error reply.
+func migrateBatch(addr string, timeout time.Duration, batch []byte, n int) ([]any, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(batch); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	replies := make([]any, n)
+	for i := range replies {
+		reply, err := readReply(br)
+		if rerr, ok := err.(replyError); ok {
+			reply, err = rerr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
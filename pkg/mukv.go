@@ -1,110 +1,292 @@
 package mukv
 
 import (
-	"fmt"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 )
 
-type MuKV struct {
-	sync.RWMutex
-	Log             zerolog.Logger
-	Datastore       sync.Map
-	expirationQueue chan Record
-	Records         map[string]*Record
-}
-
-func (mkv *MuKV) Receive(key string, ttl, duration string) (*Record, error) {
-	var err error
-	var recTTL time.Duration
-	if len(ttl) > 0 {
-		ttlStr := fmt.Sprintf("%s%s", ttl, duration)
-		recTTL, err = time.ParseDuration(ttlStr)
-
-		if err != nil {
-			return nil, err
-		}
+// Config holds the settings a MuKV is created with.
+type Config struct {
+	// Shards is the number of lock-striped shards the keyspace is split into.
+	Shards int
+	// Expire tunes the active expire cycle started by StartExpireLoop.
+	Expire ExpireConfig
+	// Databases is the number of logical databases clients can SELECT.
+	Databases int
 
-	}
+	// MaxMemory limits the estimated memory held by the keyspace, in bytes.
+	// Zero means no limit.
+	MaxMemory int64
+	// MaxMemoryPolicy selects which keys are evicted to stay under
+	// MaxMemory.
+	MaxMemoryPolicy EvictionPolicy
+	// MaxMemorySamples is the number of keys sampled per database to pick
+	// each key to evict.
+	MaxMemorySamples int
+	// LFULogFactor slows the growth of LFU counters: the higher it is, the
+	// more accesses it takes to saturate one.
+	LFULogFactor int
+	// LFUDecayTime is the number of minutes after which an unused key's
+	// LFU counter is decremented.
+	LFUDecayTime int
 
-	r := &Record{
-		Key:     key,
-		Created: time.Now(),
-		TTL:     recTTL,
-	}
+	// SaveRules trigger background snapshots as writes accumulate.
+	SaveRules []SaveRule
+	// Dir is the directory snapshots are saved in.
+	Dir string
+	// DBFilename is the name of the snapshot file within Dir.
+	DBFilename string
 
-	if r.TTL > 0 {
-		go func() {
-			mkv.expirationQueue <- *r
-		}()
-	}
+	// AppendOnly logs every write to the append-only file, which is replayed
+	// at startup in place of the snapshot.
+	AppendOnly bool
+	// AppendFilename is the name of the append-only file within Dir.
+	AppendFilename string
+	// AppendFsync sets how often the append-only file is synced to disk.
+	AppendFsync FsyncPolicy
+	// AOFLoadTruncated repairs an append-only file whose last command was
+	// cut short, as a crash may leave it, by truncating it to the last
+	// complete command. Otherwise such a file fails to load.
+	AOFLoadTruncated bool
+	// AutoAOFRewritePercentage rewrites the append-only file once it has
+	// grown by this percentage since it was last rewritten. Zero turns
+	// automatic rewrites off.
+	AutoAOFRewritePercentage int
+	// AutoAOFRewriteMinSize is the size, in bytes, below which the
+	// append-only file is not rewritten automatically.
+	AutoAOFRewriteMinSize int64
+
+	// ReplicaOf is the address of the leader to replicate from once the
+	// server starts, if any.
+	ReplicaOf string
+	// ReplicaReadOnly refuses writes from clients while replicating.
+	ReplicaReadOnly bool
 
-	return r, nil
+	// Dynamo, if set, runs the server as a node of a leaderless cluster.
+	Dynamo *DynamoConfig
+
+	// Raft, if set, runs the server as a node of a group that replicates
+	// writes through a consensus log.
+	Raft *RaftConfig
+
+	// ClusterEnabled runs the server as a node of a cluster that splits the
+	// keyspace into hash slots, serving the keys of its own slots and
+	// redirecting clients to the nodes serving the others.
+	ClusterEnabled bool
+	// ClusterConfigFile is the name of the file within Dir that the node
+	// saves its view of the cluster in.
+	ClusterConfigFile string
+	// ClusterAnnounceIP is the address the node gives other nodes and
+	// clients to reach it at.
+	ClusterAnnounceIP string
+	// ClusterNodeTimeout is how long another node may go without answering
+	// before it is flagged as failing.
+	ClusterNodeTimeout time.Duration
+
+	// LuaTimeLimit is how long a script may run before other clients are
+	// answered BUSY, and may stop it with SCRIPT KILL.
+	LuaTimeLimit time.Duration
 }
 
-func (mkv *MuKV) StartExpireLoop() {
-	logger := mkv.Log.With().Str("function", "StartExpireLoop").Logger()
-	for {
-		// Delay 10 milliseconds between expiration queue sweeps
-		delayTimer := time.NewTimer(10 * time.Millisecond)
-		rec := <-mkv.expirationQueue
-		if rec.TimeToExpiry() < .1 {
-			mkv.RWMutex.RLock()
-			record, ok := mkv.Records[rec.Key]
-			mkv.RWMutex.RUnlock()
-			if !ok {
-				logger.Error().Str("key", rec.Key).Msg("no record found")
-				continue
-			}
-			if record.TTL == 0 {
-				logger.Warn().Str("key", rec.Key).Msg("not expiring key, overwritten with no TTL")
-				continue
-			}
-
-			logger.Debug().Str("key", rec.Key).Msg("expiring key")
-			mkv.Datastore.Delete(rec.Key)
-			mkv.RWMutex.Lock()
-			delete(mkv.Records, record.Key)
-			mkv.RWMutex.Unlock()
-			continue
+var DefaultConfig = Config{
+	Shards:           64,
+	Expire:           DefaultExpireConfig,
+	Databases:        16,
+	MaxMemoryPolicy:  NoEviction,
+	MaxMemorySamples: 5,
+	LFULogFactor:     10,
+	LFUDecayTime:     1,
+	SaveRules:        DefaultSaveRules,
+	Dir:              ".",
+	DBFilename:       "dump.mukv",
 
-		}
-		go func() {
-			mkv.expirationQueue <- rec
-		}()
+	AppendFilename:           "appendonly.aof",
+	AppendFsync:              FsyncEverySec,
+	AOFLoadTruncated:         true,
+	AutoAOFRewritePercentage: 100,
+	AutoAOFRewriteMinSize:    64 << 20,
+
+	ReplicaReadOnly: true,
+
+	ClusterConfigFile:  "nodes.conf",
+	ClusterAnnounceIP:  "127.0.0.1",
+	ClusterNodeTimeout: 15 * time.Second,
+
+	LuaTimeLimit: 5 * time.Second,
+}
+
+type MuKV struct {
+	Log    zerolog.Logger
+	Config Config
+	// DBs holds a keyspace for each logical database. SWAPDB exchanges
+	// their contents rather than the keyspaces themselves, so a database
+	// index always maps to the same keyspace.
+	DBs []*Keyspace
+	// swapMu serializes SWAPDB.
+	swapMu sync.Mutex
+	// snaps tracks the snapshots of the databases still being written.
+	snaps   *snapshots
+	evictor *evictor
+	saver   *saver
+	aof     *aof
+	repl    *replication
+	dynamo  *dynamo
+	raft    *raft
+	cluster *cluster
+	// order orders writes for the append-only file.
+	order sync.RWMutex
+	// isolation is held shared by every command a client runs, and
+	// exclusively by EXEC and scripts, so that no client sees a
+	// transaction or script half done.
+	isolation sync.RWMutex
+	// multiLogged is set once MULTI has been logged for the transaction or
+	// script holding the isolation lock exclusively.
+	multiLogged bool
+	scripts     *scripting
+	// loading is set while the databases are read back from disk.
+	loading atomic.Bool
+}
+
+func (mkv *MuKV) StartExpireLoop() {
+	for _, ks := range mkv.DBs[1:] {
+		go ks.expiry.RunActive(mkv.Config.Expire)
+		go ks.expiry.Run()
+	}
+	go mkv.DBs[0].expiry.RunActive(mkv.Config.Expire)
+	mkv.DBs[0].expiry.Run()
+}
 
-		<-delayTimer.C
+// ExpiryStats returns the number of keys waiting to expire and the number
+// expired so far, across all databases.
+func (mkv *MuKV) ExpiryStats() ExpiryStats {
+	var stats ExpiryStats
+	for _, ks := range mkv.DBs {
+		s := ks.expiry.Stats()
+		stats.Pending += s.Pending
+		stats.Expired += s.Expired
 	}
+	return stats
 }
 
 func New(logger zerolog.Logger) *MuKV {
-	expirationQueue := make(chan Record)
-	records := make(map[string]*Record)
-
-	return &MuKV{
-		RWMutex:         sync.RWMutex{},
-		Datastore:       sync.Map{},
-		expirationQueue: expirationQueue,
-		Records:         records,
-		Log:             logger,
+	return NewWithConfig(logger, DefaultConfig)
+}
+
+func NewWithConfig(logger zerolog.Logger, cfg Config) *MuKV {
+	cfg.Expire = cfg.Expire.withDefaults()
+	mkv := &MuKV{
+		Log:    logger,
+		Config: cfg,
+		DBs:    make([]*Keyspace, max(cfg.Databases, 1)),
+	}
+	seed := maphash.MakeSeed()
+	mkv.snaps = &snapshots{}
+	for i := range mkv.DBs {
+		mkv.DBs[i] = newKeyspace(logger, cfg.Shards, seed)
+		mkv.DBs[i].db = i
+		mkv.DBs[i].snaps = mkv.snaps
+	}
+	mkv.evictor = newEvictor(mkv.DBs, cfg)
+	mkv.saver = newSaver(cfg)
+	mkv.aof = newAOF(cfg)
+	mkv.repl = newReplication(cfg)
+	mkv.scripts = newScripting(mkv, cfg)
+	if cfg.Dynamo != nil {
+		mkv.dynamo = newDynamo(mkv, cfg.Dynamo)
+	}
+	if cfg.Raft != nil {
+		mkv.raft = newRaft(mkv, cfg.Raft)
+	}
+	if cfg.ClusterEnabled {
+		mkv.cluster = newCluster(logger, cfg)
+		mkv.DBs[0].slots = &slotIndex{}
 	}
+	for i, ks := range mkv.DBs {
+		ks.evictor = mkv.evictor
+		ks.changes = &mkv.saver.dirty
+		ks.onDrop = func(key string) { mkv.propagateDrop(i, key) }
+		ks.lockOrder = mkv.lockOrder
+		if mkv.raft != nil {
+			ks.logExpiry = func(key string, deadline time.Time) { mkv.raft.expire(i, key, deadline) }
+		}
+	}
+	return mkv
+}
+
+// newRecord returns a record holding value, created now and without a TTL.
+func newRecord(value any) *Record {
+	return &Record{Value: value, Created: time.Now()}
 }
 
 type Record struct {
 	Key     string
+	Value   any
 	Created time.Time
 	TTL     time.Duration
-	Hits    int
+	Hits    atomic.Int64
+	// Accessed is the Unix time in nanoseconds at which the key was last
+	// read or written.
+	Accessed atomic.Int64
+	// Version is the version of the value in dynamo mode, and nil
+	// otherwise.
+	Version *Version
+	seq     uint64
+	// size is the estimated memory held by the record, as last accounted
+	// for by the keyspace.
+	size int64
+	// snapGen is the generation of the latest snapshot that has captured
+	// the record, or that was taken before the record was stored.
+	snapGen uint64
+	// sharedGen is the generation of the latest snapshot to capture the
+	// record's value as is. The value must be copied before it is modified
+	// for as long as that snapshot may still be written.
+	sharedGen uint64
+}
+
+// clone returns a record holding value with the TTL and metadata of r, for
+// commands that move or copy keys. Each key needs a record of its own, since
+// the keyspace keeps per-key state in it.
+func (r *Record) clone(value any) *Record {
+	rec := &Record{Value: value, Created: r.Created, TTL: r.TTL, Version: r.Version}
+	rec.Hits.Store(r.Hits.Load())
+	rec.Accessed.Store(r.Accessed.Load())
+	return rec
+}
+
+// IdleTime returns how long it has been since the key was last used.
+func (r *Record) IdleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - r.Accessed.Load())
 }
 
 func (r *Record) Age() time.Duration {
 	return time.Since(r.Created)
 }
 
+// Deadline returns the time at which the record expires, or the zero time
+// if it has no TTL.
+func (r *Record) Deadline() time.Time {
+	if r.TTL == 0 {
+		return time.Time{}
+	}
+	return r.Created.Add(r.TTL)
+}
+
+// SetDeadline sets the record's TTL so that it expires at t. The zero time
+// clears the TTL.
+func (r *Record) SetDeadline(t time.Time) {
+	if t.IsZero() {
+		r.TTL = 0
+		return
+	}
+	r.TTL = t.Sub(r.Created)
+}
+
 func (r *Record) Expired() bool {
-	return r.Age() >= r.TTL
+	return r.TTL > 0 && r.Age() >= r.TTL
 }
 
 func (r *Record) TimeToExpiry() float64 {
@@ -115,5 +297,5 @@ func (r *Record) TimeToExpiry() float64 {
 }
 
 func (r *Record) Touch() {
-	r.Hits = 0
+	r.Hits.Store(0)
 }
@@ -0,0 +1,76 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/redcon"
+)
+
+// testClient sends commands to a server running in the test, keeping its
+// connection state across them as a client's would be.
+type testClient struct {
+	mkv  *MuKV
+	conn *bufferConn
+}
+
+func newTestClient(mkv *MuKV) *testClient {
+	return &testClient{mkv: mkv, conn: &bufferConn{ctx: &client{}}}
+}
+
+// do runs a command and returns its reply, parsed as a Transport returns
+// it.
+func (c *testClient) do(args ...string) (any, error) {
+	cmd := redcon.Command{Args: make([][]byte, len(args))}
+	for i, arg := range args {
+		cmd.Args[i] = []byte(arg)
+	}
+	c.conn.buf = c.conn.buf[:0]
+	c.mkv.Handler(c.conn, cmd)
+	return readReply(bufio.NewReader(bytes.NewReader(c.conn.buf)))
+}
+
+// must runs a command that must succeed and returns its reply.
+func (c *testClient) must(t testing.TB, args ...string) any {
+	t.Helper()
+	reply, err := c.do(args...)
+	if err != nil {
+		t.Fatalf("%q: %v", args, err)
+	}
+	return reply
+}
+
+// bulk runs a command that must reply with a bulk string, or null, and
+// returns it.
+func (c *testClient) bulk(t testing.TB, args ...string) string {
+	t.Helper()
+	switch reply := c.must(t, args...).(type) {
+	case []byte:
+		return string(reply)
+	case nil:
+		return ""
+	default:
+		t.Fatalf("%q: got %#v, want a bulk string", args, reply)
+		return ""
+	}
+}
+
+func newTestServer(cfg Config) *MuKV {
+	return NewWithConfig(zerolog.Nop(), cfg)
+}
+
+// eventually waits for cond to hold, failing the test if it does not within
+// a few seconds.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,314 @@
+package mukv
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/redcon"
+)
+
+// transaction holds the commands a client has queued since MULTI.
+type transaction struct {
+	cmds []redcon.Command
+	// failed is set once a command could not be queued, which makes EXEC
+	// discard the transaction.
+	failed bool
+	// slot is the hash slot of the keys queued so far in cluster mode, or
+	// -1 if none have been.
+	slot int
+}
+
+// watchedKey is a key a client watches with WATCH, in the keyspace of the
+// database it was watched in.
+type watchedKey struct {
+	ks  *Keyspace
+	key string
+}
+
+// watchers tracks the clients watching the keys of a keyspace.
+type watchers struct {
+	mu sync.Mutex
+	// keys maps each watched key to its watchers, each with whether the
+	// key was live when it was watched.
+	keys map[string]map[*client]bool
+	// n is the number of watched keys, so that writes can skip the mutex
+	// while none are watched.
+	n atomic.Int64
+}
+
+// add registers c as watching key, reporting false if it already was.
+func (w *watchers) add(key string, c *client, live bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys == nil {
+		w.keys = make(map[string]map[*client]bool)
+	}
+	clients := w.keys[key]
+	if clients == nil {
+		clients = make(map[*client]bool)
+		w.keys[key] = clients
+		w.n.Add(1)
+	}
+	if _, ok := clients[c]; ok {
+		return false
+	}
+	clients[c] = live
+	return true
+}
+
+func (w *watchers) remove(key string, c *client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	clients := w.keys[key]
+	delete(clients, c)
+	if len(clients) == 0 && clients != nil {
+		delete(w.keys, key)
+		w.n.Add(-1)
+	}
+}
+
+// wasLive reports whether key was live when c watched it.
+func (w *watchers) wasLive(key string, c *client) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.keys[key][c]
+}
+
+// touch marks the clients watching key as dirty. removed is set when the
+// key is being removed, which does not concern the clients that watched it
+// while it was not live: the key may have expired without being removed
+// yet.
+func (w *watchers) touch(key string, removed bool) {
+	if w.n.Load() == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for c, live := range w.keys[key] {
+		if live || !removed {
+			c.dirty.Store(true)
+		}
+	}
+}
+
+// touchAll is touch for every watched key.
+func (w *watchers) touchAll(removed bool) {
+	if w.n.Load() == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, clients := range w.keys {
+		for c, live := range clients {
+			if live || !removed {
+				c.dirty.Store(true)
+			}
+		}
+	}
+}
+
+// watch registers c as watching key, reporting false if it already was.
+// The shard stays locked while the key's state is noted, so no write can
+// slip in between.
+func (ks *Keyspace) watch(key string, c *client) bool {
+	sh := ks.shardFor(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	rec := sh.records[key]
+	return ks.watchers.add(key, c, rec != nil && !ks.expired(rec))
+}
+
+// watchFailed reports whether a key the client watches has been modified
+// since it was watched, which includes having expired since.
+func (cl *client) watchFailed() bool {
+	if cl.dirty.Load() {
+		return true
+	}
+	for _, w := range cl.watched {
+		if !w.ks.watchers.wasLive(w.key, cl) {
+			continue
+		}
+		live := false
+		w.ks.Peek(w.key, func(rec *Record) {
+			live = rec != nil
+		})
+		if !live {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatch forgets every key the client watches.
+func (cl *client) unwatch() {
+	for _, w := range cl.watched {
+		w.ks.watchers.remove(w.key, cl)
+	}
+	cl.watched = nil
+	cl.dirty.Store(false)
+}
+
+// queue queues cmd in the transaction the client has begun, if any, and
+// reports whether it did. A command that could never run is refused rather
+// than queued, and fails the transaction.
+func (mkv *MuKV) queue(conn redcon.Conn, name string, cmd redcon.Command) bool {
+	cl := clientFor(conn)
+	t := cl.multi
+	if t == nil {
+		return false
+	}
+	switch name {
+	case "exec", "discard", "multi", "watch", "quit":
+		return false
+	}
+
+	arity, ok := commandArity[name]
+	switch {
+	case !ok:
+		mkv.handleUnknown(conn, cmd.Args[0])
+		t.failed = true
+		return true
+	case arity >= 0 && len(cmd.Args) != arity || arity < 0 && len(cmd.Args) < -arity:
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		t.failed = true
+		return true
+	}
+	if commandFlags[name]&flagWrite != 0 && !cl.leader && mkv.repl.readOnly() {
+		conn.WriteError("READONLY You can't write against a read only replica.")
+		t.failed = true
+		return true
+	}
+	// The node serving the transaction's slot runs it whole, so its keys
+	// must all be in one slot.
+	if mkv.cluster != nil && !mkv.loading.Load() {
+		if keys := keysOf(name, cmd.Args); len(keys) > 0 {
+			slot := keyHashSlot(keys[0])
+			if t.slot >= 0 && t.slot != slot {
+				conn.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+				t.failed = true
+				return true
+			}
+			t.slot = slot
+		}
+	}
+
+	// The arguments are run at EXEC, so they must outlive the connection's
+	// buffer.
+	args := make([][]byte, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = bytes.Clone(arg)
+	}
+	t.cmds = append(t.cmds, redcon.Command{Args: args})
+	conn.WriteString("QUEUED")
+	return true
+}
+
+func (mkv *MuKV) handleMulti(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cl := clientFor(conn)
+	if cl.multi != nil {
+		conn.WriteError("ERR MULTI calls can not be nested")
+		return
+	}
+	cl.multi = &transaction{slot: -1}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleDiscard(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cl := clientFor(conn)
+	if cl.multi == nil {
+		conn.WriteError("ERR DISCARD without MULTI")
+		return
+	}
+	cl.multi = nil
+	cl.unwatch()
+	conn.WriteString("OK")
+}
+
+// handleExec serves EXEC, which runs the queued commands one after another
+// with every other client shut out, replying with an array of their
+// replies. It runs nothing if a watched key has been modified.
+func (mkv *MuKV) handleExec(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cl := clientFor(conn)
+	t := cl.multi
+	if t == nil {
+		conn.WriteError("ERR EXEC without MULTI")
+		return
+	}
+	cl.multi = nil
+	defer cl.unwatch()
+	if t.failed {
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+	if cl.watchFailed() {
+		writeNullArray(conn)
+		return
+	}
+
+	// Writes are logged between MULTI and EXEC, so that replicas and the
+	// append-only file apply the transaction whole too.
+	opened := false
+	cl.noBlock = true
+	conn.WriteArray(len(t.cmds))
+	for _, c := range t.cmds {
+		name := strings.ToLower(string(c.Args[0]))
+		if !opened && commandFlags[name]&flagWrite != 0 {
+			opened = mkv.openMulti(cl.db)
+		}
+		mkv.callQueued(conn, name, c)
+	}
+	cl.noBlock = false
+	if opened {
+		mkv.closeMulti(cl.db)
+	}
+	mkv.serveBlockedAfter()
+}
+
+func (mkv *MuKV) handleWatch(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cl := clientFor(conn)
+	if cl.multi != nil {
+		conn.WriteError("ERR WATCH inside MULTI is not allowed")
+		return
+	}
+	ks := mkv.db(conn)
+	for _, key := range cmd.Args[1:] {
+		if ks.watch(string(key), cl) {
+			cl.watched = append(cl.watched, watchedKey{ks: ks, key: string(key)})
+		}
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleUnwatch(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	clientFor(conn).unwatch()
+	conn.WriteString("OK")
+}
@@ -0,0 +1,101 @@
+package mukv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// watchAndExec watches key from one client, runs write from another and
+// reports whether the watching client's transaction still ran.
+func watchAndExec(t *testing.T, write []string) bool {
+	t.Helper()
+	mkv := newTestServer(DefaultConfig)
+	watcher, other := newTestClient(mkv), newTestClient(mkv)
+	other.must(t, "SET", "k", "v")
+	other.must(t, "HSET", "h", "f", "v")
+	other.must(t, "RPUSH", "l", "a")
+
+	watcher.must(t, "WATCH", "k", "h", "l")
+	other.do(write...)
+	watcher.must(t, "MULTI")
+	watcher.must(t, "SET", "k", "tx")
+	return watcher.must(t, "EXEC") != nil
+}
+
+func TestWatchIgnoresNoOpWrites(t *testing.T) {
+	for _, write := range [][]string{
+		{"SET", "k", "x", "NX"},
+		{"INCR", "k"},
+		{"EXPIRE", "k", "10", "XX"},
+		{"PERSIST", "k"},
+		{"GETEX", "k"},
+		{"RENAME", "k", "k"},
+		{"HDEL", "k", "f"},
+		{"HDEL", "h", "missing"},
+		{"LPOP", "l", "0"},
+		{"LREM", "l", "0", "missing"},
+		{"SREM", "k", "m"},
+		{"ZADD", "k", "1", "m"},
+	} {
+		t.Run(fmt.Sprint(write), func(t *testing.T) {
+			if !watchAndExec(t, write) {
+				t.Errorf("%q aborted the transaction watching the key", write)
+			}
+		})
+	}
+}
+
+func TestWatchAbortsOnWrite(t *testing.T) {
+	for _, write := range [][]string{
+		{"SET", "k", "x"},
+		{"EXPIRE", "k", "10"},
+		{"HDEL", "h", "f"},
+		{"LPOP", "l"},
+		{"DEL", "k"},
+	} {
+		t.Run(fmt.Sprint(write), func(t *testing.T) {
+			if watchAndExec(t, write) {
+				t.Errorf("%q left the transaction watching the key to run", write)
+			}
+		})
+	}
+}
+
+// blockedPop blocks a client on BLPOP q, returning a channel that receives
+// its reply once it is served.
+func blockedPop(t *testing.T, mkv *MuKV) <-chan any {
+	t.Helper()
+	served := make(chan any, 1)
+	go func() {
+		reply, _ := newTestClient(mkv).do("BLPOP", "q", "0")
+		served <- reply
+	}()
+	blocked := &mkv.DBs[0].blocked.blocked
+	eventually(t, "BLPOP to block", func() bool { return blocked.Load() == 1 })
+	return served
+}
+
+func TestExecServesBlockedClientsOnce(t *testing.T) {
+	mkv := newTestServer(DefaultConfig)
+	served := blockedPop(t, mkv)
+
+	c := newTestClient(mkv)
+	c.must(t, "MULTI")
+	c.must(t, "RPUSH", "q", "x")
+	c.must(t, "DEL", "q")
+	reply := c.must(t, "EXEC")
+	if fmt.Sprint(reply) != "[1 1]" {
+		t.Fatalf("EXEC: got %#v, want [1 1]", reply)
+	}
+	select {
+	case reply := <-served:
+		t.Fatalf("BLPOP was served %#v by a list the transaction deleted", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.must(t, "RPUSH", "q", "y")
+	if reply := <-served; fmt.Sprintf("%s", reply) != "[q y]" {
+		t.Fatalf("BLPOP: got %#v, want [q y]", reply)
+	}
+}
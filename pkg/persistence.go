@@ -0,0 +1,379 @@
+package mukv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// SaveRule triggers a background save once at least Changes writes have been
+// made and Seconds have passed since the last successful save.
+type SaveRule struct {
+	Seconds int
+	Changes int64
+}
+
+// DefaultSaveRules are the rules Redis saves with by default.
+var DefaultSaveRules = []SaveRule{{3600, 1}, {300, 100}, {60, 10000}}
+
+// ParseSaveRules parses save rules written as pairs of seconds and changes,
+// such as "3600 1 300 100". An empty string means no rules.
+func ParseSaveRules(s string) ([]SaveRule, bool) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, false
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, false
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, false
+		}
+		rules = append(rules, SaveRule{seconds, changes})
+	}
+	return rules, true
+}
+
+func formatSaveRules(rules []SaveRule) string {
+	fields := make([]string, 0, 2*len(rules))
+	for _, rule := range rules {
+		fields = append(fields, strconv.Itoa(rule.Seconds), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// saveRetryDelay is how long a save triggered by the save rules waits after
+// a failed save before trying again.
+const saveRetryDelay = 5 * time.Second
+
+// saver writes snapshots of the keyspace to disk. Its settings can be
+// changed at runtime.
+type saver struct {
+	// The mutex guards the settings and lastTry.
+	mu       sync.Mutex
+	rules    []SaveRule
+	dir      string
+	filename string
+	lastTry  time.Time
+
+	// dirty counts the writes made since the last successful save.
+	dirty atomic.Int64
+	// saving is set while a save is being written, by SAVE or in the
+	// background.
+	saving atomic.Bool
+	// scheduled is set when BGSAVE SCHEDULE asks for a save while another
+	// is in progress.
+	scheduled atomic.Bool
+	// lastSave is the Unix time of the last successful save.
+	lastSave   atomic.Int64
+	lastFailed atomic.Bool
+	// lastDuration is how long the last background save took.
+	lastDuration atomic.Int64
+	saves        atomic.Int64
+}
+
+func newSaver(cfg Config) *saver {
+	s := &saver{rules: cfg.SaveRules, dir: cfg.Dir, filename: cfg.DBFilename}
+	s.lastSave.Store(time.Now().Unix())
+	s.lastDuration.Store(-1)
+	return s
+}
+
+// path returns the path snapshots are saved to and loaded from.
+func (s *saver) path() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return filepath.Join(s.dir, s.filename)
+}
+
+// write saves snap to path atomically: it is written to a temporary file
+// that replaces the snapshot only once complete and synced.
+func (s *saver) write(snap *snapshot, path string) error {
+	f, err := createTemp(filepath.Dir(path), "temp-*.mukv")
+	if err != nil {
+		snap.release()
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := snap.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// createTemp creates a temporary file in dir to be renamed over a file the
+// server persists to.
+func createTemp(dir, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp makes the file private, but the files it replaces are not.
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncDir syncs the directory dir so that a rename into it survives a crash.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// finish records the outcome of saving snap.
+func (s *saver) finish(snap *snapshot, err error) {
+	s.mu.Lock()
+	s.lastTry = time.Now()
+	s.mu.Unlock()
+	if err != nil {
+		s.lastFailed.Store(true)
+		return
+	}
+	s.dirty.Add(-snap.dirty)
+	s.lastSave.Store(time.Now().Unix())
+	s.lastFailed.Store(false)
+	s.saves.Add(1)
+}
+
+// due reports whether a save rule calls for a save at now.
+func (s *saver) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastFailed.Load() && now.Sub(s.lastTry) < saveRetryDelay {
+		return false
+	}
+	dirty := s.dirty.Load()
+	elapsed := now.Unix() - s.lastSave.Load()
+	for _, rule := range s.rules {
+		if dirty >= rule.Changes && dirty > 0 && elapsed >= int64(rule.Seconds) {
+			return true
+		}
+	}
+	return false
+}
+
+// Save writes a snapshot of every database to disk, returning once it has
+// been written.
+func (mkv *MuKV) Save() error {
+	if !mkv.saver.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	defer mkv.saver.saving.Store(false)
+
+	snap := mkv.snapshot()
+	err := mkv.saver.write(snap, mkv.saver.path())
+	mkv.saver.finish(snap, err)
+	return err
+}
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+// bgsave takes a snapshot of every database and writes it to disk in the
+// background, reporting false if a save is already in progress.
+func (mkv *MuKV) bgsave() bool {
+	logger := mkv.Log.With().Str("function", "bgsave").Logger()
+
+	if !mkv.saver.saving.CompareAndSwap(false, true) {
+		return false
+	}
+	mkv.saver.scheduled.Store(false)
+	snap := mkv.snapshot()
+	path := mkv.saver.path()
+	go func() {
+		defer mkv.saver.saving.Store(false)
+		start := time.Now()
+		err := mkv.saver.write(snap, path)
+		mkv.saver.lastDuration.Store(int64(time.Since(start).Seconds()))
+		mkv.saver.finish(snap, err)
+		if err != nil {
+			logger.Error().Err(err).Str("path", path).Msg("background save failed")
+			return
+		}
+		logger.Info().Str("path", path).Msg("background save done")
+	}()
+	return true
+}
+
+// StartSaveLoop runs background saves as the save rules, or BGSAVE
+// SCHEDULE, call for them.
+func (mkv *MuKV) StartSaveLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if mkv.saver.saving.Load() {
+			continue
+		}
+		if mkv.saver.scheduled.Load() || mkv.saver.due(now) {
+			mkv.bgsave()
+		}
+	}
+}
+
+// Load loads the databases from disk at startup: from the append-only file
+// if logging is on, and otherwise from the snapshot, if there is one. With
+// logging on but no append-only file yet, the file is created from the
+// snapshot. In raft mode they are loaded from the raft snapshot and log.
+func (mkv *MuKV) Load() error {
+	mkv.setLoading(true)
+	defer mkv.setLoading(false)
+	// Loading makes no changes that are not already on disk.
+	defer mkv.saver.dirty.Store(0)
+
+	// In raft mode the databases are rebuilt from the raft snapshot and
+	// log, which supersede the other files.
+	if mkv.raft != nil {
+		if err := mkv.raft.load(); err != nil {
+			return err
+		}
+		if mkv.aof.enabled.Load() {
+			return mkv.rewriteAOF()
+		}
+		return nil
+	}
+	if !mkv.aof.enabled.Load() {
+		return mkv.loadSnapshot()
+	}
+	found, err := mkv.replayAOF()
+	if err != nil {
+		return err
+	}
+	if found {
+		return mkv.aof.open()
+	}
+	if err := mkv.loadSnapshot(); err != nil {
+		return err
+	}
+	return mkv.rewriteAOF()
+}
+
+// loadSnapshot loads the snapshot saved on disk, if there is one. Keys that
+// have expired since it was saved are dropped.
+func (mkv *MuKV) loadSnapshot() error {
+	logger := mkv.Log.With().Str("function", "loadSnapshot").Logger()
+
+	path := mkv.saver.path()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	keys, err := mkv.restore(f, start)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", path, err)
+	}
+	logger.Info().Str("path", path).Int("keys", keys).Dur("took", time.Since(start)).Msg("snapshot loaded")
+	return nil
+}
+
+// restore stores the keys of the snapshot read from r, skipping those that
+// expired before now, and returns how many it stored.
+func (mkv *MuKV) restore(r io.Reader, now time.Time) (int, error) {
+	keys := 0
+	err := readSnapshot(r, now, func(db int, e snapshotEntry) error {
+		keys++
+		return mkv.storeEntry(db, e)
+	})
+	return keys, err
+}
+
+// storeEntry stores a key read back from disk in database db, along with
+// its metadata.
+func (mkv *MuKV) storeEntry(db int, e snapshotEntry) error {
+	if db >= len(mkv.DBs) {
+		return fmt.Errorf("file holds database %d, but only %d are configured", db, len(mkv.DBs))
+	}
+	rec := newRecord(e.value)
+	rec.SetDeadline(e.expireAt)
+	rec.Version = e.version
+	mkv.DBs[db].Update(e.key, func(*Record) *Record { return rec })
+	// Storing the record counts as an access, so restore its metadata
+	// afterwards.
+	rec.Hits.Store(e.hits)
+	rec.Accessed.Store(e.accessed)
+	return nil
+}
+
+func (mkv *MuKV) handleSave(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	if err := mkv.Save(); err != nil {
+		if !errors.Is(err, errSaveInProgress) {
+			mkv.Log.Error().Err(err).Msg("save failed")
+		}
+		conn.WriteError("ERR " + err.Error())
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleBGSave(conn redcon.Conn, cmd redcon.Command) {
+	schedule := false
+	switch {
+	case len(cmd.Args) == 2 && strings.EqualFold(string(cmd.Args[1]), "schedule"):
+		schedule = true
+	case len(cmd.Args) != 1:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+
+	if mkv.bgsave() {
+		conn.WriteString("Background saving started")
+		return
+	}
+	if schedule {
+		mkv.saver.scheduled.Store(true)
+		conn.WriteString("Background saving scheduled")
+		return
+	}
+	conn.WriteError("ERR " + errSaveInProgress.Error())
+}
+
+func (mkv *MuKV) handleLastSave(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	conn.WriteInt64(mkv.saver.lastSave.Load())
+}
@@ -0,0 +1,26 @@
+package mukv
+
+import "testing"
+
+func TestDirtyCountsOnlyWrites(t *testing.T) {
+	mkv := newTestServer(DefaultConfig)
+	c := newTestClient(mkv)
+	for _, step := range []struct {
+		args  []string
+		dirty int64
+	}{
+		{[]string{"SET", "k", "v"}, 1},
+		{[]string{"SET", "k", "w", "NX"}, 1},
+		{[]string{"LPUSH", "k", "x"}, 1},
+		{[]string{"DEL", "missing"}, 1},
+		{[]string{"EXPIRE", "missing", "100"}, 1},
+		{[]string{"MSET", "a", "1", "b", "2"}, 3},
+		{[]string{"DEL", "k", "a"}, 5},
+		{[]string{"FLUSHDB"}, 6},
+	} {
+		c.do(step.args...)
+		if got := mkv.saver.dirty.Load(); got != step.dirty {
+			t.Fatalf("after %q: %d changes, want %d", step.args, got, step.dirty)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package mukv
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Writes are propagated to the append-only file and to replicas as the
+// commands that made them, so they must be logged in the order they were
+// applied. Commands that write hold mkv.order while they run and are logged:
+// shared while nothing is logged, so that writes to different shards still
+// run in parallel, and exclusively otherwise. Turning logging on or off takes
+// the lock exclusively, so every command sees the same setting from start to
+// finish.
+//
+// Keys dropped by the server itself, on expiry or eviction, are logged as
+// DEL holding both the write order lock and their shard's lock. The order
+// lock keeps the DEL from landing before the command that last wrote the
+// key, which is logged only once it has let go of the shard, and the
+// shard's lock orders it before any later command on the key.
+
+// logging reports whether writes are logged, to the append-only file or to
+// replicas.
+func (mkv *MuKV) logging() bool {
+	return mkv.aof.enabled.Load() || mkv.repl.streaming.Load()
+}
+
+// lockOrder takes the write order lock for a command that writes, returning
+// the lock it holds.
+func (mkv *MuKV) lockOrder() sync.Locker {
+	for {
+		if mkv.logging() {
+			mkv.order.Lock()
+			if mkv.logging() {
+				return &mkv.order
+			}
+			mkv.order.Unlock()
+			continue
+		}
+		shared := mkv.order.RLocker()
+		shared.Lock()
+		if !mkv.logging() {
+			return shared
+		}
+		shared.Unlock()
+	}
+}
+
+// feed logs args, run in database db, to the append-only file and streams
+// it to replicas.
+func (mkv *MuKV) feed(db int, args [][]byte) {
+	mkv.aof.append(db, args)
+	mkv.repl.append(db, args)
+}
+
+// propagate logs args in place of the command the client is running, for
+// commands that would not have the same effect if replayed as written: ones
+// that pick elements at random, take times relative to now, or block.
+// Calling it more than once logs each of args in turn.
+func (mkv *MuKV) propagate(conn redcon.Conn, args ...[]byte) {
+	cl := clientFor(conn)
+	cl.propagated = true
+	mkv.feed(cl.db, args)
+}
+
+// openMulti logs MULTI ahead of the writes of a transaction or script,
+// which runs holding the isolation lock exclusively, unless one already is.
+// It reports whether it did, in which case closeMulti must log EXEC once
+// the writes are done.
+func (mkv *MuKV) openMulti(db int) bool {
+	if mkv.multiLogged {
+		return false
+	}
+	mkv.multiLogged = true
+	mkv.feed(db, [][]byte{[]byte("MULTI")})
+	return true
+}
+
+func (mkv *MuKV) closeMulti(db int) {
+	mkv.multiLogged = false
+	mkv.feed(db, [][]byte{[]byte("EXEC")})
+	mkv.aof.flush()
+}
+
+// propagateDrop logs the removal of key from database db by the server
+// rather than by a command.
+func (mkv *MuKV) propagateDrop(db int, key string) {
+	mkv.feed(db, [][]byte{[]byte("DEL"), []byte(key)})
+}
+
+// serveBlocked serves the clients blocked on keys that the command just run
+// made ready. It runs after the command has been logged, so that the pops it
+// serves are logged after the push that made them possible.
+func (mkv *MuKV) serveBlocked() {
+	for _, ks := range mkv.DBs {
+		ks.blocked.serveReady()
+	}
+}
+
+// serveBlockedAfter serves the clients blocked on keys made ready by a
+// transaction or script, once it is done and its writes are logged. It takes
+// the write order lock as a command does, so that the pops it serves are
+// logged before any later write.
+func (mkv *MuKV) serveBlockedAfter() {
+	if !slices.ContainsFunc(mkv.DBs, func(ks *Keyspace) bool { return ks.blocked.hasReady() }) {
+		return
+	}
+	order := mkv.lockOrder()
+	mkv.serveBlocked()
+	order.Unlock()
+	mkv.aof.flush()
+}
+
+// setLoading marks the databases as loading, during which keys do not
+// expire: a key read back from disk may have expired since it was written,
+// yet the commands logged after it were run while it was still live.
+func (mkv *MuKV) setLoading(loading bool) {
+	mkv.loading.Store(loading)
+	for _, ks := range mkv.DBs {
+		ks.loading.Store(loading)
+	}
+}
+
+// pxatArg formats a deadline as the Unix time in milliseconds that PXAT and
+// PEXPIREAT take.
+func pxatArg(deadline time.Time) []byte {
+	return []byte(strconv.FormatInt(deadline.UnixMilli(), 10))
+}
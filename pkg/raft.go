@@ -0,0 +1,1339 @@
+package mukv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/redcon"
+)
+
+// In raft mode a group of nodes replicates the commands that write through
+// a log kept consistent by the Raft consensus algorithm, so that a write
+// acknowledged to a client survives the loss of any minority of the nodes.
+// The elected leader appends each write to its log and replicates it, and
+// once a majority of the members hold it the write is committed: every node
+// runs it, in log order, and the leader replies with its result. Followers
+// proxy the writes sent to them to the leader, or refuse them naming the
+// leader. Reads are served from the node's own databases, so on a follower
+// they may lag behind the leader.
+//
+// Commands are logged in a form that has the same effect wherever and
+// whenever it runs: expire times relative to now are logged as deadlines,
+// and commands that pick at random or block are refused. Keys do not expire
+// by each node's own clock either: once a key expires, the leader logs its
+// removal, and until that runs the key is hidden from reads but still seen
+// by the commands that write it, on every node alike.
+//
+// Once enough entries have run, a node compacts them into a snapshot of its
+// databases, which the leader sends in their place to a follower that needs
+// them. Members are added and removed one at a time with RAFT ADD and RAFT
+// REMOVE, each change taking effect on a node as soon as it appends the
+// entry holding it, as Ongaro's dissertation describes.
+
+// RaftConfig configures raft mode.
+type RaftConfig struct {
+	// ID is the ID of this node, which the other nodes reach it by.
+	ID string
+	// Peers lists the IDs of the nodes the group starts with, this one
+	// included. A node joining a running group is started with none, and
+	// waits to be added with RAFT ADD.
+	Peers []string
+	// Dir is the directory the node keeps its term, log and snapshot in. If
+	// empty, nothing is kept, and a restarted node must not rejoin its group
+	// under the same ID.
+	Dir string
+	// ElectionTimeout is how long a follower goes without hearing from a
+	// leader before standing for election, lengthened by up to as much again
+	// at random. Zero means one second.
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often the leader contacts a follower it has
+	// nothing to send. Zero means a tenth of ElectionTimeout.
+	HeartbeatInterval time.Duration
+	// SnapshotEntries is the number of entries run after which the log is
+	// compacted into a snapshot. Zero means 10000.
+	SnapshotEntries int
+	// RedirectWrites refuses writes sent to a follower with a NOTLEADER
+	// error naming the leader, rather than proxying them to it.
+	RedirectWrites bool
+	// Transport carries requests between nodes. If nil, nodes are reached
+	// over TCP, with their IDs as addresses.
+	Transport Transport
+}
+
+// Validate reports whether the configuration describes a usable node.
+func (c *RaftConfig) Validate() error {
+	if c.ID == "" {
+		return errors.New("the node needs an ID")
+	}
+	if len(c.Peers) > 0 && !slices.Contains(c.Peers, c.ID) {
+		return fmt.Errorf("node %q is not one of the group's peers", c.ID)
+	}
+	return nil
+}
+
+const (
+	// raftElectionTimeout is the default for RaftConfig.ElectionTimeout.
+	raftElectionTimeout = time.Second
+	// raftSnapshotEntries is the default for RaftConfig.SnapshotEntries.
+	raftSnapshotEntries = 10000
+	// raftCommitTimeout bounds how long a write waits to be committed.
+	raftCommitTimeout = 10 * time.Second
+	// raftMaxAppend is the most entries sent to a follower at once.
+	raftMaxAppend = 512
+)
+
+var (
+	errNoLeader   = errors.New("TRYAGAIN No raft leader has been elected")
+	errLeaderLost = errors.New("TRYAGAIN Leadership changed before the write was committed")
+	errNotRaft    = errors.New("ERR raft mode is not enabled")
+	// errOutcomeUnknown is returned for a write that may or may not have
+	// been committed.
+	errOutcomeUnknown = errors.New("TIMEOUT The write was not committed in time, and may still be")
+)
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (role raftRole) String() string {
+	switch role {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// raftResult is the outcome of an entry proposed by the leader: the reply to
+// its command, or why it was not committed.
+type raftResult struct {
+	reply []byte
+	err   error
+}
+
+// raftWaiter waits for the result of an entry proposed in term.
+type raftWaiter struct {
+	term uint64
+	done chan raftResult
+}
+
+type raft struct {
+	mkv       *MuKV
+	self      string
+	cfg       RaftConfig
+	transport Transport
+	storage   raftStorage
+	logger    zerolog.Logger
+
+	// applyMu is held while committed entries or a snapshot are applied to
+	// the databases. It is taken before mu.
+	applyMu sync.Mutex
+	// wake tells the applier that entries were committed.
+	wake chan struct{}
+	// compacting is set while a snapshot of the databases is written to
+	// compact the log.
+	compacting atomic.Bool
+
+	mu       sync.Mutex
+	role     raftRole
+	term     uint64
+	votedFor string
+	leader   string
+	// heard is when the node last heard from the leader of its term.
+	heard time.Time
+	// deadline is when the node stands for election unless it hears from a
+	// leader first.
+	deadline time.Time
+
+	// The log holds the entries from index first on. Those before were
+	// compacted into snapshot, the databases as of entry first-1, which
+	// was of term snapTerm and had members snapMembers.
+	first       uint64
+	entries     []raftEntry
+	snapTerm    uint64
+	snapMembers []string
+	snapshot    []byte
+
+	// members are the members as of the last config entry in the log, at
+	// index configIndex, or of the snapshot.
+	members     []string
+	configIndex uint64
+	commitIndex uint64
+	lastApplied uint64
+
+	// next and match hold, as leader, the index of the next entry to send
+	// each follower and of the last entry known to match the leader's.
+	next, match map[string]uint64
+	// replicating holds the channel that wakes the goroutine replicating to
+	// each follower.
+	replicating map[string]chan struct{}
+	// waiters holds the waiters for entries proposed by this node, by
+	// index.
+	waiters map[uint64]raftWaiter
+}
+
+func newRaft(mkv *MuKV, cfg *RaftConfig) *raft {
+	r := &raft{
+		mkv:         mkv,
+		self:        cfg.ID,
+		cfg:         *cfg,
+		transport:   cfg.Transport,
+		storage:     raftStorage{dir: cfg.Dir},
+		logger:      mkv.Log.With().Str("raft", cfg.ID).Logger(),
+		wake:        make(chan struct{}, 1),
+		first:       1,
+		snapMembers: slices.Clone(cfg.Peers),
+		members:     slices.Clone(cfg.Peers),
+		waiters:     make(map[uint64]raftWaiter),
+	}
+	if r.cfg.ElectionTimeout == 0 {
+		r.cfg.ElectionTimeout = raftElectionTimeout
+	}
+	if r.cfg.HeartbeatInterval == 0 {
+		r.cfg.HeartbeatInterval = r.cfg.ElectionTimeout / 10
+	}
+	if r.cfg.SnapshotEntries == 0 {
+		r.cfg.SnapshotEntries = raftSnapshotEntries
+	}
+	if r.transport == nil {
+		r.transport = newTCPTransport()
+	}
+	r.resetDeadline()
+	return r
+}
+
+// load restores the node's state, and its databases, from disk.
+func (r *raft) load() error {
+	d, err := r.storage.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.term, r.votedFor = d.term, d.votedFor
+	if d.snapshot != nil {
+		r.first, r.snapTerm, r.snapMembers, r.snapshot = d.snapIndex+1, d.snapTerm, d.members, d.snapshot
+		r.commitIndex, r.lastApplied = d.snapIndex, d.snapIndex
+		if _, err := r.mkv.restore(bytes.NewReader(d.snapshot), time.Time{}); err != nil {
+			return fmt.Errorf("loading %s: %w", raftSnapshotFile, err)
+		}
+	}
+	r.entries = d.entries
+	r.updateMembers()
+	r.logger.Info().Uint64("term", r.term).Uint64("snapshot", r.first-1).Int("entries", len(r.entries)).Msg("raft state loaded")
+	return nil
+}
+
+// lastIndex returns the index of the last entry in the log. r.mu must be
+// held.
+func (r *raft) lastIndex() uint64 {
+	return r.first + uint64(len(r.entries)) - 1
+}
+
+// termAt returns the term of entry i, or 0 if the log no longer or does not
+// yet hold it. r.mu must be held.
+func (r *raft) termAt(i uint64) uint64 {
+	switch {
+	case i == r.first-1:
+		return r.snapTerm
+	case i < r.first || i > r.lastIndex():
+		return 0
+	}
+	return r.entries[i-r.first].term
+}
+
+func membersOf(e raftEntry) []string {
+	members := make([]string, len(e.args))
+	for i, arg := range e.args {
+		members[i] = string(arg)
+	}
+	return members
+}
+
+// membersAt returns the members as of entry i. r.mu must be held.
+func (r *raft) membersAt(i uint64) []string {
+	for ; i >= r.first; i-- {
+		if e := r.entries[i-r.first]; e.kind == entryConfig {
+			return membersOf(e)
+		}
+	}
+	return r.snapMembers
+}
+
+// updateMembers sets the members from the last config entry in the log.
+// r.mu must be held.
+func (r *raft) updateMembers() {
+	r.configIndex = r.first - 1
+	for i := r.lastIndex(); i >= r.first; i-- {
+		if r.entries[i-r.first].kind == entryConfig {
+			r.configIndex = i
+			break
+		}
+	}
+	r.members = r.membersAt(r.configIndex)
+}
+
+// quorum returns the number of members that make a majority. r.mu must be
+// held.
+func (r *raft) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+// resetDeadline puts off standing for election. r.mu must be held.
+func (r *raft) resetDeadline() {
+	timeout := r.cfg.ElectionTimeout
+	r.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+// persistState saves the term and vote, which must be on disk before the
+// node acts on them. r.mu must be held.
+func (r *raft) persistState() {
+	if err := r.storage.saveState(r.term, r.votedFor); err != nil {
+		r.logger.Error().Err(err).Msg("failed to save the raft state")
+	}
+}
+
+// stepDown makes the node a follower in term, which is at least its own.
+// r.mu must be held.
+func (r *raft) stepDown(term uint64) {
+	if term > r.term {
+		r.term, r.votedFor, r.leader = term, "", ""
+		r.persistState()
+	}
+	if r.role == raftLeader {
+		r.logger.Info().Uint64("term", r.term).Msg("stepped down as leader")
+	}
+	r.role = raftFollower
+}
+
+// appendLocal appends entries to the log, on disk first. r.mu must be held.
+func (r *raft) appendLocal(entries ...raftEntry) error {
+	if err := r.storage.append(entries); err != nil {
+		r.logger.Error().Err(err).Msg("failed to append to the raft log")
+		return err
+	}
+	r.entries = append(r.entries, entries...)
+	if slices.ContainsFunc(entries, func(e raftEntry) bool { return e.kind == entryConfig }) {
+		r.updateMembers()
+	}
+	return nil
+}
+
+// truncate drops the entries from index i on. r.mu must be held.
+func (r *raft) truncate(i uint64) {
+	r.entries = slices.Clone(r.entries[:i-r.first])
+	if err := r.storage.rewrite(r.first, r.entries); err != nil {
+		r.logger.Error().Err(err).Msg("failed to rewrite the raft log")
+	}
+	r.updateMembers()
+}
+
+// signalApply wakes the applier.
+func (r *raft) signalApply() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *raft) call(node string, args [][]byte, timeout time.Duration) (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.transport.Call(ctx, node, args)
+}
+
+// replyInts returns the integers of an array reply, or nil if it holds
+// anything else.
+func replyInts(reply any) []uint64 {
+	arr, ok := reply.([]any)
+	if !ok {
+		return nil
+	}
+	ints := make([]uint64, len(arr))
+	for i, v := range arr {
+		n, ok := v.(int64)
+		if !ok || n < 0 {
+			return nil
+		}
+		ints[i] = uint64(n)
+	}
+	return ints
+}
+
+// parseUints parses args as unsigned integers.
+func parseUints(args [][]byte) ([]uint64, bool) {
+	ints := make([]uint64, len(args))
+	for i, arg := range args {
+		n, err := strconv.ParseUint(string(arg), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		ints[i] = n
+	}
+	return ints, true
+}
+
+func uintArg(n uint64) []byte {
+	return strconv.AppendUint(nil, n, 10)
+}
+
+// campaign stands for election if the node has not heard from a leader in
+// time.
+func (r *raft) campaign() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == raftLeader || time.Now().Before(r.deadline) {
+		return
+	}
+	if !slices.Contains(r.members, r.self) {
+		r.resetDeadline()
+		return
+	}
+	r.role, r.leader = raftCandidate, ""
+	r.term++
+	r.votedFor = r.self
+	r.persistState()
+	r.resetDeadline()
+	r.logger.Info().Uint64("term", r.term).Msg("standing for election")
+	if r.quorum() == 1 {
+		r.becomeLeader()
+		return
+	}
+
+	term := r.term
+	args := [][]byte{[]byte("RAFT.VOTE"), uintArg(term), []byte(r.self), uintArg(r.lastIndex()), uintArg(r.termAt(r.lastIndex()))}
+	var peers []string
+	for _, m := range r.members {
+		if m != r.self {
+			peers = append(peers, m)
+		}
+	}
+	go r.collectVotes(term, args, peers)
+}
+
+// collectVotes asks peers for their votes in term, and makes the node
+// leader if a majority grant them.
+func (r *raft) collectVotes(term uint64, args [][]byte, peers []string) {
+	granted := make(chan bool, len(peers))
+	for _, peer := range peers {
+		go func() {
+			reply, err := r.call(peer, args, r.cfg.ElectionTimeout)
+			vals := replyInts(reply)
+			if err != nil || len(vals) != 2 {
+				granted <- false
+				return
+			}
+			r.mu.Lock()
+			if vals[0] > r.term {
+				r.stepDown(vals[0])
+			}
+			r.mu.Unlock()
+			granted <- vals[1] == 1
+		}()
+	}
+	votes := 1
+	for range peers {
+		if !<-granted {
+			continue
+		}
+		votes++
+		r.mu.Lock()
+		if r.role == raftCandidate && r.term == term && votes >= r.quorum() {
+			r.becomeLeader()
+		}
+		done := r.role != raftCandidate || r.term != term
+		r.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// becomeLeader makes the candidate the leader of its term. r.mu must be
+// held.
+func (r *raft) becomeLeader() {
+	r.role, r.leader, r.heard = raftLeader, r.self, time.Now()
+	r.next = make(map[string]uint64)
+	r.match = make(map[string]uint64)
+	r.replicating = make(map[string]chan struct{})
+	r.logger.Info().Uint64("term", r.term).Msg("elected leader")
+	// Entries of earlier terms only count as committed once one of the
+	// leader's own is.
+	if err := r.appendLocal(raftEntry{term: r.term, kind: entryNoop}); err != nil {
+		r.stepDown(r.term)
+		return
+	}
+	r.startReplicators()
+	r.advanceCommit()
+}
+
+// startReplicators starts replicating to the members that are not being
+// replicated to. r.mu must be held.
+func (r *raft) startReplicators() {
+	for _, m := range r.members {
+		if _, ok := r.replicating[m]; ok || m == r.self {
+			continue
+		}
+		wake := make(chan struct{}, 1)
+		r.replicating[m] = wake
+		r.next[m] = r.lastIndex() + 1
+		r.match[m] = 0
+		go r.replicate(m, r.term, wake)
+	}
+}
+
+// notifyReplicators wakes the goroutines replicating to followers, to send
+// new entries. r.mu must be held.
+func (r *raft) notifyReplicators() {
+	for _, wake := range r.replicating {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries to peer while the node is leader of term, as
+// they are appended and otherwise every heartbeat interval. A peer that
+// needs entries compacted away is sent the snapshot.
+func (r *raft) replicate(peer string, term uint64, wake chan struct{}) {
+	ticker := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		if r.role != raftLeader || r.term != term || r.replicating[peer] != wake {
+			r.mu.Unlock()
+			return
+		}
+		// A removed member is sent entries until its removal is committed,
+		// so that it learns of it.
+		if !slices.Contains(r.members, peer) && r.commitIndex >= r.configIndex {
+			delete(r.replicating, peer)
+			delete(r.next, peer)
+			delete(r.match, peer)
+			r.mu.Unlock()
+			return
+		}
+		var args [][]byte
+		next, sent, snapshot := r.next[peer], uint64(0), false
+		timeout := r.cfg.ElectionTimeout
+		if next < r.first {
+			args = [][]byte{[]byte("RAFT.SNAPSHOT"), uintArg(term), []byte(r.self),
+				uintArg(r.first - 1), uintArg(r.snapTerm), r.snapshot}
+			for _, m := range r.snapMembers {
+				args = append(args, []byte(m))
+			}
+			sent, snapshot = r.first-1, true
+			timeout *= 10
+		} else {
+			prev := next - 1
+			batch := r.entries[next-r.first : min(uint64(len(r.entries)), next-r.first+raftMaxAppend)]
+			args = [][]byte{[]byte("RAFT.APPEND"), uintArg(term), []byte(r.self),
+				uintArg(prev), uintArg(r.termAt(prev)), uintArg(r.commitIndex), encodeEntries(batch)}
+			sent = prev + uint64(len(batch))
+		}
+		r.mu.Unlock()
+
+		reply, err := r.call(peer, args, timeout)
+		more := false
+		if vals := replyInts(reply); err == nil && len(vals) > 0 {
+			r.mu.Lock()
+			more = r.replicated(peer, term, sent, snapshot, vals)
+			r.mu.Unlock()
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicated handles peer's reply to entries, or the snapshot, up to index
+// sent, and reports whether there is more to send it at once. r.mu must be
+// held.
+func (r *raft) replicated(peer string, term, sent uint64, snapshot bool, vals []uint64) bool {
+	if vals[0] > r.term {
+		r.stepDown(vals[0])
+		return false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false
+	}
+	switch {
+	case snapshot || len(vals) == 3 && vals[1] == 1:
+		if sent > r.match[peer] {
+			r.match[peer] = sent
+			r.advanceCommit()
+		}
+		r.next[peer] = max(r.next[peer], sent+1)
+	case len(vals) == 3:
+		// The peer's log differs before the entries sent. It suggests where
+		// to try next, which is never after them.
+		r.next[peer] = max(min(vals[2], r.next[peer]-1), 1)
+	default:
+		return false
+	}
+	return r.next[peer] <= r.lastIndex()
+}
+
+// advanceCommit commits the entries that a majority of members hold, as
+// leader. Only entries of the leader's term are counted, committing those
+// before them. A leader that has committed its own removal steps down. r.mu
+// must be held.
+func (r *raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && r.termAt(n) == r.term; n-- {
+		count := 0
+		for _, m := range r.members {
+			if m == r.self || r.match[m] >= n {
+				count++
+			}
+		}
+		if count >= r.quorum() {
+			r.commitIndex = n
+			r.signalApply()
+			r.notifyReplicators()
+			break
+		}
+	}
+	if r.role == raftLeader && !slices.Contains(r.members, r.self) && r.commitIndex >= r.configIndex {
+		r.stepDown(r.term)
+		r.leader = ""
+	}
+}
+
+// vote handles a candidate's request for the node's vote, returning the
+// node's term and whether it granted the vote.
+func (r *raft) vote(term uint64, candidate string, lastIndex, lastTerm uint64) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A leader, and a node that has heard from one lately, ignores
+	// candidates, so that a member cut off for a while, or removed from the
+	// group, cannot depose a working leader.
+	lately := r.leader != "" && time.Since(r.heard) < r.cfg.ElectionTimeout
+	if term > r.term && (r.role == raftLeader || lately) {
+		return r.term, false
+	}
+	if term > r.term {
+		r.stepDown(term)
+	}
+	myLast := r.lastIndex()
+	upToDate := lastTerm > r.termAt(myLast) || lastTerm == r.termAt(myLast) && lastIndex >= myLast
+	if term < r.term || !upToDate || r.votedFor != "" && r.votedFor != candidate {
+		return r.term, false
+	}
+	r.votedFor = candidate
+	r.persistState()
+	r.resetDeadline()
+	return r.term, true
+}
+
+// heardFrom records a request from leader of term, which is at least the
+// node's own. r.mu must be held.
+func (r *raft) heardFrom(term uint64, leader string) {
+	if term > r.term || r.role != raftFollower {
+		r.stepDown(term)
+	}
+	r.leader, r.heard = leader, time.Now()
+	r.resetDeadline()
+}
+
+// append handles entries sent by the leader of term to follow entry
+// prevIndex of term prevTerm. It returns the node's term and whether it
+// took the entries, with the index of the last entry it took or, if it
+// took none, of the entry the leader should send next.
+func (r *raft) append(term uint64, leader string, prevIndex, prevTerm, commit uint64, entries []raftEntry) (uint64, bool, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term < r.term {
+		return r.term, false, 0
+	}
+	r.heardFrom(term, leader)
+
+	// Entries the snapshot covers were committed, so they match the
+	// leader's.
+	if snapIndex := r.first - 1; prevIndex < snapIndex {
+		skip := min(snapIndex-prevIndex, uint64(len(entries)))
+		entries = entries[skip:]
+		prevIndex, prevTerm = prevIndex+skip, r.termAt(prevIndex+skip)
+		if prevIndex < snapIndex {
+			return r.term, true, prevIndex
+		}
+	}
+	if prevIndex > r.lastIndex() {
+		return r.term, false, r.lastIndex() + 1
+	}
+	if conflict := r.termAt(prevIndex); conflict != prevTerm {
+		// Skip back over the whole conflicting term at once.
+		hint := prevIndex
+		for hint > r.first && r.termAt(hint-1) == conflict {
+			hint--
+		}
+		return r.term, false, hint
+	}
+	for i, e := range entries {
+		index := prevIndex + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.termAt(index) == e.term {
+				continue
+			}
+			r.truncate(index)
+		}
+		if err := r.appendLocal(entries[i:]...); err != nil {
+			return r.term, false, index
+		}
+		break
+	}
+	last := prevIndex + uint64(len(entries))
+	if commit := min(commit, last); commit > r.commitIndex {
+		r.commitIndex = commit
+		r.signalApply()
+	}
+	return r.term, true, last
+}
+
+// install handles a snapshot sent by the leader of term in place of the
+// entries up to index, of term snapTerm, returning the node's term.
+func (r *raft) install(term uint64, leader string, index, snapTerm uint64, members []string, data []byte) uint64 {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	if term < r.term {
+		defer r.mu.Unlock()
+		return r.term
+	}
+	r.heardFrom(term, leader)
+	term = r.term
+	if index <= r.lastApplied {
+		r.mu.Unlock()
+		return term
+	}
+	if err := r.storage.saveSnapshot(index, snapTerm, members, data); err != nil {
+		r.logger.Error().Err(err).Msg("failed to save the raft snapshot")
+		r.mu.Unlock()
+		return term
+	}
+	// Entries after the snapshot are kept if the log agrees with it.
+	var kept []raftEntry
+	if r.termAt(index) == snapTerm {
+		kept = slices.Clone(r.entries[index+1-r.first:])
+	}
+	r.first, r.entries = index+1, kept
+	r.snapTerm, r.snapMembers, r.snapshot = snapTerm, members, data
+	if err := r.storage.rewrite(r.first, r.entries); err != nil {
+		r.logger.Error().Err(err).Msg("failed to rewrite the raft log")
+	}
+	r.updateMembers()
+	r.commitIndex = max(r.commitIndex, index)
+	r.lastApplied = index
+	// Entries proposed by this node that the snapshot covers will not run
+	// here, and whether they were committed is not known.
+	for i, w := range r.waiters {
+		if i <= index {
+			w.done <- raftResult{err: errOutcomeUnknown}
+			delete(r.waiters, i)
+		}
+	}
+	r.mu.Unlock()
+
+	if err := r.mkv.loadRaftSnapshot(data); err != nil {
+		r.logger.Error().Err(err).Msg("failed to load the leader's snapshot")
+	}
+	r.logger.Info().Uint64("index", index).Str("leader", leader).Msg("installed snapshot")
+	r.signalApply()
+	return term
+}
+
+// loadRaftSnapshot replaces the databases with a snapshot sent by the raft
+// leader.
+func (mkv *MuKV) loadRaftSnapshot(data []byte) error {
+	mkv.order.Lock()
+	for _, ks := range mkv.DBs {
+		ks.Flush(false)
+	}
+	// Expired keys are kept, as they are until the log removes them.
+	_, err := mkv.restore(bytes.NewReader(data), time.Time{})
+	mkv.order.Unlock()
+	if err != nil {
+		return err
+	}
+	if mkv.aof.enabled.Load() {
+		return mkv.rewriteAOF()
+	}
+	return nil
+}
+
+// runApplier runs committed entries in order, and compacts the log once
+// enough have run.
+func (r *raft) runApplier() {
+	for range r.wake {
+		for r.applyNext() {
+		}
+		r.compact()
+	}
+}
+
+// applyNext runs the next committed entry, delivering its result to the
+// client waiting for it, if any. It reports false if there was none.
+func (r *raft) applyNext() bool {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	if r.lastApplied >= r.commitIndex {
+		r.mu.Unlock()
+		return false
+	}
+	index := r.lastApplied + 1
+	e := r.entries[index-r.first]
+	r.mu.Unlock()
+
+	var reply []byte
+	switch e.kind {
+	case entryCommand:
+		conn := &bufferConn{ctx: &client{db: e.db, leader: true}}
+		r.mkv.Handler(conn, redcon.Command{Args: e.args})
+		reply = conn.buf
+	case entryExpire:
+		if deadline, err := strconv.ParseInt(string(e.args[1]), 10, 64); err == nil {
+			r.mkv.DBs[e.db].expireLogged(string(e.args[0]), deadline)
+		}
+	}
+
+	r.mu.Lock()
+	r.lastApplied = index
+	w, ok := r.waiters[index]
+	delete(r.waiters, index)
+	r.mu.Unlock()
+	if ok {
+		// The entry committed at the index may be another leader's, which
+		// replaced the one proposed.
+		if w.term == e.term {
+			w.done <- raftResult{reply: reply}
+		} else {
+			w.done <- raftResult{err: errLeaderLost}
+		}
+	}
+	return true
+}
+
+// compact replaces the entries that have run with a snapshot of the
+// databases, once there are enough of them. The snapshot is written in the
+// background, while later entries run.
+func (r *raft) compact() {
+	if !r.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	r.applyMu.Lock()
+	r.mu.Lock()
+	index := r.lastApplied
+	if index < r.first || index-r.first+1 < uint64(r.cfg.SnapshotEntries) {
+		r.mu.Unlock()
+		r.applyMu.Unlock()
+		r.compacting.Store(false)
+		return
+	}
+	term, members := r.termAt(index), r.membersAt(index)
+	r.mu.Unlock()
+	// No entry runs while applyMu is held, so the snapshot is of the
+	// databases as of index.
+	snap := r.mkv.snapshot()
+	r.applyMu.Unlock()
+
+	go func() {
+		defer r.compacting.Store(false)
+		var buf bytes.Buffer
+		if _, err := snap.WriteTo(&buf); err != nil {
+			r.logger.Error().Err(err).Msg("failed to take a raft snapshot")
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// A snapshot from the leader may have overtaken this one.
+		if index < r.first {
+			return
+		}
+		if err := r.storage.saveSnapshot(index, term, members, buf.Bytes()); err != nil {
+			r.logger.Error().Err(err).Msg("failed to save the raft snapshot")
+			return
+		}
+		r.entries = slices.Clone(r.entries[index+1-r.first:])
+		r.first = index + 1
+		r.snapTerm, r.snapMembers, r.snapshot = term, members, buf.Bytes()
+		if err := r.storage.rewrite(r.first, r.entries); err != nil {
+			r.logger.Error().Err(err).Msg("failed to rewrite the raft log")
+		}
+		r.logger.Info().Uint64("index", index).Int("bytes", buf.Len()).Msg("compacted the raft log")
+	}()
+}
+
+// notLeader returns the error for a request that only the leader can
+// serve. r.mu must be held.
+func (r *raft) notLeader() error {
+	if r.leader == "" {
+		return errNoLeader
+	}
+	return fmt.Errorf("NOTLEADER %s", r.leader)
+}
+
+// propose appends e to the log as leader, returning a waiter for its
+// result. r.mu must be held.
+func (r *raft) propose(e raftEntry) (raftWaiter, error) {
+	if r.role != raftLeader {
+		return raftWaiter{}, r.notLeader()
+	}
+	e.term = r.term
+	if err := r.appendLocal(e); err != nil {
+		return raftWaiter{}, fmt.Errorf("ERR appending to the raft log: %w", err)
+	}
+	w := raftWaiter{term: r.term, done: make(chan raftResult, 1)}
+	r.waiters[r.lastIndex()] = w
+	r.startReplicators()
+	r.notifyReplicators()
+	r.advanceCommit()
+	return w, nil
+}
+
+// wait waits for the result of a proposed entry.
+func (r *raft) wait(w raftWaiter) ([]byte, error) {
+	timer := time.NewTimer(raftCommitTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-w.done:
+		return res.reply, res.err
+	case <-timer.C:
+		return nil, errOutcomeUnknown
+	}
+}
+
+// run logs a command to run in database db, as leader, and returns its
+// reply once it has run.
+func (r *raft) run(db int, args [][]byte) ([]byte, error) {
+	r.mu.Lock()
+	w, err := r.propose(raftEntry{kind: entryCommand, db: db, args: args})
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return r.wait(w)
+}
+
+// expire logs the removal of a key that expired in database db at
+// deadline, as leader. It is called with the key's shard locked, so it does
+// not wait for the entry to be committed, nor to be appended.
+func (r *raft) expire(db int, key string, deadline time.Time) {
+	go func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.role != raftLeader {
+			return
+		}
+		e := raftEntry{kind: entryExpire, db: db, args: [][]byte{[]byte(key), pxatArg(deadline)}}
+		if _, err := r.propose(e); err != nil {
+			r.logger.Error().Err(err).Str("key", key).Msg("failed to log an expired key")
+		}
+	}()
+}
+
+// submit runs a command that writes, sent to the node by a client, and
+// returns its reply. A follower proxies it to the leader.
+func (r *raft) submit(db int, args [][]byte) ([]byte, error) {
+	r.mu.Lock()
+	role, leader := r.role, r.leader
+	r.mu.Unlock()
+	switch {
+	case role == raftLeader:
+		return r.run(db, args)
+	case leader == "":
+		return nil, errNoLeader
+	case r.cfg.RedirectWrites:
+		return nil, fmt.Errorf("NOTLEADER %s", leader)
+	}
+	proxied := append([][]byte{[]byte("RAFT.PROPOSE"), []byte(strconv.Itoa(db))}, args...)
+	reply, err := r.call(leader, proxied, raftCommitTimeout+r.cfg.ElectionTimeout)
+	var rerr replyError
+	switch {
+	case errors.As(err, &rerr):
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("IOERR error or timeout talking to the leader %s", leader)
+	}
+	raw, ok := reply.([]byte)
+	if !ok {
+		return nil, errBadReply
+	}
+	return raw, nil
+}
+
+// changeMembers adds or removes a member, as leader, returning once the
+// change is committed. Only one change may be in progress at a time, and
+// only once the leader has committed an entry of its own term, as single
+// member changes are only safe one at a time.
+func (r *raft) changeMembers(id string, add bool) error {
+	r.mu.Lock()
+	if r.role != raftLeader {
+		defer r.mu.Unlock()
+		return r.notLeader()
+	}
+	if r.configIndex > r.commitIndex || r.termAt(r.commitIndex) != r.term {
+		r.mu.Unlock()
+		return errors.New("TRYAGAIN A membership change is in progress")
+	}
+	members := slices.Clone(r.members)
+	switch i := slices.Index(members, id); {
+	case add && i >= 0:
+		r.mu.Unlock()
+		return fmt.Errorf("ERR %s is already a member", id)
+	case !add && i < 0:
+		r.mu.Unlock()
+		return fmt.Errorf("ERR %s is not a member", id)
+	case !add && len(members) == 1:
+		r.mu.Unlock()
+		return errors.New("ERR the last member cannot be removed")
+	case add:
+		members = append(members, id)
+	default:
+		members = slices.Delete(members, i, i+1)
+	}
+	e := raftEntry{kind: entryConfig}
+	for _, m := range members {
+		e.args = append(e.args, []byte(m))
+	}
+	w, err := r.propose(e)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = r.wait(w)
+	return err
+}
+
+// StartRaftLoop runs elections and applies committed entries in raft mode,
+// until the process exits.
+func (mkv *MuKV) StartRaftLoop() {
+	r := mkv.raft
+	if r == nil {
+		return
+	}
+	go r.runApplier()
+	r.signalApply()
+	ticker := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.campaign()
+	}
+}
+
+// raftCommand rewrites a command that writes into the form it is logged in,
+// which has the same effect on every node whenever it runs: expire times
+// relative to now become deadlines. Commands that could not have the same
+// effect are refused, with the error returned.
+func raftCommand(name string, args [][]byte, now time.Time) ([][]byte, string) {
+	switch name {
+	case "set":
+		if len(args) < 3 {
+			break
+		}
+		if opts, errStr := parseSetOptions(args[3:], now); errStr == "" && opts.relative {
+			args = slices.Clone(args)
+			args[3+opts.expireArg] = []byte("PXAT")
+			args[4+opts.expireArg] = pxatArg(opts.deadline)
+		}
+	case "getex":
+		if len(args) != 4 {
+			break
+		}
+		unit := time.Second
+		switch strings.ToLower(string(args[2])) {
+		case "px":
+			unit = time.Millisecond
+		case "ex":
+		default:
+			return args, ""
+		}
+		if deadline, errStr := parseExpire(args[3], unit, false, now); errStr == "" && deadline.After(now) {
+			args = [][]byte{args[0], args[1], []byte("PXAT"), pxatArg(deadline)}
+		}
+	case "expire", "pexpire":
+		if len(args) < 3 {
+			break
+		}
+		unit := time.Second
+		if name == "pexpire" {
+			unit = time.Millisecond
+		}
+		if deadline, errStr := parseExpire(args[2], unit, false, now); errStr == "" {
+			args = append([][]byte{[]byte("PEXPIREAT"), args[1], pxatArg(deadline)}, args[3:]...)
+		}
+	case "restore":
+		if len(args) < 4 || slices.ContainsFunc(args[4:], func(arg []byte) bool {
+			return strings.EqualFold(string(arg), "absttl")
+		}) {
+			break
+		}
+		if ttl, err := strconv.ParseInt(string(args[2]), 10, 64); err == nil && ttl > 0 {
+			args = slices.Clone(args)
+			args[2] = pxatArg(now.Add(time.Duration(ttl) * time.Millisecond))
+			args = append(args, []byte("ABSTTL"))
+		}
+	case "spop", "migrate", "restore-asking", "dynamo.put":
+		return nil, fmt.Sprintf("ERR %s is not supported in raft mode", args[0])
+	default:
+		if commandFlags[name]&flagBlocking != 0 {
+			return nil, fmt.Sprintf("ERR %s is not supported in raft mode", args[0])
+		}
+	}
+	return args, ""
+}
+
+// serveRaft runs the commands that write through the raft log, and refuses
+// those that cannot be, reporting whether it replied. Commands replayed from
+// disk or run from the log are left to run locally.
+func (mkv *MuKV) serveRaft(conn redcon.Conn, name string, cmd redcon.Command) bool {
+	r := mkv.raft
+	cl := clientFor(conn)
+	if r == nil || mkv.loading.Load() || cl.leader {
+		return false
+	}
+	switch name {
+	case "replicaof", "slaveof", "multi", "watch", "eval", "evalsha", "eval_ro", "evalsha_ro":
+		conn.WriteError(fmt.Sprintf("ERR %s is not allowed in raft mode", strings.ToUpper(name)))
+		return true
+	}
+	if commandFlags[name]&flagWrite == 0 {
+		return false
+	}
+	args, errStr := raftCommand(name, cmd.Args, time.Now())
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return true
+	}
+	// The arguments are logged, so they must outlive the connection's
+	// buffer.
+	logged := make([][]byte, len(args))
+	for i, arg := range args {
+		logged[i] = bytes.Clone(arg)
+	}
+	reply, err := r.submit(cl.db, logged)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return true
+	}
+	conn.WriteRaw(reply)
+	return true
+}
+
+// handleRaftVote serves RAFT.VOTE term candidate last-index last-term, a
+// candidate's request for the node's vote.
+func (mkv *MuKV) handleRaftVote(conn redcon.Conn, cmd redcon.Command) {
+	r := mkv.raft
+	if r == nil {
+		conn.WriteError(errNotRaft.Error())
+		return
+	}
+	if len(cmd.Args) != 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	term, ok1 := parseUints(cmd.Args[1:2])
+	last, ok2 := parseUints(cmd.Args[3:5])
+	if !ok1 || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	myTerm, granted := r.vote(term[0], string(cmd.Args[2]), last[0], last[1])
+	conn.WriteArray(2)
+	conn.WriteUint64(myTerm)
+	if granted {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// handleRaftAppend serves RAFT.APPEND term leader prev-index prev-term
+// commit entries, the leader's request to append entries.
+func (mkv *MuKV) handleRaftAppend(conn redcon.Conn, cmd redcon.Command) {
+	r := mkv.raft
+	if r == nil {
+		conn.WriteError(errNotRaft.Error())
+		return
+	}
+	if len(cmd.Args) != 7 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	term, ok1 := parseUints(cmd.Args[1:2])
+	vals, ok2 := parseUints(cmd.Args[3:6])
+	if !ok1 || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	entries, err := decodeEntries(cmd.Args[6])
+	if err != nil {
+		conn.WriteError("ERR malformed raft entries")
+		return
+	}
+	myTerm, ok, index := r.append(term[0], string(cmd.Args[2]), vals[0], vals[1], vals[2], entries)
+	conn.WriteArray(3)
+	conn.WriteUint64(myTerm)
+	if ok {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+	conn.WriteUint64(index)
+}
+
+// handleRaftSnapshot serves RAFT.SNAPSHOT term leader index snap-term data
+// [member ...], the leader's request to install a snapshot.
+func (mkv *MuKV) handleRaftSnapshot(conn redcon.Conn, cmd redcon.Command) {
+	r := mkv.raft
+	if r == nil {
+		conn.WriteError(errNotRaft.Error())
+		return
+	}
+	if len(cmd.Args) < 6 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	term, ok1 := parseUints(cmd.Args[1:2])
+	vals, ok2 := parseUints(cmd.Args[3:5])
+	if !ok1 || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	var members []string
+	for _, arg := range cmd.Args[6:] {
+		members = append(members, string(arg))
+	}
+	myTerm := r.install(term[0], string(cmd.Args[2]), vals[0], vals[1], members, bytes.Clone(cmd.Args[5]))
+	conn.WriteArray(1)
+	conn.WriteUint64(myTerm)
+}
+
+// handleRaftPropose serves RAFT.PROPOSE db command [arg ...], a write
+// proxied by a follower, replying with the command's reply as a bulk
+// string.
+func (mkv *MuKV) handleRaftPropose(conn redcon.Conn, cmd redcon.Command) {
+	r := mkv.raft
+	if r == nil {
+		conn.WriteError(errNotRaft.Error())
+		return
+	}
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	db, err := strconv.Atoi(string(cmd.Args[1]))
+	if err != nil || db < 0 || db >= len(mkv.DBs) {
+		conn.WriteError("ERR DB index is out of range")
+		return
+	}
+	args := make([][]byte, len(cmd.Args)-2)
+	for i, arg := range cmd.Args[2:] {
+		args[i] = bytes.Clone(arg)
+	}
+	reply, err := r.run(db, args)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteBulk(reply)
+}
+
+// handleRaft serves RAFT, which manages the group's members.
+func (mkv *MuKV) handleRaft(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	r := mkv.raft
+	if r == nil {
+		conn.WriteError(errNotRaft.Error())
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch {
+	case sub == "help" && len(cmd.Args) == 2:
+		conn.WriteArray(9)
+		conn.WriteString("RAFT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+		conn.WriteString("ADD <node-id>")
+		conn.WriteString("    Add a node to the group. Only the leader can.")
+		conn.WriteString("REMOVE <node-id>")
+		conn.WriteString("    Remove a node from the group. Only the leader can.")
+		conn.WriteString("LEADER")
+		conn.WriteString("    Return the ID of the leader, if known.")
+		conn.WriteString("MEMBERS")
+		conn.WriteString("    Return the IDs of the group's members.")
+	case (sub == "add" || sub == "remove") && len(cmd.Args) == 3:
+		if err := r.changeMembers(string(cmd.Args[2]), sub == "add"); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case sub == "leader" && len(cmd.Args) == 2:
+		r.mu.Lock()
+		leader := r.leader
+		r.mu.Unlock()
+		if leader == "" {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(leader)
+	case sub == "members" && len(cmd.Args) == 2:
+		r.mu.Lock()
+		members := slices.Clone(r.members)
+		r.mu.Unlock()
+		conn.WriteArray(len(members))
+		for _, m := range members {
+			conn.WriteBulkString(m)
+		}
+	case sub == "help" || sub == "add" || sub == "remove" || sub == "leader" || sub == "members":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for raft|%s", sub))
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try RAFT HELP.", cmd.Args[1]))
+	}
+}
+
+func (mkv *MuKV) raftInfo() []string {
+	r := mkv.raft
+	if r == nil {
+		return []string{"raft_enabled:0"}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return []string{
+		"raft_enabled:1",
+		fmt.Sprintf("raft_node:%s", r.self),
+		fmt.Sprintf("raft_role:%s", r.role),
+		fmt.Sprintf("raft_term:%d", r.term),
+		fmt.Sprintf("raft_leader:%s", r.leader),
+		fmt.Sprintf("raft_members:%s", strings.Join(r.members, ",")),
+		fmt.Sprintf("raft_commit_index:%d", r.commitIndex),
+		fmt.Sprintf("raft_last_applied:%d", r.lastApplied),
+		fmt.Sprintf("raft_last_index:%d", r.lastIndex()),
+		fmt.Sprintf("raft_snapshot_index:%d", r.first-1),
+	}
+}
@@ -0,0 +1,207 @@
+package mukv
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newRaftGroup starts a group of three nodes, n1 to n3, on a network the
+// test can cut them off from. They are cut off for good once the test ends,
+// as their loops run until the process exits.
+func newRaftGroup(t *testing.T, electionTimeout time.Duration) (map[string]*MuKV, *MemoryNetwork) {
+	t.Helper()
+	ids := []string{"n1", "n2", "n3"}
+	network := NewMemoryNetwork()
+	nodes := make(map[string]*MuKV)
+	for _, id := range ids {
+		cfg := DefaultConfig
+		cfg.Raft = &RaftConfig{
+			ID:              id,
+			Peers:           ids,
+			ElectionTimeout: electionTimeout,
+			SnapshotEntries: 20,
+			Transport:       network.Transport(id),
+		}
+		nodes[id] = newTestServer(cfg)
+		network.Add(id, nodes[id])
+	}
+	for _, node := range nodes {
+		go node.StartRaftLoop()
+		go node.StartExpireLoop()
+	}
+	t.Cleanup(func() {
+		for _, id := range ids {
+			network.SetDown(id, true)
+		}
+	})
+	return nodes, network
+}
+
+// raftState returns the role, term and leader node holds.
+func raftState(node *MuKV) (raftRole, uint64, string) {
+	r := node.raft
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role, r.term, r.leader
+}
+
+// waitForLeader waits for the nodes other than those in down to agree on a
+// leader among them, and returns it with its term.
+func waitForLeader(t *testing.T, nodes map[string]*MuKV, down ...string) (string, uint64) {
+	t.Helper()
+	var leader string
+	var term uint64
+	eventually(t, "a leader to be elected", func() bool {
+		leader, term = "", 0
+		for id, node := range nodes {
+			if slices.Contains(down, id) {
+				continue
+			}
+			role, nodeTerm, nodeLeader := raftState(node)
+			if role == raftLeader {
+				if leader != "" {
+					return false
+				}
+				leader, term = id, nodeTerm
+			}
+			if nodeLeader == "" {
+				return false
+			}
+		}
+		return leader != ""
+	})
+	return leader, term
+}
+
+// waitForValue waits for every node but those in down to hold value at
+// key.
+func waitForValue(t *testing.T, nodes map[string]*MuKV, key, value string, down ...string) {
+	t.Helper()
+	for id, node := range nodes {
+		if slices.Contains(down, id) {
+			continue
+		}
+		c := newTestClient(node)
+		eventually(t, fmt.Sprintf("%s to hold %s=%q", id, key, value), func() bool {
+			return c.bulk(t, "GET", key) == value
+		})
+	}
+}
+
+func TestRaftElection(t *testing.T) {
+	nodes, network := newRaftGroup(t, 100*time.Millisecond)
+	leader, term := waitForLeader(t, nodes)
+
+	network.SetDown(leader, true)
+	next, nextTerm := waitForLeader(t, nodes, leader)
+	if next == leader || nextTerm <= term {
+		t.Fatalf("leader %s of term %d followed by %s of term %d", leader, term, next, nextTerm)
+	}
+
+	network.SetDown(leader, false)
+	eventually(t, "the old leader to step down", func() bool {
+		role, term, _ := raftState(nodes[leader])
+		return role == raftFollower && term >= nextTerm
+	})
+}
+
+func TestRaftCommit(t *testing.T) {
+	nodes, _ := newRaftGroup(t, 100*time.Millisecond)
+	leader, _ := waitForLeader(t, nodes)
+	var follower string
+	for id := range nodes {
+		if id != leader {
+			follower = id
+		}
+	}
+
+	c := newTestClient(nodes[leader])
+	c.must(t, "SET", "k", "v1")
+	if got := c.bulk(t, "GET", "k"); got != "v1" {
+		t.Errorf("GET k on the leader = %q, want v1", got)
+	}
+	waitForValue(t, nodes, "k", "v1")
+
+	// Writes sent to a follower are proxied to the leader.
+	f := newTestClient(nodes[follower])
+	for range 5 {
+		f.must(t, "INCR", "n")
+	}
+	waitForValue(t, nodes, "n", "5")
+
+	if _, err := f.do("SPOP", "s"); err == nil {
+		t.Error("SPOP, which picks at random, was not refused")
+	}
+}
+
+func TestRaftSnapshotInstall(t *testing.T) {
+	nodes, network := newRaftGroup(t, 100*time.Millisecond)
+	leader, _ := waitForLeader(t, nodes)
+	var behind string
+	for id := range nodes {
+		if id != leader {
+			behind = id
+		}
+	}
+
+	network.SetDown(behind, true)
+	c := newTestClient(nodes[leader])
+	for i := range 100 {
+		c.must(t, "SET", fmt.Sprintf("k%d", i), fmt.Sprint(i))
+	}
+	r := nodes[leader].raft
+	eventually(t, "the leader to compact its log", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.first > 50
+	})
+
+	network.SetDown(behind, false)
+	waitForValue(t, nodes, "k99", "99")
+	b := nodes[behind]
+	if n := b.DBs[0].Len(); n != 100 {
+		t.Errorf("%s holds %d keys, want 100", behind, n)
+	}
+	b.raft.mu.Lock()
+	installed := b.raft.snapshot != nil
+	b.raft.mu.Unlock()
+	if !installed {
+		t.Errorf("%s caught up without a snapshot", behind)
+	}
+}
+
+func TestRaftExpiry(t *testing.T) {
+	nodes, network := newRaftGroup(t, time.Second)
+	leader, _ := waitForLeader(t, nodes)
+	c := newTestClient(nodes[leader])
+
+	c.must(t, "SET", "k", "v", "PX", "100")
+	waitForValue(t, nodes, "k", "v")
+
+	// Followers leave an expired key to the leader, hiding it meanwhile.
+	network.SetDown(leader, true)
+	time.Sleep(200 * time.Millisecond)
+	for id, node := range nodes {
+		if id == leader {
+			continue
+		}
+		if got := newTestClient(node).must(t, "GET", "k"); got != nil {
+			t.Errorf("GET k on %s after it expired = %q, want nil", id, got)
+		}
+		if n := node.DBs[0].Len(); n != 1 {
+			t.Errorf("%s removed the expired key itself", id)
+		}
+	}
+
+	// The next leader logs its removal.
+	waitForLeader(t, nodes, leader)
+	for id, node := range nodes {
+		if id == leader {
+			continue
+		}
+		ks := node.DBs[0]
+		eventually(t, fmt.Sprintf("%s to remove the expired key", id), func() bool { return ks.Len() == 0 })
+	}
+}
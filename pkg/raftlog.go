@@ -0,0 +1,355 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A raft node keeps three files in its directory. raft-state holds its
+// current term and the node it voted for in that term. raft-log holds the
+// entries after the snapshot: the index of the first as a uvarint, then for
+// each entry its encoded length as a uvarint, the entry, and a CRC-64 of it
+// as a little-endian uint64. raft-snapshot holds the index and term of the
+// last entry it covers and the members as of that entry, followed by the
+// databases in the snapshot file format.
+//
+// raft-state and raft-snapshot are replaced atomically. raft-log is appended
+// to and synced before the entries are acknowledged, so a crash can only
+// tear entries that no node has counted on; those are dropped when the log
+// is loaded. It is rewritten when entries are truncated or compacted.
+
+const (
+	raftStateFile    = "raft-state"
+	raftLogFile      = "raft-log"
+	raftSnapshotFile = "raft-snapshot"
+)
+
+// Kinds of raft log entry.
+const (
+	// entryNoop is appended by each new leader, which can only count its
+	// own entries as committed.
+	entryNoop byte = iota
+	// entryCommand holds a command to run.
+	entryCommand
+	// entryConfig holds the IDs of the group's members, who make up the
+	// group from when the entry is appended.
+	entryConfig
+	// entryExpire holds a key that expired in database db, and the
+	// deadline, in Unix milliseconds, it expired at.
+	entryExpire
+)
+
+// raftEntry is an entry of the raft log. args holds the command of an
+// entryCommand, run in database db, the members of an entryConfig, or the
+// key and deadline of an entryExpire.
+type raftEntry struct {
+	term uint64
+	kind byte
+	db   int
+	args [][]byte
+}
+
+func appendRaftEntry(buf []byte, e raftEntry) []byte {
+	buf = binary.AppendUvarint(buf, e.term)
+	buf = append(buf, e.kind)
+	buf = binary.AppendUvarint(buf, uint64(e.db))
+	buf = binary.AppendUvarint(buf, uint64(len(e.args)))
+	for _, arg := range e.args {
+		buf = appendString(buf, arg)
+	}
+	return buf
+}
+
+func readRaftEntry(sr *snapshotReader) raftEntry {
+	e := raftEntry{term: sr.uvarint(), kind: sr.byte(), db: sr.count()}
+	n := sr.count()
+	if sr.err != nil {
+		return e
+	}
+	e.args = make([][]byte, 0, min(n, 1024))
+	for range n {
+		arg := sr.bytes()
+		if sr.err != nil {
+			return e
+		}
+		e.args = append(e.args, arg)
+	}
+	return e
+}
+
+// encodeEntries encodes entries for RAFT.APPEND.
+func encodeEntries(entries []raftEntry) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(entries)))
+	for _, e := range entries {
+		buf = appendRaftEntry(buf, e)
+	}
+	return buf
+}
+
+// decodeEntries decodes entries encoded by encodeEntries.
+func decodeEntries(b []byte) ([]raftEntry, error) {
+	sr := &snapshotReader{r: bufio.NewReader(bytes.NewReader(b)), crc: io.Discard}
+	n := sr.count()
+	entries := make([]raftEntry, 0, min(n, 1024))
+	for range n {
+		e := readRaftEntry(sr)
+		if sr.err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	if sr.err != nil || sr.r.Buffered() > 0 {
+		return nil, errBadSnapshot
+	}
+	return entries, nil
+}
+
+// raftStorage persists a raft node's state in dir. With no dir, nothing is
+// persisted.
+type raftStorage struct {
+	dir string
+	// log is raft-log, open for appending.
+	log *os.File
+}
+
+// raftDisk is the state a raft node loads at startup.
+type raftDisk struct {
+	term      uint64
+	votedFor  string
+	snapIndex uint64
+	snapTerm  uint64
+	members   []string
+	// snapshot holds the databases as of snapIndex, or nil with no
+	// snapshot.
+	snapshot []byte
+	entries  []raftEntry
+}
+
+// replace atomically replaces the file name with what write writes.
+func (s *raftStorage) replace(name string, write func(w io.Writer) error) error {
+	f, err := createTemp(s.dir, "temp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+	return nil
+}
+
+func (s *raftStorage) saveState(term uint64, votedFor string) error {
+	if s.dir == "" {
+		return nil
+	}
+	return s.replace(raftStateFile, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%d %s\n", term, votedFor)
+		return err
+	})
+}
+
+func appendLogRecord(buf []byte, e raftEntry) []byte {
+	body := appendRaftEntry(nil, e)
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	buf = append(buf, body...)
+	return binary.LittleEndian.AppendUint64(buf, crc64.Checksum(body, crcTable))
+}
+
+// append adds entries to the end of the log and syncs it.
+func (s *raftStorage) append(entries []raftEntry) error {
+	if s.dir == "" || len(entries) == 0 {
+		return nil
+	}
+	if s.log == nil {
+		return errors.New("raft log is not open")
+	}
+	var buf []byte
+	for _, e := range entries {
+		buf = appendLogRecord(buf, e)
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log with entries, the first of which has index
+// first.
+func (s *raftStorage) rewrite(first uint64, entries []raftEntry) error {
+	if s.dir == "" {
+		return nil
+	}
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	err := s.replace(raftLogFile, func(w io.Writer) error {
+		buf := binary.AppendUvarint(nil, first)
+		for _, e := range entries {
+			buf = appendLogRecord(buf, e)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.openLog()
+}
+
+func (s *raftStorage) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.log = f
+	return nil
+}
+
+func (s *raftStorage) saveSnapshot(index, term uint64, members []string, data []byte) error {
+	if s.dir == "" {
+		return nil
+	}
+	return s.replace(raftSnapshotFile, func(w io.Writer) error {
+		buf := binary.AppendUvarint(nil, index)
+		buf = binary.AppendUvarint(buf, term)
+		buf = binary.AppendUvarint(buf, uint64(len(members)))
+		for _, m := range members {
+			buf = appendString(buf, []byte(m))
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// load reads back what was persisted, and opens the log for appending.
+func (s *raftStorage) load() (*raftDisk, error) {
+	d := &raftDisk{}
+	if s.dir == "" {
+		return d, nil
+	}
+
+	state, err := os.ReadFile(filepath.Join(s.dir, raftStateFile))
+	switch {
+	case err == nil:
+		term, vote, _ := strings.Cut(strings.TrimSpace(string(state)), " ")
+		if d.term, err = strconv.ParseUint(term, 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed %s", raftStateFile)
+		}
+		d.votedFor = vote
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	snap, err := os.ReadFile(filepath.Join(s.dir, raftSnapshotFile))
+	switch {
+	case err == nil:
+		br := bytes.NewReader(snap)
+		sr := &snapshotReader{r: bufio.NewReader(br), crc: io.Discard}
+		d.snapIndex, d.snapTerm = sr.uvarint(), sr.uvarint()
+		n := sr.count()
+		for i := 0; i < n && sr.err == nil; i++ {
+			d.members = append(d.members, string(sr.bytes()))
+		}
+		if sr.err != nil {
+			return nil, fmt.Errorf("malformed %s", raftSnapshotFile)
+		}
+		d.snapshot = snap[len(snap)-br.Len()-sr.r.Buffered():]
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	first, err := s.loadLog(d)
+	if err != nil {
+		return nil, err
+	}
+	// Compaction saves the snapshot before rewriting the log, so a crash in
+	// between leaves entries the snapshot covers.
+	switch {
+	case first == 0:
+		err = s.rewrite(d.snapIndex+1, nil)
+	case first <= d.snapIndex:
+		d.entries = d.entries[min(uint64(len(d.entries)), d.snapIndex+1-first):]
+		err = s.rewrite(d.snapIndex+1, d.entries)
+	case first > d.snapIndex+1:
+		err = fmt.Errorf("%s starts at entry %d, but %s ends at %d", raftLogFile, first, raftSnapshotFile, d.snapIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadLog reads the entries of raft-log into d, and returns the index of
+// the first, or 0 if there is no log. A torn last entry is truncated.
+func (s *raftStorage) loadLog(d *raftDisk) (uint64, error) {
+	path := filepath.Join(s.dir, raftLogFile)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	first, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil
+	}
+	off := n
+	for off < len(b) {
+		size, n := binary.Uvarint(b[off:])
+		if n <= 0 || uint64(len(b)-off-n) < size+8 {
+			break
+		}
+		body := b[off+n : off+n+int(size)]
+		if binary.LittleEndian.Uint64(b[off+n+int(size):]) != crc64.Checksum(body, crcTable) {
+			break
+		}
+		sr := &snapshotReader{r: bufio.NewReader(bytes.NewReader(body)), crc: io.Discard}
+		e := readRaftEntry(sr)
+		if sr.err != nil {
+			break
+		}
+		d.entries = append(d.entries, e)
+		off += n + int(size) + 8
+	}
+	if off < len(b) {
+		if err := os.Truncate(path, int64(off)); err != nil {
+			return 0, err
+		}
+	}
+	return first, s.openLog()
+}
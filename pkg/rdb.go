@@ -0,0 +1,930 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// An RDB file is a snapshot as Redis saves it:
+//
+//	"REDIS" version
+//	for each non-empty database:
+//	    SELECTDB length [RESIZEDB length length]
+//	    for each key:
+//	        [EXPIRETIME_MS | EXPIRETIME] [IDLE] [FREQ] type key value
+//	EOF crc64
+//
+// with AUX fields and function libraries anywhere between the header and
+// EOF. The version is four ASCII digits. Small collections are stored packed
+// into a single string, as a ziplist, listpack, intset or zipmap, and strings
+// may be LZF compressed. The checksum covers everything before it and is
+// zero if Redis was configured not to compute it.
+const (
+	rdbMagic = "REDIS"
+	// Files from before version 9 use a subset of the encodings of later
+	// ones, so they load too.
+	rdbMaxVersion = 11
+	// rdbChecksumVersion is the first version to end with a checksum.
+	rdbChecksumVersion = 5
+)
+
+// Value types in an RDB file.
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5
+	rdbTypeModule2         = 7
+	rdbTypeHashZipmap      = 9
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpacks = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeStreamListpack2 = 19
+	rdbTypeSetListpack     = 20
+	rdbTypeStreamListpack3 = 21
+)
+
+// Opcodes that appear in an RDB file in place of a value type.
+const (
+	rdbOpFunction2    = 0xf5
+	rdbOpModuleAux    = 0xf7
+	rdbOpIdle         = 0xf8
+	rdbOpFreq         = 0xf9
+	rdbOpAux          = 0xfa
+	rdbOpResizeDB     = 0xfb
+	rdbOpExpireTimeMS = 0xfc
+	rdbOpExpireTime   = 0xfd
+	rdbOpSelectDB     = 0xfe
+	rdbOpEOF          = 0xff
+)
+
+// Special string encodings, flagged by a length whose top two bits are set.
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// Opcodes of the self-describing format module values are saved in.
+const (
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSInt   = 1
+	rdbModuleOpUInt   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+)
+
+// Quicklist nodes in RDB_TYPE_LIST_QUICKLIST_2 hold either one plain element
+// or a listpack of them.
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// rdbCRCTable is the table for the CRC-64 Redis checksums RDB files with, which
+// uses the Jones polynomial.
+var rdbCRCTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// rdbCRC extends crc, as Redis computes it, with p. Redis neither inverts
+// the CRC before nor after, unlike the crc64 package.
+func rdbCRC(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, rdbCRCTable, p)
+}
+
+var errBadRDB = errors.New("malformed RDB file")
+
+// RDBImportStats reports what ImportRDB loaded and what it left out.
+type RDBImportStats struct {
+	// Keys is the number of keys imported.
+	Keys int
+	// Expired is the number of keys left out because their TTL had passed.
+	Expired int
+	// Skipped counts what was left out because mukv has no equivalent for
+	// it, by what it was, such as "stream keys".
+	Skipped map[string]int
+}
+
+// ImportRDB loads the keys in the Redis RDB file at path into the databases,
+// replacing any keys of the same name. Streams, module values and functions
+// have no equivalent in mukv and are skipped.
+func (mkv *MuKV) ImportRDB(path string) (RDBImportStats, error) {
+	logger := mkv.Log.With().Str("function", "ImportRDB").Logger()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return RDBImportStats{}, err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	stats, err := readRDB(f, start, mkv.storeEntry)
+	if err != nil {
+		return stats, fmt.Errorf("importing %s: %w", path, err)
+	}
+	// The keys were stored without going through commands, so they are
+	// only logged by rewriting the append-only file.
+	if stats.Keys > 0 && mkv.aof.enabled.Load() {
+		if err := mkv.rewriteAOF(); err != nil {
+			return stats, err
+		}
+	}
+	logger.Info().Str("path", path).Int("keys", stats.Keys).Int("expired", stats.Expired).
+		Dur("took", time.Since(start)).Msg("RDB file imported")
+	return stats, nil
+}
+
+// rdbReader decodes an RDB file, checksumming what it reads.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+	err error
+}
+
+func (rr *rdbReader) fail(err error) {
+	if rr.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rr.err = err
+	}
+}
+
+func (rr *rdbReader) byte() byte {
+	b, err := rr.r.ReadByte()
+	if err != nil {
+		rr.fail(err)
+		return 0
+	}
+	rr.crc = rdbCRC(rr.crc, []byte{b})
+	return b
+}
+
+// read reads n bytes, returning fewer only if it fails.
+func (rr *rdbReader) read(n int) []byte {
+	b := make([]byte, 0, min(n, 1<<20))
+	for len(b) < n {
+		chunk := min(n-len(b), 1<<20)
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(rr.r, b[len(b)-chunk:]); err != nil {
+			rr.fail(err)
+			return nil
+		}
+		rr.crc = rdbCRC(rr.crc, b[len(b)-chunk:])
+	}
+	return b
+}
+
+// fixed reads n bytes, which are zeroes if it fails.
+func (rr *rdbReader) fixed(n int) []byte {
+	if b := rr.read(n); len(b) == n {
+		return b
+	}
+	return make([]byte, n)
+}
+
+// length reads a length, or the special encoding of a string if encoded is
+// set.
+func (rr *rdbReader) length() (n uint64, encoded bool) {
+	b := rr.byte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(rr.byte()), false
+	case 3:
+		return uint64(b & 0x3f), true
+	}
+	switch b {
+	case 0x80:
+		return uint64(binary.BigEndian.Uint32(rr.fixed(4))), false
+	case 0x81:
+		return binary.BigEndian.Uint64(rr.fixed(8)), false
+	}
+	rr.fail(fmt.Errorf("%w: bad length encoding %#x", errBadRDB, b))
+	return 0, false
+}
+
+// count reads a collection or string length, bounded so that a corrupt
+// length cannot make the reader allocate without limit.
+func (rr *rdbReader) count() int {
+	n, encoded := rr.length()
+	if encoded || n > maxBulkLen {
+		rr.fail(errBadRDB)
+		return 0
+	}
+	return int(n)
+}
+
+func (rr *rdbReader) string() []byte {
+	n, encoded := rr.length()
+	if !encoded {
+		if n > maxBulkLen {
+			rr.fail(errBadRDB)
+			return nil
+		}
+		return rr.read(int(n))
+	}
+	switch n {
+	case rdbEncInt8:
+		return strconv.AppendInt(nil, int64(int8(rr.byte())), 10)
+	case rdbEncInt16:
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(rr.fixed(2)))), 10)
+	case rdbEncInt32:
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(rr.fixed(4)))), 10)
+	case rdbEncLZF:
+		clen := rr.count()
+		ulen := rr.count()
+		data := rr.read(clen)
+		if rr.err != nil {
+			return nil
+		}
+		s, err := lzfDecompress(data, ulen)
+		if err != nil {
+			rr.fail(err)
+		}
+		return s
+	}
+	rr.fail(fmt.Errorf("%w: unknown string encoding %d", errBadRDB, n))
+	return nil
+}
+
+// float reads a sorted set score as RDB_TYPE_ZSET stores it, in decimal
+// with a one-byte length.
+func (rr *rdbReader) float() float64 {
+	n := rr.byte()
+	switch n {
+	case 253:
+		rr.fail(fmt.Errorf("%w: NaN score", errBadRDB))
+		return 0
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	}
+	return parseScore(rr.fixed(int(n)), rr)
+}
+
+func (rr *rdbReader) double() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(rr.fixed(8)))
+}
+
+// parseScore parses a sorted set score held in a string, failing rr if it
+// is not a number.
+func parseScore(b []byte, rr *rdbReader) float64 {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		rr.fail(fmt.Errorf("%w: bad score %q", errBadRDB, b))
+	}
+	return f
+}
+
+// packed reads a string holding packed entries, decoding it with decode.
+func (rr *rdbReader) packed(decode func([]byte) ([][]byte, error)) [][]byte {
+	b := rr.string()
+	if rr.err != nil {
+		return nil
+	}
+	entries, err := decode(b)
+	if err != nil {
+		rr.fail(err)
+	}
+	return entries
+}
+
+// skipModule skips a module value saved in the self-describing format,
+// after the module ID.
+func (rr *rdbReader) skipModule() {
+	for rr.err == nil {
+		op, _ := rr.length()
+		switch op {
+		case rdbModuleOpEOF:
+			return
+		case rdbModuleOpSInt, rdbModuleOpUInt:
+			rr.length()
+		case rdbModuleOpFloat:
+			rr.fixed(4)
+		case rdbModuleOpDouble:
+			rr.fixed(8)
+		case rdbModuleOpString:
+			rr.string()
+		default:
+			rr.fail(fmt.Errorf("%w: unknown module opcode %d", errBadRDB, op))
+		}
+	}
+}
+
+// skipStream skips a stream of type typ.
+func (rr *rdbReader) skipStream(typ byte) {
+	for range rr.count() {
+		rr.string() // The ID of the first entry in the listpack.
+		rr.string() // The listpack.
+	}
+	rr.length() // The number of entries.
+	rr.length() // The last ID.
+	rr.length()
+	if typ >= rdbTypeStreamListpack2 {
+		rr.length() // The first ID.
+		rr.length()
+		rr.length() // The greatest deleted ID.
+		rr.length()
+		rr.length() // The number of entries ever added.
+	}
+	for range rr.count() {
+		rr.string() // The consumer group's name.
+		rr.length() // Its last delivered ID.
+		rr.length()
+		if typ >= rdbTypeStreamListpack2 {
+			rr.length() // Its read counter.
+		}
+		for range rr.count() {
+			rr.fixed(16) // The ID of the pending entry.
+			rr.fixed(8)  // Its delivery time.
+			rr.length()  // Its delivery count.
+		}
+		for range rr.count() {
+			rr.string() // The consumer's name.
+			rr.fixed(8) // Its seen time.
+			if typ >= rdbTypeStreamListpack3 {
+				rr.fixed(8) // Its active time.
+			}
+			for range rr.count() {
+				rr.fixed(16) // The ID of an entry pending for it.
+			}
+		}
+		if rr.err != nil {
+			return
+		}
+	}
+}
+
+// value reads a value of type typ. For a value mukv has no equivalent for,
+// it returns nil and what is skipped instead.
+func (rr *rdbReader) value(typ byte) (any, string) {
+	switch typ {
+	case rdbTypeString:
+		return encodeString(rr.string()), ""
+	case rdbTypeList:
+		n := rr.count()
+		l := &deque{}
+		for range n {
+			l.PushBack(rr.string())
+		}
+		return l, ""
+	case rdbTypeListZiplist:
+		return newListValue(rr.packed(ziplistEntries)), ""
+	case rdbTypeListQuicklist:
+		l := &deque{}
+		for range rr.count() {
+			for _, e := range rr.packed(ziplistEntries) {
+				l.PushBack(e)
+			}
+		}
+		return l, ""
+	case rdbTypeListQuicklist2:
+		l := &deque{}
+		for range rr.count() {
+			container, _ := rr.length()
+			switch container {
+			case quicklistNodePlain:
+				l.PushBack(rr.string())
+			case quicklistNodePacked:
+				for _, e := range rr.packed(listpackEntries) {
+					l.PushBack(e)
+				}
+			default:
+				rr.fail(fmt.Errorf("%w: unknown quicklist container %d", errBadRDB, container))
+			}
+		}
+		return l, ""
+	case rdbTypeSet:
+		n := rr.count()
+		s := newSetValue()
+		for range n {
+			s.Add(string(rr.string()))
+		}
+		return s, ""
+	case rdbTypeSetIntset:
+		return newSetFrom(rr.packed(intsetEntries)), ""
+	case rdbTypeSetListpack:
+		return newSetFrom(rr.packed(listpackEntries)), ""
+	case rdbTypeZSet, rdbTypeZSet2:
+		n := rr.count()
+		z := newZSetValue()
+		for range n {
+			member := rr.string()
+			if typ == rdbTypeZSet {
+				z.Add(string(member), rr.float())
+			} else {
+				z.Add(string(member), rr.double())
+			}
+		}
+		return z, ""
+	case rdbTypeZSetZiplist:
+		return newZSetFrom(rr.packed(ziplistEntries), rr), ""
+	case rdbTypeZSetListpack:
+		return newZSetFrom(rr.packed(listpackEntries), rr), ""
+	case rdbTypeHash:
+		n := rr.count()
+		h := make(hashValue, min(n, 1024))
+		for range n {
+			field := rr.string()
+			h[string(field)] = rr.string()
+		}
+		return h, ""
+	case rdbTypeHashZipmap:
+		return newHashFrom(rr.packed(zipmapEntries), rr), ""
+	case rdbTypeHashZiplist:
+		return newHashFrom(rr.packed(ziplistEntries), rr), ""
+	case rdbTypeHashListpack:
+		return newHashFrom(rr.packed(listpackEntries), rr), ""
+	case rdbTypeStreamListpacks, rdbTypeStreamListpack2, rdbTypeStreamListpack3:
+		rr.skipStream(typ)
+		return nil, "stream keys"
+	case rdbTypeModule2:
+		id, _ := rr.length()
+		rr.skipModule()
+		return nil, fmt.Sprintf("module keys (%s)", moduleTypeName(id))
+	}
+	rr.fail(fmt.Errorf("%w: unsupported value type %d", errBadRDB, typ))
+	return nil, ""
+}
+
+func newListValue(entries [][]byte) *deque {
+	l := &deque{}
+	for _, e := range entries {
+		l.PushBack(e)
+	}
+	return l
+}
+
+func newSetFrom(members [][]byte) *setValue {
+	s := newSetValue()
+	for _, m := range members {
+		s.Add(string(m))
+	}
+	return s
+}
+
+// newZSetFrom returns a sorted set from packed entries alternating between
+// members and their scores.
+func newZSetFrom(entries [][]byte, rr *rdbReader) *zsetValue {
+	if len(entries)%2 != 0 {
+		rr.fail(fmt.Errorf("%w: odd number of sorted set entries", errBadRDB))
+	}
+	z := newZSetValue()
+	for i := 0; i+1 < len(entries); i += 2 {
+		z.Add(string(entries[i]), parseScore(entries[i+1], rr))
+	}
+	return z
+}
+
+// newHashFrom returns a hash from packed entries alternating between fields
+// and their values.
+func newHashFrom(entries [][]byte, rr *rdbReader) hashValue {
+	if len(entries)%2 != 0 {
+		rr.fail(fmt.Errorf("%w: odd number of hash entries", errBadRDB))
+	}
+	h := make(hashValue, len(entries)/2)
+	for i := 0; i+1 < len(entries); i += 2 {
+		h[string(entries[i])] = entries[i+1]
+	}
+	return h
+}
+
+// isEmpty reports whether v is a collection with no elements, which Redis
+// never saves but a damaged file may hold.
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case hashValue:
+		return len(v) == 0
+	case *deque:
+		return v.Len() == 0
+	case *setValue:
+		return v.Len() == 0
+	case *zsetValue:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// moduleTypeNameChars are the characters module type names are made of.
+const moduleTypeNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// moduleTypeName returns the name of the module type with the given ID,
+// which packs its nine characters above a 10-bit encoding version.
+func moduleTypeName(id uint64) string {
+	var name [9]byte
+	id >>= 10
+	for i := len(name) - 1; i >= 0; i-- {
+		name[i] = moduleTypeNameChars[id&63]
+		id >>= 6
+	}
+	return string(name[:])
+}
+
+// readRDB decodes an RDB file from r, calling fn with the database index of
+// each key along with the key. Keys that expired before now are skipped, as
+// are values mukv has no equivalent for.
+func readRDB(r io.Reader, now time.Time, fn func(db int, e snapshotEntry) error) (RDBImportStats, error) {
+	stats := RDBImportStats{Skipped: map[string]int{}}
+	rr := &rdbReader{r: bufio.NewReader(r)}
+
+	header := rr.fixed(len(rdbMagic) + 4)
+	if rr.err != nil {
+		return stats, fmt.Errorf("reading RDB header: %w", rr.err)
+	}
+	if !bytes.Equal(header[:len(rdbMagic)], []byte(rdbMagic)) {
+		return stats, fmt.Errorf("%w: bad magic", errBadRDB)
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || version < 1 || version > rdbMaxVersion {
+		return stats, fmt.Errorf("%w: unsupported version %q", errBadRDB, header[len(rdbMagic):])
+	}
+
+	db := 0
+	// The metadata of the next key.
+	var expireAt time.Time
+	var freq, idle int64 = 0, -1
+	for rr.err == nil {
+		op := rr.byte()
+		switch op {
+		case rdbOpEOF:
+			if version < rdbChecksumVersion {
+				return stats, nil
+			}
+			sum := rr.crc
+			var b [8]byte
+			if _, err := io.ReadFull(rr.r, b[:]); err != nil {
+				return stats, fmt.Errorf("reading RDB checksum: %w", err)
+			}
+			if want := binary.LittleEndian.Uint64(b[:]); want != 0 && want != sum {
+				return stats, fmt.Errorf("%w: checksum mismatch", errBadRDB)
+			}
+			return stats, nil
+		case rdbOpSelectDB:
+			db = rr.count()
+			continue
+		case rdbOpResizeDB:
+			rr.length()
+			rr.length()
+			continue
+		case rdbOpAux:
+			rr.string()
+			rr.string()
+			continue
+		case rdbOpExpireTimeMS:
+			expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(rr.fixed(8))))
+			continue
+		case rdbOpExpireTime:
+			expireAt = time.Unix(int64(int32(binary.LittleEndian.Uint32(rr.fixed(4)))), 0)
+			continue
+		case rdbOpIdle:
+			n, _ := rr.length()
+			idle = int64(min(n, math.MaxInt32))
+			continue
+		case rdbOpFreq:
+			freq = int64(rr.byte())
+			continue
+		case rdbOpModuleAux:
+			id, _ := rr.length()
+			rr.length() // The opcode of when it was saved.
+			rr.length() // When it was saved.
+			rr.skipModule()
+			stats.Skipped[fmt.Sprintf("module aux fields (%s)", moduleTypeName(id))]++
+			continue
+		case rdbOpFunction2:
+			rr.string()
+			stats.Skipped["function libraries"]++
+			continue
+		}
+
+		e := snapshotEntry{key: string(rr.string()), expireAt: expireAt, hits: freq}
+		e.accessed = now.UnixNano()
+		if idle >= 0 {
+			e.accessed = now.Add(-time.Duration(idle) * time.Second).UnixNano()
+		}
+		expireAt, freq, idle = time.Time{}, 0, -1
+
+		var skipped string
+		e.value, skipped = rr.value(op)
+		switch {
+		case rr.err != nil:
+		case skipped != "":
+			stats.Skipped[skipped]++
+		case isEmpty(e.value):
+			stats.Skipped["empty keys"]++
+		case !e.expireAt.IsZero() && !e.expireAt.After(now):
+			stats.Expired++
+		default:
+			if err := fn(db, e); err != nil {
+				return stats, err
+			}
+			stats.Keys++
+		}
+	}
+	return stats, fmt.Errorf("reading RDB: %w", rr.err)
+}
+
+// ziplistEntries decodes a ziplist, the packed encoding of small collections
+// before listpacks replaced it. Integer entries are returned in decimal.
+func ziplistEntries(b []byte) ([][]byte, error) {
+	// The header holds the total size, the offset of the last entry and the
+	// number of entries.
+	const headerLen = 10
+	if len(b) < headerLen+1 {
+		return nil, fmt.Errorf("%w: ziplist too short", errBadRDB)
+	}
+	var entries [][]byte
+	p := headerLen
+	for p < len(b) && b[p] != 0xff {
+		// Skip the length of the previous entry.
+		if b[p] < 0xfe {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(b) {
+			break
+		}
+		enc := b[p]
+		var n int // The length of the entry's data.
+		var v int64
+		isInt := true
+		switch {
+		case enc>>6 == 0:
+			n, isInt = int(enc&0x3f), false
+			p++
+		case enc>>6 == 1 && p+1 < len(b):
+			n, isInt = int(enc&0x3f)<<8|int(b[p+1]), false
+			p += 2
+		case enc>>6 == 2 && p+4 < len(b):
+			n, isInt = int(binary.BigEndian.Uint32(b[p+1:])), false
+			p += 5
+		case enc == 0xc0 && p+2 < len(b):
+			v = int64(int16(binary.LittleEndian.Uint16(b[p+1:])))
+			p += 3
+		case enc == 0xd0 && p+4 < len(b):
+			v = int64(int32(binary.LittleEndian.Uint32(b[p+1:])))
+			p += 5
+		case enc == 0xe0 && p+8 < len(b):
+			v = int64(binary.LittleEndian.Uint64(b[p+1:]))
+			p += 9
+		case enc == 0xf0 && p+3 < len(b):
+			v = int64(int32(uint32(b[p+1])<<8|uint32(b[p+2])<<16|uint32(b[p+3])<<24) >> 8)
+			p += 4
+		case enc == 0xfe && p+1 < len(b):
+			v = int64(int8(b[p+1]))
+			p += 2
+		case enc >= 0xf1 && enc <= 0xfd:
+			v = int64(enc&0x0f) - 1
+			p++
+		default:
+			return nil, fmt.Errorf("%w: bad ziplist entry encoding %#x", errBadRDB, enc)
+		}
+		if isInt {
+			entries = append(entries, strconv.AppendInt(nil, v, 10))
+			continue
+		}
+		if n > len(b)-p {
+			return nil, fmt.Errorf("%w: ziplist truncated", errBadRDB)
+		}
+		entries = append(entries, bytes.Clone(b[p:p+n]))
+		p += n
+	}
+	if p >= len(b) {
+		return nil, fmt.Errorf("%w: ziplist truncated", errBadRDB)
+	}
+	return entries, nil
+}
+
+// listpackEntries decodes a listpack, the packed encoding of small
+// collections. Integer entries are returned in decimal.
+func listpackEntries(b []byte) ([][]byte, error) {
+	// The header holds the total size and the number of entries.
+	const headerLen = 6
+	if len(b) < headerLen+1 {
+		return nil, fmt.Errorf("%w: listpack too short", errBadRDB)
+	}
+	var entries [][]byte
+	p := headerLen
+	for p < len(b) && b[p] != 0xff {
+		start := p
+		enc := b[p]
+		var n int // The length of the entry's data.
+		var v int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			v = int64(enc)
+			p++
+		case enc&0xc0 == 0x80:
+			n, isInt = int(enc&0x3f), false
+			p++
+		case enc&0xe0 == 0xc0 && p+1 < len(b):
+			v = int64(enc&0x1f)<<8 | int64(b[p+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			p += 2
+		case enc&0xf0 == 0xe0 && p+1 < len(b):
+			n, isInt = int(enc&0x0f)<<8|int(b[p+1]), false
+			p += 2
+		case enc == 0xf0 && p+4 < len(b):
+			n, isInt = int(binary.LittleEndian.Uint32(b[p+1:])), false
+			p += 5
+		case enc == 0xf1 && p+2 < len(b):
+			v = int64(int16(binary.LittleEndian.Uint16(b[p+1:])))
+			p += 3
+		case enc == 0xf2 && p+3 < len(b):
+			v = int64(int32(uint32(b[p+1])<<8|uint32(b[p+2])<<16|uint32(b[p+3])<<24) >> 8)
+			p += 4
+		case enc == 0xf3 && p+4 < len(b):
+			v = int64(int32(binary.LittleEndian.Uint32(b[p+1:])))
+			p += 5
+		case enc == 0xf4 && p+8 < len(b):
+			v = int64(binary.LittleEndian.Uint64(b[p+1:]))
+			p += 9
+		default:
+			return nil, fmt.Errorf("%w: bad listpack entry encoding %#x", errBadRDB, enc)
+		}
+		if isInt {
+			entries = append(entries, strconv.AppendInt(nil, v, 10))
+		} else {
+			if n > len(b)-p {
+				return nil, fmt.Errorf("%w: listpack truncated", errBadRDB)
+			}
+			entries = append(entries, bytes.Clone(b[p:p+n]))
+			p += n
+		}
+		// Skip the entry's length, which follows it so that listpacks can
+		// be walked backwards.
+		p += listpackBacklenSize(p - start)
+	}
+	if p >= len(b) {
+		return nil, fmt.Errorf("%w: listpack truncated", errBadRDB)
+	}
+	return entries, nil
+}
+
+// listpackBacklenSize returns how many bytes the length of an entry of n
+// bytes takes when written after it.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset, the sorted array small sets of integers
+// are stored as, returning its members in decimal.
+func intsetEntries(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: intset too short", errBadRDB)
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if width != 2 && width != 4 && width != 8 || n > (len(b)-8)/width {
+		return nil, fmt.Errorf("%w: bad intset", errBadRDB)
+	}
+	entries := make([][]byte, n)
+	for i := range entries {
+		at := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(at)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(at)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(at))
+		}
+		entries[i] = strconv.AppendInt(nil, v, 10)
+	}
+	return entries, nil
+}
+
+// zipmapEntries decodes a zipmap, the packed encoding of small hashes before
+// ziplists replaced it, returning its fields alternating with their values.
+func zipmapEntries(b []byte) ([][]byte, error) {
+	bad := fmt.Errorf("%w: bad zipmap", errBadRDB)
+	// The first byte holds the number of fields, if there are fewer than
+	// 254.
+	p := 1
+	readLen := func() (int, bool) {
+		if p >= len(b) || b[p] == 0xff {
+			return 0, false
+		}
+		if b[p] < 0xfe {
+			p++
+			return int(b[p-1]), true
+		}
+		if p+4 >= len(b) {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(b[p+1:]))
+		p += 5
+		return n, true
+	}
+	var entries [][]byte
+	for {
+		n, ok := readLen()
+		if !ok {
+			break
+		}
+		if n > len(b)-p {
+			return nil, bad
+		}
+		entries = append(entries, bytes.Clone(b[p:p+n]))
+		p += n
+
+		n, ok = readLen()
+		// The value's length is followed by the number of unused bytes
+		// after it.
+		if !ok || p >= len(b) {
+			return nil, bad
+		}
+		free := int(b[p])
+		p++
+		if n+free > len(b)-p {
+			return nil, bad
+		}
+		entries = append(entries, bytes.Clone(b[p:p+n]))
+		p += n + free
+	}
+	if p >= len(b) {
+		return nil, bad
+	}
+	return entries, nil
+}
+
+// lzfDecompress decompresses data compressed with LZF into n bytes.
+func lzfDecompress(data []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(data); {
+		ctrl := int(data[i])
+		i++
+		if ctrl < 1<<5 {
+			// A run of ctrl+1 literal bytes.
+			run := ctrl + 1
+			if run > len(data)-i || len(out)+run > n {
+				return nil, fmt.Errorf("%w: bad LZF data", errBadRDB)
+			}
+			out = append(out, data[i:i+run]...)
+			i += run
+			continue
+		}
+		// A back reference to length+2 bytes already decompressed.
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(data) {
+				return nil, fmt.Errorf("%w: bad LZF data", errBadRDB)
+			}
+			length += int(data[i])
+			i++
+		}
+		if i >= len(data) {
+			return nil, fmt.Errorf("%w: bad LZF data", errBadRDB)
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(data[i]) - 1
+		i++
+		length += 2
+		if ref < 0 || len(out)+length > n {
+			return nil, fmt.Errorf("%w: bad LZF data", errBadRDB)
+		}
+		// The reference may overlap the bytes it produces, so copy them
+		// one at a time.
+		for j := range length {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, fmt.Errorf("%w: bad LZF data", errBadRDB)
+	}
+	return out, nil
+}
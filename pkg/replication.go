@@ -0,0 +1,650 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// A replica connects to its leader with PSYNC and receives a snapshot of the
+// leader's databases, followed by a stream of the writes the leader makes
+// after taking it. The stream holds the commands the append-only file would
+// log, in the same order, so applying them in turn keeps the replica's
+// databases identical to the leader's. Replicas report how much of the
+// stream they have applied, their offset, with REPLCONF ACK every second,
+// and the leader pings them through the stream so that an idle leader can be
+// told from a lost one.
+const (
+	// replicaBufferLimit is how much of the stream a replica may fall behind
+	// by, in bytes, before it is disconnected.
+	replicaBufferLimit = 256 << 20
+	// replicationPingPeriod is how often the leader pings its replicas.
+	replicationPingPeriod = 10 * time.Second
+	// replicationTimeout is how long a replica waits to hear from its
+	// leader before it reconnects.
+	replicationTimeout = 60 * time.Second
+	// replicaAckPeriod is how often a replica reports its offset.
+	replicaAckPeriod = time.Second
+	// replicaRetryDelay is how long a replica waits before reconnecting to
+	// its leader.
+	replicaRetryDelay  = time.Second
+	replicaDialTimeout = 5 * time.Second
+)
+
+// replication holds the state of both sides of replication: the replicas
+// streamed to, and the leader followed, if any.
+type replication struct {
+	// The mutex guards the fields below it and orders the stream.
+	mu sync.Mutex
+	// replid identifies the stream, and offset is its length in bytes.
+	replid string
+	offset int64
+	// db is the database the streamed commands leave selected, or -1 if the
+	// next command must select its own.
+	db       int
+	replicas map[*replica]struct{}
+	// link is the connection to the leader, or nil when not following one.
+	link *leaderLink
+
+	// streaming is set while replicas are attached.
+	streaming atomic.Bool
+	following atomic.Bool
+	// replicaReadOnly refuses writes from clients while following a leader.
+	replicaReadOnly atomic.Bool
+	// port is the port clients connect on, which replicas report to their
+	// leader.
+	port atomic.Int64
+}
+
+func newReplication(cfg Config) *replication {
+	r := &replication{replid: newReplID(), db: -1, replicas: map[*replica]struct{}{}}
+	r.replicaReadOnly.Store(cfg.ReplicaReadOnly)
+	return r
+}
+
+// newReplID returns a random stream ID, as Redis formats them.
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// readOnly reports whether clients are refused writes.
+func (r *replication) readOnly() bool {
+	return r.following.Load() && r.replicaReadOnly.Load()
+}
+
+// append streams args, run in database db, to the replicas.
+func (r *replication) append(db int, args [][]byte) {
+	if !r.streaming.Load() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var chunk []byte
+	chunk, r.db = appendLogged(nil, r.db, db, args)
+	r.push(chunk)
+}
+
+// push streams chunk to the replicas. r.mu must be held.
+func (r *replication) push(chunk []byte) {
+	r.offset += int64(len(chunk))
+	for rep := range r.replicas {
+		rep.push(chunk)
+	}
+}
+
+// ping pings the replicas through the stream.
+func (r *replication) ping() {
+	if !r.streaming.Load() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.push(appendCommand(nil, [][]byte{[]byte("PING")}))
+}
+
+// StartReplicationLoop pings replicas while there are any.
+func (mkv *MuKV) StartReplicationLoop() {
+	ticker := time.NewTicker(replicationPingPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		mkv.repl.ping()
+	}
+}
+
+// replica is a replica attached to this server.
+type replica struct {
+	conn redcon.DetachedConn
+	addr string
+	// port is the port the replica serves clients on.
+	port int
+	// legacy is set for replicas that connected with SYNC, which expect the
+	// snapshot without a FULLRESYNC reply before it.
+	legacy bool
+
+	// The mutex guards buf, the part of the stream not yet written to the
+	// replica.
+	mu    sync.Mutex
+	buf   []byte
+	ready chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	online atomic.Bool
+	// ackOffset is the offset the replica last reported, and lastAck the
+	// Unix time it reported it at.
+	ackOffset atomic.Int64
+	lastAck   atomic.Int64
+}
+
+// push queues chunk to be written to the replica, disconnecting it if it has
+// fallen too far behind.
+func (rep *replica) push(chunk []byte) {
+	rep.mu.Lock()
+	if len(rep.buf)+len(chunk) > replicaBufferLimit {
+		rep.mu.Unlock()
+		rep.close()
+		return
+	}
+	rep.buf = append(rep.buf, chunk...)
+	rep.mu.Unlock()
+	select {
+	case rep.ready <- struct{}{}:
+	default:
+	}
+}
+
+// close disconnects the replica. The network connection is closed directly,
+// since the replica's writer may be using the buffered one.
+func (rep *replica) close() {
+	rep.once.Do(func() {
+		close(rep.done)
+		rep.conn.NetConn().Close()
+	})
+}
+
+// readAcks records the offsets the replica reports until it disconnects.
+func (rep *replica) readAcks() {
+	defer rep.close()
+	for {
+		cmd, err := rep.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		if len(cmd.Args) == 3 && strings.EqualFold(string(cmd.Args[0]), "replconf") &&
+			strings.EqualFold(string(cmd.Args[1]), "ack") {
+			if n, ok := parseInt(cmd.Args[2]); ok {
+				rep.ackOffset.Store(n)
+				rep.lastAck.Store(time.Now().Unix())
+			}
+		}
+	}
+}
+
+// attachReplica starts streaming to the replica connected on conn, and
+// returns a snapshot of the databases taken at the offset the stream starts
+// from for it, along with the stream's ID.
+func (mkv *MuKV) attachReplica(rep *replica) (*snapshot, string, int64) {
+	r := mkv.repl
+	// Holding the write order lock keeps writes from being both in the
+	// snapshot and in the stream.
+	mkv.order.Lock()
+	defer mkv.order.Unlock()
+	r.mu.Lock()
+	r.replicas[rep] = struct{}{}
+	// The replica has no database selected yet.
+	r.db = -1
+	replid, offset := r.replid, r.offset
+	r.mu.Unlock()
+	r.streaming.Store(true)
+	return mkv.snapshot(), replid, offset
+}
+
+// detachReplica stops streaming to rep, and stops streaming altogether once
+// no replicas are left.
+func (mkv *MuKV) detachReplica(rep *replica) {
+	rep.close()
+	r := mkv.repl
+	mkv.order.Lock()
+	defer mkv.order.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.replicas, rep)
+	if len(r.replicas) == 0 {
+		r.streaming.Store(false)
+	}
+}
+
+// dropReplicas disconnects every replica, which then resynchronize from the
+// start.
+func (r *replication) dropReplicas() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for rep := range r.replicas {
+		rep.close()
+	}
+}
+
+// serveReplica sends rep the snapshot it starts from and then streams to it
+// until it disconnects.
+func (mkv *MuKV) serveReplica(rep *replica, snap *snapshot, replid string, offset int64) {
+	logger := mkv.Log.With().Str("function", "serveReplica").Str("replica", rep.addr).Logger()
+	defer mkv.detachReplica(rep)
+	go rep.readAcks()
+
+	var b bytes.Buffer
+	if _, err := snap.WriteTo(&b); err != nil {
+		logger.Error().Err(err).Msg("failed to encode the snapshot")
+		return
+	}
+	if !rep.legacy {
+		rep.conn.WriteString(fmt.Sprintf("FULLRESYNC %s %d", replid, offset))
+	}
+	rep.conn.WriteBulk(b.Bytes())
+	if err := rep.conn.Flush(); err != nil {
+		logger.Warn().Err(err).Msg("failed to send the snapshot")
+		return
+	}
+	rep.ackOffset.Store(offset)
+	rep.lastAck.Store(time.Now().Unix())
+	rep.online.Store(true)
+	logger.Info().Int("bytes", b.Len()).Msg("replica synchronized")
+
+	for {
+		select {
+		case <-rep.ready:
+		case <-rep.done:
+			logger.Info().Msg("replica disconnected")
+			return
+		}
+		rep.mu.Lock()
+		chunk := rep.buf
+		rep.buf = nil
+		rep.mu.Unlock()
+		rep.conn.WriteRaw(chunk)
+		if err := rep.conn.Flush(); err != nil {
+			logger.Info().Err(err).Msg("replica disconnected")
+			return
+		}
+	}
+}
+
+// leaderLink is a replica's connection to its leader.
+type leaderLink struct {
+	addr string
+	stop chan struct{}
+
+	// The mutex guards conn, which is nil while disconnected.
+	mu      sync.Mutex
+	conn    net.Conn
+	stopped bool
+
+	up      atomic.Bool
+	syncing atomic.Bool
+	// offset is how much of the stream has been applied.
+	offset atomic.Int64
+	// lastIO is the Unix time the leader was last heard from, or 0.
+	lastIO atomic.Int64
+}
+
+// setConn records the connection to the leader, reporting false if the link
+// was closed meanwhile.
+func (l *leaderLink) setConn(c net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = c
+	return !l.stopped
+}
+
+// close stops following the leader.
+func (l *leaderLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+var errLinkClosed = errors.New("stopped following the leader")
+
+// replicaOf makes the server a replica of the leader at addr, replacing its
+// databases with the leader's. It reports false if the server already
+// follows that leader.
+func (mkv *MuKV) replicaOf(addr string) bool {
+	r := mkv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.link != nil {
+		if r.link.addr == addr {
+			return false
+		}
+		r.link.close()
+	}
+	r.link = &leaderLink{addr: addr, stop: make(chan struct{})}
+	r.following.Store(true)
+	go mkv.follow(r.link)
+	return true
+}
+
+// stopReplicating stops following the leader, keeping the databases as
+// they are. The stream gets a new ID, since it no longer follows the
+// leader's.
+func (mkv *MuKV) stopReplicating() {
+	r := mkv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.link == nil {
+		return
+	}
+	r.link.close()
+	r.link = nil
+	r.following.Store(false)
+	r.replid = newReplID()
+}
+
+// follow keeps the server synchronized with the leader until the link is
+// closed, reconnecting whenever the connection is lost.
+func (mkv *MuKV) follow(link *leaderLink) {
+	logger := mkv.Log.With().Str("function", "follow").Str("leader", link.addr).Logger()
+	for {
+		err := mkv.syncFrom(link)
+		link.up.Store(false)
+		link.syncing.Store(false)
+		select {
+		case <-link.stop:
+			logger.Info().Msg("stopped following the leader")
+			return
+		default:
+		}
+		logger.Warn().Err(err).Msg("lost the connection to the leader")
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+// syncFrom connects to the leader, loads its snapshot and applies the stream
+// of writes that follows until the connection is lost.
+func (mkv *MuKV) syncFrom(link *leaderLink) error {
+	logger := mkv.Log.With().Str("function", "syncFrom").Str("leader", link.addr).Logger()
+
+	c, err := net.DialTimeout("tcp", link.addr, replicaDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !link.setConn(c) {
+		return errLinkClosed
+	}
+	link.syncing.Store(true)
+	cr := &countingReader{r: c}
+	br := bufio.NewReader(cr)
+
+	// call sends a command to the leader and returns its simple string
+	// reply.
+	call := func(args ...string) (string, error) {
+		cmd := make([][]byte, len(args))
+		for i, arg := range args {
+			cmd[i] = []byte(arg)
+		}
+		c.SetDeadline(time.Now().Add(replicationTimeout))
+		if _, err := c.Write(appendCommand(nil, cmd)); err != nil {
+			return "", err
+		}
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if !strings.HasPrefix(line, "+") {
+			return "", fmt.Errorf("leader replied to %s with %q", args[0], line)
+		}
+		return line[1:], nil
+	}
+	if _, err := call("PING"); err != nil {
+		return err
+	}
+	port := strconv.FormatInt(mkv.repl.port.Load(), 10)
+	if _, err := call("REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+	reply, err := call("PSYNC", "?", "-1")
+	if err != nil {
+		return err
+	}
+	var replid string
+	var offset int64
+	if _, err := fmt.Sscanf(reply, "FULLRESYNC %s %d", &replid, &offset); err != nil {
+		return fmt.Errorf("leader replied to PSYNC with %q", reply)
+	}
+
+	// The snapshot follows as a bulk string.
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"), 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("leader sent %q in place of a snapshot", line)
+	}
+	c.SetDeadline(time.Time{})
+	snap := make([]byte, size+2)
+	if _, err := io.ReadFull(br, snap); err != nil {
+		return err
+	}
+	if err := mkv.loadFromLeader(snap[:size], replid, offset); err != nil {
+		return err
+	}
+	link.offset.Store(offset)
+	link.lastIO.Store(time.Now().Unix())
+	link.syncing.Store(false)
+	link.up.Store(true)
+	logger.Info().Int64("bytes", size).Int64("offset", offset).Msg("synchronized with the leader")
+
+	done := make(chan struct{})
+	defer close(done)
+	go link.sendAcks(c, done)
+
+	conn := &bufferConn{ctx: &client{leader: true}}
+	for {
+		c.SetReadDeadline(time.Now().Add(replicationTimeout))
+		start := cr.n - int64(br.Buffered())
+		args, err := readCommand(br)
+		if err != nil {
+			return err
+		}
+		link.lastIO.Store(time.Now().Unix())
+		mkv.Handler(conn, redcon.Command{Args: args})
+		conn.buf = conn.buf[:0]
+		link.offset.Add(cr.n - int64(br.Buffered()) - start)
+	}
+}
+
+// sendAcks reports the replica's offset to the leader on c until done is
+// closed.
+func (l *leaderLink) sendAcks(c net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replicaAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		offset := strconv.FormatInt(l.offset.Load(), 10)
+		ack := appendCommand(nil, [][]byte{[]byte("REPLCONF"), []byte("ACK"), []byte(offset)})
+		if _, err := c.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// loadFromLeader replaces the databases with the snapshot the leader sent,
+// and continues the leader's stream from it.
+func (mkv *MuKV) loadFromLeader(snap []byte, replid string, offset int64) error {
+	r := mkv.repl
+	mkv.order.Lock()
+	for _, ks := range mkv.DBs {
+		ks.Flush(false)
+	}
+	_, err := mkv.restore(bytes.NewReader(snap), time.Now())
+	// Replicas of this server were streamed the old databases, and must
+	// start over from the new ones.
+	r.dropReplicas()
+	r.mu.Lock()
+	r.replid, r.offset, r.db = replid, offset, -1
+	r.mu.Unlock()
+	mkv.order.Unlock()
+	if err != nil {
+		return fmt.Errorf("loading the leader's snapshot: %w", err)
+	}
+
+	// The keys were stored without going through commands, so they are
+	// only logged by rewriting the append-only file.
+	if mkv.aof.enabled.Load() {
+		return mkv.rewriteAOF()
+	}
+	return nil
+}
+
+func (mkv *MuKV) handleReplicaOf(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	if strings.EqualFold(string(cmd.Args[1]), "no") && strings.EqualFold(string(cmd.Args[2]), "one") {
+		mkv.stopReplicating()
+		conn.WriteString("OK")
+		return
+	}
+	port, ok := parseInt(cmd.Args[2])
+	if !ok || port < 1 || port > 65535 {
+		conn.WriteError("ERR Invalid master port")
+		return
+	}
+	if !mkv.replicaOf(net.JoinHostPort(string(cmd.Args[1]), strconv.FormatInt(port, 10))) {
+		conn.WriteString("OK Already connected to specified master")
+		return
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handleReplConf(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	for i := 1; i < len(cmd.Args); i += 2 {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "listening-port":
+			port, ok := parseInt(cmd.Args[i+1])
+			if !ok || port < 0 || port > 65535 {
+				conn.WriteError("ERR Invalid listening port")
+				return
+			}
+			clientFor(conn).listeningPort = int(port)
+		case "capa", "ip-address":
+			// Capabilities are Redis features this server does not use.
+		default:
+			conn.WriteError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", cmd.Args[i]))
+			return
+		}
+	}
+	conn.WriteString("OK")
+}
+
+func (mkv *MuKV) handlePSync(conn redcon.Conn, cmd redcon.Command) {
+	legacy := strings.EqualFold(string(cmd.Args[0]), "sync")
+	if legacy && len(cmd.Args) != 1 || !legacy && len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	// Partial resynchronization is not supported, so every replica starts
+	// from a full snapshot whatever offset it asks for.
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr())
+	rep := &replica{
+		addr:   host,
+		port:   clientFor(conn).listeningPort,
+		legacy: legacy,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	rep.lastAck.Store(time.Now().Unix())
+	rep.conn = conn.Detach()
+	snap, replid, offset := mkv.attachReplica(rep)
+	go mkv.serveReplica(rep, snap, replid, offset)
+}
+
+func (mkv *MuKV) replicationInfo() []string {
+	r := mkv.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lines []string
+	if link := r.link; link != nil {
+		host, port, _ := net.SplitHostPort(link.addr)
+		status := "down"
+		if link.up.Load() {
+			status = "up"
+		}
+		lastIO := int64(-1)
+		if at := link.lastIO.Load(); at != 0 {
+			lastIO = time.Now().Unix() - at
+		}
+		lines = append(lines,
+			"role:slave",
+			fmt.Sprintf("master_host:%s", host),
+			fmt.Sprintf("master_port:%s", port),
+			fmt.Sprintf("master_link_status:%s", status),
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolInt(link.syncing.Load())),
+			fmt.Sprintf("slave_repl_offset:%d", link.offset.Load()),
+			fmt.Sprintf("slave_read_only:%d", boolInt(r.replicaReadOnly.Load())),
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(r.replicas)))
+	now := time.Now().Unix()
+	i := 0
+	for rep := range r.replicas {
+		state := "wait_bgsave"
+		if rep.online.Load() {
+			state = "online"
+		}
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, rep.addr, rep.port, state, rep.ackOffset.Load(), now-rep.lastAck.Load()))
+		i++
+	}
+	return append(lines,
+		fmt.Sprintf("master_replid:%s", r.replid),
+		fmt.Sprintf("master_repl_offset:%d", r.offset),
+	)
+}
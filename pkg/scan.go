@@ -0,0 +1,120 @@
+package mukv
+
+import (
+	"hash/maphash"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+// scanSeed orders the elements of collections for HSCAN and friends. It is
+// fixed for the life of the process so that cursors stay valid across calls.
+var scanSeed = maphash.MakeSeed()
+
+// scanOptions holds the MATCH, COUNT, NOVALUES and TYPE options of a *SCAN
+// command.
+type scanOptions struct {
+	pattern   string
+	count     int
+	noValues  bool
+	valueType string
+}
+
+func parseScanCursor(arg []byte) (uint64, string) {
+	cursor, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		return 0, "ERR invalid cursor"
+	}
+	return cursor, ""
+}
+
+// parseScanOptions parses the options of a *SCAN command. TYPE is accepted
+// only when typed is set, for SCAN over the keyspace.
+func parseScanOptions(args [][]byte, typed bool) (scanOptions, string) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			if i+1 == len(args) {
+				return opts, errSyntax
+			}
+			i++
+			opts.pattern = string(args[i])
+		case "count":
+			if i+1 == len(args) {
+				return opts, errSyntax
+			}
+			i++
+			n, err := strconv.Atoi(string(args[i]))
+			if err != nil {
+				return opts, errNotInteger
+			}
+			if n < 1 {
+				return opts, errSyntax
+			}
+			opts.count = n
+		case "novalues":
+			opts.noValues = true
+		case "type":
+			if !typed || i+1 == len(args) {
+				return opts, errSyntax
+			}
+			i++
+			opts.valueType = strings.ToLower(string(args[i]))
+			if !slices.Contains(valueTypeNames[:], opts.valueType) {
+				return opts, "ERR unknown type name"
+			}
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, ""
+}
+
+func (opts scanOptions) matches(name string) bool {
+	return opts.pattern == "" || match.Match(name, opts.pattern)
+}
+
+// scanNames walks names in the order of their hashes, returning up to count
+// names whose hash is at or after cursor along with the cursor to continue
+// from, which is 0 once the walk is complete. Any name present for the whole
+// walk is returned exactly once, however the collection changes between
+// calls.
+func scanNames(names []string, cursor uint64, count int) ([]string, uint64) {
+	type hashed struct {
+		name string
+		hash uint64
+	}
+	pending := make([]hashed, 0, len(names))
+	for _, name := range names {
+		if h := maphash.String(scanSeed, name); h >= cursor {
+			pending = append(pending, hashed{name, h})
+		}
+	}
+	slices.SortFunc(pending, func(a, b hashed) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	// Never split names sharing a hash across calls, since the cursor
+	// could not tell them apart.
+	n := min(count, len(pending))
+	for n < len(pending) && pending[n].hash == pending[n-1].hash {
+		n++
+	}
+	page := make([]string, n)
+	for i := range page {
+		page[i] = pending[i].name
+	}
+	if n == len(pending) {
+		return page, 0
+	}
+	return page, pending[n].hash
+}
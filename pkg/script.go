@@ -0,0 +1,609 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts run one at a time in a single Lua VM, holding the isolation lock
+// exclusively as EXEC does, so no other client sees a script half done.
+// Rather than the script, the writes it makes are logged as it makes them,
+// between MULTI and EXEC, so replicas and the append-only file get the
+// same result however the script came to it.
+
+const (
+	errBusy     = "BUSY Redis is busy running a script. You can only call SCRIPT KILL."
+	errNoScript = "NOSCRIPT No matching script. Please use EVAL."
+)
+
+// scriptName is the name scripts are compiled under, which errors name
+// them by.
+const scriptName = "user_script"
+
+// scripting holds the Lua VM and the scripts loaded into it.
+type scripting struct {
+	mu sync.Mutex
+	// scripts maps the SHA1 digest of each loaded script, in hex, to the
+	// script compiled.
+	scripts map[string]*lua.FunctionProto
+
+	// vm runs scripts, which only EVAL and friends do, holding the
+	// isolation lock exclusively.
+	vm *lua.LState
+	// onError turns an error a script raises into its error reply.
+	onError *lua.LFunction
+	// timeLimit is how long a script may run, in milliseconds, before
+	// other clients are answered BUSY and may stop it with SCRIPT KILL.
+	timeLimit atomic.Int32
+	// running is the script being run, if any.
+	running atomic.Pointer[runningScript]
+}
+
+// runningScript is a script being run.
+type runningScript struct {
+	sha     string
+	started time.Time
+	cancel  context.CancelFunc
+	// conn is the client the script calls commands as.
+	conn *bufferConn
+	// readOnly is set for scripts run by EVAL_RO and EVALSHA_RO.
+	readOnly bool
+	// opened is set once the script has logged MULTI ahead of its writes.
+	opened bool
+
+	// mu guards wrote and killed, which SCRIPT KILL looks at.
+	mu sync.Mutex
+	// wrote is set once the script has called a command that writes,
+	// after which it cannot be killed.
+	wrote  bool
+	killed bool
+}
+
+func newScripting(mkv *MuKV, cfg Config) *scripting {
+	s := &scripting{scripts: make(map[string]*lua.FunctionProto)}
+	s.timeLimit.Store(int32(min(cfg.LuaTimeLimit.Milliseconds(), 1<<30)))
+	s.vm = mkv.newScriptVM()
+	s.onError = s.vm.NewFunction(s.scriptError)
+	return s
+}
+
+// newScriptVM creates the VM scripts run in, holding the base, table,
+// string and math libraries and the redis library. Globals can be neither
+// created nor read before they are set, to catch scripts leaking state
+// into later ones.
+func (mkv *MuKV) newScriptVM() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	globals := L.G.Global
+	for _, name := range []string{"dofile", "loadfile", "print", "_printregs"} {
+		globals.RawSetString(name, lua.LNil)
+	}
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return mkv.luaCall(L, false) },
+		"pcall":        func(L *lua.LState) int { return mkv.luaCall(L, true) },
+		"error_reply":  luaErrorReply,
+		"status_reply": luaStatusReply,
+		"sha1hex":      luaSHA1Hex,
+		"log":          mkv.luaLog,
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	globals.RawSetString("redis", redis)
+
+	protect := L.NewTable()
+	protect.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Attempt to modify a readonly table")
+		return 0
+	}))
+	protect.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.ToString(2))
+		return 0
+	}))
+	L.SetMetatable(globals, protect)
+	return L
+}
+
+// scriptSHA returns the SHA1 digest of body in hex, which scripts are
+// known by.
+func scriptSHA(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles body and caches it, returning its digest, or the error
+// reply if it does not compile.
+func (s *scripting) load(body []byte) (string, *lua.FunctionProto, string) {
+	sha := scriptSHA(body)
+	if proto := s.lookup(sha); proto != nil {
+		return sha, proto, ""
+	}
+	chunk, err := parse.Parse(bytes.NewReader(body), scriptName)
+	if err != nil {
+		return "", nil, "ERR Error compiling script (new function): " + err.Error()
+	}
+	proto, err := lua.Compile(chunk, scriptName)
+	if err != nil {
+		return "", nil, "ERR Error compiling script (new function): " + err.Error()
+	}
+	s.mu.Lock()
+	s.scripts[sha] = proto
+	s.mu.Unlock()
+	return sha, proto, ""
+}
+
+func (s *scripting) lookup(sha string) *lua.FunctionProto {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scripts[sha]
+}
+
+// busy reports whether a script has run past the time limit.
+func (s *scripting) busy() bool {
+	rs := s.running.Load()
+	return rs != nil && time.Since(rs.started) >= time.Duration(s.timeLimit.Load())*time.Millisecond
+}
+
+// kill stops the running script, returning the error reply if it cannot.
+func (s *scripting) kill() string {
+	rs := s.running.Load()
+	if rs == nil {
+		return "NOTBUSY No scripts in execution right now."
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.wrote {
+		return "UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way."
+	}
+	rs.killed = true
+	rs.cancel()
+	return ""
+}
+
+// write notes that the script is about to write, reporting false if it
+// has been killed and must not.
+func (rs *runningScript) write() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.killed {
+		return false
+	}
+	rs.wrote = true
+	return true
+}
+
+// handleEval serves EVAL and EVALSHA, and EVAL_RO and EVALSHA_RO if
+// readOnly is set. The caller holds the isolation lock exclusively.
+func (mkv *MuKV) handleEval(conn redcon.Conn, cmd redcon.Command, bySHA, readOnly bool) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	numKeys, err := strconv.Atoi(string(cmd.Args[2]))
+	switch {
+	case err != nil:
+		conn.WriteError(errNotInteger)
+		return
+	case numKeys < 0:
+		conn.WriteError("ERR Number of keys can't be negative")
+		return
+	case numKeys > len(cmd.Args)-3:
+		conn.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+
+	s := mkv.scripts
+	var sha string
+	var proto *lua.FunctionProto
+	if bySHA {
+		sha = strings.ToLower(string(cmd.Args[1]))
+		if proto = s.lookup(sha); proto == nil {
+			conn.WriteError(errNoScript)
+			return
+		}
+	} else {
+		var errStr string
+		if sha, proto, errStr = s.load(cmd.Args[1]); errStr != "" {
+			conn.WriteError(errStr)
+			return
+		}
+	}
+	mkv.runScript(conn, sha, proto, cmd.Args[3:3+numKeys], cmd.Args[3+numKeys:], readOnly)
+}
+
+// runScript runs a script with keys and args as KEYS and ARGV, and writes
+// what it returns as the reply.
+func (mkv *MuKV) runScript(conn redcon.Conn, sha string, proto *lua.FunctionProto, keys, args [][]byte, readOnly bool) {
+	s := mkv.scripts
+	L := s.vm
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rs := &runningScript{
+		sha:      sha,
+		started:  time.Now(),
+		cancel:   cancel,
+		conn:     &bufferConn{ctx: &client{db: clientFor(conn).db, noBlock: true}},
+		readOnly: readOnly,
+	}
+	L.G.Global.RawSetString("KEYS", luaStrings(L, keys))
+	L.G.Global.RawSetString("ARGV", luaStrings(L, args))
+	L.SetContext(ctx)
+	s.running.Store(rs)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err := L.PCall(0, 1, s.onError)
+
+	s.running.Store(nil)
+	L.RemoveContext()
+	if rs.opened {
+		mkv.closeMulti(clientFor(rs.conn).db)
+	}
+	// A script run by a transaction leaves the clients it unblocked to the
+	// transaction.
+	if !clientFor(conn).noBlock {
+		mkv.serveBlockedAfter()
+	}
+	if err != nil {
+		msg := err.Error()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			msg = apiErr.Object.String()
+		}
+		conn.WriteError(msg)
+		return
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	writeLuaValue(conn, ret)
+}
+
+// scriptError is the error handler scripts run under. It turns the error
+// raised into the error reply, naming the script and the line it stopped
+// at.
+func (s *scripting) scriptError(L *lua.LState) int {
+	rs := s.running.Load()
+	var msg string
+	switch v := L.Get(1).(type) {
+	case *lua.LTable:
+		msg = lua.LVAsString(v.RawGetString("err"))
+	default:
+		msg = "ERR " + lua.LVAsString(v)
+	}
+	if rs.killed {
+		msg = "ERR Script killed by user with SCRIPT KILL..."
+	}
+	msg += " script: " + rs.sha
+	for level := 1; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		L.GetInfo("l", dbg, lua.LNil)
+		if dbg.CurrentLine > 0 {
+			msg += fmt.Sprintf(", on @%s:%d", scriptName, dbg.CurrentLine)
+			break
+		}
+	}
+	L.Push(lua.LString(msg + "."))
+	return 1
+}
+
+// luaCall serves redis.call, which raises a command's error reply as an
+// error, and redis.pcall, which returns it, if protected is set.
+func (mkv *MuKV) luaCall(L *lua.LState, protected bool) int {
+	fail := func(msg string) int {
+		err := luaError(L, msg)
+		if protected {
+			L.Push(err)
+			return 1
+		}
+		L.Error(err, 0)
+		return 0
+	}
+
+	rs := mkv.scripts.running.Load()
+	n := L.GetTop()
+	if n == 0 {
+		return fail("Please specify at least one argument for this redis lib call")
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = []byte(v)
+		case lua.LNumber:
+			args[i] = luaNumberArg(float64(v))
+		default:
+			return fail("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	name := strings.ToLower(string(args[0]))
+	arity, ok := commandArity[name]
+	flags := commandFlags[name]
+	switch {
+	case !ok:
+		return fail("Unknown Redis command called from script")
+	case arity >= 0 && n != arity || arity < 0 && n < -arity:
+		return fail("Wrong number of args calling Redis command from script")
+	case flags&flagNoScript != 0:
+		return fail("This Redis command is not allowed from script")
+	}
+	db := clientFor(rs.conn).db
+	if flags&flagWrite != 0 {
+		if rs.readOnly {
+			return fail("Write commands are not allowed from read-only scripts.")
+		}
+		if !rs.write() {
+			return fail("Script killed by user with SCRIPT KILL...")
+		}
+		if !rs.opened {
+			rs.opened = mkv.openMulti(db)
+		}
+	}
+
+	rs.conn.buf = rs.conn.buf[:0]
+	cmd := redcon.Command{Args: args}
+	if !mkv.routeCluster(rs.conn, name, cmd) {
+		mkv.callQueued(rs.conn, name, cmd)
+	}
+	reply, err := readReply(bufio.NewReader(bytes.NewReader(rs.conn.buf)))
+	if rerr, ok := err.(replyError); ok {
+		return fail("-" + string(rerr))
+	}
+	if err != nil {
+		return fail(err.Error())
+	}
+	L.Push(luaValue(L, reply))
+	return 1
+}
+
+// luaError returns the table scripts see an error reply as. msg is either
+// an error reply with a leading '-', whose first word is its code, or a
+// message to give the generic ERR code.
+func luaError(L *lua.LState, msg string) *lua.LTable {
+	code := "ERR"
+	if rest, ok := strings.CutPrefix(msg, "-"); ok {
+		msg = rest
+		if c, m, ok := strings.Cut(rest, " "); ok {
+			code, msg = c, m
+		}
+	}
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(code+" "+strings.TrimRight(msg, "\r\n")))
+	return t
+}
+
+func luaErrorReply(L *lua.LState) int {
+	msg, ok := L.Get(1).(lua.LString)
+	if L.GetTop() != 1 || !ok {
+		L.Push(luaError(L, "wrong number or type of arguments"))
+		return 1
+	}
+	if !strings.HasPrefix(string(msg), "-") {
+		msg = "-" + msg
+	}
+	L.Push(luaError(L, string(msg)))
+	return 1
+}
+
+func luaStatusReply(L *lua.LState) int {
+	msg, ok := L.Get(1).(lua.LString)
+	if L.GetTop() != 1 || !ok {
+		L.Push(luaError(L, "wrong number or type of arguments"))
+		return 1
+	}
+	t := L.NewTable()
+	t.RawSetString("ok", msg)
+	L.Push(t)
+	return 1
+}
+
+func luaSHA1Hex(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("wrong number of arguments")
+	}
+	L.Push(lua.LString(scriptSHA([]byte(L.ToString(1)))))
+	return 1
+}
+
+// luaLog serves redis.log, writing its arguments to the server log at the
+// level given first.
+func (mkv *MuKV) luaLog(L *lua.LState) int {
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+	}
+	level, ok := L.Get(1).(lua.LNumber)
+	if !ok || level < 0 || level > 3 {
+		L.RaiseError("Invalid debug level.")
+	}
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToString(i))
+	}
+	logger := mkv.Log.With().Str("function", "script").Logger()
+	event := logger.Debug()
+	switch int(level) {
+	case 2:
+		event = logger.Info()
+	case 3:
+		event = logger.Warn()
+	}
+	event.Msg(strings.Join(parts, " "))
+	return 0
+}
+
+// luaNumberArg formats a Lua number passed to redis.call as Redis does:
+// integral values as integers, so they can be used as counts and
+// increments, and others with full precision.
+func luaNumberArg(f float64) []byte {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return strconv.AppendInt(nil, int64(f), 10)
+	}
+	return fmt.Appendf(nil, "%.17g", f)
+}
+
+// luaStrings returns strs as a Lua array of strings.
+func luaStrings(L *lua.LState, strs [][]byte) *lua.LTable {
+	t := L.CreateTable(len(strs), 0)
+	for i, s := range strs {
+		t.RawSetInt(i+1, lua.LString(s))
+	}
+	return t
+}
+
+// luaValue converts a reply read by readReply to the value scripts see:
+// integers become numbers, bulk strings strings, arrays tables, nulls
+// false, and status and error replies tables holding them as ok and err.
+func luaValue(L *lua.LState, reply any) lua.LValue {
+	switch v := reply.(type) {
+	case int64:
+		return lua.LNumber(v)
+	case []byte:
+		return lua.LString(v)
+	case string:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case replyError:
+		return luaError(L, "-"+string(v))
+	case []any:
+		t := L.CreateTable(len(v), 0)
+		for i, elem := range v {
+			t.RawSetInt(i+1, luaValue(L, elem))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// writeLuaValue writes v, returned by a script, as a reply, converting it
+// the other way from luaValue. Numbers are truncated to integers, true
+// becomes 1, and an array ends at its first nil.
+func writeLuaValue(conn redcon.Conn, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		conn.WriteBulkString(string(v))
+	case lua.LNumber:
+		conn.WriteInt64(int64(v))
+	case lua.LBool:
+		if v {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteNull()
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			conn.WriteError(string(msg))
+			return
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			conn.WriteString(string(msg))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		conn.WriteArray(n)
+		for i := 1; i <= n; i++ {
+			writeLuaValue(conn, v.RawGetInt(i))
+		}
+	default:
+		conn.WriteNull()
+	}
+}
+
+func (mkv *MuKV) handleScript(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	s := mkv.scripts
+	sub := strings.ToLower(string(cmd.Args[1]))
+	switch {
+	case sub == "help" && len(cmd.Args) == 2:
+		conn.WriteArray(9)
+		conn.WriteString("SCRIPT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+		conn.WriteString("EXISTS <sha1> [<sha1> ...]")
+		conn.WriteString("    Return information about the existence of the scripts in the script cache.")
+		conn.WriteString("FLUSH [ASYNC|SYNC]")
+		conn.WriteString("    Flush the Lua scripts cache.")
+		conn.WriteString("KILL")
+		conn.WriteString("    Kill the currently executing Lua script.")
+		conn.WriteString("LOAD <script>")
+		conn.WriteString("    Load a script into the scripts cache without executing it.")
+	case sub == "load" && len(cmd.Args) == 3:
+		sha, _, errStr := s.load(cmd.Args[2])
+		if errStr != "" {
+			conn.WriteError(errStr)
+			return
+		}
+		conn.WriteBulkString(sha)
+	case sub == "exists" && len(cmd.Args) >= 3:
+		conn.WriteArray(len(cmd.Args) - 2)
+		for _, sha := range cmd.Args[2:] {
+			conn.WriteInt(boolInt(s.lookup(strings.ToLower(string(sha))) != nil))
+		}
+	case sub == "flush" && len(cmd.Args) <= 3:
+		if len(cmd.Args) == 3 {
+			switch strings.ToLower(string(cmd.Args[2])) {
+			case "async", "sync":
+			default:
+				conn.WriteError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+				return
+			}
+		}
+		s.mu.Lock()
+		s.scripts = make(map[string]*lua.FunctionProto)
+		s.mu.Unlock()
+		conn.WriteString("OK")
+	case sub == "kill" && len(cmd.Args) == 2:
+		if errStr := s.kill(); errStr != "" {
+			conn.WriteError(errStr)
+			return
+		}
+		conn.WriteString("OK")
+	case sub == "help" || sub == "load" || sub == "exists" || sub == "flush" || sub == "kill":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for script|%s", sub))
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", cmd.Args[1]))
+	}
+}
+
+// cachedScripts returns the number of scripts loaded.
+func (s *scripting) cachedScripts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.scripts)
+}
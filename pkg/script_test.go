@@ -0,0 +1,62 @@
+package mukv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLuaNumberArg(t *testing.T) {
+	for _, tt := range []struct {
+		in   float64
+		want string
+	}{
+		{0, "0"},
+		{-7, "-7"},
+		{1234567, "1234567"},
+		{1e15, "1000000000000000"},
+		{0.5, "0.5"},
+		{-2.25, "-2.25"},
+		{1e300, "1.0000000000000001e+300"},
+	} {
+		if got := string(luaNumberArg(tt.in)); got != tt.want {
+			t.Errorf("luaNumberArg(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScriptNumberArgs(t *testing.T) {
+	c := newTestClient(newTestServer(DefaultConfig))
+	script := "redis.call('SET', KEYS[1], 1234567) return redis.call('INCRBY', KEYS[1], 1000000)"
+	if got := c.must(t, "EVAL", script, "1", "n"); got != int64(2234567) {
+		t.Errorf("EVAL replied %#v, want 2234567", got)
+	}
+	if got := c.bulk(t, "GET", "n"); got != "2234567" {
+		t.Errorf("GET n = %q, want 2234567", got)
+	}
+	c.must(t, "EVAL", "return redis.call('SET', KEYS[1], 0.5)", "1", "f")
+	if got := c.bulk(t, "GET", "f"); got != "0.5" {
+		t.Errorf("GET f = %q, want 0.5", got)
+	}
+}
+
+func TestScriptServesBlockedClientsOnce(t *testing.T) {
+	mkv := newTestServer(DefaultConfig)
+	served := blockedPop(t, mkv)
+
+	c := newTestClient(mkv)
+	script := "redis.call('RPUSH', KEYS[1], 'x'); redis.call('DEL', KEYS[1]); return 1"
+	if reply := c.must(t, "EVAL", script, "1", "q"); reply != int64(1) {
+		t.Fatalf("EVAL: got %#v, want 1", reply)
+	}
+	select {
+	case reply := <-served:
+		t.Fatalf("BLPOP was served %#v by a list the script deleted", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.must(t, "EVAL", "return redis.call('RPUSH', KEYS[1], 'y')", "1", "q")
+	if reply := <-served; fmt.Sprintf("%s", reply) != "[q y]" {
+		t.Fatalf("BLPOP: got %#v, want [q y]", reply)
+	}
+}
@@ -0,0 +1,607 @@
+package mukv
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// maxIntsetEntries is the size past which a set of integers is converted
+// from an intset to a hash table.
+const maxIntsetEntries = 512
+
+// setValue is an unordered set of byte strings. A small set holding only
+// integers is encoded compactly as a sorted slice, its intset, and converted
+// to a hash table once a member is added that the intset cannot hold.
+type setValue struct {
+	ints    []int64
+	members map[string]struct{}
+}
+
+func newSetValue() *setValue {
+	return &setValue{}
+}
+
+func (s *setValue) Clone() *setValue {
+	return &setValue{ints: slices.Clone(s.ints), members: maps.Clone(s.members)}
+}
+
+func (s *setValue) Encoding() string {
+	if s.members == nil {
+		return "intset"
+	}
+	return "hashtable"
+}
+
+func (s *setValue) Len() int {
+	if s.members == nil {
+		return len(s.ints)
+	}
+	return len(s.members)
+}
+
+func (s *setValue) Has(m string) bool {
+	if s.members != nil {
+		_, ok := s.members[m]
+		return ok
+	}
+	n, ok := canonicalInt(m)
+	if !ok {
+		return false
+	}
+	_, found := slices.BinarySearch(s.ints, n)
+	return found
+}
+
+// Add adds m to the set and reports whether it was not already a member.
+func (s *setValue) Add(m string) bool {
+	if s.members == nil {
+		if n, ok := canonicalInt(m); ok && len(s.ints) < maxIntsetEntries {
+			i, found := slices.BinarySearch(s.ints, n)
+			if found {
+				return false
+			}
+			s.ints = slices.Insert(s.ints, i, n)
+			return true
+		}
+		s.convert()
+	}
+	if _, ok := s.members[m]; ok {
+		return false
+	}
+	s.members[m] = struct{}{}
+	return true
+}
+
+// Remove removes m from the set and reports whether it was a member.
+func (s *setValue) Remove(m string) bool {
+	if s.members != nil {
+		if _, ok := s.members[m]; !ok {
+			return false
+		}
+		delete(s.members, m)
+		return true
+	}
+	n, ok := canonicalInt(m)
+	if !ok {
+		return false
+	}
+	i, found := slices.BinarySearch(s.ints, n)
+	if !found {
+		return false
+	}
+	s.ints = slices.Delete(s.ints, i, i+1)
+	return true
+}
+
+// Members returns the members of the set in no particular order.
+func (s *setValue) Members() []string {
+	members := make([]string, 0, s.Len())
+	if s.members == nil {
+		for _, n := range s.ints {
+			members = append(members, strconv.FormatInt(n, 10))
+		}
+		return members
+	}
+	for m := range s.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+// Random returns a member chosen uniformly at random. The set must not be
+// empty.
+func (s *setValue) Random() string {
+	if s.members == nil {
+		return strconv.FormatInt(s.ints[rand.IntN(len(s.ints))], 10)
+	}
+	skip := rand.IntN(len(s.members))
+	for m := range s.members {
+		if skip == 0 {
+			return m
+		}
+		skip--
+	}
+	panic("unreachable")
+}
+
+// convert switches the set from the intset to the hash table encoding.
+func (s *setValue) convert() {
+	s.members = make(map[string]struct{}, len(s.ints))
+	for _, n := range s.ints {
+		s.members[strconv.FormatInt(n, 10)] = struct{}{}
+	}
+	s.ints = nil
+}
+
+func (mkv *MuKV) handleSAdd(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	added := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		s, ok := asSet(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for _, m := range cmd.Args[2:] {
+			if s.Add(string(m)) {
+				added++
+			}
+		}
+		if added == 0 {
+			return Unchanged
+		}
+		if rec == nil {
+			rec = newRecord(s)
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(added)
+	}
+}
+
+func (mkv *MuKV) handleSRem(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	removed := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		s, ok := asSet(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for _, m := range cmd.Args[2:] {
+			if s.Remove(string(m)) {
+				removed++
+			}
+		}
+		switch {
+		case removed == 0:
+			return Unchanged
+		case s.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(removed)
+	}
+}
+
+// handleSIsMember implements SISMEMBER and SMISMEMBER.
+func (mkv *MuKV) handleSIsMember(conn redcon.Conn, cmd redcon.Command, multi bool) {
+	if len(cmd.Args) < 3 || (!multi && len(cmd.Args) != 3) {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		s, ok := asSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		if multi {
+			conn.WriteArray(len(cmd.Args) - 2)
+		}
+		for _, m := range cmd.Args[2:] {
+			if s.Has(string(m)) {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	})
+}
+
+func (mkv *MuKV) handleSMembers(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		s, ok := asSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		writeMembers(conn, s.Members())
+	})
+}
+
+func (mkv *MuKV) handleSCard(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		s, ok := asSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(s.Len())
+	})
+}
+
+func writeMembers(conn redcon.Conn, members []string) {
+	conn.WriteArray(len(members))
+	for _, m := range members {
+		conn.WriteBulkString(m)
+	}
+}
+
+// setOp identifies the set algebra computed by SINTER, SUNION and SDIFF.
+type setOp int
+
+const (
+	setInter setOp = iota
+	setUnion
+	setDiff
+)
+
+// combineSets computes op over the sets held by recs, stopping early once an
+// intersection reaches limit members if limit is positive. It reports false
+// if any record holds another type.
+func combineSets(op setOp, recs []*Record, limit int) (*setValue, bool) {
+	sets := make([]*setValue, len(recs))
+	for i, rec := range recs {
+		s, ok := asSet(rec)
+		if !ok {
+			return nil, false
+		}
+		sets[i] = s
+	}
+
+	result := newSetValue()
+	switch op {
+	case setInter:
+		// Walk the smallest set, checking its members against the others.
+		smallest := slices.MinFunc(sets, func(a, b *setValue) int {
+			return a.Len() - b.Len()
+		})
+		for _, m := range smallest.Members() {
+			if !slices.ContainsFunc(sets, func(s *setValue) bool { return !s.Has(m) }) {
+				result.Add(m)
+				if limit > 0 && result.Len() == limit {
+					break
+				}
+			}
+		}
+	case setUnion:
+		for _, s := range sets {
+			for _, m := range s.Members() {
+				result.Add(m)
+			}
+		}
+	case setDiff:
+		for _, m := range sets[0].Members() {
+			if !slices.ContainsFunc(sets[1:], func(s *setValue) bool { return s.Has(m) }) {
+				result.Add(m)
+			}
+		}
+	}
+	return result, true
+}
+
+// handleSetOp implements SINTER, SUNION and SDIFF.
+func (mkv *MuKV) handleSetOp(conn redcon.Conn, cmd redcon.Command, op setOp) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[1:]), func(recs []*Record) {
+		s, ok := combineSets(op, recs, 0)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		writeMembers(conn, s.Members())
+	})
+}
+
+// handleSetOpStore implements SINTERSTORE, SUNIONSTORE and SDIFFSTORE,
+// which atomically replace the destination with the result.
+func (mkv *MuKV) handleSetOpStore(conn redcon.Conn, cmd redcon.Command, op setOp) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	n := 0
+	wrongType := false
+	keys := argStrings(cmd.Args[1:])
+	mkv.db(conn).UpdateAll(keys, func(recs []*Record) []*Record {
+		s, ok := combineSets(op, recs[1:], 0)
+		if !ok {
+			wrongType = true
+			return nil
+		}
+		n = s.Len()
+		if n == 0 {
+			recs[0] = nil
+		} else {
+			recs[0] = newRecord(s)
+		}
+		// A source that is also the destination must not overwrite it.
+		for i := 1; i < len(recs); i++ {
+			if keys[i] == keys[0] {
+				recs[i] = recs[0]
+			} else {
+				recs[i] = Unchanged
+			}
+		}
+		return recs
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+func (mkv *MuKV) handleSInterCard(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	numKeys, ok := parseInt(cmd.Args[1])
+	if !ok || numKeys <= 0 {
+		conn.WriteError("ERR numkeys should be greater than 0")
+		return
+	}
+	if int64(len(cmd.Args)-2) < numKeys {
+		conn.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	limit := int64(0)
+	switch rest := cmd.Args[2+numKeys:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.EqualFold(string(rest[0]), "limit"):
+		if limit, ok = parseInt(rest[1]); !ok || limit < 0 {
+			conn.WriteError("ERR LIMIT can't be negative")
+			return
+		}
+	default:
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[2:2+numKeys]), func(recs []*Record) {
+		s, ok := combineSets(setInter, recs, int(limit))
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(s.Len())
+	})
+}
+
+func (mkv *MuKV) handleSMove(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	moved := false
+	wrongType := false
+	member := string(cmd.Args[3])
+	mkv.db(conn).UpdateAll(argStrings(cmd.Args[1:3]), func(recs []*Record) []*Record {
+		src, ok := asSet(recs[0])
+		dst, ok2 := asSet(recs[1])
+		if !ok || !ok2 {
+			wrongType = true
+			return nil
+		}
+		if !src.Remove(member) {
+			return nil
+		}
+		moved = true
+		if recs[1] == nil {
+			recs[1] = newRecord(dst)
+		}
+		dst.Add(member)
+		if src.Len() == 0 {
+			recs[0] = nil
+		}
+		return recs
+	})
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case moved:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+func (mkv *MuKV) handleSRandMember(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var count int64
+	if len(cmd.Args) == 3 {
+		var ok bool
+		if count, ok = parseInt(cmd.Args[2]); !ok {
+			conn.WriteError(errNotInteger)
+			return
+		}
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		s, ok := asSet(rec)
+		switch {
+		case !ok:
+			conn.WriteError(errWrongType)
+		case len(cmd.Args) == 2 && s.Len() == 0:
+			conn.WriteNull()
+		case len(cmd.Args) == 2:
+			conn.WriteBulkString(s.Random())
+		case count >= 0:
+			// Distinct members, as many as the set holds.
+			members := s.Members()
+			rand.Shuffle(len(members), func(i, j int) {
+				members[i], members[j] = members[j], members[i]
+			})
+			writeMembers(conn, members[:min(int(count), len(members))])
+		case s.Len() == 0:
+			conn.WriteArray(0)
+		default:
+			// Members may repeat, exactly -count of them.
+			members := s.Members()
+			picked := make([]string, -count)
+			for i := range picked {
+				picked[i] = members[rand.IntN(len(members))]
+			}
+			writeMembers(conn, picked)
+		}
+	})
+}
+
+func (mkv *MuKV) handleSPop(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	count := int64(1)
+	if len(cmd.Args) == 3 {
+		var ok bool
+		if count, ok = parseInt(cmd.Args[2]); !ok || count < 0 {
+			conn.WriteError("ERR value is out of range, must be positive")
+			return
+		}
+	}
+
+	var popped []string
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		s, ok := asSet(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for range min(int(count), s.Len()) {
+			m := s.Random()
+			s.Remove(m)
+			popped = append(popped, m)
+		}
+		switch {
+		case len(popped) == 0:
+			return Unchanged
+		case s.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+	if len(popped) > 0 {
+		// The members are picked at random, so log which ones were removed.
+		args := [][]byte{[]byte("SREM"), cmd.Args[1]}
+		for _, m := range popped {
+			args = append(args, []byte(m))
+		}
+		mkv.propagate(conn, args...)
+	}
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case len(cmd.Args) == 3:
+		writeMembers(conn, popped)
+	case len(popped) == 0:
+		conn.WriteNull()
+	default:
+		conn.WriteBulkString(popped[0])
+	}
+}
+
+func (mkv *MuKV) handleSScan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cursor, errStr := parseScanCursor(cmd.Args[2])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	opts, errStr := parseScanOptions(cmd.Args[3:], false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		s, ok := asSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		page, next := scanNames(s.Members(), cursor, opts.count)
+		page = slices.DeleteFunc(page, func(m string) bool {
+			return !opts.matches(m)
+		})
+		conn.WriteArray(2)
+		conn.WriteBulkString(strconv.FormatUint(next, 10))
+		writeMembers(conn, page)
+	})
+}
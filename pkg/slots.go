@@ -0,0 +1,208 @@
+package mukv
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// clusterSlots is the number of hash slots the keyspace is split into in
+// cluster mode.
+const clusterSlots = 16384
+
+// crc16Table is the table for CRC-16/XMODEM, the checksum Redis Cluster
+// hashes keys with.
+var crc16Table = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the hash slot of key. If key holds a non-empty hash
+// tag, the part between the first { and the } after it, only the tag is
+// hashed, so that related keys can be placed in the same slot.
+func keyHashSlot(key string) int {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			key = key[open+1 : open+1+end]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// parseSlot parses a hash slot number.
+func parseSlot(arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, false
+	}
+	return slot, true
+}
+
+// slotIndex tracks the keys in each hash slot of a keyspace in cluster
+// mode, for listing and counting the keys of a slot being migrated.
+type slotIndex struct {
+	mu   sync.Mutex
+	keys [clusterSlots]map[string]struct{}
+}
+
+func (si *slotIndex) add(key string) {
+	slot := keyHashSlot(key)
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	if si.keys[slot] == nil {
+		si.keys[slot] = make(map[string]struct{})
+	}
+	si.keys[slot][key] = struct{}{}
+}
+
+func (si *slotIndex) remove(key string) {
+	slot := keyHashSlot(key)
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	delete(si.keys[slot], key)
+	if len(si.keys[slot]) == 0 {
+		si.keys[slot] = nil
+	}
+}
+
+// count returns the number of keys in slot.
+func (si *slotIndex) count(slot int) int {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return len(si.keys[slot])
+}
+
+// list returns up to n of the keys in slot.
+func (si *slotIndex) list(slot, n int) []string {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	keys := make([]string, 0, min(n, len(si.keys[slot])))
+	for key := range si.keys[slot] {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// keySpec locates the keys among a command's arguments: every step-th
+// argument from first to last, where a negative last counts back from the
+// end (-1 being the last argument). If numKeys is set, the argument at that
+// index gives the number of further keys, which follow it.
+type keySpec struct {
+	first, last, step int
+	numKeys           int
+}
+
+var (
+	oneKey       = keySpec{first: 1, last: 1, step: 1}
+	allKeys      = keySpec{first: 1, last: -1, step: 1}
+	twoKeys      = keySpec{first: 1, last: 2, step: 1}
+	keysTimeout  = keySpec{first: 1, last: -2, step: 1}
+	keyValues    = keySpec{first: 1, last: -1, step: 2}
+	numKeysFirst = keySpec{numKeys: 1}
+	destNumKeys  = keySpec{first: 1, last: 1, step: 1, numKeys: 2}
+	numKeysAfter = keySpec{numKeys: 2}
+)
+
+// commandKeys holds the key spec of each command that takes keys.
+var commandKeys = map[string]keySpec{
+	"set": oneKey, "get": oneKey, "getdel": oneKey, "getex": oneKey,
+	"getset": oneKey, "append": oneKey, "strlen": oneKey, "getrange": oneKey,
+	"substr": oneKey, "setrange": oneKey, "incr": oneKey, "decr": oneKey,
+	"incrby": oneKey, "decrby": oneKey, "incrbyfloat": oneKey,
+	"mget": allKeys, "mset": keyValues, "msetnx": keyValues, "lcs": twoKeys,
+
+	"ttl": oneKey, "pttl": oneKey, "expire": oneKey, "pexpire": oneKey,
+	"expireat": oneKey, "pexpireat": oneKey, "expiretime": oneKey,
+	"pexpiretime": oneKey, "persist": oneKey,
+
+	"hset": oneKey, "hmset": oneKey, "hsetnx": oneKey, "hget": oneKey,
+	"hmget": oneKey, "hdel": oneKey, "hexists": oneKey, "hlen": oneKey,
+	"hstrlen": oneKey, "hgetall": oneKey, "hkeys": oneKey, "hvals": oneKey,
+	"hincrby": oneKey, "hincrbyfloat": oneKey, "hrandfield": oneKey,
+	"hscan": oneKey,
+
+	"lpush": oneKey, "rpush": oneKey, "lpushx": oneKey, "rpushx": oneKey,
+	"lpop": oneKey, "rpop": oneKey, "llen": oneKey, "lrange": oneKey,
+	"lindex": oneKey, "lset": oneKey, "linsert": oneKey, "lrem": oneKey,
+	"ltrim": oneKey, "lpos": oneKey, "lmove": twoKeys, "rpoplpush": twoKeys,
+	"lmpop": numKeysFirst, "blpop": keysTimeout, "brpop": keysTimeout,
+	"blmove": twoKeys, "brpoplpush": twoKeys, "blmpop": numKeysAfter,
+
+	"sadd": oneKey, "srem": oneKey, "sismember": oneKey, "smismember": oneKey,
+	"smembers": oneKey, "scard": oneKey, "sinter": allKeys, "sunion": allKeys,
+	"sdiff": allKeys, "sinterstore": allKeys, "sunionstore": allKeys,
+	"sdiffstore": allKeys, "sintercard": numKeysFirst, "smove": twoKeys,
+	"srandmember": oneKey, "spop": oneKey, "sscan": oneKey,
+
+	"zadd": oneKey, "zincrby": oneKey, "zrem": oneKey, "zscore": oneKey,
+	"zmscore": oneKey, "zcard": oneKey, "zcount": oneKey, "zlexcount": oneKey,
+	"zrank": oneKey, "zrevrank": oneKey, "zrange": oneKey, "zrevrange": oneKey,
+	"zrangebyscore": oneKey, "zrevrangebyscore": oneKey, "zrangebylex": oneKey,
+	"zrevrangebylex": oneKey, "zrangestore": twoKeys, "zremrangebyrank": oneKey,
+	"zremrangebyscore": oneKey, "zremrangebylex": oneKey, "zpopmin": oneKey,
+	"zpopmax": oneKey, "zmpop": numKeysFirst, "bzpopmin": keysTimeout,
+	"bzpopmax": keysTimeout, "bzmpop": numKeysAfter, "zunion": numKeysFirst,
+	"zinter": numKeysFirst, "zdiff": numKeysFirst, "zunionstore": destNumKeys,
+	"zinterstore": destNumKeys, "zdiffstore": destNumKeys,
+	"zintercard": numKeysFirst, "zrandmember": oneKey, "zscan": oneKey,
+
+	"type": oneKey, "rename": twoKeys, "renamenx": twoKeys, "copy": twoKeys,
+	"object": {first: 2, last: 2, step: 1}, "touch": allKeys, "del": allKeys,
+	"unlink": allKeys, "exists": allKeys, "dump": oneKey, "restore": oneKey,
+	"restore-asking": oneKey,
+
+	"eval": numKeysAfter, "evalsha": numKeysAfter, "eval_ro": numKeysAfter,
+	"evalsha_ro": numKeysAfter, "watch": allKeys,
+}
+
+// keysOf returns the keys among args, the arguments of the command named
+// name. Arguments too few to hold the keys the spec calls for yield what
+// keys there are, leaving the command to report the error.
+func keysOf(name string, args [][]byte) []string {
+	spec, ok := commandKeys[name]
+	if !ok {
+		return nil
+	}
+	var keys []string
+	if spec.step > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			keys = append(keys, string(args[i]))
+		}
+	}
+	if spec.numKeys > 0 && spec.numKeys < len(args) {
+		n, err := strconv.Atoi(string(args[spec.numKeys]))
+		if err != nil || n < 0 {
+			return keys
+		}
+		for i := spec.numKeys + 1; i <= spec.numKeys+n && i < len(args); i++ {
+			keys = append(keys, string(args[i]))
+		}
+	}
+	return keys
+}
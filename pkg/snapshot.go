@@ -0,0 +1,601 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot file holds the whole keyspace at a point in time:
+//
+//	"MUKV" version
+//	for each non-empty database:
+//	    opSelectDB uvarint(db)
+//	    for each key:
+//	        [opVersion stamp node uvarint(len) (node counter)...]
+//	        type key expire-at hits accessed value
+//	opEOF crc64
+//
+// Strings are written as a uvarint length followed by their bytes. expire-at
+// and accessed are Unix times in milliseconds, with 0 meaning no TTL, and
+// hits is the key's hit counter. A key written in dynamo mode is preceded by
+// its version, with the stamp as a varint and the clock as pairs of a node
+// and a uvarint counter. The checksum covers everything before it.
+const (
+	snapshotMagic   = "MUKV"
+	snapshotVersion = 1
+
+	opVersion  = 0xfd
+	opSelectDB = 0xfe
+	opEOF      = 0xff
+)
+
+// Value type codes in a snapshot.
+const (
+	snapString byte = iota
+	snapInt
+	snapHash
+	snapList
+	snapIntSet
+	snapSet
+	snapZSet
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// snapshotEntry is a key captured for a snapshot, holding a value that the
+// keyspace will not modify.
+type snapshotEntry struct {
+	key      string
+	value    any
+	expireAt time.Time
+	hits     int64
+	accessed int64
+	version  *Version
+}
+
+// A snapshot is taken without holding writers off for more than an instant.
+// Taking it only fixes the point in time it is of; its keys are captured as
+// it is written out, a shard at a time, along with their values as they
+// are, uncopied. Until the snapshot has walked a key, a command about to
+// write the key captures it first. Once the snapshot holds a value, a
+// command about to write it replaces it with a copy, so the snapshot's
+// stays as it was until written.
+
+// snapshots tracks the snapshots of a server's databases that are still to
+// be written.
+type snapshots struct {
+	// mu guards active, and the capture of records by snapshots.
+	mu sync.Mutex
+	// gen is the generation of the latest snapshot taken, each taking the
+	// next.
+	gen atomic.Uint64
+	// active holds the snapshots not yet written, oldest first.
+	active []*snapshot
+	// oldest is the generation of the oldest active snapshot, or 0 if there
+	// is none.
+	oldest atomic.Uint64
+}
+
+// snapshot is the databases at a point in time, captured as it is written.
+type snapshot struct {
+	snaps *snapshots
+	gen   uint64
+	dbs   []*Keyspace
+	// captured holds, for each database, the keys captured for the snapshot
+	// and not yet written. snaps.mu guards it.
+	captured [][]snapshotEntry
+	released bool
+	// dirty is the number of changes made before the snapshot was taken.
+	dirty int64
+}
+
+// snapshot takes a snapshot of every database, which must be written or
+// released.
+func (mkv *MuKV) snapshot() *snapshot {
+	// Keyspaces cannot be swapped while all of them are locked.
+	mkv.swapMu.Lock()
+	defer mkv.swapMu.Unlock()
+	// No command is halfway through a write while every shard is locked.
+	for _, ks := range mkv.DBs {
+		for _, sh := range ks.shards {
+			sh.RLock()
+		}
+	}
+	defer func() {
+		for _, ks := range mkv.DBs {
+			for _, sh := range ks.shards {
+				sh.RUnlock()
+			}
+		}
+	}()
+
+	c := mkv.snaps
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap := &snapshot{
+		snaps:    c,
+		gen:      c.gen.Add(1),
+		dbs:      mkv.DBs,
+		captured: make([][]snapshotEntry, len(mkv.DBs)),
+		dirty:    mkv.saver.dirty.Load(),
+	}
+	c.active = append(c.active, snap)
+	c.oldest.Store(c.active[0].gen)
+	return snap
+}
+
+// release forgets the snapshot, letting the values it holds be modified.
+func (snap *snapshot) release() {
+	c := snap.snaps
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if snap.released {
+		return
+	}
+	snap.released = true
+	c.active = slices.DeleteFunc(c.active, func(s *snapshot) bool { return s == snap })
+	if len(c.active) > 0 {
+		c.oldest.Store(c.active[0].gen)
+	} else {
+		c.oldest.Store(0)
+	}
+}
+
+// capture captures rec, a record of database db, for the active snapshots
+// taken since it was last captured. c.mu must be held, and the record's
+// shard locked.
+func (c *snapshots) capture(db int, rec *Record) {
+	captured := false
+	for _, snap := range c.active {
+		if snap.gen <= rec.snapGen {
+			continue
+		}
+		snap.captured[db] = append(snap.captured[db], snapshotEntry{
+			key:      rec.Key,
+			value:    rec.Value,
+			expireAt: rec.Deadline(),
+			hits:     rec.Hits.Load(),
+			accessed: rec.Accessed.Load(),
+			version:  rec.Version,
+		})
+		captured = true
+	}
+	rec.snapGen = c.gen.Load()
+	if captured {
+		rec.sharedGen = rec.snapGen
+	}
+}
+
+// captureShard captures the live records of sh for the snapshots yet to
+// walk them. sh must be locked.
+func (ks *Keyspace) captureShard(sh *shard) {
+	c := ks.snaps
+	if c == nil || c.oldest.Load() == 0 {
+		return
+	}
+	gen := c.gen.Load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rec := range sh.records {
+		if rec.snapGen < gen && !ks.dropsExpired(rec) {
+			c.capture(ks.db, rec)
+		}
+	}
+}
+
+// own readies rec, the live record a command is about to run on, for being
+// modified: snapshots yet to capture it do so first, and a value a
+// snapshot holds is replaced with a copy. rec's shard must be write locked.
+func (ks *Keyspace) own(rec *Record) {
+	c := ks.snaps
+	if c == nil || rec == nil {
+		return
+	}
+	oldest := c.oldest.Load()
+	if oldest == 0 {
+		return
+	}
+	if rec.snapGen < c.gen.Load() {
+		c.mu.Lock()
+		c.capture(ks.db, rec)
+		c.mu.Unlock()
+	}
+	if rec.sharedGen >= oldest {
+		rec.Value = cloneValue(rec.Value)
+		rec.sharedGen = 0
+	}
+}
+
+// dropsExpired reports whether a snapshot leaves rec out as expired. In raft
+// mode expired keys are kept until the log removes them, so snapshots keep
+// them too.
+func (ks *Keyspace) dropsExpired(rec *Record) bool {
+	return ks.logExpiry == nil && rec.Expired()
+}
+
+// walk captures the records of sh, one of ks's shards, that the snapshot
+// has yet to, and returns every entry captured for database db since the
+// last call.
+func (snap *snapshot) walk(db int, ks *Keyspace, sh *shard) []snapshotEntry {
+	c := snap.snaps
+	sh.RLock()
+	defer sh.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rec := range sh.records {
+		if rec.snapGen < snap.gen && !ks.dropsExpired(rec) {
+			c.capture(db, rec)
+		}
+	}
+	entries := snap.captured[db]
+	snap.captured[db] = nil
+	return entries
+}
+
+// unixMilli returns t in Unix milliseconds, or 0 for the zero time.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// WriteTo writes the snapshot to w in the snapshot file format, capturing
+// the databases as it goes, and releases it. It can only be called once.
+func (snap *snapshot) WriteTo(w io.Writer) (int64, error) {
+	defer snap.release()
+	crc := crc64.New(crcTable)
+	cw := &countingWriter{w: io.MultiWriter(w, crc)}
+	bw := bufio.NewWriter(cw)
+
+	var buf []byte
+	buf = append(buf, snapshotMagic...)
+	buf = append(buf, snapshotVersion)
+	for db, ks := range snap.dbs {
+		selected := false
+		for _, sh := range ks.shards {
+			entries := snap.walk(db, ks, sh)
+			if len(entries) > 0 && !selected {
+				buf = append(buf, opSelectDB)
+				buf = binary.AppendUvarint(buf, uint64(db))
+				selected = true
+			}
+			for _, e := range entries {
+				buf = appendEntry(buf, e)
+				// Flush each entry so that large keyspaces are not encoded
+				// into one huge buffer.
+				if _, err := bw.Write(buf); err != nil {
+					return cw.n, err
+				}
+				buf = buf[:0]
+			}
+		}
+	}
+	buf = append(buf, opEOF)
+	if _, err := bw.Write(buf); err != nil {
+		return cw.n, err
+	}
+	if err := bw.Flush(); err != nil {
+		return cw.n, err
+	}
+	_, err := w.Write(binary.LittleEndian.AppendUint64(nil, crc.Sum64()))
+	return cw.n + 8, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func appendString(buf []byte, s []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendEntry(buf []byte, e snapshotEntry) []byte {
+	if v := e.version; v != nil {
+		buf = append(buf, opVersion)
+		buf = binary.AppendVarint(buf, v.Stamp)
+		buf = appendString(buf, []byte(v.Node))
+		buf = binary.AppendUvarint(buf, uint64(len(v.Clock)))
+		for node, n := range v.Clock {
+			buf = appendString(buf, []byte(node))
+			buf = binary.AppendUvarint(buf, n)
+		}
+	}
+
+	buf = append(buf, valueType(e.value))
+	buf = appendString(buf, []byte(e.key))
+	buf = binary.AppendVarint(buf, unixMilli(e.expireAt))
+	buf = binary.AppendVarint(buf, e.hits)
+	buf = binary.AppendVarint(buf, e.accessed/int64(time.Millisecond))
+	return appendValue(buf, e.value)
+}
+
+// valueType returns the type code v is written under.
+func valueType(v any) byte {
+	switch v := v.(type) {
+	case []byte:
+		return snapString
+	case int64:
+		return snapInt
+	case hashValue:
+		return snapHash
+	case *deque:
+		return snapList
+	case *setValue:
+		if v.members == nil {
+			return snapIntSet
+		}
+		return snapSet
+	case *zsetValue:
+		return snapZSet
+	}
+	return 0
+}
+
+// appendValue appends v to buf as written after its type code.
+func appendValue(buf []byte, v any) []byte {
+	switch v := v.(type) {
+	case []byte:
+		buf = appendString(buf, v)
+	case int64:
+		buf = binary.AppendVarint(buf, v)
+	case hashValue:
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		for field, val := range v {
+			buf = appendString(buf, []byte(field))
+			buf = appendString(buf, val)
+		}
+	case *deque:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		for i := range v.Len() {
+			buf = appendString(buf, v.At(i))
+		}
+	case *setValue:
+		if v.members == nil {
+			buf = binary.AppendUvarint(buf, uint64(len(v.ints)))
+			for _, n := range v.ints {
+				buf = binary.AppendVarint(buf, n)
+			}
+			break
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(v.members)))
+		for m := range v.members {
+			buf = appendString(buf, []byte(m))
+		}
+	case *zsetValue:
+		buf = binary.AppendUvarint(buf, uint64(v.Len()))
+		v.Ascend(0, func(item zsetItem) bool {
+			buf = appendString(buf, []byte(item.member))
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(item.score))
+			return true
+		})
+	}
+	return buf
+}
+
+var errBadSnapshot = errors.New("malformed snapshot")
+
+// snapshotReader decodes a snapshot, checksumming what it reads.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc io.Writer
+	err error
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) fail(err error) {
+	if sr.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		sr.err = err
+	}
+}
+
+func (sr *snapshotReader) byte() byte {
+	b, err := sr.ReadByte()
+	if err != nil {
+		sr.fail(err)
+	}
+	return b
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	n, err := binary.ReadUvarint(sr)
+	if err != nil {
+		sr.fail(err)
+	}
+	return n
+}
+
+func (sr *snapshotReader) varint() int64 {
+	n, err := binary.ReadVarint(sr)
+	if err != nil {
+		sr.fail(err)
+	}
+	return n
+}
+
+// count reads a collection length, bounded so that a corrupt length cannot
+// make the reader allocate without limit.
+func (sr *snapshotReader) count() int {
+	n := sr.uvarint()
+	if n > math.MaxInt32 {
+		sr.fail(errBadSnapshot)
+		return 0
+	}
+	return int(n)
+}
+
+func (sr *snapshotReader) bytes() []byte {
+	n := sr.count()
+	if sr.err != nil {
+		return nil
+	}
+	b := make([]byte, 0, min(n, 1<<20))
+	for len(b) < n {
+		chunk := min(n-len(b), 1<<20)
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(sr.r, b[len(b)-chunk:]); err != nil {
+			sr.fail(err)
+			return nil
+		}
+		sr.crc.Write(b[len(b)-chunk:])
+	}
+	return b
+}
+
+func (sr *snapshotReader) float() float64 {
+	var b [8]byte
+	for i := range b {
+		b[i] = sr.byte()
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (sr *snapshotReader) value(typ byte) any {
+	switch typ {
+	case snapString:
+		return sr.bytes()
+	case snapInt:
+		return sr.varint()
+	case snapHash:
+		n := sr.count()
+		h := make(hashValue, min(n, 1024))
+		for range n {
+			field := sr.bytes()
+			h[string(field)] = sr.bytes()
+		}
+		return h
+	case snapList:
+		n := sr.count()
+		l := &deque{}
+		for range n {
+			l.PushBack(sr.bytes())
+		}
+		return l
+	case snapIntSet:
+		n := sr.count()
+		s := newSetValue()
+		for range min(n, maxIntsetEntries+1) {
+			s.ints = append(s.ints, sr.varint())
+		}
+		if n > maxIntsetEntries {
+			sr.fail(errBadSnapshot)
+		}
+		return s
+	case snapSet:
+		n := sr.count()
+		s := newSetValue()
+		s.members = make(map[string]struct{}, min(n, 1024))
+		for range n {
+			s.members[string(sr.bytes())] = struct{}{}
+		}
+		return s
+	case snapZSet:
+		n := sr.count()
+		z := newZSetValue()
+		for range n {
+			member := sr.bytes()
+			z.Add(string(member), sr.float())
+		}
+		return z
+	}
+	sr.fail(fmt.Errorf("%w: unknown value type %d", errBadSnapshot, typ))
+	return nil
+}
+
+// readSnapshot decodes a snapshot from r, calling fn with the database index
+// of each entry along with the entry. Keys that expired before now are
+// skipped.
+func readSnapshot(r io.Reader, now time.Time, fn func(db int, e snapshotEntry) error) error {
+	crc := crc64.New(crcTable)
+	sr := &snapshotReader{r: bufio.NewReader(r), crc: crc}
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(sr.r, header); err != nil {
+		return fmt.Errorf("reading snapshot header: %w", err)
+	}
+	crc.Write(header)
+	if !bytes.Equal(header[:len(snapshotMagic)], []byte(snapshotMagic)) {
+		return fmt.Errorf("%w: bad magic", errBadSnapshot)
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", errBadSnapshot, header[len(snapshotMagic)])
+	}
+
+	db := 0
+	// version is the version read for the entry that follows.
+	var version *Version
+	for sr.err == nil {
+		op := sr.byte()
+		switch op {
+		case opEOF:
+			sum := crc.Sum64()
+			var b [8]byte
+			if _, err := io.ReadFull(sr.r, b[:]); err != nil {
+				return fmt.Errorf("reading snapshot checksum: %w", err)
+			}
+			if binary.LittleEndian.Uint64(b[:]) != sum {
+				return fmt.Errorf("%w: checksum mismatch", errBadSnapshot)
+			}
+			return nil
+		case opSelectDB:
+			db = int(sr.uvarint())
+			continue
+		case opVersion:
+			version = &Version{Stamp: sr.varint(), Node: string(sr.bytes())}
+			n := sr.count()
+			version.Clock = make(map[string]uint64, min(n, 1024))
+			for range n {
+				node := string(sr.bytes())
+				version.Clock[node] = sr.uvarint()
+			}
+			continue
+		}
+
+		e := snapshotEntry{key: string(sr.bytes()), version: version}
+		version = nil
+		if at := sr.varint(); at != 0 {
+			e.expireAt = time.UnixMilli(at)
+		}
+		e.hits = sr.varint()
+		e.accessed = sr.varint() * int64(time.Millisecond)
+		e.value = sr.value(op)
+		if sr.err != nil {
+			break
+		}
+		if !e.expireAt.IsZero() && !e.expireAt.After(now) {
+			continue
+		}
+		if err := fn(db, e); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("reading snapshot: %w", sr.err)
+}
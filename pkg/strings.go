@@ -0,0 +1,583 @@
+package mukv
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// maxIntEncodedLen is the longest string stored integer-encoded: the length
+// of the decimal form of math.MinInt64.
+const maxIntEncodedLen = 20
+
+// encodeString returns the value to store for the string b. A string holding
+// the canonical decimal form of an integer is stored as an int64, so that
+// counters are not reparsed on every increment.
+func encodeString(b []byte) any {
+	if len(b) <= maxIntEncodedLen {
+		if n, ok := canonicalInt(string(b)); ok {
+			return n
+		}
+	}
+	// b may share its backing array with the rest of the command, which
+	// APPEND must not grow into.
+	return slices.Clip(b)
+}
+
+// incrBy adds incr to the integer held by the string at key, creating the
+// key at 0 if it does not exist, and returns the result.
+func incrBy(ks *Keyspace, key string, incr int64) (int64, string) {
+	var result int64
+	var errStr string
+	ks.Update(key, func(rec *Record) *Record {
+		var cur int64
+		if rec != nil {
+			switch v := rec.Value.(type) {
+			case int64:
+				cur = v
+			case []byte:
+				n, ok := canonicalInt(string(v))
+				if !ok {
+					errStr = errNotInteger
+					return Unchanged
+				}
+				cur = n
+			default:
+				errStr = errWrongType
+				return Unchanged
+			}
+		}
+		var ok bool
+		if result, ok = addInt64(cur, incr); !ok {
+			errStr = "ERR increment or decrement would overflow"
+			return Unchanged
+		}
+		if rec == nil {
+			return newRecord(result)
+		}
+		rec.Value = result
+		return rec
+	})
+	return result, errStr
+}
+
+// handleIncr implements INCR and DECR, which add by to the counter.
+func (mkv *MuKV) handleIncr(conn redcon.Conn, cmd redcon.Command, by int64) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	result, errStr := incrBy(mkv.db(conn), string(cmd.Args[1]), by)
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteInt64(result)
+	}
+}
+
+// handleIncrBy implements INCRBY and DECRBY, the latter negating the
+// increment.
+func (mkv *MuKV) handleIncrBy(conn redcon.Conn, cmd redcon.Command, negate bool) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	incr, ok := parseInt(cmd.Args[2])
+	if !ok {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	if negate {
+		if incr == math.MinInt64 {
+			conn.WriteError("ERR decrement would overflow")
+			return
+		}
+		incr = -incr
+	}
+
+	result, errStr := incrBy(mkv.db(conn), string(cmd.Args[1]), incr)
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteInt64(result)
+	}
+}
+
+func (mkv *MuKV) handleIncrByFloat(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	incr, ok := parseFloat(cmd.Args[2])
+	if !ok {
+		conn.WriteError("ERR value is not a valid float")
+		return
+	}
+
+	var result []byte
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		val, ok := asString(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		var cur float64
+		if rec != nil {
+			if cur, ok = parseFloat(val); !ok {
+				errStr = "ERR value is not a valid float"
+				return Unchanged
+			}
+		}
+		sum := cur + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			errStr = "ERR increment would produce NaN or Infinity"
+			return Unchanged
+		}
+		result = []byte(formatFloat(sum))
+		if rec == nil {
+			return newRecord(encodeString(result))
+		}
+		rec.Value = encodeString(result)
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteBulk(result)
+	}
+}
+
+// maxStringLen is the largest string SETRANGE and APPEND may build, matching
+// Redis's default proto-max-bulk-len.
+const maxStringLen = 512 << 20
+
+const errStringTooLong = "ERR string exceeds maximum allowed size (proto-max-bulk-len)"
+
+func (mkv *MuKV) handleAppend(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	n := 0
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		val, ok := asString(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		if len(val)+len(cmd.Args[2]) > maxStringLen {
+			errStr = errStringTooLong
+			return Unchanged
+		}
+		// The stored value is clipped, so append reallocates rather than
+		// writing past it, and grows in place from then on.
+		val = append(val, cmd.Args[2]...)
+		n = len(val)
+		if rec == nil {
+			return newRecord(val)
+		}
+		rec.Value = val
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+func (mkv *MuKV) handleStrLen(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		if _, ok := asString(rec); !ok {
+			conn.WriteError(errWrongType)
+		} else if rec == nil {
+			conn.WriteInt(0)
+		} else {
+			conn.WriteInt(rec.Len())
+		}
+	})
+}
+
+func (mkv *MuKV) handleGetRange(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	start, ok := parseInt(cmd.Args[2])
+	end, ok2 := parseInt(cmd.Args[3])
+	if !ok || !ok2 {
+		conn.WriteError(errNotInteger)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		val, ok := asString(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		// Unlike normalizeRange, an end before the start of the string
+		// clamps to the first byte, as it does in Redis.
+		n := int64(len(val))
+		if start < 0 && end < 0 && start > end {
+			conn.WriteBulkString("")
+			return
+		}
+		if start < 0 {
+			start = max(start+n, 0)
+		}
+		if end < 0 {
+			end = max(end+n, 0)
+		}
+		end = min(end, n-1)
+		if start > end || n == 0 {
+			conn.WriteBulkString("")
+			return
+		}
+		conn.WriteBulk(val[start : end+1])
+	})
+}
+
+func (mkv *MuKV) handleSetRange(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	offset, ok := parseInt(cmd.Args[2])
+	if !ok {
+		conn.WriteError(errNotInteger)
+		return
+	}
+	if offset < 0 {
+		conn.WriteError("ERR offset is out of range")
+		return
+	}
+	patch := cmd.Args[3]
+	if offset+int64(len(patch)) > maxStringLen {
+		conn.WriteError(errStringTooLong)
+		return
+	}
+
+	n := 0
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		val, ok := asString(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		if len(patch) == 0 {
+			// Nothing to write, so a missing key stays missing.
+			n = len(val)
+			return Unchanged
+		}
+		if end := int(offset) + len(patch); end > len(val) {
+			val = slices.Grow(val, end-len(val))[:end]
+		}
+		copy(val[offset:], patch)
+		n = len(val)
+		if rec == nil {
+			return newRecord(val)
+		}
+		rec.Value = val
+		return rec
+	})
+
+	if errStr != "" {
+		conn.WriteError(errStr)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+func (mkv *MuKV) handleGetDel(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	var val []byte
+	var wrongType bool
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		var ok bool
+		if val, ok = asString(rec); !ok {
+			wrongType = true
+			return Unchanged
+		}
+		return nil
+	})
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case val == nil:
+		conn.WriteNull()
+	default:
+		conn.WriteBulk(val)
+	}
+}
+
+func (mkv *MuKV) handleGetEx(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	now := time.Now()
+	var deadline time.Time
+	var expire, absolute, persist bool
+	switch opts := cmd.Args[2:]; {
+	case len(opts) == 0:
+	case len(opts) == 1 && strings.EqualFold(string(opts[0]), "persist"):
+		persist = true
+	case len(opts) == 2:
+		opt := strings.ToLower(string(opts[0]))
+		if opt != "ex" && opt != "px" && opt != "exat" && opt != "pxat" {
+			conn.WriteError(errSyntax)
+			return
+		}
+		unit := time.Second
+		if opt[0] == 'p' {
+			unit = time.Millisecond
+		}
+		absolute = strings.HasSuffix(opt, "at")
+		var errStr string
+		deadline, errStr = parseExpire(opts[1], unit, absolute, now)
+		if errStr == errNotInteger {
+			conn.WriteError(errStr)
+			return
+		}
+		base := now
+		if absolute {
+			base = time.Unix(0, 0)
+		}
+		if errStr != "" || !deadline.After(base) {
+			conn.WriteError("ERR invalid expire time in 'getex' command")
+			return
+		}
+		expire = true
+	default:
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	var val []byte
+	var wrongType, written bool
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		var ok bool
+		if val, ok = asString(rec); !ok {
+			wrongType = true
+			return Unchanged
+		}
+		if rec == nil || !expire && !persist || persist && rec.TTL == 0 {
+			return Unchanged
+		}
+		written = true
+		switch {
+		case expire && mkv.db(conn).passed(deadline, now):
+			// An absolute time in the past deletes the key, as EXPIREAT
+			// would.
+			return nil
+		case expire:
+			rec.SetDeadline(deadline)
+		case persist:
+			rec.SetDeadline(time.Time{})
+		}
+		return rec
+	})
+	switch {
+	case !written:
+		// Nothing was written, so there is nothing to log.
+		clientFor(conn).propagated = true
+	case expire && !absolute:
+		// Replaying a relative expire time would restart it, so log the
+		// deadline instead.
+		mkv.propagate(conn, cmd.Args[0], cmd.Args[1], []byte("PXAT"), pxatArg(deadline))
+	}
+
+	switch {
+	case wrongType:
+		conn.WriteError(errWrongType)
+	case val == nil:
+		conn.WriteNull()
+	default:
+		conn.WriteBulk(val)
+	}
+}
+
+func (mkv *MuKV) handleGetSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	mkv.handleSet(conn, redcon.Command{
+		Raw:  cmd.Raw,
+		Args: [][]byte{[]byte("set"), cmd.Args[1], cmd.Args[2], []byte("get")},
+	})
+}
+
+// lcsMatch is a run of bytes common to both strings compared by LCS, given
+// by its inclusive start and end offsets in each.
+type lcsMatch struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+func (m lcsMatch) Len() int {
+	return m.aEnd - m.aStart + 1
+}
+
+// lcs returns the longest common subsequence of a and b, along with the runs
+// it is made of, ordered from the end of the strings to their start as Redis
+// reports them.
+func lcs(a, b []byte) ([]byte, []lcsMatch) {
+	// table[i*(len(b)+1)+j] is the LCS length of a[:i] and b[:j].
+	w := len(b) + 1
+	table := make([]uint32, (len(a)+1)*w)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				table[i*w+j] = table[(i-1)*w+j-1] + 1
+			} else {
+				table[i*w+j] = max(table[(i-1)*w+j], table[i*w+j-1])
+			}
+		}
+	}
+
+	seq := make([]byte, table[len(a)*w+len(b)])
+	var matches []lcsMatch
+	extend := false
+	k := len(seq)
+	for i, j := len(a), len(b); i > 0 && j > 0; {
+		if a[i-1] == b[j-1] {
+			k--
+			seq[k] = a[i-1]
+			i--
+			j--
+			// Consecutive matches walk back along a diagonal and extend the
+			// current run.
+			if extend {
+				matches[len(matches)-1].aStart = i
+				matches[len(matches)-1].bStart = j
+			} else {
+				matches = append(matches, lcsMatch{i, i, j, j})
+			}
+			extend = true
+			continue
+		}
+		extend = false
+		if table[(i-1)*w+j] > table[i*w+j-1] {
+			i--
+		} else {
+			j--
+		}
+	}
+	return seq, matches
+}
+
+func (mkv *MuKV) handleLCS(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var withLen, withIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 3; i < len(cmd.Args); i++ {
+		switch opt := strings.ToLower(string(cmd.Args[i])); {
+		case opt == "len":
+			withLen = true
+		case opt == "idx":
+			withIdx = true
+		case opt == "withmatchlen":
+			withMatchLen = true
+		case opt == "minmatchlen" && i+1 < len(cmd.Args):
+			i++
+			n, ok := parseInt(cmd.Args[i])
+			if !ok {
+				conn.WriteError(errNotInteger)
+				return
+			}
+			minMatchLen = max(n, 0)
+		default:
+			conn.WriteError(errSyntax)
+			return
+		}
+	}
+	if withLen && withIdx {
+		conn.WriteError("ERR If you want both the length and indexes, please just use IDX.")
+		return
+	}
+
+	var a, b []byte
+	wrongType := false
+	mkv.db(conn).ViewAll(argStrings(cmd.Args[1:3]), func(recs []*Record) {
+		var ok, ok2 bool
+		a, ok = asString(recs[0])
+		b, ok2 = asString(recs[1])
+		// Copy the strings out, since the comparison runs without the lock.
+		a, b = slices.Clone(a), slices.Clone(b)
+		wrongType = !ok || !ok2
+	})
+	if wrongType {
+		conn.WriteError("ERR The specified keys must contain string values")
+		return
+	}
+
+	seq, matches := lcs(a, b)
+	switch {
+	case withLen:
+		conn.WriteInt(len(seq))
+	case withIdx:
+		matches = slices.DeleteFunc(matches, func(m lcsMatch) bool {
+			return int64(m.Len()) < minMatchLen
+		})
+		conn.WriteArray(4)
+		conn.WriteBulkString("matches")
+		conn.WriteArray(len(matches))
+		for _, m := range matches {
+			if withMatchLen {
+				conn.WriteArray(3)
+			} else {
+				conn.WriteArray(2)
+			}
+			conn.WriteArray(2)
+			conn.WriteInt(m.aStart)
+			conn.WriteInt(m.aEnd)
+			conn.WriteArray(2)
+			conn.WriteInt(m.bStart)
+			conn.WriteInt(m.bEnd)
+			if withMatchLen {
+				conn.WriteInt(m.Len())
+			}
+		}
+		conn.WriteBulkString("len")
+		conn.WriteInt(len(seq))
+	default:
+		conn.WriteBulk(seq)
+	}
+}
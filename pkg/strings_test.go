@@ -0,0 +1,39 @@
+package mukv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetExLogsOnlyWrites(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.Dir = t.TempDir()
+	cfg.AppendOnly = true
+	mkv := newTestServer(cfg)
+	if err := mkv.Load(); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(mkv)
+	c.must(t, "SET", "k", "v")
+	for _, args := range [][]string{
+		{"GETEX", "k"},
+		{"GETEX", "k", "PERSIST"},
+		{"GETEX", "missing", "EX", "100"},
+		{"GETEX", "k", "EX", "100"},
+	} {
+		c.must(t, args...)
+	}
+
+	logged, err := os.ReadFile(filepath.Join(cfg.Dir, cfg.AppendFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(logged, []byte("GETEX")); n != 1 {
+		t.Fatalf("GETEX logged %d times, want once:\n%s", n, logged)
+	}
+	if !bytes.Contains(logged, []byte("PXAT")) {
+		t.Fatalf("GETEX logged without its deadline:\n%s", logged)
+	}
+}
@@ -0,0 +1,178 @@
+package mukv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Transport carries requests between the nodes of a dynamo cluster or a raft
+// group. Call sends a command to a node and returns its reply, with simple
+// strings as strings, bulk strings as []byte, integers as int64, arrays as
+// []any and nulls as nil. An error reply is returned as the error.
+type Transport interface {
+	Call(ctx context.Context, node string, args [][]byte) (any, error)
+}
+
+// maxIdleConns is the number of idle connections kept open to each node.
+const maxIdleConns = 8
+
+// tcpTransport reaches nodes over TCP, with their IDs as addresses, keeping
+// idle connections open for reuse.
+type tcpTransport struct {
+	mu   sync.Mutex
+	idle map[string][]*transportConn
+}
+
+type transportConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func newTCPTransport() *tcpTransport {
+	return &tcpTransport{idle: make(map[string][]*transportConn)}
+}
+
+func (t *tcpTransport) Call(ctx context.Context, node string, args [][]byte) (any, error) {
+	for {
+		c, reused, err := t.get(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := t.roundTrip(ctx, c, args)
+		var rerr replyError
+		if err == nil || errors.As(err, &rerr) {
+			t.put(node, c)
+			return reply, err
+		}
+		c.Close()
+		// An idle connection may have been closed by the node since it was
+		// last used, so try again on a new one. Nodes store versions, so a
+		// command run twice has the same effect as run once.
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *tcpTransport) roundTrip(ctx context.Context, c *transportConn, args [][]byte) (any, error) {
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+	if _, err := c.Write(appendCommand(nil, args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.br)
+}
+
+// get returns an idle connection to node, reporting true, or dials a new
+// one.
+func (t *tcpTransport) get(ctx context.Context, node string) (*transportConn, bool, error) {
+	t.mu.Lock()
+	if idle := t.idle[node]; len(idle) > 0 {
+		c := idle[len(idle)-1]
+		t.idle[node] = idle[:len(idle)-1]
+		t.mu.Unlock()
+		return c, true, nil
+	}
+	t.mu.Unlock()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", node)
+	if err != nil {
+		return nil, false, err
+	}
+	return &transportConn{Conn: c, br: bufio.NewReader(c)}, false, nil
+}
+
+// put returns c to the idle connections to node.
+func (t *tcpTransport) put(node string, c *transportConn) {
+	c.SetDeadline(time.Time{})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[node]) >= maxIdleConns {
+		c.Close()
+		return
+	}
+	t.idle[node] = append(t.idle[node], c)
+}
+
+// callLocal runs args on mkv as a client would, and returns its reply as a
+// Transport does.
+func callLocal(mkv *MuKV, args [][]byte) (any, error) {
+	conn := &bufferConn{ctx: &client{}}
+	mkv.Handler(conn, redcon.Command{Args: args})
+	return readReply(bufio.NewReader(bytes.NewReader(conn.buf)))
+}
+
+// MemoryNetwork connects nodes running in one process, for tests and
+// simulations. Nodes can be cut off from it, or from each other, to see how
+// the others cope.
+type MemoryNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*MuKV
+	down  map[string]bool
+	cut   map[[2]string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		nodes: make(map[string]*MuKV),
+		down:  make(map[string]bool),
+		cut:   make(map[[2]string]bool),
+	}
+}
+
+// Add attaches mkv to the network as node.
+func (n *MemoryNetwork) Add(node string, mkv *MuKV) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[node] = mkv
+}
+
+// SetDown cuts node off from the rest of the network, or reconnects it.
+func (n *MemoryNetwork) SetDown(node string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[node] = down
+}
+
+// SetLink cuts the link between nodes a and b, in both directions, or
+// restores it, to partition the network.
+func (n *MemoryNetwork) SetLink(a, b string, up bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut[[2]string{a, b}] = !up
+	n.cut[[2]string{b, a}] = !up
+}
+
+// Transport returns the transport node reaches the other nodes through.
+func (n *MemoryNetwork) Transport(node string) Transport {
+	return &memoryTransport{network: n, from: node}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    string
+}
+
+func (t *memoryTransport) Call(ctx context.Context, node string, args [][]byte) (any, error) {
+	n := t.network
+	n.mu.RLock()
+	target := n.nodes[node]
+	cut := n.down[t.from] || n.down[node] || n.cut[[2]string{t.from, node}]
+	n.mu.RUnlock()
+	if target == nil || cut {
+		return nil, fmt.Errorf("node %s is unreachable", node)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return callLocal(target, args)
+}
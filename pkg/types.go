@@ -0,0 +1,171 @@
+package mukv
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+)
+
+const errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// ValueType identifies the kind of value a record holds.
+type ValueType int
+
+const (
+	TypeString ValueType = iota
+	TypeHash
+	TypeList
+	TypeSet
+	TypeZSet
+)
+
+var valueTypeNames = [...]string{
+	TypeString: "string",
+	TypeHash:   "hash",
+	TypeList:   "list",
+	TypeSet:    "set",
+	TypeZSet:   "zset",
+}
+
+func (t ValueType) String() string {
+	return valueTypeNames[t]
+}
+
+// hashValue maps the fields of a hash to their values.
+type hashValue map[string][]byte
+
+// Type returns the kind of value held by the record.
+func (r *Record) Type() ValueType {
+	switch r.Value.(type) {
+	case hashValue:
+		return TypeHash
+	case *deque:
+		return TypeList
+	case *setValue:
+		return TypeSet
+	case *zsetValue:
+		return TypeZSet
+	default:
+		return TypeString
+	}
+}
+
+// Len returns the number of fields, elements or members held by a hash, list
+// set or sorted set, or the length in bytes of a string.
+func (r *Record) Len() int {
+	switch v := r.Value.(type) {
+	case hashValue:
+		return len(v)
+	case *deque:
+		return v.Len()
+	case *setValue:
+		return v.Len()
+	case *zsetValue:
+		return v.Len()
+	case []byte:
+		return len(v)
+	case int64:
+		return len(strconv.FormatInt(v, 10))
+	default:
+		return 0
+	}
+}
+
+// Encoding returns the name of the internal representation of the record's
+// value, as OBJECT ENCODING reports it.
+func (r *Record) Encoding() string {
+	switch v := r.Value.(type) {
+	case int64:
+		return "int"
+	case []byte:
+		if len(v) <= maxEmbstrLen {
+			return "embstr"
+		}
+		return "raw"
+	case hashValue:
+		return "hashtable"
+	case *deque:
+		return "quicklist"
+	case *setValue:
+		return v.Encoding()
+	case *zsetValue:
+		return "skiplist"
+	}
+	return "unknown"
+}
+
+// maxEmbstrLen is the longest string Redis stores in the same allocation as
+// its object header, which OBJECT ENCODING reports as embstr.
+const maxEmbstrLen = 44
+
+// cloneValue returns a deep copy of v, for COPY.
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case []byte:
+		return slices.Clone(v)
+	case hashValue:
+		return maps.Clone(v)
+	case *deque:
+		return v.Clone()
+	case *setValue:
+		return v.Clone()
+	case *zsetValue:
+		return v.Clone()
+	}
+	return v
+}
+
+// asString returns the string held by rec, formatting an integer-encoded
+// string, or nil if rec is nil. It reports false if rec holds another type.
+func asString(rec *Record) ([]byte, bool) {
+	if rec == nil {
+		return nil, true
+	}
+	switch v := rec.Value.(type) {
+	case []byte:
+		return v, true
+	case int64:
+		return strconv.AppendInt(nil, v, 10), true
+	}
+	return nil, false
+}
+
+// asHash returns the hash held by rec, or an empty hash if rec is nil. It
+// reports false if rec holds another type.
+func asHash(rec *Record) (hashValue, bool) {
+	if rec == nil {
+		return hashValue{}, true
+	}
+	h, ok := rec.Value.(hashValue)
+	return h, ok
+}
+
+// asList returns the list held by rec, or an empty list if rec is nil. It
+// reports false if rec holds another type.
+func asList(rec *Record) (*deque, bool) {
+	if rec == nil {
+		return &deque{}, true
+	}
+	l, ok := rec.Value.(*deque)
+	return l, ok
+}
+
+// asSet returns the set held by rec, or an empty set if rec is nil. It
+// reports false if rec holds another type.
+func asSet(rec *Record) (*setValue, bool) {
+	if rec == nil {
+		return newSetValue(), true
+	}
+	s, ok := rec.Value.(*setValue)
+	return s, ok
+}
+
+// asZSet returns the sorted set held by rec, or an empty sorted set if rec is
+// nil. It reports false if rec holds another type.
+func asZSet(rec *Record) (*zsetValue, bool) {
+	if rec == nil {
+		return newZSetValue(), true
+	}
+	z, ok := rec.Value.(*zsetValue)
+	return z, ok
+}
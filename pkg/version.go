@@ -0,0 +1,117 @@
+package mukv
+
+import (
+	"maps"
+	"strconv"
+)
+
+// Version identifies a version of a key's value in dynamo mode. Clock is a
+// version vector, counting for each node the writes to the key it has
+// coordinated, which orders versions that saw one another. Versions written
+// without either seeing the other are concurrent, and the one written last,
+// by Stamp and then by Node, wins.
+type Version struct {
+	Clock map[string]uint64
+	// Stamp is the Unix time in milliseconds the version was written at.
+	Stamp int64
+	// Node is the node that coordinated the write.
+	Node string
+}
+
+// versionOrder is how one version is ordered against another.
+type versionOrder int
+
+const (
+	versionEqual versionOrder = iota
+	versionBefore
+	versionAfter
+	versionConcurrent
+)
+
+// clock returns the version vector of v, which is empty for a nil version.
+func (v *Version) clock() map[string]uint64 {
+	if v == nil {
+		return nil
+	}
+	return v.Clock
+}
+
+// compare returns how v is ordered against w. A nil version, that of a key
+// never written, comes before every other.
+func (v *Version) compare(w *Version) versionOrder {
+	vc, wc := v.clock(), w.clock()
+	before, after := false, false
+	for node, n := range vc {
+		if m := wc[node]; n < m {
+			before = true
+		} else if n > m {
+			after = true
+		}
+	}
+	for node, m := range wc {
+		if _, ok := vc[node]; !ok && m > 0 {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return versionConcurrent
+	case before:
+		return versionBefore
+	case after:
+		return versionAfter
+	}
+	return versionEqual
+}
+
+// wins reports whether v wins over w, which is concurrent with it.
+func (v *Version) wins(w *Version) bool {
+	if v.Stamp != w.Stamp {
+		return v.Stamp > w.Stamp
+	}
+	return v.Node > w.Node
+}
+
+// merge returns a version that follows both v and w, keeping the stamp and
+// node of v.
+func (v *Version) merge(w *Version) *Version {
+	merged := &Version{Clock: maps.Clone(v.Clock), Stamp: v.Stamp, Node: v.Node}
+	if merged.Clock == nil {
+		merged.Clock = make(map[string]uint64, len(w.clock()))
+	}
+	for node, n := range w.clock() {
+		merged.Clock[node] = max(merged.Clock[node], n)
+	}
+	return merged
+}
+
+// appendArgs appends v to args as the command arguments it is sent between
+// nodes as: the stamp, the node, and a node and counter for each entry of
+// the clock.
+func (v *Version) appendArgs(args [][]byte) [][]byte {
+	args = append(args, strconv.AppendInt(nil, v.Stamp, 10), []byte(v.Node))
+	for node, n := range v.Clock {
+		args = append(args, []byte(node), strconv.AppendUint(nil, n, 10))
+	}
+	return args
+}
+
+// parseVersion parses a version from the arguments appendArgs appends.
+func parseVersion(args [][]byte) (*Version, bool) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return nil, false
+	}
+	stamp, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	v := &Version{Clock: make(map[string]uint64, len(args)/2-1), Stamp: stamp, Node: string(args[1])}
+	for i := 2; i < len(args); i += 2 {
+		n, err := strconv.ParseUint(string(args[i+1]), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		v.Clock[string(args[i])] = n
+	}
+	return v, true
+}
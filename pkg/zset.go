@@ -0,0 +1,1328 @@
+package mukv
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/redcon"
+)
+
+// zsetItem is a member of a sorted set along with its score.
+type zsetItem struct {
+	score  float64
+	member string
+}
+
+// zsetLess orders items by score, then by member for equal scores.
+func zsetLess(a, b zsetItem) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.member < b.member
+}
+
+// zsetValue is a sorted set: a B-tree of items ordered by score, kept
+// alongside a map from member to score for O(1) lookups. The B-tree counts
+// the items below each node, so items can be reached by rank.
+type zsetValue struct {
+	tree   *btree.BTreeG[zsetItem]
+	scores map[string]float64
+}
+
+func newZSetValue() *zsetValue {
+	return &zsetValue{
+		tree:   btree.NewBTreeGOptions(zsetLess, btree.Options{NoLocks: true}),
+		scores: make(map[string]float64),
+	}
+}
+
+func (z *zsetValue) Clone() *zsetValue {
+	return &zsetValue{tree: z.tree.Copy(), scores: maps.Clone(z.scores)}
+}
+
+func (z *zsetValue) Len() int {
+	return len(z.scores)
+}
+
+func (z *zsetValue) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Add sets the score of member and reports whether it was not already a
+// member.
+func (z *zsetValue) Add(member string, score float64) bool {
+	old, ok := z.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+		z.tree.Delete(zsetItem{old, member})
+	}
+	z.scores[member] = score
+	z.tree.Set(zsetItem{score, member})
+	return !ok
+}
+
+// Remove removes member and reports whether it was a member.
+func (z *zsetValue) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.tree.Delete(zsetItem{score, member})
+	return true
+}
+
+// At returns the item of rank i, counting from the lowest score.
+func (z *zsetValue) At(i int) zsetItem {
+	item, _ := z.tree.GetAt(i)
+	return item
+}
+
+// Rank returns the rank of member, counting from the lowest score.
+func (z *zsetValue) Rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	target := zsetItem{score, member}
+	return z.search(func(item zsetItem) bool {
+		return !zsetLess(item, target)
+	}), true
+}
+
+// search returns the lowest rank whose item satisfies pred, or Len() if
+// none do. pred must be false for a prefix of the ranks and true for the
+// rest.
+func (z *zsetValue) search(pred func(zsetItem) bool) int {
+	lo, hi := 0, z.Len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if pred(z.At(mid)) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+func (z *zsetValue) PopMin() zsetItem {
+	item, _ := z.tree.PopMin()
+	delete(z.scores, item.member)
+	return item
+}
+
+func (z *zsetValue) PopMax() zsetItem {
+	item, _ := z.tree.PopMax()
+	delete(z.scores, item.member)
+	return item
+}
+
+// Ascend calls iter for each item from rank i upwards until iter returns
+// false.
+func (z *zsetValue) Ascend(i int, iter func(item zsetItem) bool) {
+	if i >= z.Len() {
+		return
+	}
+	z.tree.Ascend(z.At(i), iter)
+}
+
+// Descend calls iter for each item from rank i downwards until iter returns
+// false.
+func (z *zsetValue) Descend(i int, iter func(item zsetItem) bool) {
+	if i < 0 {
+		return
+	}
+	z.tree.Descend(z.At(i), iter)
+}
+
+// scoreBound is one end of a score range, as in ZRANGEBYSCORE.
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func parseScoreBound(arg []byte) (scoreBound, bool) {
+	var b scoreBound
+	s := string(arg)
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return b, false
+	}
+	b.score = score
+	return b, true
+}
+
+// above reports whether score lies above b when b is a minimum.
+func (b scoreBound) above(score float64) bool {
+	if b.exclusive {
+		return score > b.score
+	}
+	return score >= b.score
+}
+
+// below reports whether score lies below b when b is a maximum.
+func (b scoreBound) below(score float64) bool {
+	if b.exclusive {
+		return score < b.score
+	}
+	return score <= b.score
+}
+
+// lexBound is one end of a lexicographical range, as in ZRANGEBYLEX.
+type lexBound struct {
+	member    string
+	exclusive bool
+	// inf is -1 for "-" and 1 for "+".
+	inf int
+}
+
+func parseLexBound(arg []byte) (lexBound, bool) {
+	s := string(arg)
+	switch {
+	case s == "-":
+		return lexBound{inf: -1}, true
+	case s == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{member: s[1:], exclusive: true}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{member: s[1:]}, true
+	}
+	return lexBound{}, false
+}
+
+// compare compares member against the bound, as cmp.Compare does.
+func (b lexBound) compare(member string) int {
+	if b.inf != 0 {
+		return -b.inf
+	}
+	return cmp.Compare(member, b.member)
+}
+
+// above reports whether member lies above b when b is a minimum.
+func (b lexBound) above(member string) bool {
+	c := b.compare(member)
+	return c > 0 || (c == 0 && !b.exclusive)
+}
+
+// below reports whether member lies below b when b is a maximum.
+func (b lexBound) below(member string) bool {
+	c := b.compare(member)
+	return c < 0 || (c == 0 && !b.exclusive)
+}
+
+// formatScore formats a score the way Redis replies with one: shortest
+// round-trip form, switching to exponent notation for very large or small
+// magnitudes.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(score); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// zrangeSpec describes the items selected by ZRANGE and its older variants.
+type zrangeSpec struct {
+	byScore, byLex bool
+	rev            bool
+	start, stop    int64
+	min, max       scoreBound
+	lexMin, lexMax lexBound
+	offset, count  int64
+	withScores     bool
+}
+
+// parseZRange parses the range and options of a ZRANGE-style command into
+// spec, which carries the defaults of the command being parsed. Options
+// that only the unified ZRANGE syntax accepts are rejected unless unified
+// is set.
+func parseZRange(args [][]byte, spec zrangeSpec, unified bool) (zrangeSpec, string) {
+	spec.count = -1
+	limit := false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "withscores":
+			spec.withScores = true
+		case opt == "limit" && i+2 < len(args):
+			offset, ok := parseInt(args[i+1])
+			count, ok2 := parseInt(args[i+2])
+			if !ok || !ok2 {
+				return spec, errNotInteger
+			}
+			spec.offset, spec.count = offset, count
+			limit = true
+			i += 2
+		case opt == "byscore" && unified:
+			spec.byScore = true
+		case opt == "bylex" && unified:
+			spec.byLex = true
+		case opt == "rev" && unified:
+			spec.rev = true
+		default:
+			return spec, errSyntax
+		}
+	}
+	switch {
+	case spec.byScore && spec.byLex:
+		return spec, errSyntax
+	case limit && !spec.byScore && !spec.byLex:
+		return spec, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+	case spec.withScores && spec.byLex:
+		return spec, "ERR syntax error, WITHSCORES not supported in combination with BYLEX"
+	}
+
+	// Reversed score and lex ranges give the maximum first.
+	lo, hi := args[0], args[1]
+	if spec.rev && (spec.byScore || spec.byLex) {
+		lo, hi = hi, lo
+	}
+	var ok, ok2 bool
+	switch {
+	case spec.byScore:
+		spec.min, ok = parseScoreBound(lo)
+		spec.max, ok2 = parseScoreBound(hi)
+		if !ok || !ok2 {
+			return spec, "ERR min or max is not a float"
+		}
+	case spec.byLex:
+		spec.lexMin, ok = parseLexBound(lo)
+		spec.lexMax, ok2 = parseLexBound(hi)
+		if !ok || !ok2 {
+			return spec, "ERR min or max not valid string range item"
+		}
+	default:
+		spec.start, ok = parseInt(lo)
+		spec.stop, ok2 = parseInt(hi)
+		if !ok || !ok2 {
+			return spec, errNotInteger
+		}
+	}
+	return spec, ""
+}
+
+// items returns the items of z selected by spec, in reply order.
+func (spec zrangeSpec) items(z *zsetValue) []zsetItem {
+	var items []zsetItem
+	if !spec.byScore && !spec.byLex {
+		from, to, ok := normalizeRange(spec.start, spec.stop, z.Len())
+		if !ok {
+			return nil
+		}
+		items = make([]zsetItem, 0, to-from+1)
+		for i := from; i <= to; i++ {
+			if spec.rev {
+				items = append(items, z.At(z.Len()-1-i))
+			} else {
+				items = append(items, z.At(i))
+			}
+		}
+		return items
+	}
+
+	above := func(item zsetItem) bool { return spec.min.above(item.score) }
+	below := func(item zsetItem) bool { return spec.max.below(item.score) }
+	if spec.byLex {
+		above = func(item zsetItem) bool { return spec.lexMin.above(item.member) }
+		below = func(item zsetItem) bool { return spec.lexMax.below(item.member) }
+	}
+	if spec.offset < 0 || spec.count == 0 {
+		return nil
+	}
+	skip := spec.offset
+	collect := func(item zsetItem) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		items = append(items, item)
+		return spec.count < 0 || int64(len(items)) < spec.count
+	}
+	if spec.rev {
+		last := z.search(func(item zsetItem) bool { return !below(item) }) - 1
+		z.Descend(last, func(item zsetItem) bool {
+			return above(item) && collect(item)
+		})
+	} else {
+		first := z.search(above)
+		z.Ascend(first, func(item zsetItem) bool {
+			return below(item) && collect(item)
+		})
+	}
+	return items
+}
+
+func writeZItems(conn redcon.Conn, items []zsetItem, withScores bool) {
+	if withScores {
+		conn.WriteArray(len(items) * 2)
+	} else {
+		conn.WriteArray(len(items))
+	}
+	for _, item := range items {
+		conn.WriteBulkString(item.member)
+		if withScores {
+			conn.WriteBulkString(formatScore(item.score))
+		}
+	}
+}
+
+func (mkv *MuKV) handleZAdd(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+flags:
+	for ; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		case "ch":
+			ch = true
+		case "incr":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	pairs := cmd.Args[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		conn.WriteError(errSyntax)
+		return
+	case nx && xx:
+		conn.WriteError("ERR XX and NX options at the same time are not compatible")
+		return
+	case (gt && lt) || (nx && (gt || lt)):
+		conn.WriteError("ERR GT, LT, and/or NX options at the same time are not compatible")
+		return
+	case incr && len(pairs) > 2:
+		conn.WriteError("ERR INCR option supports a single increment-element pair")
+		return
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, ok := parseFloat(pairs[j*2])
+		if !ok {
+			conn.WriteError("ERR value is not a valid float")
+			return
+		}
+		scores[j] = score
+	}
+
+	added, changed := 0, 0
+	var result float64
+	var updated bool
+	var errStr string
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		z, ok := asZSet(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		for j, score := range scores {
+			member := string(pairs[j*2+1])
+			cur, exists := z.Score(member)
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			if incr && exists {
+				score += cur
+				if math.IsNaN(score) {
+					errStr = "ERR resulting score is not a number (NaN)"
+					return Unchanged
+				}
+			}
+			if exists && ((gt && score <= cur) || (lt && score >= cur)) {
+				continue
+			}
+			result, updated = score, true
+			if z.Add(member, score) {
+				added++
+				changed++
+			} else if !exists || cur != score {
+				changed++
+			}
+		}
+		if changed == 0 {
+			return Unchanged
+		}
+		if rec == nil {
+			rec = newRecord(z)
+		}
+		return rec
+	})
+
+	switch {
+	case errStr != "":
+		conn.WriteError(errStr)
+	case incr && !updated:
+		conn.WriteNull()
+	case incr:
+		conn.WriteBulkString(formatScore(result))
+	case ch:
+		conn.WriteInt(changed)
+	default:
+		conn.WriteInt(added)
+	}
+}
+
+func (mkv *MuKV) handleZIncrBy(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	mkv.handleZAdd(conn, redcon.Command{
+		Raw:  cmd.Raw,
+		Args: [][]byte{[]byte("zadd"), cmd.Args[1], []byte("incr"), cmd.Args[2], cmd.Args[3]},
+	})
+}
+
+func (mkv *MuKV) handleZRem(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	removed := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		z, ok := asZSet(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for _, member := range cmd.Args[2:] {
+			if z.Remove(string(member)) {
+				removed++
+			}
+		}
+		switch {
+		case removed == 0:
+			return Unchanged
+		case z.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(removed)
+	}
+}
+
+// handleZScore implements ZSCORE and ZMSCORE.
+func (mkv *MuKV) handleZScore(conn redcon.Conn, cmd redcon.Command, multi bool) {
+	if len(cmd.Args) < 3 || (!multi && len(cmd.Args) != 3) {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		if multi {
+			conn.WriteArray(len(cmd.Args) - 2)
+		}
+		for _, member := range cmd.Args[2:] {
+			if score, ok := z.Score(string(member)); ok {
+				conn.WriteBulkString(formatScore(score))
+			} else {
+				conn.WriteNull()
+			}
+		}
+	})
+}
+
+func (mkv *MuKV) handleZCard(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != 2 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(z.Len())
+	})
+}
+
+// handleZCount implements ZCOUNT and ZLEXCOUNT.
+func (mkv *MuKV) handleZCount(conn redcon.Conn, cmd redcon.Command, byLex bool) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	spec, errStr := parseZRange(cmd.Args[2:], zrangeSpec{byScore: !byLex, byLex: byLex}, false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		conn.WriteInt(len(spec.items(z)))
+	})
+}
+
+// handleZRank implements ZRANK and ZREVRANK.
+func (mkv *MuKV) handleZRank(conn redcon.Conn, cmd redcon.Command, rev bool) {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	withScore := len(cmd.Args) == 4
+	if withScore && !strings.EqualFold(string(cmd.Args[3]), "withscore") {
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		member := string(cmd.Args[2])
+		rank, ok := z.Rank(member)
+		switch {
+		case !ok && withScore:
+			writeNullArray(conn)
+			return
+		case !ok:
+			conn.WriteNull()
+			return
+		}
+		if rev {
+			rank = z.Len() - 1 - rank
+		}
+		if withScore {
+			score, _ := z.Score(member)
+			conn.WriteArray(2)
+			conn.WriteInt(rank)
+			conn.WriteBulkString(formatScore(score))
+		} else {
+			conn.WriteInt(rank)
+		}
+	})
+}
+
+// handleZRange implements ZRANGE and its older variants, whose defaults
+// arrive in spec.
+func (mkv *MuKV) handleZRange(conn redcon.Conn, cmd redcon.Command, spec zrangeSpec, unified bool) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	spec, errStr := parseZRange(cmd.Args[2:], spec, unified)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		writeZItems(conn, spec.items(z), spec.withScores)
+	})
+}
+
+func (mkv *MuKV) handleZRangeStore(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	spec, errStr := parseZRange(cmd.Args[3:], zrangeSpec{}, true)
+	if errStr == "" && spec.withScores {
+		errStr = errSyntax
+	}
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	n := 0
+	wrongType := false
+	mkv.db(conn).UpdateAll(argStrings(cmd.Args[1:3]), func(recs []*Record) []*Record {
+		src, ok := asZSet(recs[1])
+		if !ok {
+			wrongType = true
+			return nil
+		}
+		dst := newZSetValue()
+		for _, item := range spec.items(src) {
+			dst.Add(item.member, item.score)
+		}
+		n = dst.Len()
+		if n == 0 {
+			recs[0] = nil
+		} else {
+			recs[0] = newRecord(dst)
+		}
+		if string(cmd.Args[1]) == string(cmd.Args[2]) {
+			recs[1] = recs[0]
+		} else {
+			recs[1] = Unchanged
+		}
+		return recs
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+// handleZRemRange implements ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX, whose range kind arrives in spec.
+func (mkv *MuKV) handleZRemRange(conn redcon.Conn, cmd redcon.Command, spec zrangeSpec) {
+	if len(cmd.Args) != 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	spec, errStr := parseZRange(cmd.Args[2:], spec, false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	removed := 0
+	wrongType := false
+	mkv.db(conn).Update(string(cmd.Args[1]), func(rec *Record) *Record {
+		z, ok := asZSet(rec)
+		if !ok {
+			wrongType = true
+			return Unchanged
+		}
+		for _, item := range spec.items(z) {
+			z.Remove(item.member)
+			removed++
+		}
+		switch {
+		case removed == 0:
+			return Unchanged
+		case z.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(removed)
+	}
+}
+
+// zpopCommand names the command popping the lowest or, if max is set, the
+// highest scoring members of a sorted set, which blocking pops are logged
+// as.
+func zpopCommand(max bool) string {
+	if max {
+		return "ZPOPMAX"
+	}
+	return "ZPOPMIN"
+}
+
+// popZSet pops up to count items from the low or high end of the sorted set
+// at key. It returns nil if the key does not exist.
+func popZSet(ks *Keyspace, key string, max bool, count int) ([]zsetItem, string) {
+	var items []zsetItem
+	var errStr string
+	ks.Update(key, func(rec *Record) *Record {
+		z, ok := asZSet(rec)
+		if !ok {
+			errStr = errWrongType
+			return Unchanged
+		}
+		if rec == nil {
+			return Unchanged
+		}
+		items = make([]zsetItem, 0, min(count, z.Len()))
+		for range min(count, z.Len()) {
+			if max {
+				items = append(items, z.PopMax())
+			} else {
+				items = append(items, z.PopMin())
+			}
+		}
+		switch {
+		case len(items) == 0:
+			return Unchanged
+		case z.Len() == 0:
+			return nil
+		}
+		return rec
+	})
+	return items, errStr
+}
+
+// handleZPop implements ZPOPMIN and ZPOPMAX.
+func (mkv *MuKV) handleZPop(conn redcon.Conn, cmd redcon.Command, max bool) {
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	count := int64(1)
+	if len(cmd.Args) == 3 {
+		var ok bool
+		if count, ok = parseInt(cmd.Args[2]); !ok || count < 0 {
+			conn.WriteError("ERR value is out of range, must be positive")
+			return
+		}
+	}
+
+	items, errStr := popZSet(mkv.db(conn), string(cmd.Args[1]), max, int(count))
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	writeZItems(conn, items, true)
+}
+
+// parseZMPop parses the numkeys, keys, MIN or MAX and COUNT arguments shared
+// by ZMPOP and BZMPOP.
+func parseZMPop(args [][]byte) (keys []string, max bool, count int, errStr string) {
+	numKeys, ok := parseInt(args[0])
+	if !ok || numKeys <= 0 {
+		return nil, false, 0, "ERR numkeys should be greater than 0"
+	}
+	if int64(len(args)) < numKeys+2 {
+		return nil, false, 0, errSyntax
+	}
+	keys = argStrings(args[1 : numKeys+1])
+	args = args[numKeys+1:]
+	switch strings.ToLower(string(args[0])) {
+	case "min":
+	case "max":
+		max = true
+	default:
+		return nil, false, 0, errSyntax
+	}
+	count = 1
+	switch {
+	case len(args) == 1:
+	case len(args) == 3 && strings.EqualFold(string(args[1]), "count"):
+		n, ok := parseInt(args[2])
+		if !ok || n <= 0 {
+			return nil, false, 0, "ERR count should be greater than 0"
+		}
+		count = int(n)
+	default:
+		return nil, false, 0, errSyntax
+	}
+	return keys, max, count, ""
+}
+
+func writeZMPopReply(conn redcon.Conn, key string, items []zsetItem) {
+	conn.WriteArray(2)
+	conn.WriteBulkString(key)
+	conn.WriteArray(len(items))
+	for _, item := range items {
+		conn.WriteArray(2)
+		conn.WriteBulkString(item.member)
+		conn.WriteBulkString(formatScore(item.score))
+	}
+}
+
+func (mkv *MuKV) handleZMPop(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	keys, max, count, errStr := parseZMPop(cmd.Args[1:])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	for _, key := range keys {
+		items, errStr := popZSet(mkv.db(conn), key, max, count)
+		if errStr != "" {
+			conn.WriteError(errStr)
+			return
+		}
+		if len(items) > 0 {
+			writeZMPopReply(conn, key, items)
+			return
+		}
+	}
+	writeNullArray(conn)
+}
+
+// handleBZPop implements BZPOPMIN and BZPOPMAX.
+func (mkv *MuKV) handleBZPop(conn redcon.Conn, cmd redcon.Command, max bool) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	timeout, errStr := parseTimeout(cmd.Args[len(cmd.Args)-1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	keys := argStrings(cmd.Args[1 : len(cmd.Args)-1])
+	served := mkv.block(conn, keys, timeout, func(key string) bool {
+		items, errStr := popZSet(mkv.db(conn), key, max, 1)
+		switch {
+		case errStr != "":
+			conn.WriteError(errStr)
+		case len(items) > 0:
+			mkv.propagate(conn, []byte(zpopCommand(max)), []byte(key))
+			conn.WriteArray(3)
+			conn.WriteBulkString(key)
+			conn.WriteBulkString(items[0].member)
+			conn.WriteBulkString(formatScore(items[0].score))
+		default:
+			return false
+		}
+		return true
+	})
+	if !served {
+		writeNullArray(conn)
+	}
+}
+
+func (mkv *MuKV) handleBZMPop(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 5 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	timeout, errStr := parseTimeout(cmd.Args[1])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	keys, max, count, errStr := parseZMPop(cmd.Args[2:])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	served := mkv.block(conn, keys, timeout, func(key string) bool {
+		items, errStr := popZSet(mkv.db(conn), key, max, count)
+		switch {
+		case errStr != "":
+			conn.WriteError(errStr)
+		case len(items) > 0:
+			mkv.propagate(conn, []byte(zpopCommand(max)), []byte(key), []byte(strconv.Itoa(len(items))))
+			writeZMPopReply(conn, key, items)
+		default:
+			return false
+		}
+		return true
+	})
+	if !served {
+		writeNullArray(conn)
+	}
+}
+
+// zsetOpArgs holds the parsed arguments of ZUNION, ZINTER, ZDIFF and their
+// STORE variants.
+type zsetOpArgs struct {
+	keys       []string
+	weights    []float64
+	aggregate  string
+	withScores bool
+}
+
+// parseZSetOp parses numkeys, the keys and the options that follow them.
+// WEIGHTS and AGGREGATE are accepted when weighted is set, WITHSCORES when
+// withScores is.
+func parseZSetOp(args [][]byte, weighted, withScores bool) (zsetOpArgs, string) {
+	op := zsetOpArgs{aggregate: "sum"}
+	numKeys, ok := parseInt(args[0])
+	if !ok {
+		return op, errNotInteger
+	}
+	if numKeys <= 0 {
+		return op, "ERR at least 1 input key is needed for this command"
+	}
+	if int64(len(args)-1) < numKeys {
+		return op, errSyntax
+	}
+	op.keys = argStrings(args[1 : numKeys+1])
+	for i := int(numKeys) + 1; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "weights" && weighted && i+len(op.keys) < len(args):
+			op.weights = make([]float64, len(op.keys))
+			for j := range op.weights {
+				i++
+				w, ok := parseFloat(args[i])
+				if !ok {
+					return op, "ERR weight value is not a float"
+				}
+				op.weights[j] = w
+			}
+		case opt == "aggregate" && weighted && i+1 < len(args):
+			i++
+			op.aggregate = strings.ToLower(string(args[i]))
+			if op.aggregate != "sum" && op.aggregate != "min" && op.aggregate != "max" {
+				return op, errSyntax
+			}
+		case opt == "withscores" && withScores:
+			op.withScores = true
+		default:
+			return op, errSyntax
+		}
+	}
+	return op, ""
+}
+
+// zsetInput returns the member scores held by rec, which may be a sorted set
+// or a plain set whose members all score 1. It reports false if rec holds
+// another type.
+func zsetInput(rec *Record) (map[string]float64, bool) {
+	if rec == nil {
+		return nil, true
+	}
+	switch v := rec.Value.(type) {
+	case *zsetValue:
+		return v.scores, true
+	case *setValue:
+		scores := make(map[string]float64, v.Len())
+		for _, m := range v.Members() {
+			scores[m] = 1
+		}
+		return scores, true
+	}
+	return nil, false
+}
+
+// combineZSets computes op over the sorted sets held by recs, which line up
+// with args.keys. It reports false if any record holds another type.
+func combineZSets(op setOp, args zsetOpArgs, recs []*Record) (*zsetValue, bool) {
+	inputs := make([]map[string]float64, len(recs))
+	for i, rec := range recs {
+		scores, ok := zsetInput(rec)
+		if !ok {
+			return nil, false
+		}
+		inputs[i] = scores
+	}
+	weight := func(i int, score float64) float64 {
+		if args.weights == nil {
+			return score
+		}
+		// Redis scores inf*0 as 0 rather than NaN.
+		if w := score * args.weights[i]; !math.IsNaN(w) {
+			return w
+		}
+		return 0
+	}
+	aggregate := func(a, b float64) float64 {
+		switch args.aggregate {
+		case "min":
+			return min(a, b)
+		case "max":
+			return max(a, b)
+		}
+		if sum := a + b; !math.IsNaN(sum) {
+			return sum
+		}
+		return 0
+	}
+
+	result := newZSetValue()
+	switch op {
+	case setUnion:
+		scores := make(map[string]float64)
+		for i, input := range inputs {
+			for m, score := range input {
+				score = weight(i, score)
+				if cur, ok := scores[m]; ok {
+					score = aggregate(cur, score)
+				}
+				scores[m] = score
+			}
+		}
+		for m, score := range scores {
+			result.Add(m, score)
+		}
+	case setInter:
+	members:
+		for m, score := range inputs[0] {
+			score = weight(0, score)
+			for i, input := range inputs[1:] {
+				other, ok := input[m]
+				if !ok {
+					continue members
+				}
+				score = aggregate(score, weight(i+1, other))
+			}
+			result.Add(m, score)
+		}
+	case setDiff:
+		for m, score := range inputs[0] {
+			if !slices.ContainsFunc(inputs[1:], func(input map[string]float64) bool {
+				_, ok := input[m]
+				return ok
+			}) {
+				result.Add(m, score)
+			}
+		}
+	}
+	return result, true
+}
+
+// handleZSetOp implements ZUNION, ZINTER and ZDIFF.
+func (mkv *MuKV) handleZSetOp(conn redcon.Conn, cmd redcon.Command, op setOp) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	args, errStr := parseZSetOp(cmd.Args[1:], op != setDiff, true)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).ViewAll(args.keys, func(recs []*Record) {
+		z, ok := combineZSets(op, args, recs)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		writeZItems(conn, z.tree.Items(), args.withScores)
+	})
+}
+
+// handleZSetOpStore implements ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE.
+func (mkv *MuKV) handleZSetOpStore(conn redcon.Conn, cmd redcon.Command, op setOp) {
+	if len(cmd.Args) < 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	args, errStr := parseZSetOp(cmd.Args[2:], op != setDiff, false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	n := 0
+	wrongType := false
+	keys := append([]string{string(cmd.Args[1])}, args.keys...)
+	mkv.db(conn).UpdateAll(keys, func(recs []*Record) []*Record {
+		z, ok := combineZSets(op, args, recs[1:])
+		if !ok {
+			wrongType = true
+			return nil
+		}
+		n = z.Len()
+		if n == 0 {
+			recs[0] = nil
+		} else {
+			recs[0] = newRecord(z)
+		}
+		// A source that is also the destination must not overwrite it.
+		for i := 1; i < len(recs); i++ {
+			if keys[i] == keys[0] {
+				recs[i] = recs[0]
+			} else {
+				recs[i] = Unchanged
+			}
+		}
+		return recs
+	})
+
+	if wrongType {
+		conn.WriteError(errWrongType)
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+func (mkv *MuKV) handleZInterCard(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	numKeys, ok := parseInt(cmd.Args[1])
+	if !ok || numKeys <= 0 {
+		conn.WriteError("ERR numkeys should be greater than 0")
+		return
+	}
+	if int64(len(cmd.Args)-2) < numKeys {
+		conn.WriteError("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	limit := int64(0)
+	switch rest := cmd.Args[2+numKeys:]; {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.EqualFold(string(rest[0]), "limit"):
+		if limit, ok = parseInt(rest[1]); !ok || limit < 0 {
+			conn.WriteError("ERR LIMIT can't be negative")
+			return
+		}
+	default:
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	args := zsetOpArgs{keys: argStrings(cmd.Args[2 : 2+numKeys]), aggregate: "sum"}
+	mkv.db(conn).ViewAll(args.keys, func(recs []*Record) {
+		z, ok := combineZSets(setInter, args, recs)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		n := int64(z.Len())
+		if limit > 0 {
+			n = min(n, limit)
+		}
+		conn.WriteInt64(n)
+	})
+}
+
+func (mkv *MuKV) handleZRandMember(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 || len(cmd.Args) > 4 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	var count int64
+	if len(cmd.Args) > 2 {
+		var ok bool
+		if count, ok = parseInt(cmd.Args[2]); !ok {
+			conn.WriteError(errNotInteger)
+			return
+		}
+	}
+	withScores := len(cmd.Args) == 4
+	if withScores && !strings.EqualFold(string(cmd.Args[3]), "withscores") {
+		conn.WriteError(errSyntax)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		switch {
+		case !ok:
+			conn.WriteError(errWrongType)
+			return
+		case len(cmd.Args) == 2 && z.Len() == 0:
+			conn.WriteNull()
+			return
+		case len(cmd.Args) == 2:
+			conn.WriteBulkString(z.At(rand.IntN(z.Len())).member)
+			return
+		}
+
+		var picked []zsetItem
+		if count >= 0 {
+			// Distinct members, as many as the sorted set holds.
+			for _, i := range rand.Perm(z.Len())[:min(int(count), z.Len())] {
+				picked = append(picked, z.At(i))
+			}
+		} else if z.Len() > 0 {
+			// Members may repeat, exactly -count of them.
+			picked = make([]zsetItem, -count)
+			for i := range picked {
+				picked[i] = z.At(rand.IntN(z.Len()))
+			}
+		}
+		writeZItems(conn, picked, withScores)
+	})
+}
+
+func (mkv *MuKV) handleZScan(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 {
+		errStr := fmt.Sprintf("ERR wrong number of arguments for %s", cmd.Args[0])
+		conn.WriteError(errStr)
+		return
+	}
+	cursor, errStr := parseScanCursor(cmd.Args[2])
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+	opts, errStr := parseScanOptions(cmd.Args[3:], false)
+	if errStr != "" {
+		conn.WriteError(errStr)
+		return
+	}
+
+	mkv.db(conn).View(string(cmd.Args[1]), func(rec *Record) {
+		z, ok := asZSet(rec)
+		if !ok {
+			conn.WriteError(errWrongType)
+			return
+		}
+		members := make([]string, 0, z.Len())
+		for m := range z.scores {
+			members = append(members, m)
+		}
+		page, next := scanNames(members, cursor, opts.count)
+		page = slices.DeleteFunc(page, func(m string) bool {
+			return !opts.matches(m)
+		})
+		conn.WriteArray(2)
+		conn.WriteBulkString(strconv.FormatUint(next, 10))
+		conn.WriteArray(len(page) * 2)
+		for _, m := range page {
+			conn.WriteBulkString(m)
+			conn.WriteBulkString(formatScore(z.scores[m]))
+		}
+	})
+}